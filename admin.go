@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ADMIN */
+
+// requireAdmin allows the request only with "Authorization: Bearer <ADMIN_TOKEN>".
+// Without a configured token the admin endpoints do not exist.
+func (a *app) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.cfg.Admin.Token == "" {
+			writeProblem(w, r, probNotFound, "admin endpoints are disabled")
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.cfg.Admin.Token)) != 1 {
+			log.Printf("level=WARN service=go-app event=admin_unauthorized path=%s request_id=%s instance=%s", r.URL.Path, requestID(r.Context()), a.instanceID)
+			writeProblem(w, r, probUnauthorized, "missing or invalid admin token")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// maintenanceState is the body of GET and PUT /admin/maintenance.
+type maintenanceState struct {
+	Enabled    bool   `json:"enabled"`
+	RetryAfter string `json:"retry_after,omitempty"`
+	Ready      *bool  `json:"ready,omitempty"`
+}
+
+// maintenanceHandler reports (GET) or changes (PUT) maintenance mode.
+// Changes go through the settings store, so they reach the whole fleet
+// when SSM-backed settings are configured.
+func (a *app) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var req maintenanceState
+		if err := decodeJSON(r, &req); err != nil {
+			a.writeBodyError(w, r, err, "invalid JSON body: "+err.Error())
+			return
+		}
+
+		changes := [][2]string{{"MAINTENANCE_MODE", strconv.FormatBool(req.Enabled)}}
+		if req.RetryAfter != "" {
+			changes = append(changes, [2]string{"MAINTENANCE_RETRY_AFTER", req.RetryAfter})
+		}
+		if req.Ready != nil {
+			changes = append(changes, [2]string{"MAINTENANCE_READY", strconv.FormatBool(*req.Ready)})
+		}
+
+		for _, c := range changes {
+			if err := a.settings.set(r.Context(), c[0], c[1]); err != nil {
+				log.Printf("level=ERROR service=go-app event=maintenance_update_failed key=%s err=%v request_id=%s instance=%s", c[0], err, requestID(r.Context()), a.instanceID)
+				writeProblem(w, r, probValidation, "failed to update "+c[0]+": "+err.Error())
+				return
+			}
+		}
+		log.Printf("level=INFO service=go-app event=maintenance_updated enabled=%t request_id=%s instance=%s", req.Enabled, requestID(r.Context()), a.instanceID)
+	}
+
+	s := a.settings.get()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maintenanceState{
+		Enabled:    s.Maintenance,
+		RetryAfter: s.MaintenanceRetryAfter.String(),
+		Ready:      &s.MaintenanceReady,
+	})
+}
+
+// serveMaintenance answers a request rejected by maintenance mode with the
+// maintenance page and a Retry-After hint.
+func (a *app) serveMaintenance(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	log.Printf("level=WARN service=go-app event=submit_rejected reason=maintenance request_id=%s instance=%s", requestID(r.Context()), a.instanceID)
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	w.Header().Set("Cache-Control", "no-store")
+
+	page, err := fs.ReadFile(a.web, "maintenance.html")
+	if err != nil {
+		writeProblem(w, r, probMaintenance, "submissions are temporarily unavailable")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(page)
+}
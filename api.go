@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/* AUTHENTICATION */
+
+type actorKey struct{}
+
+// requireAPIToken admits requests bearing one of the configured API tokens
+// and records the matching client name as the request's actor.
+func (a *app) requireAPIToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(a.cfg.API.Tokens) == 0 {
+			writeProblem(w, r, probNotFound, "API is disabled")
+			return
+		}
+
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		for name, want := range a.cfg.API.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1 {
+				next(w, r.WithContext(context.WithValue(r.Context(), actorKey{}, name)))
+				return
+			}
+		}
+
+		log.Printf("level=WARN service=go-app event=api_unauthorized path=%s request_id=%s instance=%s", r.URL.Path, requestID(r.Context()), a.instanceID)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+		writeProblem(w, r, probUnauthorized, "missing or invalid bearer token")
+	}
+}
+
+// actorFrom returns the authenticated client name for the request, or "".
+func actorFrom(ctx context.Context) string {
+	name, _ := ctx.Value(actorKey{}).(string)
+	return name
+}
+
+/* JSON API HELPERS */
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// decodeJSON reads a single JSON object from the body, rejecting unknown
+// fields and trailing data.
+func decodeJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return errors.New("unexpected data after JSON object")
+	}
+	return nil
+}
+
+// mediaType returns the request's Content-Type without parameters.
+func mediaType(r *http.Request) string {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mt
+}
+
+// pathID parses the {id} path parameter.
+func pathID(r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	return id, err == nil && id > 0
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"client_alb_go_s3_rds/storage"
+)
+
+/* DOCUMENTS API */
+
+// apiDownloadDocument handles GET /api/v1/users/{id}/document, streaming the
+// user's KYC document from the document store. A Range header is passed
+// through, so large files can be fetched in parts or resumed.
+func (a *app) apiDownloadDocument(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r)
+	if !ok {
+		writeProblem(w, r, probValidation, "invalid user id")
+		return
+	}
+
+	u, err := getUser(r.Context(), a.db, id)
+	if err != nil {
+		a.writeUserResult(w, r, nil, err, id)
+		return
+	}
+	// The version stored with the document, so a later object written to
+	// the same key is never served in its place.
+	version, err := documentVersion(r.Context(), a.db, id, u.Document.Bucket, u.Document.Key)
+	if err != nil {
+		a.writeUserResult(w, r, nil, err, id)
+		return
+	}
+	if !a.servable(w, r, u.Document.Bucket, u.Document.Key) {
+		return
+	}
+
+	obj := storage.Object{Bucket: u.Document.Bucket, Key: u.Document.Key, VersionID: version}
+	out, err := a.store.Get(r.Context(), obj, r.Header.Get("Range"))
+	if err != nil {
+		a.writeStorageError(w, r, err, u.Document.Key)
+		return
+	}
+	defer out.Close()
+
+	h := w.Header()
+	h.Set("Content-Type", documentContentType(u.Document.Key, out.ContentType))
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(u.Document.Key)}))
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "private, no-store")
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("Content-Length", strconv.FormatInt(out.Size, 10))
+	if out.ETag != "" {
+		h.Set("ETag", out.ETag)
+	}
+	if !out.LastModified.IsZero() {
+		h.Set("Last-Modified", out.LastModified.UTC().Format(http.TimeFormat))
+	}
+
+	status := http.StatusOK
+	if out.ContentRange != "" {
+		h.Set("Content-Range", out.ContentRange)
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+
+	n, err := io.Copy(w, out.Body)
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=document_stream_aborted id=%d bytes=%d err=%v request_id=%s instance=%s", id, n, err, requestID(r.Context()), a.instanceID)
+		return
+	}
+	log.Printf("level=INFO service=go-app event=document_downloaded id=%d bytes=%d partial=%t actor=%s request_id=%s instance=%s", id, n, status == http.StatusPartialContent, actorFrom(r.Context()), requestID(r.Context()), a.instanceID)
+}
+
+// apiDownloadThumbnail handles GET /api/v1/users/{id}/documents/{doc}/thumbnail,
+// streaming the JPEG preview of one document of the user; see thumbnails.go.
+// A document without a preview, not an image or not yet previewed,
+// answers 404.
+func (a *app) apiDownloadThumbnail(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r)
+	if !ok {
+		writeProblem(w, r, probValidation, "invalid user id")
+		return
+	}
+	docID, err := strconv.ParseInt(r.PathValue("doc"), 10, 64)
+	if err != nil || docID <= 0 {
+		writeProblem(w, r, probValidation, "invalid document id")
+		return
+	}
+
+	var bucket, key string
+	var thumbBucket, thumbKey sql.NullString
+	err = a.db.QueryRowContext(r.Context(), `
+	SELECT bucket, object_key, thumbnail_bucket, thumbnail_key FROM documents WHERE user_id = $1 AND id = $2
+	`, id, docID).Scan(&bucket, &key, &thumbBucket, &thumbKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeProblem(w, r, probNotFound, "document not found")
+		return
+	}
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_query_failed op=document_thumbnail id=%d err=%v request_id=%s instance=%s", id, err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "database error")
+		return
+	}
+	if !thumbKey.Valid {
+		writeProblem(w, r, probNotFound, "document has no thumbnail")
+		return
+	}
+	if !a.servable(w, r, bucket, key) {
+		return
+	}
+
+	out, err := a.store.Get(r.Context(), storage.Object{Bucket: thumbBucket.String, Key: thumbKey.String}, "")
+	if err != nil {
+		a.writeStorageError(w, r, err, thumbKey.String)
+		return
+	}
+	defer out.Close()
+
+	h := w.Header()
+	h.Set("Content-Type", "image/jpeg")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "private, no-store")
+	h.Set("Content-Length", strconv.FormatInt(out.Size, 10))
+	if _, err := io.Copy(w, out.Body); err != nil {
+		log.Printf("level=WARN service=go-app event=thumbnail_stream_aborted id=%d document=%d err=%v request_id=%s instance=%s", id, docID, err, requestID(r.Context()), a.instanceID)
+		return
+	}
+	log.Printf("level=INFO service=go-app event=thumbnail_downloaded id=%d document=%d actor=%s request_id=%s instance=%s", id, docID, actorFrom(r.Context()), requestID(r.Context()), a.instanceID)
+}
+
+// presignedURL is the response of POST /api/v1/users/{id}/document/url.
+type presignedURL struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// apiPresignDocument handles POST /api/v1/users/{id}/document/url,
+// returning a short-lived presigned GET URL so the reviewer UI can load the
+// document straight from the store, or through CloudFront when
+// CLOUDFRONT_DOMAIN is set; a store that cannot presign answers 404. Every
+// issued URL is recorded in document_access_log first; if that fails no URL
+// is handed out.
+func (a *app) apiPresignDocument(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r)
+	if !ok {
+		writeProblem(w, r, probValidation, "invalid user id")
+		return
+	}
+
+	u, err := getUser(r.Context(), a.db, id)
+	if err != nil {
+		a.writeUserResult(w, r, nil, err, id)
+		return
+	}
+
+	version, err := documentVersion(r.Context(), a.db, id, u.Document.Bucket, u.Document.Key)
+	if err != nil {
+		a.writeUserResult(w, r, nil, err, id)
+		return
+	}
+	if !a.servable(w, r, u.Document.Bucket, u.Document.Key) {
+		return
+	}
+
+	expiry := a.cfg.S3.PresignExpiry
+	expiresAt := time.Now().Add(expiry).UTC()
+	actor := actorFrom(r.Context())
+
+	_, err = a.db.ExecContext(r.Context(), `
+	INSERT INTO document_access_log(user_id, action, actor, bucket, object_key, expires_at)
+	VALUES ($1, 'presign_get', $2, $3, $4, $5)
+	`, id, actor, u.Document.Bucket, u.Document.Key, expiresAt)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_insert_failed op=document_access_log id=%d err=%v request_id=%s instance=%s", id, err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "database error")
+		return
+	}
+
+	url, err := a.store.Presign(r.Context(), storage.Object{Bucket: u.Document.Bucket, Key: u.Document.Key, VersionID: version}, storage.PresignInput{
+		Expiry:             expiry,
+		ContentType:        documentContentType(u.Document.Key, ""),
+		ContentDisposition: mime.FormatMediaType("inline", map[string]string{"filename": path.Base(u.Document.Key)}),
+	})
+	if errors.Is(err, storage.ErrUnsupported) {
+		writeProblem(w, r, probNotFound, "presigned URLs are not available with this storage backend")
+		return
+	}
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=s3_presign_failed id=%d err=%v request_id=%s instance=%s", id, err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probStorage, "failed to presign document URL")
+		return
+	}
+
+	log.Printf("level=INFO service=go-app event=document_url_issued id=%d expires_in=%s actor=%s request_id=%s instance=%s", id, expiry, actor, requestID(r.Context()), a.instanceID)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, presignedURL{URL: url, ExpiresAt: expiresAt})
+}
+
+// apiReplaceDocuments handles PUT /api/v1/users/{id}/document, the
+// re-upload of a rejected submission. It takes the document fields of the
+// /submit form; the documents sent replace those of the same type, which
+// are kept, marked replaced by the caller, for audit. Together with the
+// ones not replaced they must still make up the user's KYC tier. The user
+// moves to KYC_RE_UPLOADED, recorded in the status history under the
+// caller's name.
+func (a *app) apiReplaceDocuments(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r)
+	if !ok {
+		writeProblem(w, r, probValidation, "invalid user id")
+		return
+	}
+	if a.dbDown.Load() {
+		writeProblem(w, r, probDatabaseUnavailable, "database unavailable")
+		return
+	}
+	ctx := r.Context()
+
+	u, err := getUser(ctx, a.db, id)
+	if err == nil {
+		u.Documents, err = userDocuments(ctx, a.db, id)
+	}
+	if err != nil {
+		a.writeUserResult(w, r, nil, err, id)
+		return
+	}
+	// Checked again when the status changes; failing now saves uploading
+	// documents that could not be used.
+	from := u.KYCStatus
+	if from == "" {
+		from = statusUploaded
+	}
+	if !canTransition(from, statusReUploaded) {
+		writeProblem(w, r, probConflict, (&transitionError{From: from, To: statusReUploaded}).Error())
+		return
+	}
+
+	docs, err := a.collectFormDocuments(r)
+	if err != nil {
+		writeDocumentError(w, r, err)
+		return
+	}
+	if len(docs) == 0 {
+		writeProblem(w, r, probValidation, "at least one KYC document is required (id_front, id_back, proof_of_address or selfie)")
+		return
+	}
+	if err := categorizeDocuments(docs, r.FormValue(idDocumentField)); err != nil {
+		writeDocumentError(w, r, err)
+		return
+	}
+	replaced := make([]string, 0, len(docs))
+	for _, d := range docs {
+		replaced = append(replaced, d.Type)
+	}
+	kept := slices.Clone(docs)
+	for _, d := range u.Documents {
+		if d.ReplacedAt == nil && !slices.Contains(replaced, d.Type) {
+			kept = append(kept, submittedDocument{Type: d.Type, Category: d.Category})
+		}
+	}
+	tier, _ := a.kycTier(u.KYCTier)
+	if err := a.checkDocumentSet(kept, tier); err != nil {
+		writeDocumentError(w, r, err)
+		return
+	}
+	if err := a.uploadFormFiles(r, u.Reference, docs); err != nil {
+		writeDocumentError(w, r, err)
+		return
+	}
+
+	actor := actorFrom(ctx)
+	err = inTx(ctx, a.db, func(tx *sql.Tx) error {
+		if _, err := transitionStatusTx(ctx, tx, id, statusReUploaded, actor, "documents replaced: "+strings.Join(replaced, ", ")); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+		UPDATE documents SET replaced_at = CURRENT_TIMESTAMP, replaced_by = $3
+		WHERE user_id = $1 AND replaced_at IS NULL AND doc_type = ANY($2)
+		`, id, pq.Array(replaced), actor)
+		if err != nil {
+			return err
+		}
+		if err := insertDocuments(ctx, tx, id, docs); err != nil {
+			return err
+		}
+		// The primary document follows its type to the new upload.
+		for _, d := range u.Documents {
+			if d.Bucket != u.Document.Bucket || d.Key != u.Document.Key || !slices.Contains(replaced, d.Type) {
+				continue
+			}
+			for _, nd := range docs {
+				if nd.Type == d.Type {
+					_, err := tx.ExecContext(ctx, `UPDATE users SET document_bucket = $2, document_key = $3 WHERE id = $1`, id, nd.Bucket, nd.Key)
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if te, ok := isTransitionError(err); ok {
+		writeProblem(w, r, probConflict, te.Error())
+		return
+	}
+	if err != nil {
+		a.writeUserResult(w, r, nil, err, id)
+		return
+	}
+	log.Printf("level=INFO service=go-app event=documents_replaced id=%d types=%s actor=%s request_id=%s instance=%s", id, strings.Join(replaced, ","), actor, requestID(ctx), a.instanceID)
+
+	u, err = getUser(ctx, a.db, id)
+	if err == nil {
+		a.tagStatus(ctx, u)
+		u.Documents, err = userDocuments(ctx, a.db, id)
+	}
+	a.writeUserResult(w, r, u, err, id)
+}
+
+// documentContentType prefers the type stored on the object and falls back
+// to the key's extension; uploads made before types were recorded have the
+// generic binary/octet-stream.
+func documentContentType(key, stored string) string {
+	if stored != "" && stored != "binary/octet-stream" {
+		return stored
+	}
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// writeStorageError maps a document store read failure to an API response.
+func (a *app) writeStorageError(w http.ResponseWriter, r *http.Request, err error, key string) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		writeProblem(w, r, probNotFound, "document not found in storage")
+	case errors.Is(err, storage.ErrInvalidRange):
+		writeProblem(w, r, probRangeNotSatisfiable, "requested range not satisfiable")
+	default:
+		log.Printf("level=ERROR service=go-app event=s3_get_failed key=%s err=%v request_id=%s instance=%s", key, err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, storageProblem(err), "failed to read document from storage")
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"client_alb_go_s3_rds/config"
+)
+
+/* USERS API */
+
+// createUserRequest is the JSON form of POST /api/v1/users, used when the
+// documents were already uploaded straight to S3 via POST /submit/upload-url.
+// DocumentKey is the single untyped document of older clients. Tier is the
+// KYC tier the documents must satisfy, KYC_TIER if unset.
+type createUserRequest struct {
+	Name        string        `json:"name"`
+	Email       string        `json:"email"`
+	Phone       string        `json:"phone"`
+	Tier        string        `json:"kyc_tier,omitempty"`
+	Documents   []documentRef `json:"documents,omitempty"`
+	DocumentKey string        `json:"document_key,omitempty"`
+}
+
+// documentRef names a directly uploaded document, its type and, for the
+// types that may be one of several, its category.
+type documentRef struct {
+	Type     string `json:"type"`
+	Category string `json:"category,omitempty"`
+	Key      string `json:"key"`
+}
+
+// apiCreateUser handles POST /api/v1/users. It accepts the same multipart
+// form as /submit, with an optional kyc_tier field, or JSON referencing
+// already-uploaded documents.
+func (a *app) apiCreateUser(w http.ResponseWriter, r *http.Request) {
+	if a.dbDown.Load() {
+		writeProblem(w, r, probDatabaseUnavailable, "database unavailable")
+		return
+	}
+
+	sub := submission{Reference: newReference(), Bucket: a.cfg.S3.Bucket, Status: statusUploaded, CreatedAt: time.Now()}
+
+	switch mediaType(r) {
+	case "multipart/form-data":
+		if !sub.setContact(contactFields{Name: r.FormValue("name"), Email: r.FormValue("email"), Phone: r.FormValue("phone")}, a.cfg.Phone.DefaultRegion, w, r) {
+			return
+		}
+
+		tier, ok := a.kycTier(r.FormValue("kyc_tier"))
+		if !ok {
+			writeProblem(w, r, probValidation, "kyc_tier must be one of "+strings.Join(config.KYCTiers, ", "))
+			return
+		}
+		sub.Tier = tier
+		docs, err := a.formDocuments(r, tier, sub.Reference)
+		if err != nil {
+			writeDocumentError(w, r, err)
+			return
+		}
+		sub.setDocuments(docs)
+
+	case "application/json":
+		var req createUserRequest
+		if err := decodeJSON(r, &req); err != nil {
+			a.writeBodyError(w, r, err, "invalid JSON body: "+err.Error())
+			return
+		}
+		if !sub.setContact(contactFields{Name: req.Name, Email: req.Email, Phone: req.Phone}, a.cfg.Phone.DefaultRegion, w, r) {
+			return
+		}
+		tier, ok := a.kycTier(req.Tier)
+		if !ok {
+			writeProblem(w, r, probValidation, "kyc_tier must be one of "+strings.Join(config.KYCTiers, ", "))
+			return
+		}
+		sub.Tier = tier
+		refs := req.Documents
+		if req.DocumentKey != "" {
+			refs = append(refs, documentRef{Type: docKYC, Key: req.DocumentKey})
+		}
+		if len(refs) == 0 {
+			writeProblem(w, r, probValidation, "documents are required; upload each via POST /submit/upload-url")
+			return
+		}
+
+		docs := make([]submittedDocument, 0, len(refs))
+		seen := map[string]bool{}
+		for _, ref := range refs {
+			if !validDocumentType(ref.Type) || ref.Key == "" {
+				writeProblem(w, r, probValidation, "each document needs a key and a type of "+strings.Join(documentFields, ", "))
+				return
+			}
+			if seen[ref.Key] {
+				writeProblem(w, r, probValidation, "document "+ref.Key+" is listed twice")
+				return
+			}
+			seen[ref.Key] = true
+			category, err := documentCategory(ref.Type, ref.Category)
+			if err != nil {
+				writeProblem(w, r, probValidation, err.Error())
+				return
+			}
+
+			doc, err := a.directDocument(r.Context(), ref.Type, ref.Key)
+			if err != nil {
+				writeDocumentError(w, r, err)
+				return
+			}
+			doc.Category = category
+			docs = append(docs, doc)
+		}
+		if err := a.checkDocumentSet(docs, tier); err != nil {
+			writeDocumentError(w, r, err)
+			return
+		}
+		for _, d := range docs {
+			a.tagDocument(r.Context(), sub.Reference, d)
+		}
+		sub.setDocuments(docs)
+
+	default:
+		writeProblem(w, r, probUnsupportedType, "use multipart/form-data or application/json")
+		return
+	}
+	// API clients are trusted with what they store; a disposable address
+	// is only flagged.
+	sub.DisposableEmail = a.disposable.blocked(sub.Email)
+
+	id, err := insertUser(r.Context(), a.db, sub)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_insert_failed err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "failed to store user")
+		return
+	}
+
+	u, err := getUser(r.Context(), a.db, id)
+	if err == nil {
+		u.Documents, err = userDocuments(r.Context(), a.db, id)
+	}
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_query_failed id=%d err=%v request_id=%s instance=%s", id, err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "failed to load user")
+		return
+	}
+
+	log.Printf("level=INFO service=go-app event=user_created id=%d source=api request_id=%s instance=%s", id, requestID(r.Context()), a.instanceID)
+	w.Header().Set("Location", "/api/v1/users/"+strconv.FormatInt(id, 10))
+	writeJSON(w, http.StatusCreated, u)
+}
+
+// setContact validates c and stores it in s, answering the request with
+// the field errors and reporting false when it is invalid.
+func (s *submission) setContact(c contactFields, region string, w http.ResponseWriter, r *http.Request) bool {
+	c, errs := validateContact(c, region)
+	if len(errs) > 0 {
+		writeFieldErrors(w, r, errs)
+		return false
+	}
+	s.Name, s.Email, s.Phone, s.PhoneRaw = c.Name, c.Email, c.Phone, c.PhoneRaw
+	return true
+}
+
+// List paging bounds for GET /api/v1/users.
+const (
+	defaultListLimit = 50
+	maxListLimit     = 200
+)
+
+// userPage is the GET /api/v1/users response. NextCursor is empty on the
+// last page.
+type userPage struct {
+	Users      []user `json:"users"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// apiListUsers handles GET /api/v1/users. Query parameters:
+//
+//	kyc_status      filter, repeatable or comma-separated
+//	email           exact match, case-insensitive
+//	reference       submission reference number
+//	created_after   RFC 3339, inclusive
+//	created_before  RFC 3339, exclusive
+//	sort            created_at, -created_at (default), id or -id
+//	limit           page size, 1-200 (default 50)
+//	cursor          next_cursor from the previous page
+func (a *app) apiListUsers(w http.ResponseWriter, r *http.Request) {
+	f, err := parseUserFilter(r.URL.Query())
+	if err != nil {
+		writeProblem(w, r, probValidation, err.Error())
+		return
+	}
+
+	// Fetch one extra row to learn whether another page follows.
+	limit := f.Limit
+	f.Limit++
+	users, err := listUsers(r.Context(), a.db, f)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_query_failed op=list_users err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "database error")
+		return
+	}
+
+	page := userPage{Users: users}
+	if len(users) > limit {
+		page.Users = users[:limit]
+		last := page.Users[limit-1]
+		page.NextCursor = encodeCursor(f.SortBy, last)
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func parseUserFilter(q url.Values) (userFilter, error) {
+	f := userFilter{SortBy: "created_at", Desc: true, Limit: defaultListLimit}
+
+	for _, v := range q["kyc_status"] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				f.Statuses = append(f.Statuses, s)
+			}
+		}
+	}
+	f.Email = strings.TrimSpace(q.Get("email"))
+	if v := q.Get("reference"); v != "" {
+		if f.Reference = normalizeReference(v); f.Reference == "" {
+			return f, errors.New("reference must look like KYC-XXXX-XXXX")
+		}
+	}
+
+	if v := q.Get("email_verified"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, errors.New("email_verified must be true or false")
+		}
+		f.EmailVerified = &b
+	}
+	if v := q.Get("disposable_email"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, errors.New("disposable_email must be true or false")
+		}
+		f.Disposable = &b
+	}
+
+	for name, dst := range map[string]*time.Time{"created_after": &f.CreatedAfter, "created_before": &f.CreatedBefore} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+			}
+			*dst = t
+		}
+	}
+
+	if v := q.Get("sort"); v != "" {
+		f.Desc = strings.HasPrefix(v, "-")
+		f.SortBy = strings.TrimPrefix(v, "-")
+		if f.SortBy != "created_at" && f.SortBy != "id" {
+			return f, errors.New("sort must be one of created_at, -created_at, id, -id")
+		}
+	}
+
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			return f, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+		f.Limit = n
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil {
+			return f, errors.New("invalid cursor")
+		}
+		f.After = c
+	}
+	return f, nil
+}
+
+// encodeCursor makes the opaque next_cursor token for a page ending at u.
+func encodeCursor(sortBy string, u user) string {
+	c := userCursor{ID: u.ID}
+	if sortBy == "created_at" {
+		c.CreatedAt = u.CreatedAt
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*userCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c userCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// apiGetUser handles GET /api/v1/users/{id}.
+func (a *app) apiGetUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r)
+	if !ok {
+		writeProblem(w, r, probValidation, "invalid user id")
+		return
+	}
+
+	u, err := getUser(r.Context(), a.db, id)
+	if err == nil {
+		u.Documents, err = userDocuments(r.Context(), a.db, id)
+	}
+	a.writeUserResult(w, r, u, err, id)
+}
+
+// apiUpdateUser handles PATCH /api/v1/users/{id}, changing the contact
+// fields present in the JSON body. A new email address is flagged anew as
+// disposable or not.
+func (a *app) apiUpdateUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r)
+	if !ok {
+		writeProblem(w, r, probValidation, "invalid user id")
+		return
+	}
+
+	var patch userPatch
+	if err := decodeJSON(r, &patch); err != nil {
+		a.writeBodyError(w, r, err, "invalid JSON body: "+err.Error())
+		return
+	}
+	if patch.Phone != nil {
+		raw := strings.TrimSpace(*patch.Phone)
+		patch.PhoneRaw = &raw
+	}
+	if errs := validateFields(a.cfg.Phone.DefaultRegion, patch.Name, patch.Email, patch.Phone); len(errs) > 0 {
+		writeFieldErrors(w, r, errs)
+		return
+	}
+	if patch.Email != nil {
+		disposable := a.disposable.blocked(*patch.Email)
+		patch.DisposableEmail = &disposable
+	}
+
+	u, err := updateUser(r.Context(), a.db, id, patch)
+	if err == nil {
+		log.Printf("level=INFO service=go-app event=user_updated id=%d request_id=%s instance=%s", id, requestID(r.Context()), a.instanceID)
+	}
+	a.writeUserResult(w, r, u, err, id)
+}
+
+// statusRequest is the body of PATCH /api/v1/users/{id}/status.
+type statusRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// apiUpdateStatus handles PATCH /api/v1/users/{id}/status, moving the
+// record through the KYC state machine. Illegal transitions get a 409
+// naming the statuses that are allowed next.
+func (a *app) apiUpdateStatus(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r)
+	if !ok {
+		writeProblem(w, r, probValidation, "invalid user id")
+		return
+	}
+
+	var req statusRequest
+	if err := decodeJSON(r, &req); err != nil {
+		a.writeBodyError(w, r, err, "invalid JSON body: "+err.Error())
+		return
+	}
+	if !validStatus(req.Status) {
+		writeProblem(w, r, probValidation, "unknown status "+strconv.Quote(req.Status))
+		return
+	}
+	if req.Status == statusRejected && strings.TrimSpace(req.Reason) == "" {
+		writeProblem(w, r, probValidation, "a reason is required when rejecting")
+		return
+	}
+
+	if req.Status == statusApproved && !a.approvable(w, r, id) {
+		return
+	}
+
+	actor := actorFrom(r.Context())
+	u, err := transitionStatus(r.Context(), a.db, id, req.Status, actor, strings.TrimSpace(req.Reason))
+	if te, ok := isTransitionError(err); ok {
+		writeProblem(w, r, probConflict, te.Error())
+		return
+	}
+	if err == nil {
+		log.Printf("level=INFO service=go-app event=kyc_status_changed id=%d status=%s actor=%s request_id=%s instance=%s", id, req.Status, actor, requestID(r.Context()), a.instanceID)
+		a.tagStatus(r.Context(), u)
+	}
+	a.writeUserResult(w, r, u, err, id)
+}
+
+// statusHistoryResponse is the GET /api/v1/users/{id}/status/history body.
+type statusHistoryResponse struct {
+	History []statusChange `json:"history"`
+}
+
+// apiStatusHistory handles GET /api/v1/users/{id}/status/history.
+func (a *app) apiStatusHistory(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r)
+	if !ok {
+		writeProblem(w, r, probValidation, "invalid user id")
+		return
+	}
+
+	if _, err := getUser(r.Context(), a.db, id); err != nil {
+		a.writeUserResult(w, r, nil, err, id)
+		return
+	}
+	history, err := statusHistory(r.Context(), a.db, id)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_query_failed op=status_history id=%d err=%v request_id=%s instance=%s", id, err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, statusHistoryResponse{History: history})
+}
+
+// apiDeleteUser handles DELETE /api/v1/users/{id}. The row goes first and
+// the documents second: if S3 fails, an object stays queued for the cleanup
+// loop rather than leaving a user that points at a missing document.
+func (a *app) apiDeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r)
+	if !ok {
+		writeProblem(w, r, probValidation, "invalid user id")
+		return
+	}
+
+	_, pending, err := deleteUser(r.Context(), a.db, id)
+	if err != nil {
+		a.writeUserResult(w, r, nil, err, id)
+		return
+	}
+	log.Printf("level=INFO service=go-app event=user_deleted id=%d actor=%s request_id=%s instance=%s", id, actorFrom(r.Context()), requestID(r.Context()), a.instanceID)
+
+	for _, p := range pending {
+		a.deleteDocument(r.Context(), p)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *app) writeUserResult(w http.ResponseWriter, r *http.Request, u *user, err error, id int64) {
+	switch {
+	case errors.Is(err, errUserNotFound):
+		writeProblem(w, r, probNotFound, "user not found")
+	case err != nil:
+		log.Printf("level=ERROR service=go-app event=db_query_failed id=%d err=%v request_id=%s instance=%s", id, err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "database error")
+	default:
+		writeJSON(w, http.StatusOK, u)
+	}
+}
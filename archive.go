@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/lib/pq"
+
+	"client_alb_go_s3_rds/config"
+)
+
+/* DOCUMENT ARCHIVAL */
+
+// New documents are stored in S3_STORAGE_CLASS. Once a user has been
+// approved for S3_ARCHIVE_AFTER their documents are rarely read again, and
+// the cleanup loop moves them to S3_ARCHIVE_STORAGE_CLASS by copying each
+// object onto itself, recording the new class in the documents table. An
+// object shared through deduplication moves only once every user referring
+// to it is approved. Reading an archived document needs it restored first.
+//
+// With S3_ARCHIVE_BUCKET set, the cleanup loop also copies the documents of
+// approved users, server-side, under S3_ARCHIVE_PREFIX in that bucket,
+// encrypted under S3_ARCHIVE_KMS_KEY_ID and kept by its own, stricter,
+// lifecycle rules, and points their rows at the copies. With
+// S3_ARCHIVE_DELETE_ORIGINAL the originals are queued for deletion once
+// S3_ARCHIVE_GRACE_PERIOD has passed; otherwise they are left to the
+// primary bucket's lifecycle. The copy happens first, so the storage class
+// transition above applies to it.
+
+// archiveBatch bounds the objects archived per cleanup run.
+const archiveBatch = 100
+
+// objectStorageClass returns the storage class S3 reports for an object,
+// which it leaves out for STANDARD.
+func objectStorageClass(c types.StorageClass) string {
+	if c == "" {
+		return string(types.StorageClassStandard)
+	}
+	return string(c)
+}
+
+// archiveDocuments moves a batch of approved users' documents to the
+// archive storage class.
+func (a *app) archiveDocuments(ctx context.Context) {
+	if a.cfg.S3.ArchiveAfter <= 0 {
+		return
+	}
+
+	rows, err := a.db.QueryContext(ctx, `
+	SELECT d.bucket, d.object_key, COALESCE(d.version_id, ''), COALESCE(MAX(d.retention_mode), ''), MAX(d.retain_until) FROM documents d
+	JOIN users u ON u.id = d.user_id
+	WHERE d.storage_class <> ALL($1)
+	  AND u.kyc_status = $2
+	  AND (SELECT MAX(changed_at) FROM kyc_status_history h WHERE h.user_id = u.id AND h.to_status = $2)
+	      < CURRENT_TIMESTAMP - make_interval(secs => $3)
+	  AND NOT EXISTS(
+		SELECT 1 FROM documents o JOIN users ou ON ou.id = o.user_id
+		WHERE o.bucket = d.bucket AND o.object_key = d.object_key AND ou.kyc_status <> $2
+	  )
+	GROUP BY d.bucket, d.object_key, d.version_id
+	LIMIT $4
+	`, pq.Array(config.ArchiveStorageClasses), statusApproved, a.cfg.S3.ArchiveAfter.Seconds(), archiveBatch)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_query_failed op=archive_documents err=%v instance=%s", err, a.instanceID)
+		return
+	}
+	var queue []submittedDocument
+	for rows.Next() {
+		var d submittedDocument
+		var retainUntil sql.NullTime
+		if err := rows.Scan(&d.Bucket, &d.Key, &d.VersionID, &d.RetentionMode, &retainUntil); err != nil {
+			log.Printf("level=ERROR service=go-app event=db_scan_failed op=archive_documents err=%v instance=%s", err, a.instanceID)
+			break
+		}
+		if retainUntil.Valid {
+			d.RetainUntil = &retainUntil.Time
+		}
+		queue = append(queue, d)
+	}
+	rows.Close()
+
+	for _, d := range queue {
+		a.archiveDocument(ctx, d)
+	}
+}
+
+// archiveDocument copies the object of d, the version it refers to when it
+// has one, onto itself in the archive storage class, keeping its metadata,
+// tags and Object Lock, and records the class. A failure is logged and the
+// object tried again on the next run.
+func (a *app) archiveDocument(ctx context.Context, d submittedDocument) {
+	bucket, key, class := d.Bucket, d.Key, a.cfg.S3.ArchiveStorageClass
+	source := (&url.URL{Path: bucket + "/" + key}).EscapedPath()
+	if d.VersionID != "" {
+		source += "?versionId=" + url.QueryEscape(d.VersionID)
+	}
+	in := &s3.CopyObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(source),
+		StorageClass:      types.StorageClass(class),
+		MetadataDirective: types.MetadataDirectiveCopy,
+		TaggingDirective:  types.TaggingDirectiveCopy,
+
+		ServerSideEncryption: types.ServerSideEncryptionAwsKms,
+		SSEKMSKeyId:          a.objectKMSKey(bucket, key),
+	}
+	// A copy does not inherit the Object Lock of its source.
+	if d.RetainUntil != nil && d.RetainUntil.After(time.Now()) {
+		in.ObjectLockMode = types.ObjectLockMode(d.RetentionMode)
+		in.ObjectLockRetainUntilDate = aws.Time(*d.RetainUntil)
+	}
+	out, err := a.s3.CopyObject(ctx, in)
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=document_archive_failed bucket=%s key=%s err=%v instance=%s", bucket, key, err, a.instanceID)
+		return
+	}
+
+	// In a versioned bucket the copy is a new version, which the documents
+	// now refer to; the one it was copied from stays until a lifecycle rule
+	// expires noncurrent versions.
+	_, err = a.db.ExecContext(ctx, `
+	UPDATE documents SET storage_class = $3, version_id = COALESCE($4, version_id)
+	WHERE bucket = $1 AND object_key = $2
+	`, bucket, key, class, out.VersionId)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_update_failed op=archive_document key=%s err=%v instance=%s", key, err, a.instanceID)
+		return
+	}
+	log.Printf("level=INFO service=go-app event=document_archived bucket=%s key=%s storage_class=%s instance=%s", bucket, key, class, a.instanceID)
+}
+
+// archived reports whether the object key in bucket is a copy in the
+// archive bucket.
+func (a *app) archived(bucket, key string) bool {
+	return a.cfg.S3.ArchiveBucket != "" && bucket == a.cfg.S3.ArchiveBucket && strings.HasPrefix(key, a.cfg.S3.ArchivePrefix)
+}
+
+// archiveKey returns where key, a key under S3_KEY_PREFIX, is copied in the
+// archive bucket.
+func (a *app) archiveKey(key string) string {
+	return a.cfg.S3.ArchivePrefix + strings.TrimPrefix(key, a.cfg.S3.KeyPrefix)
+}
+
+// copyToArchive copies a batch of approved users' documents to the archive
+// bucket. Like archiveDocuments, it leaves an object shared through
+// deduplication until every user referring to it is approved, and skips
+// archived storage classes, which cannot be copied without a restore.
+func (a *app) copyToArchive(ctx context.Context) {
+	if a.cfg.S3.ArchiveBucket == "" {
+		return
+	}
+
+	rows, err := a.db.QueryContext(ctx, `
+	SELECT d.bucket, d.object_key, COALESCE(d.version_id, ''), MIN(d.storage_class), COALESCE(MAX(d.retention_mode), ''), MAX(d.retain_until) FROM documents d
+	JOIN users u ON u.id = d.user_id
+	WHERE u.kyc_status = $1
+	  AND d.storage_class <> ALL($2)
+	  AND NOT (d.bucket = $3 AND starts_with(d.object_key, $4))
+	  AND NOT EXISTS(
+		SELECT 1 FROM documents o JOIN users ou ON ou.id = o.user_id
+		WHERE o.bucket = d.bucket AND o.object_key = d.object_key AND ou.kyc_status <> $1
+	  )
+	GROUP BY d.bucket, d.object_key, d.version_id
+	LIMIT $5
+	`, statusApproved, pq.Array(config.ArchiveStorageClasses), a.cfg.S3.ArchiveBucket, a.cfg.S3.ArchivePrefix, archiveBatch)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_query_failed op=copy_to_archive err=%v instance=%s", err, a.instanceID)
+		return
+	}
+	var queue []submittedDocument
+	for rows.Next() {
+		var d submittedDocument
+		var retainUntil sql.NullTime
+		if err := rows.Scan(&d.Bucket, &d.Key, &d.VersionID, &d.StorageClass, &d.RetentionMode, &retainUntil); err != nil {
+			log.Printf("level=ERROR service=go-app event=db_scan_failed op=copy_to_archive err=%v instance=%s", err, a.instanceID)
+			break
+		}
+		if retainUntil.Valid {
+			d.RetainUntil = &retainUntil.Time
+		}
+		queue = append(queue, d)
+	}
+	rows.Close()
+
+	for _, d := range queue {
+		a.copyDocumentToArchive(ctx, d)
+	}
+}
+
+// copyDocumentToArchive copies the object of d to the archive bucket,
+// keeping its storage class, metadata, tags and Object Lock, and moves the
+// rows referring to it over to the copy, queueing the original for
+// deletion after the grace period when originals are deleted. A failure is
+// logged and the object tried again on the next run; a copy left behind by
+// a failed update is copied over.
+func (a *app) copyDocumentToArchive(ctx context.Context, d submittedDocument) {
+	bucket, key := a.cfg.S3.ArchiveBucket, a.archiveKey(d.Key)
+	source := (&url.URL{Path: d.Bucket + "/" + d.Key}).EscapedPath()
+	if d.VersionID != "" {
+		source += "?versionId=" + url.QueryEscape(d.VersionID)
+	}
+	in := &s3.CopyObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(source),
+		StorageClass:      types.StorageClass(d.StorageClass),
+		MetadataDirective: types.MetadataDirectiveCopy,
+		TaggingDirective:  types.TaggingDirectiveCopy,
+
+		ServerSideEncryption: types.ServerSideEncryptionAwsKms,
+		SSEKMSKeyId:          a.objectKMSKey(bucket, key),
+	}
+	// A copy does not inherit the Object Lock of its source.
+	if d.RetainUntil != nil && d.RetainUntil.After(time.Now()) {
+		in.ObjectLockMode = types.ObjectLockMode(d.RetentionMode)
+		in.ObjectLockRetainUntilDate = aws.Time(*d.RetainUntil)
+	}
+	out, err := a.s3.CopyObject(ctx, in)
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=document_archive_copy_failed bucket=%s key=%s err=%v instance=%s", d.Bucket, d.Key, err, a.instanceID)
+		return
+	}
+
+	err = inTx(ctx, a.db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+		UPDATE documents SET bucket = $3, object_key = $4, version_id = $5
+		WHERE bucket = $1 AND object_key = $2
+		`, d.Bucket, d.Key, bucket, key, out.VersionId)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET document_bucket = $3, document_key = $4 WHERE document_bucket = $1 AND document_key = $2`, d.Bucket, d.Key, bucket, key); err != nil {
+			return err
+		}
+		if !a.cfg.S3.ArchiveDelete {
+			return nil
+		}
+		_, err = tx.ExecContext(ctx, `
+		INSERT INTO document_deletions(bucket, object_key, version_id, retained_until)
+		VALUES ($1, $2, NULLIF($3, ''), CURRENT_TIMESTAMP + make_interval(secs => $4))
+		`, d.Bucket, d.Key, d.VersionID, a.cfg.S3.ArchiveGracePeriod.Seconds())
+		return err
+	})
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_update_failed op=copy_to_archive key=%s err=%v instance=%s", d.Key, err, a.instanceID)
+		return
+	}
+	log.Printf("level=INFO service=go-app event=document_copied_to_archive bucket=%s key=%s archive_bucket=%s archive_key=%s delete_original=%t instance=%s", d.Bucket, d.Key, bucket, key, a.cfg.S3.ArchiveDelete, a.instanceID)
+}
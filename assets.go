@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+/* STATIC ASSETS */
+
+//go:embed web
+var embeddedWeb embed.FS
+
+// webAssets returns the filesystem the form page and static assets are
+// served from: the copy embedded in the binary, or dir when set so the
+// page can be edited without rebuilding during local development.
+func webAssets(dir string) fs.FS {
+	if dir != "" {
+		return os.DirFS(dir)
+	}
+
+	sub, err := fs.Sub(embeddedWeb, "web")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// assetCacheControl is the Cache-Control of embedded assets by extension.
+// Asset URLs are not versioned, so scripts and styles, which must match
+// the page, are only trusted for an hour; the ETag makes revalidating them
+// cheap. Anything else is revalidated every time.
+var assetCacheControl = map[string]string{
+	".css":   "public, max-age=3600",
+	".js":    "public, max-age=3600",
+	".png":   "public, max-age=86400",
+	".jpg":   "public, max-age=86400",
+	".svg":   "public, max-age=86400",
+	".ico":   "public, max-age=86400",
+	".woff2": "public, max-age=86400",
+}
+
+// assetModTime is the Last-Modified of embedded assets, which carry no
+// modification time of their own: the build time, or zero when unknown.
+var assetModTime, _ = time.Parse(time.RFC3339, currentBuild().BuildTime)
+
+// contentHash is a short, stable digest of parts, used in ETags.
+func contentHash(parts ...[]byte) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// ifNoneMatch returns the entity tags of r's If-None-Match header without
+// quotes or weakness markers.
+func ifNoneMatch(r *http.Request) []string {
+	var tags []string
+	for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		t = strings.Trim(strings.TrimPrefix(strings.TrimSpace(t), "W/"), `"`)
+		if t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// staticHandler serves /static/ from the web assets with an ETag and
+// Last-Modified, answering conditional and HEAD requests without a body.
+// Embedded assets only change with a new build, so browsers may cache them
+// as assetCacheControl allows; an override directory is being edited and
+// must always be revalidated.
+func (a *app) staticHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		info, err := fs.Stat(a.web, name)
+		if !strings.HasPrefix(name, "static/") || err != nil || info.IsDir() {
+			a.writeError(w, r, probNotFound, "no route for "+r.URL.Path)
+			return
+		}
+		data, err := fs.ReadFile(a.web, name)
+		if err != nil {
+			a.writeServerError(w, r)
+			return
+		}
+
+		cacheControl, modTime := "no-cache", info.ModTime()
+		if a.cfg.HTTP.WebDir == "" {
+			if cc, ok := assetCacheControl[path.Ext(name)]; ok {
+				cacheControl = cc
+			}
+			modTime = assetModTime
+		}
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Header().Set("ETag", `"`+contentHash(data)+`"`)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeContent(w, r, name, modTime, bytes.NewReader(data))
+	})
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"client_alb_go_s3_rds/config"
+)
+
+/* ASYNC SUBMISSIONS */
+
+// With the async_submit flag on, /submit only queues the submission, files
+// included, in submission_jobs and answers 202; workers on every instance
+// then upload the files and store the user. The browser no longer waits on
+// S3, and a job survives the instance that accepted it.
+
+// Job states.
+const (
+	jobQueued = "queued"
+	jobDone   = "done"
+	jobFailed = "failed"
+)
+
+// jobLease is how long a claimed job is hidden from other workers. A
+// worker that dies mid-job leaves it to be picked up again afterwards.
+const jobLease = 5 * time.Minute
+
+// jobRetention is how long finished jobs are kept before being purged.
+const jobRetention = 7 * 24 * time.Hour
+
+// statusURL is where an applicant can follow a submission.
+func statusURL(reference string) string {
+	return "/status/" + reference
+}
+
+// enqueueSubmission queues sub, whose documents passed checkFormDocuments,
+// reading the files still to upload back from where streamUploadForm
+// stored them. The job ID doubles as the
+// user's spool ID, so a job that is processed twice stores one user.
+func (a *app) enqueueSubmission(r *http.Request, sub submission) error {
+	ctx := r.Context()
+	jobID := newUUID()
+	sub.SpoolID = jobID
+	payload, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+
+	return inTx(ctx, a.db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO submission_jobs(id, reference, payload) VALUES ($1, $2, $3)`, jobID, sub.Reference, string(payload))
+		if err != nil {
+			return err
+		}
+		for _, d := range sub.Documents {
+			if d.Key != "" {
+				continue
+			}
+			f := formFiles(r)[d.Type]
+			data, err := a.readFormFile(ctx, f)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `
+			INSERT INTO submission_job_files(job_id, doc_type, filename, content_type, data)
+			VALUES ($1, $2, $3, $4, $5)
+			`, jobID, d.Type, f.Filename, d.ContentType, data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// runSubmissionWorkers processes queued submissions until ctx is done.
+func (a *app) runSubmissionWorkers(ctx context.Context) {
+	for i := 0; i < a.cfg.Async.Workers; i++ {
+		go a.submissionWorker(ctx, i)
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if a.dbDown.Load() {
+			continue
+		}
+		res, err := a.db.ExecContext(ctx, `
+		DELETE FROM submission_jobs
+		WHERE state <> $1 AND updated_at < CURRENT_TIMESTAMP - make_interval(secs => $2)
+		`, jobQueued, jobRetention.Seconds())
+		if err != nil {
+			log.Printf("level=ERROR service=go-app event=db_delete_failed op=submission_jobs err=%v instance=%s", err, a.instanceID)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("level=INFO service=go-app event=submission_jobs_purged count=%d instance=%s", n, a.instanceID)
+		}
+	}
+}
+
+// submissionWorker claims and processes one job at a time, polling while
+// the queue is empty.
+func (a *app) submissionWorker(ctx context.Context, n int) {
+	ticker := time.NewTicker(a.cfg.Async.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if a.dbDown.Load() || a.draining.Load() {
+			continue
+		}
+		// Keep going while there is work, rather than one job per tick.
+		for ctx.Err() == nil {
+			worked, err := a.processNextJob(ctx)
+			if err != nil {
+				log.Printf("level=ERROR service=go-app event=submission_job_claim_failed worker=%d err=%v instance=%s", n, err, a.instanceID)
+			}
+			if !worked {
+				break
+			}
+		}
+	}
+}
+
+// processNextJob claims the oldest due job and runs it, reporting whether
+// there was one.
+func (a *app) processNextJob(ctx context.Context) (bool, error) {
+	var jobID, payload string
+	var attempts int
+	err := a.db.QueryRowContext(ctx, `
+	UPDATE submission_jobs
+	SET attempts = attempts + 1, run_after = CURRENT_TIMESTAMP + make_interval(secs => $2), updated_at = CURRENT_TIMESTAMP
+	WHERE id = (
+		SELECT id FROM submission_jobs
+		WHERE state = $1 AND run_after <= CURRENT_TIMESTAMP
+		ORDER BY run_after
+		FOR UPDATE SKIP LOCKED
+		LIMIT 1
+	)
+	RETURNING id, payload, attempts
+	`, jobQueued, jobLease.Seconds()).Scan(&jobID, &payload, &attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Give up before the lease runs out and another worker takes the job.
+	jobCtx, cancel := context.WithTimeout(ctx, jobLease)
+	defer cancel()
+	start := time.Now()
+	userID, err := a.runJob(jobCtx, jobID, payload)
+	if err == nil {
+		log.Printf("level=INFO service=go-app event=submission_job_done job=%s user_id=%d attempts=%d duration_ms=%d instance=%s", jobID, userID, attempts, time.Since(start).Milliseconds(), a.instanceID)
+		return true, nil
+	}
+
+	state, wait := jobQueued, backoffDelay(config.RetryConfig{InitialBackoff: a.cfg.Async.RetryBackoff, MaxBackoff: a.cfg.Async.RetryMaxBackoff}, attempts)
+	if attempts >= a.cfg.Async.MaxAttempts {
+		state = jobFailed
+	}
+	log.Printf("level=ERROR service=go-app event=submission_job_failed job=%s attempts=%d state=%s retry_in=%s err=%v instance=%s", jobID, attempts, state, wait, err, a.instanceID)
+	_, dbErr := a.db.ExecContext(ctx, `
+	UPDATE submission_jobs
+	SET state = $2, last_error = $3, run_after = CURRENT_TIMESTAMP + make_interval(secs => $4), updated_at = CURRENT_TIMESTAMP
+	WHERE id = $1
+	`, jobID, state, err.Error(), wait.Seconds())
+	if dbErr != nil {
+		log.Printf("level=ERROR service=go-app event=db_update_failed op=submission_job job=%s err=%v instance=%s", jobID, dbErr, a.instanceID)
+	}
+	return true, nil
+}
+
+// runJob uploads a job's files, then stores its user and finishes the job
+// in one transaction, which also drops the files from the queue.
+func (a *app) runJob(ctx context.Context, jobID, payload string) (int64, error) {
+	var sub submission
+	if err := json.Unmarshal([]byte(payload), &sub); err != nil {
+		return 0, err
+	}
+
+	rows, err := a.db.QueryContext(ctx, `SELECT doc_type, filename, content_type, data FROM submission_job_files WHERE job_id = $1`, jobID)
+	if err != nil {
+		return 0, err
+	}
+	type jobFile struct {
+		filename, contentType string
+		data                  []byte
+	}
+	files := map[string]jobFile{}
+	for rows.Next() {
+		var docType string
+		var f jobFile
+		if err := rows.Scan(&docType, &f.filename, &f.contentType, &f.data); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		files[docType] = f
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, d := range sub.Documents {
+		if d.Key != "" {
+			a.tagDocument(ctx, sub.Reference, d)
+			continue
+		}
+		f, ok := files[d.Type]
+		if !ok {
+			return 0, errors.New("queued file " + d.Type + " is missing")
+		}
+		sum := sha256.Sum256(f.data)
+		stored, err := a.uploadDocument(ctx, bytes.NewReader(f.data), int64(len(f.data)), sum[:], f.filename, f.contentType, sub.Reference, a.documentTagging(sub.Reference, d))
+		if err != nil {
+			metricUploadFailures.Add(1)
+			return 0, err
+		}
+		sub.Documents[i] = submittedDocument{
+			Type:        d.Type,
+			Category:    d.Category,
+			Bucket:      stored.Bucket,
+			Key:         stored.Key,
+			Filename:    f.filename,
+			ContentType: f.contentType,
+			Size:        int64(len(f.data)),
+			SHA256:      hex.EncodeToString(sum[:]),
+
+			StorageClass:  stored.StorageClass,
+			VersionID:     stored.VersionID,
+			RetentionMode: stored.RetentionMode,
+			RetainUntil:   stored.RetainUntil,
+			Deduplicated:  stored.Deduplicated,
+		}
+	}
+	sub.setDocuments(sub.Documents)
+
+	var userID int64
+	err = inTx(ctx, a.db, func(tx *sql.Tx) error {
+		var err error
+		if userID, err = insertUserTx(ctx, tx, sub); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM submission_job_files WHERE job_id = $1`, jobID); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+		UPDATE submission_jobs SET state = $2, user_id = NULLIF($3, 0), last_error = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		`, jobID, jobDone, userID)
+		return err
+	})
+	return userID, err
+}
+
+// queuedSubmission returns the state of the job queued under reference,
+// or "" when there is none.
+func queuedSubmission(ctx context.Context, db *sql.DB, reference string) (string, error) {
+	var state string
+	err := db.QueryRowContext(ctx, `SELECT state FROM submission_jobs WHERE reference = $1`, reference).Scan(&state)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return state, err
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+
+	"client_alb_go_s3_rds/config"
+)
+
+/* RETRY WITH BACKOFF */
+
+// retry calls op until it succeeds, the attempt or time budget in rc is
+// exhausted, or ctx is done. Waits grow exponentially from InitialBackoff up
+// to MaxBackoff with full jitter, so a fleet restarting together does not
+// hammer a recovering dependency in lockstep. onRetry, if set, is called
+// before each wait. The last error from op is returned.
+func retry(ctx context.Context, rc config.RetryConfig, op func(context.Context) error, onRetry func(attempt int, err error, wait time.Duration)) error {
+	if rc.Budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rc.Budget)
+		defer cancel()
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = op(ctx); err == nil {
+			return nil
+		}
+		if attempt >= rc.MaxAttempts {
+			return err
+		}
+
+		wait := backoffDelay(rc, attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return err
+		}
+		if onRetry != nil {
+			onRetry(attempt, err, wait)
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// backoffDelay returns a random wait in [0, min(MaxBackoff, InitialBackoff*2^(attempt-1))).
+func backoffDelay(rc config.RetryConfig, attempt int) time.Duration {
+	ceiling := rc.InitialBackoff
+	for i := 1; i < attempt && ceiling < rc.MaxBackoff; i++ {
+		ceiling *= 2
+	}
+	if rc.MaxBackoff > 0 && ceiling > rc.MaxBackoff {
+		ceiling = rc.MaxBackoff
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling)
+}
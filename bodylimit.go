@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/* REQUEST BODY LIMITS */
+
+// multipartOverhead allows for the form fields and part headers around
+// the uploaded file itself.
+const multipartOverhead = 1 << 20
+
+// limitBody caps the request body: multipart uploads at the largest
+// document size limit for each document field plus overhead, resumable
+// upload chunks at that limit, CSV imports at
+// HTTP_MAX_IMPORT_BODY, anything else at HTTP_MAX_JSON_BODY.
+// Requests that announce a larger Content-Length are refused before any of
+// the body is read; others fail with 413 when they cross the limit.
+func (a *app) limitBody(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := a.cfg.HTTP.MaxJSONBodyBytes
+		switch mt := mediaType(r); {
+		case strings.HasPrefix(mt, "multipart/"):
+			limit = a.maxDocumentLimit()*int64(len(documentFields)) + multipartOverhead
+		case mt == chunkContentType:
+			limit = a.maxDocumentLimit()
+		case mt == "text/csv":
+			limit = a.cfg.HTTP.MaxImportBodyBytes
+		}
+
+		if r.ContentLength > limit {
+			a.rejectTooLarge(w, r, limit)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next(w, r)
+	}
+}
+
+// writeBodyError answers a failure to read or parse the request body: 413
+// when the body limit was hit, otherwise a malformed-request problem.
+func (a *app) writeBodyError(w http.ResponseWriter, r *http.Request, err error, detail string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		a.rejectTooLarge(w, r, tooLarge.Limit)
+		return
+	}
+	writeProblem(w, r, probMalformed, detail)
+}
+
+func (a *app) rejectTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	metricBodyTooLarge.Add(1)
+	log.Printf("level=WARN service=go-app event=body_too_large path=%s content_length=%d limit=%d client_ip=%s request_id=%s instance=%s", r.URL.Path, r.ContentLength, limit, a.clientIP(r), requestID(r.Context()), a.instanceID)
+	w.Header().Set("Connection", "close")
+	writeProblem(w, r, probTooLarge, "request body exceeds the limit of "+strconv.FormatInt(limit, 10)+" bytes")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"time"
+
+	"client_alb_go_s3_rds/config"
+	"client_alb_go_s3_rds/storage"
+)
+
+/* DOCUMENT BUNDLES */
+
+// bundleEntry is a document as listed in the manifest.json of a bundle:
+// the file it was written to, or why it was left out.
+type bundleEntry struct {
+	document
+	File    string `json:"file,omitempty"`
+	Omitted string `json:"omitted,omitempty"`
+}
+
+// apiDownloadBundle handles GET /api/v1/users/{id}/documents.zip, streaming
+// every document of the user, replaced ones under replaced/, as one zip for
+// handing a case to a compliance team. The zip is written as the objects
+// are read from the store, without temporary files; documents are stored
+// uncompressed, being images and PDFs that already are. It ends with
+// manifest.json, which lists each document with its checksum and the file
+// it is in. Documents found infected or still in quarantine, archived ones,
+// which need a restore, and any the store fails to open are listed there as
+// omitted. Every document handed out is recorded in document_access_log
+// first; if that fails no bundle is sent.
+//
+// Once the first file is written the response is committed, so a failure
+// reading a document can only cut the stream short, leaving a zip without
+// its central directory; it is logged.
+func (a *app) apiDownloadBundle(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r)
+	if !ok {
+		writeProblem(w, r, probValidation, "invalid user id")
+		return
+	}
+
+	ctx := r.Context()
+	if _, err := getUser(ctx, a.db, id); err != nil {
+		a.writeUserResult(w, r, nil, err, id)
+		return
+	}
+	docs, err := userDocuments(ctx, a.db, id)
+	if err != nil {
+		a.writeUserResult(w, r, nil, err, id)
+		return
+	}
+
+	entries := make([]bundleEntry, len(docs))
+	for i, d := range docs {
+		entries[i].document = d
+		switch {
+		case d.ScanStatus == scanInfected:
+			entries[i].Omitted = "quarantined: malware was found in it"
+		case slices.Contains(config.ArchiveStorageClasses, d.StorageClass):
+			entries[i].Omitted = "archived: restore it to download it"
+		case a.inQuarantine(d.Bucket, d.Key):
+			entries[i].Omitted = "pending: still being checked for malware"
+		}
+	}
+
+	actor := actorFrom(ctx)
+	err = inTx(ctx, a.db, func(tx *sql.Tx) error {
+		for _, e := range entries {
+			if e.Omitted != "" {
+				continue
+			}
+			_, err := tx.ExecContext(ctx, `
+			INSERT INTO document_access_log(user_id, action, actor, bucket, object_key)
+			VALUES ($1, 'download_bundle', $2, $3, $4)
+			`, id, actor, e.Bucket, e.Key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_insert_failed op=document_access_log id=%d err=%v request_id=%s instance=%s", id, err, requestID(ctx), a.instanceID)
+		writeProblem(w, r, probDatabase, "database error")
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/zip")
+	h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("user-%d-documents.zip", id)))
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "private, no-store")
+
+	rc := http.NewResponseController(w)
+	zw := zip.NewWriter(w)
+	var written int64
+	for i := range entries {
+		e := &entries[i]
+		if e.Omitted != "" {
+			continue
+		}
+		rc.SetWriteDeadline(time.Now().Add(a.cfg.HTTP.WriteTimeout))
+		n, err := a.writeBundleFile(ctx, zw, e)
+		written += n
+		if err != nil {
+			log.Printf("level=WARN service=go-app event=bundle_stream_aborted id=%d document=%d bytes=%d err=%v request_id=%s instance=%s", id, e.ID, written, err, requestID(ctx), a.instanceID)
+			return
+		}
+	}
+
+	rc.SetWriteDeadline(time.Now().Add(a.cfg.HTTP.WriteTimeout))
+	err = writeBundleManifest(zw, entries)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=bundle_stream_aborted id=%d bytes=%d err=%v request_id=%s instance=%s", id, written, err, requestID(ctx), a.instanceID)
+		return
+	}
+	omitted := 0
+	for _, e := range entries {
+		if e.Omitted != "" {
+			omitted++
+		}
+	}
+	log.Printf("level=INFO service=go-app event=document_bundle_downloaded id=%d documents=%d omitted=%d bytes=%d actor=%s request_id=%s instance=%s", id, len(entries)-omitted, omitted, written, actor, requestID(ctx), a.instanceID)
+}
+
+// writeBundleFile copies the object of e into zw and records the file it
+// went to in e. An object the store cannot open is recorded as omitted
+// instead, before anything of it is written; the error returned is one
+// that leaves the zip unusable.
+func (a *app) writeBundleFile(ctx context.Context, zw *zip.Writer, e *bundleEntry) (int64, error) {
+	blob, err := a.store.Get(ctx, storage.Object{Bucket: e.Bucket, Key: e.Key, VersionID: e.VersionID}, "")
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=bundle_document_omitted document=%d key=%s err=%v request_id=%s instance=%s", e.ID, e.Key, err, requestID(ctx), a.instanceID)
+		e.Omitted = "could not be read from storage"
+		return 0, nil
+	}
+	defer blob.Close()
+
+	name := e.Filename
+	if name == "" {
+		name = path.Base(e.Key)
+	}
+	e.File = safeFilename(fmt.Sprintf("%d-%s-%s", e.ID, e.Type, name))
+	if e.ReplacedAt != nil {
+		e.File = "replaced/" + e.File
+	}
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: e.File, Method: zip.Store, Modified: e.CreatedAt})
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(fw, blob.Body)
+}
+
+// writeBundleManifest adds manifest.json, listing entries, to zw.
+func writeBundleManifest(zw *zip.Writer, entries []bundleEntry) error {
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: "manifest.json", Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]any{"documents": entries})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/* CAPTCHA */
+
+// captchaProvider describes a CAPTCHA service: the widget the form embeds,
+// the form field the widget fills with its answer, where answers are
+// verified, and the origins the page's CSP must allow for the widget.
+type captchaProvider struct {
+	script    string
+	class     string
+	field     string
+	verifyURL string
+	origins   []string
+}
+
+// captchaProviders are the supported providers by CAPTCHA_PROVIDER value.
+// All three verify answers with the same form-encoded siteverify request.
+var captchaProviders = map[string]captchaProvider{
+	"recaptcha": {
+		script:    "https://www.google.com/recaptcha/api.js",
+		class:     "g-recaptcha",
+		field:     "g-recaptcha-response",
+		verifyURL: "https://www.google.com/recaptcha/api/siteverify",
+		origins:   []string{"https://www.google.com", "https://www.gstatic.com"},
+	},
+	"hcaptcha": {
+		script:    "https://js.hcaptcha.com/1/api.js",
+		class:     "h-captcha",
+		field:     "h-captcha-response",
+		verifyURL: "https://api.hcaptcha.com/siteverify",
+		origins:   []string{"https://hcaptcha.com", "https://*.hcaptcha.com"},
+	},
+	"turnstile": {
+		script:    "https://challenges.cloudflare.com/turnstile/v0/api.js",
+		class:     "cf-turnstile",
+		field:     "cf-turnstile-response",
+		verifyURL: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+		origins:   []string{"https://challenges.cloudflare.com"},
+	},
+}
+
+// captcha returns the configured provider, or false when the form has no
+// CAPTCHA.
+func (a *app) captcha() (captchaProvider, bool) {
+	p, ok := captchaProviders[a.cfg.Captcha.Provider]
+	return p, ok
+}
+
+// captchaWidget is what the form page needs to show the CAPTCHA.
+type captchaWidget struct {
+	Script  string
+	Class   string
+	SiteKey string
+}
+
+// captchaWidget returns the form's CAPTCHA widget, or nil when there is
+// none.
+func (a *app) captchaWidget() *captchaWidget {
+	p, ok := a.captcha()
+	if !ok {
+		return nil
+	}
+	return &captchaWidget{Script: p.script, Class: p.class, SiteKey: a.cfg.Captcha.SiteKey}
+}
+
+// captchaAnswer is the part of a siteverify response we act on. Score is
+// only sent by providers that score answers.
+type captchaAnswer struct {
+	Success    bool     `json:"success"`
+	Score      *float64 `json:"score"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+var (
+	errCaptchaMissing = errors.New("no captcha answer")
+	// errCaptchaUnavailable means the provider could not be asked, rather
+	// than that it turned the answer down.
+	errCaptchaUnavailable = errors.New("captcha provider unavailable")
+)
+
+// verifyCaptcha asks the provider whether answer, sent from remoteIP, is a
+// solved CAPTCHA, returning nil if it is.
+func (a *app) verifyCaptcha(ctx context.Context, p captchaProvider, answer, remoteIP string) error {
+	if answer == "" {
+		return errCaptchaMissing
+	}
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.Captcha.Timeout)
+	defer cancel()
+	form := url.Values{"secret": {a.cfg.Captcha.SecretKey}, "response": {answer}, "remoteip": {remoteIP}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCaptchaUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: siteverify returned %s", errCaptchaUnavailable, resp.Status)
+	}
+	var ans captchaAnswer
+	if err := json.NewDecoder(resp.Body).Decode(&ans); err != nil {
+		return fmt.Errorf("%w: %v", errCaptchaUnavailable, err)
+	}
+	if !ans.Success {
+		return fmt.Errorf("answer rejected: %s", strings.Join(ans.ErrorCodes, ","))
+	}
+	if ans.Score != nil && *ans.Score < a.cfg.Captcha.MinScore {
+		return fmt.Errorf("score %.2f is below %.2f", *ans.Score, a.cfg.Captcha.MinScore)
+	}
+	return nil
+}
+
+// requireCaptcha refuses form posts without a solved CAPTCHA when
+// CAPTCHA_PROVIDER is set; browsers get the form back, filled in, to try
+// again. It must run after the form has been parsed.
+func (a *app) requireCaptcha(next http.HandlerFunc) http.HandlerFunc {
+	p, ok := a.captcha()
+	if !ok {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := a.verifyCaptcha(r.Context(), p, r.PostFormValue(p.field), a.clientIP(r))
+		if err == nil {
+			next(w, r)
+			return
+		}
+
+		code := "captcha.required"
+		if errors.Is(err, errCaptchaUnavailable) {
+			// Fail closed: letting bots through whenever the provider is
+			// slow would defeat the point.
+			log.Printf("level=ERROR service=go-app event=captcha_unavailable err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+			code = "captcha.unavailable"
+		} else {
+			metricCaptchaFailures.Add(1)
+			log.Printf("level=WARN service=go-app event=captcha_failed err=%q client_ip=%s request_id=%s instance=%s", err, a.clientIP(r), requestID(r.Context()), a.instanceID)
+		}
+		c := contactFields{Name: r.FormValue("name"), Email: r.FormValue("email"), Phone: r.FormValue("phone")}
+		a.rejectSubmission(w, r, c, []fieldError{newFieldError("captcha", code)})
+	}
+}
@@ -0,0 +1,94 @@
+// Package clamav scans content for malware with clamd, the ClamAV daemon,
+// typically run as a sidecar container listening on TCP port 3310.
+//
+// Content is sent with the INSTREAM command, so clamd needs no access to
+// the files themselves. clamd refuses streams longer than its
+// StreamMaxLength setting, 25MB by default, which must cover the largest
+// document accepted.
+package clamav
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// chunkSize is the most content sent in one INSTREAM chunk.
+const chunkSize = 64 << 10
+
+// Client scans through the clamd listening at Addr, a host:port.
+type Client struct {
+	Addr string
+}
+
+// Result is clamd's verdict on one stream. Signature names the malware
+// found, and is empty when the content is clean.
+type Result struct {
+	Infected  bool
+	Signature string
+}
+
+// Scan streams r to clamd and returns its verdict. The connection is bound
+// by ctx's deadline, if it has one. An error means no verdict was reached,
+// including when clamd itself reports one.
+func (c *Client) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// The "z" prefix has clamd terminate its reply with a NUL.
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return Result{}, err
+	}
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return Result{}, err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	// A zero-length chunk ends the stream.
+	if _, err := conn.Write(make([]byte, 4)); err != nil {
+		return Result{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return Result{}, err
+	}
+	return parseReply(strings.TrimSuffix(reply, "\x00"))
+}
+
+// parseReply reads clamd's answer to INSTREAM: "stream: OK",
+// "stream: <signature> FOUND" or a message ending in "ERROR".
+func parseReply(reply string) (Result, error) {
+	verdict := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case verdict == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	default:
+		return Result{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
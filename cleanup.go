@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"client_alb_go_s3_rds/storage"
+)
+
+/* DOCUMENT CLEANUP */
+
+// deleteDocument removes a deleted user's stored object, or just the
+// version of it the document was, and on success its document_deletions
+// entry. An object something else still refers to, as deduplicated
+// documents do, is left in place. Failures are recorded on the entry and
+// left for cleanupDocuments to retry; a version Object Lock still retains
+// is not retried before its retention ends, nor an original copied to the
+// archive bucket before its grace period ends.
+func (a *app) deleteDocument(ctx context.Context, p pendingDeletion) {
+	obj := storage.Object{Bucket: p.Bucket, Key: p.Key, VersionID: p.VersionID}
+	referenced, err := a.deleteUnreferenced(ctx, obj)
+	if err != nil {
+		if info, headErr := a.store.Head(ctx, obj); headErr == nil && info.RetainUntil.After(time.Now()) {
+			log.Printf("level=INFO service=go-app event=document_delete_deferred reason=retained bucket=%s key=%s retain_until=%s request_id=%s instance=%s", p.Bucket, p.Key, info.RetainUntil.UTC().Format(time.RFC3339), requestID(ctx), a.instanceID)
+			if _, dbErr := a.db.ExecContext(ctx, `UPDATE document_deletions SET retained_until = $2 WHERE id = $1`, p.ID, info.RetainUntil.UTC()); dbErr != nil {
+				log.Printf("level=ERROR service=go-app event=db_update_failed op=document_deletion id=%d err=%v request_id=%s instance=%s", p.ID, dbErr, requestID(ctx), a.instanceID)
+			}
+			return
+		}
+		log.Printf("level=WARN service=go-app event=document_delete_deferred bucket=%s key=%s err=%v request_id=%s instance=%s", p.Bucket, p.Key, err, requestID(ctx), a.instanceID)
+		if _, dbErr := a.db.ExecContext(ctx,
+			`UPDATE document_deletions SET attempts = attempts + 1, last_error = $2 WHERE id = $1`,
+			p.ID, err.Error(),
+		); dbErr != nil {
+			log.Printf("level=ERROR service=go-app event=db_update_failed op=document_deletion id=%d err=%v request_id=%s instance=%s", p.ID, dbErr, requestID(ctx), a.instanceID)
+		}
+		return
+	}
+
+	if _, err := a.db.ExecContext(ctx, `DELETE FROM document_deletions WHERE id = $1`, p.ID); err != nil {
+		log.Printf("level=ERROR service=go-app event=db_delete_failed op=document_deletion id=%d err=%v request_id=%s instance=%s", p.ID, err, requestID(ctx), a.instanceID)
+		return
+	}
+	if referenced {
+		log.Printf("level=INFO service=go-app event=document_delete_skipped reason=referenced bucket=%s key=%s request_id=%s instance=%s", p.Bucket, p.Key, requestID(ctx), a.instanceID)
+		return
+	}
+	log.Printf("level=INFO service=go-app event=document_deleted bucket=%s key=%s version=%s request_id=%s instance=%s", p.Bucket, p.Key, p.VersionID, requestID(ctx), a.instanceID)
+}
+
+// cleanupDocuments retries queued document deletions, copies approved
+// users' documents to the archive bucket and archives them, and expires
+// stale resumable uploads, upload progress, SMS codes and drafts every
+// cleanup interval. S3 deletes and aborts are idempotent, so several
+// instances working the same queue is harmless.
+func (a *app) cleanupDocuments(ctx context.Context) {
+	ticker := time.NewTicker(a.cfg.S3.CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if a.dbDown.Load() {
+			continue
+		}
+
+		rows, err := a.db.QueryContext(ctx, `
+		SELECT id, bucket, object_key, COALESCE(version_id, '') FROM document_deletions
+		WHERE retained_until IS NULL OR retained_until <= CURRENT_TIMESTAMP
+		ORDER BY id LIMIT 100
+		`)
+		if err != nil {
+			log.Printf("level=ERROR service=go-app event=db_query_failed op=document_deletions err=%v instance=%s", err, a.instanceID)
+			continue
+		}
+
+		var queue []pendingDeletion
+		for rows.Next() {
+			var p pendingDeletion
+			if err := rows.Scan(&p.ID, &p.Bucket, &p.Key, &p.VersionID); err != nil {
+				log.Printf("level=ERROR service=go-app event=db_scan_failed op=document_deletions err=%v instance=%s", err, a.instanceID)
+				break
+			}
+			queue = append(queue, p)
+		}
+		rows.Close()
+
+		for _, p := range queue {
+			a.deleteDocument(ctx, p)
+		}
+
+		a.copyToArchive(ctx)
+		a.archiveDocuments(ctx)
+		a.expireUploads(ctx)
+		a.expireProgress(ctx)
+		a.expireOTPs(ctx)
+		a.expireDrafts(ctx)
+	}
+}
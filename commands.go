@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"client_alb_go_s3_rds/clamav"
+	"client_alb_go_s3_rds/config"
+)
+
+/* SUBCOMMANDS */
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s <command> [flags]
+
+Commands:
+  serve                 run the HTTP server (default)
+  migrate up            apply pending schema migrations
+  migrate down [-steps] revert the most recent migrations
+  migrate status        list applied and pending migrations
+  healthcheck           check RDS and S3 once and exit non-zero on failure
+  reconcile [-repair]   check S3 against the database once and exit non-zero
+                        on findings left unrepaired
+`, os.Args[0])
+}
+
+// envFileFlag registers the -env-file flag shared by every subcommand.
+func envFileFlag(fs *flag.FlagSet) *string {
+	return fs.String("env-file", "", "load settings from this .env file (defaults to .env when APP_ENV=local)")
+}
+
+// loadEnvFile applies a .env file for local development. It is opt-in:
+// nothing is read unless -env-file is given or APP_ENV=local.
+func loadEnvFile(path string) {
+	if path == "" && os.Getenv("APP_ENV") == "local" {
+		path = ".env"
+	}
+	if path == "" {
+		return
+	}
+
+	if err := config.LoadDotEnv(path); err != nil {
+		log.Fatalf("level=FATAL service=go-app error=env_file_failed path=%s err=%v", path, err)
+	}
+	log.Printf("level=INFO service=go-app event=env_file_loaded path=%s", path)
+}
+
+// newApp resolves the instance identity and configuration shared by every
+// subcommand, exiting with the full list of problems if config is invalid.
+func newApp(envFile string) *app {
+	loadEnvFile(envFile)
+
+	cfg, err := config.Load()
+	if err != nil {
+		instanceID := hostnameIdentity().ID
+		var verr *config.ValidationError
+		if errors.As(err, &verr) {
+			for _, p := range verr.Problems {
+				log.Printf("level=ERROR service=go-app event=invalid_config problem=%q instance=%s", p, instanceID)
+			}
+		}
+		log.Fatalf("level=FATAL service=go-app error=invalid_config err=%v", err)
+	}
+
+	logOutput.setFormat(cfg.LogFormat)
+
+	identity, err := resolveIdentity(context.Background(), cfg.Identity)
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=metadata_unavailable fallback=hostname err=%q instance=%s", err, identity.ID)
+	}
+
+	return &app{
+		cfg:        cfg,
+		identity:   identity,
+		instanceID: identity.ID,
+		web:        webAssets(cfg.HTTP.WebDir),
+		settings:   newSettingsStore(cfg, logOutput, identity.ID),
+		disposable: newDisposableList(cfg.Disposable, identity.ID),
+	}
+}
+
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	migrate := fs.Bool("migrate", true, "apply pending migrations before serving")
+	envFile := envFileFlag(fs)
+	fs.Parse(args)
+
+	a := newApp(*envFile)
+	build := currentBuild()
+	log.Printf("level=INFO service=go-app event=app_start env=%s git_sha=%s build_time=%s go_version=%s instance=%s az=%s identity_source=%s",
+		a.cfg.Env, build.GitSHA, build.BuildTime, build.GoVersion, a.instanceID, a.identity.AZ, a.identity.Source)
+	for _, setting := range a.cfg.Effective() {
+		log.Printf("level=INFO service=go-app event=effective_config setting=%q instance=%s", setting, a.instanceID)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	store, s3Client, err := newStorage(ctx, a.cfg, a.instanceID)
+	if err != nil {
+		log.Fatalf("level=FATAL service=go-app error=s3_init_failed err=%v", err)
+	}
+	a.store = store
+	a.s3 = s3Client
+
+	if a.cfg.Degraded.Enabled {
+		sp, err := newSpool(a.cfg.Degraded, a.cfg.S3, a.s3, a.instanceID)
+		if err != nil {
+			log.Fatalf("level=FATAL service=go-app error=spool_init_failed err=%v", err)
+		}
+		a.spool = sp
+		a.background.Add(1)
+		go func() {
+			defer a.background.Done()
+			a.replaySpool(ctx)
+		}()
+	}
+
+	if a.cfg.OTP.Enabled {
+		client, err := newSMSClient(ctx, a.cfg.OTP)
+		if err != nil {
+			log.Fatalf("level=FATAL service=go-app error=sms_init_failed err=%v", err)
+		}
+		a.sms = client
+	}
+
+	if err := a.initDatabase(ctx, *migrate); err != nil {
+		log.Fatalf("level=FATAL service=go-app error=db_init_failed err=%v", err)
+	}
+
+	if a.cfg.Scan.ClamAVAddr != "" {
+		a.scanner = &clamav.Client{Addr: a.cfg.Scan.ClamAVAddr}
+		go a.scanDocuments(ctx)
+	}
+	if a.cfg.Thumbnails.Enabled {
+		go a.makeThumbnails(ctx)
+	}
+
+	if a.cfg.Reconcile.Interval > 0 {
+		go a.reconcileDocuments(ctx)
+	}
+	go a.settings.run(ctx)
+	go a.disposable.run(ctx)
+	go a.cleanupDocuments(ctx)
+	go a.runSubmissionWorkers(ctx)
+	go a.runEmailWorker(ctx)
+	initFlags(ctx, a.cfg.Flags, a.instanceID)
+	go a.awaitReady(ctx)
+
+	if err := a.serve(ctx); err != nil {
+		log.Fatalf("level=FATAL service=go-app error=server_failed err=%v", err)
+	}
+}
+
+func runMigrate(args []string) {
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	direction, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("migrate "+direction, flag.ExitOnError)
+	steps := fs.Int("steps", 1, "number of migrations to revert (down only)")
+	envFile := envFileFlag(fs)
+	fs.Parse(args)
+
+	a := newApp(*envFile)
+	ctx := context.Background()
+
+	if err := a.initDatabase(ctx, false); err != nil {
+		log.Fatalf("level=FATAL service=go-app error=db_init_failed err=%v", err)
+	}
+	defer a.db.Close()
+
+	switch direction {
+	case "up":
+		applied, err := migrateUp(ctx, a.db)
+		for _, m := range applied {
+			log.Printf("level=INFO service=go-app event=migration_applied version=%d name=%s instance=%s", m.version, m.name, a.instanceID)
+		}
+		if err != nil {
+			log.Fatalf("level=FATAL service=go-app error=migrate_up_failed err=%v", err)
+		}
+		log.Printf("level=INFO service=go-app event=migrate_up_complete applied=%d instance=%s", len(applied), a.instanceID)
+
+	case "down":
+		reverted, err := migrateDown(ctx, a.db, *steps)
+		for _, m := range reverted {
+			log.Printf("level=INFO service=go-app event=migration_reverted version=%d name=%s instance=%s", m.version, m.name, a.instanceID)
+		}
+		if err != nil {
+			log.Fatalf("level=FATAL service=go-app error=migrate_down_failed err=%v", err)
+		}
+
+	case "status":
+		pending, err := pendingMigrations(ctx, a.db)
+		if err != nil {
+			log.Fatalf("level=FATAL service=go-app error=migrate_status_failed err=%v", err)
+		}
+		isPending := map[int]bool{}
+		for _, m := range pending {
+			isPending[m.version] = true
+		}
+		for _, m := range migrations {
+			state := "applied"
+			if isPending[m.version] {
+				state = "pending"
+			}
+			fmt.Printf("%04d_%s\t%s\n", m.version, m.name, state)
+		}
+
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+// runHealthcheck performs a single pass over the app's dependencies, for
+// container health probes and init containers. It never retries.
+func runHealthcheck(args []string) {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 5*time.Second, "overall time limit for all checks")
+	envFile := envFileFlag(fs)
+	fs.Parse(args)
+
+	a := newApp(*envFile)
+	a.cfg.DB.Retry.MaxAttempts = 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	db, err := connectDB(ctx, "RDS_DB", a.cfg.DB, a.instanceID)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_connect_failed err=%v instance=%s", err, a.instanceID)
+	} else {
+		a.db = db
+		defer db.Close()
+	}
+	if store, client, err := newStorage(ctx, a.cfg, a.instanceID); err != nil {
+		log.Printf("level=ERROR service=go-app event=s3_client_failed err=%v instance=%s", err, a.instanceID)
+	} else {
+		a.store = store
+		a.s3 = client
+	}
+
+	if !a.logReport(a.selfCheck(ctx)) {
+		os.Exit(1)
+	}
+}
+
+// runReconcile reconciles the bucket with the database once; see
+// reconcile.go. It exits 1 when anything found was left unrepaired, so a
+// scheduler can alert on it.
+func runReconcile(args []string) {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "queue orphaned objects for deletion and repair dangling rows where possible (defaults to RECONCILE_REPAIR)")
+	envFile := envFileFlag(fs)
+	fs.Parse(args)
+
+	a := newApp(*envFile)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := a.initDatabase(ctx, false); err != nil {
+		log.Fatalf("level=FATAL service=go-app error=db_init_failed err=%v", err)
+	}
+	defer a.db.Close()
+	store, client, err := newStorage(ctx, a.cfg, a.instanceID)
+	if err != nil {
+		log.Fatalf("level=FATAL service=go-app error=s3_init_failed err=%v", err)
+	}
+	a.store = store
+	a.s3 = client
+
+	report, err := a.reconcile(ctx, *repair || a.cfg.Reconcile.Repair)
+	if err != nil {
+		log.Fatalf("level=FATAL service=go-app error=reconcile_failed err=%v", err)
+	}
+	if report.unresolved() {
+		os.Exit(1)
+	}
+}
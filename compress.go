@@ -0,0 +1,199 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* RESPONSE COMPRESSION */
+
+// compressibleTypes are the media types worth compressing; documents and
+// images are already compressed and pass through untouched.
+var compressibleTypes = map[string]bool{
+	"text/html":                true,
+	"text/css":                 true,
+	"text/plain":               true,
+	"text/csv":                 true,
+	"text/javascript":          true,
+	"application/javascript":   true,
+	"application/json":         true,
+	"application/problem+json": true,
+	"application/x-ndjson":     true,
+}
+
+var gzipWriters = sync.Pool{New: func() any {
+	w, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+	return w
+}}
+
+var flateWriters = sync.Pool{New: func() any {
+	w, _ := flate.NewWriter(io.Discard, flate.DefaultCompression)
+	return w
+}}
+
+// compress gzip- or deflate-encodes responses of compressible types once
+// they reach HTTP_COMPRESS_MIN_SIZE; smaller bodies are not worth the CPU.
+func (a *app) compress(next http.HandlerFunc) http.HandlerFunc {
+	minSize := int(a.cfg.HTTP.CompressMinBytes)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next(w, r)
+			return
+		}
+
+		// Not deferred: after a panic, recoverPanics must still find the
+		// response unwritten.
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize}
+		next(cw, r)
+		cw.close()
+	}
+}
+
+// acceptedEncoding picks gzip, else deflate, from an Accept-Encoding header.
+func acceptedEncoding(header string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	switch {
+	case accepted["gzip"]:
+		return "gzip"
+	case accepted["deflate"]:
+		return "deflate"
+	default:
+		return ""
+	}
+}
+
+// compressWriter holds back the status and the first minSize bytes until it
+// knows whether the response is worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.status == 0 {
+		cw.status = code
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= cw.minSize {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide sends the held-back header and bytes, compressing when the type
+// qualifies and (unless big is already known) the body is large enough.
+func (cw *compressWriter) decide(big bool) error {
+	cw.decided = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	h := cw.Header()
+	mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	compressible := compressibleTypes[mt] && h.Get("Content-Encoding") == "" &&
+		cw.status != http.StatusNoContent && cw.status != http.StatusNotModified
+	if compressible {
+		h.Add("Vary", "Accept-Encoding")
+	}
+
+	if compressible && (big || len(cw.buf) >= cw.minSize) {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		if etag := h.Get("ETag"); strings.HasSuffix(etag, `"`) {
+			// The encoded body is a different representation.
+			h.Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+cw.encoding+`"`)
+		}
+		cw.ResponseWriter.WriteHeader(cw.status)
+
+		if cw.encoding == "gzip" {
+			gz := gzipWriters.Get().(*gzip.Writer)
+			gz.Reset(cw.ResponseWriter)
+			cw.enc = gz
+		} else {
+			fl := flateWriters.Get().(*flate.Writer)
+			fl.Reset(cw.ResponseWriter)
+			cw.enc = fl
+		}
+		_, err := cw.enc.Write(cw.buf)
+		cw.buf = nil
+		return err
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	_, err := cw.ResponseWriter.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
+
+// Flush sends everything written so far, deciding early if need be, so
+// streamed responses are not held back.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(len(cw.buf) > 0)
+	}
+	if f, ok := cw.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			// The handler wrote nothing; leave the default 200 to net/http.
+			return
+		}
+		cw.decide(false)
+	}
+
+	switch enc := cw.enc.(type) {
+	case *gzip.Writer:
+		enc.Close()
+		gzipWriters.Put(enc)
+	case *flate.Writer:
+		enc.Close()
+		flateWriters.Put(enc)
+	}
+}
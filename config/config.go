@@ -0,0 +1,1327 @@
+// Package config loads every application setting from the environment once
+// at startup and validates it, so a misconfigured instance fails fast with a
+// complete list of problems instead of dying on the first missing variable.
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	neturl "net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"client_alb_go_s3_rds/phone"
+)
+
+/* CONFIG TYPES */
+
+// Config is the fully resolved application configuration.
+type Config struct {
+	// Env is the APP_ENV profile (local, dev, stage or prod) that supplied
+	// the defaults below.
+	Env       string
+	LogFormat string
+
+	HTTP       HTTPConfig
+	DB         DBConfig
+	S3         S3Config
+	Storage    StorageConfig
+	CloudFront CloudFrontConfig
+	Identity   IdentityConfig
+	Startup    StartupConfig
+	Flags      FlagsConfig
+	Health     HealthConfig
+	Degraded   DegradedConfig
+	Async      AsyncSubmitConfig
+	Admin      AdminConfig
+	Webhooks   WebhookConfig
+	API        APIConfig
+	CORS       CORSConfig
+	Security   SecurityHeadersConfig
+	Phone      PhoneConfig
+	Docs       DocumentsConfig
+	Captcha    CaptchaConfig
+	Spam       SpamConfig
+	Disposable DisposableEmailConfig
+	Email      EmailConfig
+	OTP        OTPConfig
+	Consent    ConsentConfig
+	Drafts     DraftsConfig
+	Scan       ScanConfig
+	Thumbnails ThumbnailConfig
+	Reconcile  ReconcileConfig
+
+	// Settings holds the initial runtime settings; see SettingsSources for
+	// how they change afterwards.
+	Settings        Settings
+	SettingsSources SettingsSources
+}
+
+// HTTPConfig holds the settings of the public HTTP listener.
+type HTTPConfig struct {
+	Host string
+	Port int
+
+	// WebDir overrides the embedded form page and static assets with files
+	// from disk, for local development.
+	WebDir string
+
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	// IdleTimeout should exceed the ALB idle timeout (60s by default) so the
+	// instance never closes a keep-alive connection the ALB is about to reuse.
+	IdleTimeout    time.Duration
+	MaxHeaderBytes int
+
+	// TLSCertFile and TLSKeyFile enable HTTPS on the listener for end-to-end
+	// encryption from the ALB. The pair is re-read when either file changes.
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSReloadInterval time.Duration
+
+	// DrainTimeout is how long shutdown waits for in-flight requests. It
+	// should match the ALB target group deregistration delay.
+	DrainTimeout time.Duration
+
+	// TrustedProxies are the networks (the ALB's subnets) whose
+	// X-Forwarded-For entries are believed when working out the client IP.
+	TrustedProxies []netip.Prefix
+
+	// MaxJSONBodyBytes caps non-multipart request bodies; uploads are
+	// capped by the MAX_UPLOAD_SIZE runtime setting instead.
+	MaxJSONBodyBytes int64
+
+	// MaxImportBodyBytes caps CSV bodies sent to the bulk import.
+	MaxImportBodyBytes int64
+
+	// CompressMinBytes is the smallest HTML, JSON or CSV body that is
+	// gzip-encoded for clients that accept it; 0 disables compression.
+	CompressMinBytes int64
+
+	// HandlerTimeout bounds each request's handler, and through its context
+	// every SQL and S3 call the handler makes. Routes taking document
+	// uploads get UploadTimeout instead; streams get neither. 0 disables.
+	HandlerTimeout time.Duration
+	UploadTimeout  time.Duration
+}
+
+// TLSEnabled reports whether the listener serves HTTPS.
+func (c HTTPConfig) TLSEnabled() bool {
+	return c.TLSCertFile != ""
+}
+
+// Addr returns the listen address for the HTTP server.
+func (c HTTPConfig) Addr() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+// DBConfig describes how to reach a Postgres database. When SecretARN is
+// set, the credentials (and any connection fields left empty) are read from
+// that Secrets Manager secret instead of the environment.
+type DBConfig struct {
+	Host           string
+	Port           int
+	User           string
+	Password       string `secret:"true"`
+	Name           string
+	SSLMode        string
+	ConnectTimeout time.Duration
+
+	SecretARN     string
+	SecretRefresh time.Duration
+
+	// IAMAuth replaces the password with a short-lived RDS IAM auth token
+	// generated for every new connection. It forces verify-full TLS against
+	// the RDS CA bundle at SSLRootCert.
+	IAMAuth     bool
+	Region      string
+	SSLRootCert string
+
+	Retry RetryConfig
+}
+
+// RetryConfig bounds an exponential backoff loop. Attempts stop at whichever
+// of MaxAttempts or Budget is exhausted first.
+type RetryConfig struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Budget         time.Duration
+}
+
+// DSN returns the lib/pq connection string for the database.
+func (c DBConfig) DSN() string {
+	return "host=" + dsnQuote(c.Host) +
+		" port=" + strconv.Itoa(c.Port) +
+		" user=" + dsnQuote(c.User) +
+		" password=" + dsnQuote(c.Password) +
+		" dbname=" + dsnQuote(c.Name) +
+		" sslmode=" + dsnQuote(c.SSLMode) +
+		dsnOpt("sslrootcert", c.SSLRootCert)
+}
+
+func dsnOpt(key, val string) string {
+	if val == "" {
+		return ""
+	}
+	return " " + key + "=" + dsnQuote(val)
+}
+
+// dsnQuote quotes a key/value DSN value so generated passwords containing
+// spaces, quotes or backslashes survive lib/pq's parser.
+func dsnQuote(v string) string {
+	if v != "" && !strings.ContainsAny(v, ` '\`) {
+		return v
+	}
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
+
+// S3Config describes where KYC documents are stored.
+type S3Config struct {
+	Bucket    string
+	Region    string
+	KeyPrefix string
+
+	// EndpointURL and UsePathStyle point the client at LocalStack or MinIO
+	// instead of AWS.
+	EndpointURL  string
+	UsePathStyle bool
+
+	// CleanupInterval is how often documents of deleted users that could
+	// not be removed right away are retried.
+	CleanupInterval time.Duration
+
+	// PresignExpiry bounds the lifetime of the presigned document URLs
+	// handed to reviewers.
+	PresignExpiry time.Duration
+
+	// Documents larger than PartSize are uploaded in parts of that size,
+	// UploadConcurrency at a time.
+	PartSize          int64
+	UploadConcurrency int
+
+	// KMSKeyID is the KMS key documents are encrypted under with SSE-KMS;
+	// the account's aws/s3 key when empty.
+	KMSKeyID string
+
+	// KeyTemplate lays out the keys of documents uploaded through the app
+	// under KeyPrefix, from the KeyTemplateFields in braces.
+	KeyTemplate string
+
+	// Dedupe stores a document identical to one already stored as a
+	// reference to it instead of a second copy.
+	Dedupe bool
+
+	// New documents are stored in StorageClass; those of users approved
+	// for ArchiveAfter are moved to ArchiveStorageClass, or never when it
+	// is zero.
+	StorageClass        string
+	ArchiveAfter        time.Duration
+	ArchiveStorageClass string
+
+	// With ArchiveBucket set, the documents of approved users are copied
+	// under ArchivePrefix in that bucket, encrypted under ArchiveKMSKeyID,
+	// and the originals deleted ArchiveGracePeriod later when ArchiveDelete
+	// is set.
+	ArchiveBucket      string
+	ArchivePrefix      string
+	ArchiveKMSKeyID    string
+	ArchiveDelete      bool
+	ArchiveGracePeriod time.Duration
+
+	// While documents are scanned for malware, new uploads wait in
+	// QuarantineBucket, or under the quarantine/ prefix of Bucket when it
+	// is empty, until they are found clean.
+	QuarantineBucket string
+
+	// Failed calls are tried up to MaxAttempts times in RetryMode; S3 must
+	// answer each request within Timeout. BreakerThreshold failures in a
+	// row stop all calls for BreakerCooldown.
+	RetryMode        string
+	MaxAttempts      int
+	Timeout          time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// Documents are kept immutable with Object Lock in ObjectLockMode for
+	// ObjectLockDays from when they are stored, or not when the mode is
+	// "none".
+	ObjectLockMode string
+	ObjectLockDays int
+
+	// With RoleARN set, S3 is called as that role, assumed with
+	// RoleExternalID, for a bucket in another account; every other AWS
+	// call keeps the instance's credentials.
+	RoleARN        string
+	RoleExternalID string
+
+	// With Accelerate set, uploads go through the bucket's Transfer
+	// Acceleration endpoint, or the standard one when the bucket does not
+	// have it enabled.
+	Accelerate bool
+}
+
+// StorageConfig selects where documents are kept. Backend "s3" is AWS S3
+// as S3Config describes; "minio" is a MinIO server at S3_ENDPOINT_URL;
+// "gcs" is Google Cloud Storage through its S3-compatible XML API, with
+// HMAC keys as the AWS credentials; "local" keeps them as files under
+// LocalDir, for tests and on-prem deployments without object storage.
+// Direct, resumable and other uploads that need the full S3 API, object
+// tags and archival are only available with "s3" and "minio".
+type StorageConfig struct {
+	Backend  string
+	LocalDir string
+}
+
+// CloudFrontConfig, when Domain is set, has document URLs handed to
+// reviewers issued as CloudFront signed URLs on Domain, a distribution with
+// the bucket as its origin, instead of S3 presigned URLs. They are signed
+// with the private key in PrivateKeyFile, a PEM file, of the public key
+// KeyPairID names in the distribution's trusted key group.
+type CloudFrontConfig struct {
+	Domain         string
+	KeyPairID      string
+	PrivateKeyFile string
+}
+
+// IdentityConfig selects where the instance identity reported in logs and
+// responses comes from: "auto", "ec2", "ecs" or "hostname".
+type IdentityConfig struct {
+	Source  string
+	Timeout time.Duration
+}
+
+// StartupConfig controls the dependency self-check that gates readiness.
+// WriteProbe puts and deletes a tiny object to prove the IAM policy allows
+// uploads, not just bucket access.
+type StartupConfig struct {
+	CheckTimeout  time.Duration
+	RetryInterval time.Duration
+	WriteProbe    bool
+}
+
+// FlagsConfig lists the feature flag sources beyond FEATURE_* variables.
+// AppConfig is used only when application, environment and profile are
+// all set.
+type FlagsConfig struct {
+	SSMPath              string
+	AppConfigApplication string
+	AppConfigEnvironment string
+	AppConfigProfile     string
+	RefreshInterval      time.Duration
+}
+
+// HealthConfig selects the dependency checks /readyz runs and bounds each
+// one independently. Valid checks are "rds", "s3" and "migrations".
+type HealthConfig struct {
+	ReadyChecks       []string
+	RDSTimeout        time.Duration
+	S3Timeout         time.Duration
+	MigrationsTimeout time.Duration
+}
+
+// DegradedConfig controls booting without a reachable database, which is
+// off unless Enabled. Accepted submissions are spooled to SpoolBackend ("s3"
+// under SpoolPrefix, or "local" in SpoolDir) and replayed once RDS answers
+// again.
+type DegradedConfig struct {
+	Enabled          bool
+	SpoolBackend     string
+	SpoolDir         string
+	SpoolPrefix      string
+	RecoveryInterval time.Duration
+}
+
+// AsyncSubmitConfig sizes the workers that process submissions queued by
+// the async_submit flag. A failed job is retried with backoff between
+// RetryBackoff and RetryMaxBackoff until MaxAttempts, then left failed.
+type AsyncSubmitConfig struct {
+	Workers         int
+	PollInterval    time.Duration
+	MaxAttempts     int
+	RetryBackoff    time.Duration
+	RetryMaxBackoff time.Duration
+}
+
+// AdminConfig protects the /admin endpoints. They are disabled unless a
+// token is configured. Reviewers maps each KYC reviewer's name to a personal
+// bearer token for the review endpoints, which record that name.
+type AdminConfig struct {
+	Token     string            `secret:"true"`
+	Reviewers map[string]string `secret:"true"`
+}
+
+// WebhookConfig authenticates callbacks from the external KYC provider.
+// The receiver is disabled unless KYCProviderSecret, the HMAC key shared
+// with the provider, is set. Signatures older than Tolerance are refused
+// so a captured request cannot be replayed later.
+type WebhookConfig struct {
+	KYCProviderSecret string `secret:"true"`
+	Tolerance         time.Duration
+}
+
+// CORSConfig lets browser apps on other origins call /api/*. With no
+// allowed origins, cross-origin requests get no CORS headers and browsers
+// block them.
+type CORSConfig struct {
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+	ExposedHeaders []string
+	MaxAge         time.Duration
+}
+
+// SecurityHeadersConfig controls the browser security headers on HTML
+// responses. An empty ContentSecurityPolicy means the default policy, which
+// also allows the S3 endpoint direct uploads post to. HSTSMaxAge of 0 omits
+// Strict-Transport-Security; it is only ever sent over HTTPS.
+type SecurityHeadersConfig struct {
+	ContentSecurityPolicy string
+	FrameOptions          string
+	ReferrerPolicy        string
+	HSTSMaxAge            time.Duration
+}
+
+// PhoneConfig controls how submitted phone numbers are read. Numbers
+// written without a country code are taken to be from DefaultRegion, an
+// ISO 3166-1 country code.
+type PhoneConfig struct {
+	DefaultRegion string
+}
+
+// DocumentsConfig controls which KYC documents are accepted. AllowedTypes
+// are MIME types; a document's type is detected from its content.
+// MaxImageBytes and MaxPDFBytes limit the size of image and PDF documents;
+// zero leaves that type to the MAX_UPLOAD_SIZE runtime setting. Images must
+// measure ImageMinSide to ImageMaxSide pixels on each side, and have at most
+// ImageMaxPixels in all, which bounds the memory decoding one takes; this
+// also bounds the images thumbnails are made of. Tier is the KYC
+// tier, one of KYCTiers, whose documents the form asks for.
+type DocumentsConfig struct {
+	AllowedTypes   []string
+	MaxImageBytes  int64
+	MaxPDFBytes    int64
+	ImageMinSide   int
+	ImageMaxSide   int
+	ImageMaxPixels int
+	Tier           string
+}
+
+// CaptchaConfig puts a CAPTCHA on the public form. Provider is one of
+// CaptchaProviders; "none", the default, leaves the form without one, as
+// suits local and dev environments. SiteKey is shown to browsers and
+// SecretKey verifies their answers. MinScore applies to providers that
+// score answers, such as reCAPTCHA v3.
+type CaptchaConfig struct {
+	Provider  string
+	SiteKey   string
+	SecretKey string `secret:"true"`
+	MinScore  float64
+	Timeout   time.Duration
+}
+
+// SpamConfig sets the form's cheap bot checks, which complement a CAPTCHA:
+// a Honeypot field hidden from people, and MinFillTime, the least time a
+// person takes between loading the form and submitting it (0 disables the
+// check). Action is what happens to a submission failing either: "drop"
+// answers as if it were stored and stores nothing; "flag" only logs and
+// counts it.
+type SpamConfig struct {
+	Honeypot    bool
+	MinFillTime time.Duration
+	Action      string
+}
+
+// DisposableEmailConfig blocks email addresses at disposable providers,
+// which are never verifiable. Domains lists them inline; SourceURL, a plain
+// text list with one domain per line, adds more and is fetched again every
+// RefreshInterval. A domain also covers its subdomains. Action is what
+// happens to a form submission from one: "reject" refuses it with an error
+// on the email field; "flag" stores it marked disposable_email.
+type DisposableEmailConfig struct {
+	Domains         []string
+	SourceURL       string
+	RefreshInterval time.Duration
+	Action          string
+}
+
+// EmailConfig has form applicants confirm their email address through a
+// link sent with SES. It is off unless From, an SES-verified sender, is
+// set; BaseURL is then the public origin the link points at. Links expire
+// after TokenTTL. An email that fails to send is retried with backoff up
+// to MaxAttempts times.
+type EmailConfig struct {
+	From         string
+	Region       string
+	BaseURL      string
+	TokenTTL     time.Duration
+	PollInterval time.Duration
+	MaxAttempts  int
+}
+
+// OTPConfig has form applicants confirm their phone number with a code
+// sent by SMS through SNS before a submission is accepted. Codes expire
+// after CodeTTL and stop working after MaxAttempts wrong guesses; at most
+// MaxSends codes go to one number per SendWindow. SenderID names the
+// sender where the destination country supports it.
+type OTPConfig struct {
+	Enabled     bool
+	Region      string
+	SenderID    string
+	CodeTTL     time.Duration
+	MaxAttempts int
+	MaxSends    int
+	SendWindow  time.Duration
+}
+
+// ConsentConfig names the privacy policy form applicants must accept.
+// PolicyVersion is recorded with each acceptance; change it whenever the
+// policy changes. PolicyURL, if set, links the policy from the form.
+type ConsentConfig struct {
+	PolicyVersion string
+	PolicyURL     string
+}
+
+// DraftsConfig controls the multi-step form at /apply. TTL is how long an
+// untouched draft, and the documents uploaded to it, are kept.
+type DraftsConfig struct {
+	TTL time.Duration
+}
+
+// ScanConfig has every document scanned for malware by the clamd at
+// ClamAVAddr, a host:port, before its submission can be approved. It is off
+// when ClamAVAddr is empty. Unscanned documents are picked up every
+// Interval, and each scan given up after Timeout.
+type ScanConfig struct {
+	ClamAVAddr string
+	Interval   time.Duration
+	Timeout    time.Duration
+}
+
+// ThumbnailConfig has a JPEG preview, at most Size pixels on its longer
+// side, made of every JPEG and PNG document, so reviewers can see documents
+// without downloading them. Documents without one are picked up every
+// Interval. Previews are made once a document is found clean when scanning
+// is on.
+type ThumbnailConfig struct {
+	Enabled  bool
+	Size     int
+	Interval time.Duration
+}
+
+// ReconcileConfig schedules the reconciliation of the bucket with the
+// database every Interval, or never when it is zero. Objects no row refers
+// to are only reported once older than MinAge, which must outlast an
+// upload in progress. With Repair, what can be fixed is.
+type ReconcileConfig struct {
+	Interval time.Duration
+	MinAge   time.Duration
+	Repair   bool
+}
+
+// SpamActions lists the accepted SPAM_ACTION values.
+var SpamActions = []string{"drop", "flag"}
+
+// DisposableEmailActions lists the accepted DISPOSABLE_EMAIL_ACTION values.
+var DisposableEmailActions = []string{"reject", "flag"}
+
+// CaptchaProviders lists the accepted CAPTCHA_PROVIDER values.
+var CaptchaProviders = []string{"none", "recaptcha", "hcaptcha", "turnstile"}
+
+// KYCTiers lists the accepted KYC_TIER values.
+var KYCTiers = []string{"basic", "standard", "enhanced"}
+
+// KeyTemplateFields lists the placeholders S3_KEY_TEMPLATE may use: the
+// upload date in UTC, the submission's reference, a random UUID and the
+// sanitized filename.
+var KeyTemplateFields = []string{"yyyy", "mm", "dd", "reference", "uuid", "filename"}
+
+// S3RoleSession is how long the credentials of S3_ROLE_ARN last before
+// the role is assumed again. An hour is the longest a role allows unless
+// its maximum session duration is raised.
+const S3RoleSession = time.Hour
+
+var (
+	roleARN        = regexp.MustCompile(`^arn:aws[a-z-]*:iam::\d{12}:role/[\w+=,.@/-]+$`)
+	roleExternalID = regexp.MustCompile(`^[\w+=,.@:/-]+$`)
+)
+
+// StorageClasses lists the accepted S3_STORAGE_CLASS values.
+var StorageClasses = []string{"STANDARD", "STANDARD_IA", "INTELLIGENT_TIERING"}
+
+// ArchiveStorageClasses lists the accepted S3_ARCHIVE_STORAGE_CLASS values.
+var ArchiveStorageClasses = []string{"GLACIER", "GLACIER_IR", "DEEP_ARCHIVE"}
+
+// FullS3 reports whether the backend speaks the whole S3 API the app uses
+// beyond storing and reading documents.
+func (c StorageConfig) FullS3() bool {
+	return c.Backend == "s3" || c.Backend == "minio"
+}
+
+// StorageBackends lists the accepted STORAGE_BACKEND values.
+var StorageBackends = []string{"s3", "minio", "gcs", "local"}
+
+// ObjectLockModes lists the accepted S3_OBJECT_LOCK_MODE values.
+var ObjectLockModes = []string{"none", "GOVERNANCE", "COMPLIANCE"}
+
+// S3RetryModes lists the accepted S3_RETRY_MODE values.
+var S3RetryModes = []string{"standard", "adaptive"}
+
+// DocumentTypes are the document MIME types the service can detect.
+var DocumentTypes = []string{"application/pdf", "image/jpeg", "image/png", "image/webp"}
+
+// APIConfig authenticates callers of /api/v1. Tokens maps each client name,
+// which is recorded as the actor of any change it makes, to its bearer
+// token. With no tokens configured the API is disabled.
+type APIConfig struct {
+	Tokens map[string]string `secret:"true"`
+}
+
+/* LOADING */
+
+// DefaultRDSCABundle is where the AWS RDS global CA bundle is expected when
+// certificate verification is on and no explicit path is configured.
+const DefaultRDSCABundle = "/etc/ssl/certs/rds-global-bundle.pem"
+
+// ValidationError lists every missing or invalid setting found by Load.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// Load reads the configuration from the process environment.
+func Load() (*Config, error) {
+	return LoadFrom(os.LookupEnv)
+}
+
+// LoadFrom reads the configuration using lookup to resolve variables. All
+// problems are collected and returned together as a *ValidationError.
+func LoadFrom(lookup func(string) (string, bool)) (*Config, error) {
+	l := &loader{lookup: lookup}
+
+	env := l.oneOf("APP_ENV", "prod", Envs...)
+	l.prof = profiles[env]
+
+	cfg := &Config{
+		Env:       env,
+		LogFormat: l.oneOf("LOG_FORMAT", l.prof.logFormat, "text", "json"),
+		HTTP: HTTPConfig{
+			Host:               l.str("HTTP_HOST", ""),
+			Port:               l.port("HTTP_PORT", 8080),
+			WebDir:             l.str("WEB_DIR", ""),
+			ReadTimeout:        l.duration("HTTP_READ_TIMEOUT", time.Minute),
+			ReadHeaderTimeout:  l.duration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+			WriteTimeout:       l.duration("HTTP_WRITE_TIMEOUT", time.Minute),
+			IdleTimeout:        l.duration("HTTP_IDLE_TIMEOUT", 75*time.Second),
+			MaxHeaderBytes:     int(l.size("HTTP_MAX_HEADER_BYTES", 1<<20)),
+			TLSCertFile:        l.str("TLS_CERT_FILE", ""),
+			TLSKeyFile:         l.str("TLS_KEY_FILE", ""),
+			TLSReloadInterval:  l.duration("TLS_RELOAD_INTERVAL", 30*time.Second),
+			DrainTimeout:       l.duration("SHUTDOWN_DRAIN_TIMEOUT", 30*time.Second),
+			MaxJSONBodyBytes:   l.size("HTTP_MAX_JSON_BODY", 1<<20),
+			MaxImportBodyBytes: l.size("HTTP_MAX_IMPORT_BODY", 10<<20),
+			CompressMinBytes:   l.sizeOrZero("HTTP_COMPRESS_MIN_SIZE", 1024),
+			HandlerTimeout:     l.duration("HTTP_HANDLER_TIMEOUT", 15*time.Second),
+			UploadTimeout:      l.duration("HTTP_UPLOAD_TIMEOUT", 50*time.Second),
+			TrustedProxies:     l.prefixes("TRUSTED_PROXIES", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"),
+		},
+		DB: l.db("RDS_DB", "RDS_SECRET_ARN", "ap-south-1"),
+		S3: S3Config{
+			Bucket:      l.required("S3_BUCKET_NAME"),
+			Region:      l.str("S3_REGION", "ap-south-1"),
+			KeyPrefix:   l.str("S3_KEY_PREFIX", l.prof.keyPrefix),
+			EndpointURL: l.url("S3_ENDPOINT_URL"),
+			// Local S3 emulators rarely resolve bucket subdomains, so path
+			// style defaults on whenever a custom endpoint is configured.
+			UsePathStyle:        l.boolean("S3_USE_PATH_STYLE", l.str("S3_ENDPOINT_URL", "") != ""),
+			CleanupInterval:     l.duration("S3_CLEANUP_INTERVAL", 5*time.Minute),
+			PresignExpiry:       l.duration("S3_PRESIGN_EXPIRY", 5*time.Minute),
+			PartSize:            l.size("S3_UPLOAD_PART_SIZE", 5<<20),
+			UploadConcurrency:   l.positive("S3_UPLOAD_CONCURRENCY", 5),
+			KMSKeyID:            l.str("S3_KMS_KEY_ID", ""),
+			KeyTemplate:         l.keyTemplate("S3_KEY_TEMPLATE", "{uuid}/{filename}"),
+			Dedupe:              l.boolean("S3_DEDUPE", false),
+			StorageClass:        l.oneOf("S3_STORAGE_CLASS", "STANDARD", StorageClasses...),
+			ArchiveAfter:        l.duration("S3_ARCHIVE_AFTER", 0),
+			ArchiveStorageClass: l.oneOf("S3_ARCHIVE_STORAGE_CLASS", "GLACIER", ArchiveStorageClasses...),
+			ArchiveBucket:       l.str("S3_ARCHIVE_BUCKET", ""),
+			QuarantineBucket:    l.str("S3_QUARANTINE_BUCKET", ""),
+			ArchivePrefix:       l.str("S3_ARCHIVE_PREFIX", ""),
+			ArchiveKMSKeyID:     l.str("S3_ARCHIVE_KMS_KEY_ID", ""),
+			ArchiveDelete:       l.boolean("S3_ARCHIVE_DELETE_ORIGINAL", false),
+			ArchiveGracePeriod:  l.duration("S3_ARCHIVE_GRACE_PERIOD", 7*24*time.Hour),
+			RetryMode:           l.oneOf("S3_RETRY_MODE", "adaptive", S3RetryModes...),
+			MaxAttempts:         l.positive("S3_MAX_ATTEMPTS", 3),
+			Timeout:             l.duration("S3_TIMEOUT", 30*time.Second),
+			BreakerThreshold:    l.positive("S3_BREAKER_THRESHOLD", 5),
+			BreakerCooldown:     l.duration("S3_BREAKER_COOLDOWN", 30*time.Second),
+			ObjectLockMode:      l.oneOf("S3_OBJECT_LOCK_MODE", "none", ObjectLockModes...),
+			ObjectLockDays:      l.positive("S3_OBJECT_LOCK_DAYS", 2555),
+			RoleARN:             l.str("S3_ROLE_ARN", ""),
+			RoleExternalID:      l.str("S3_ROLE_EXTERNAL_ID", ""),
+			Accelerate:          l.boolean("S3_ACCELERATE", false),
+		},
+	}
+
+	cfg.Storage = StorageConfig{
+		Backend:  l.oneOf("STORAGE_BACKEND", "s3", StorageBackends...),
+		LocalDir: l.str("STORAGE_LOCAL_DIR", "data/documents"),
+	}
+	switch cfg.Storage.Backend {
+	case "minio":
+		if cfg.S3.EndpointURL == "" {
+			l.fail("S3_ENDPOINT_URL", "is required with STORAGE_BACKEND=minio")
+		}
+	case "gcs":
+		if cfg.S3.EndpointURL == "" {
+			cfg.S3.EndpointURL = "https://storage.googleapis.com"
+		}
+	}
+	if cfg.S3.ArchiveAfter > 0 && cfg.Storage.Backend != "s3" {
+		l.fail("S3_ARCHIVE_AFTER", "needs STORAGE_BACKEND=s3")
+	}
+	if b := cfg.S3.ArchiveBucket; b != "" {
+		if !cfg.Storage.FullS3() {
+			l.fail("S3_ARCHIVE_BUCKET", "needs STORAGE_BACKEND=s3 or minio")
+		}
+		// Within one bucket, archived documents are told apart by prefix.
+		archive, keys := cfg.S3.ArchivePrefix, cfg.S3.KeyPrefix
+		if b == cfg.S3.Bucket && (archive == "" || strings.HasPrefix(archive, keys) || strings.HasPrefix(keys, archive)) {
+			l.fail("S3_ARCHIVE_PREFIX", "must be set outside S3_KEY_PREFIX when S3_ARCHIVE_BUCKET is S3_BUCKET_NAME")
+		}
+	}
+	if cfg.S3.ObjectLockMode != "none" && !cfg.Storage.FullS3() {
+		l.fail("S3_OBJECT_LOCK_MODE", "needs STORAGE_BACKEND=s3 or minio")
+	}
+
+	if arn := cfg.S3.RoleARN; arn != "" {
+		if !roleARN.MatchString(arn) {
+			l.fail("S3_ROLE_ARN", "must be an IAM role ARN, such as arn:aws:iam::123456789012:role/kyc-documents, got %q", arn)
+		}
+		if cfg.Storage.Backend != "s3" {
+			l.fail("S3_ROLE_ARN", "needs STORAGE_BACKEND=s3")
+		}
+		// A presigned URL stops working when the credentials that signed it
+		// expire; those of the role are renewed while S3_PRESIGN_EXPIRY is
+		// left of them, so it must be shorter than a session.
+		if cfg.S3.PresignExpiry >= S3RoleSession {
+			l.fail("S3_PRESIGN_EXPIRY", "must be under %s with S3_ROLE_ARN, the length of the role's sessions", S3RoleSession)
+		}
+	} else if cfg.S3.RoleExternalID != "" {
+		l.fail("S3_ROLE_EXTERNAL_ID", "needs S3_ROLE_ARN")
+	}
+	if id := cfg.S3.RoleExternalID; id != "" && (len(id) < 2 || len(id) > 1224 || !roleExternalID.MatchString(id)) {
+		l.fail("S3_ROLE_EXTERNAL_ID", "must be 2 to 1224 letters, digits or +=,.@:/- characters")
+	}
+	if cfg.S3.Accelerate {
+		if cfg.Storage.Backend != "s3" || cfg.S3.EndpointURL != "" {
+			l.fail("S3_ACCELERATE", "needs STORAGE_BACKEND=s3 without S3_ENDPOINT_URL")
+		}
+		// The accelerate endpoint is virtual-hosted only, and its TLS
+		// certificate does not cover bucket names with dots.
+		if cfg.S3.UsePathStyle || strings.Contains(cfg.S3.Bucket+cfg.S3.QuarantineBucket, ".") {
+			l.fail("S3_ACCELERATE", "needs virtual-hosted addressing and a bucket name without dots")
+		}
+	}
+
+	cfg.CloudFront = CloudFrontConfig{
+		Domain:         l.str("CLOUDFRONT_DOMAIN", ""),
+		KeyPairID:      l.str("CLOUDFRONT_KEY_PAIR_ID", ""),
+		PrivateKeyFile: l.str("CLOUDFRONT_PRIVATE_KEY_FILE", ""),
+	}
+	if d := cfg.CloudFront.Domain; d != "" {
+		if strings.ContainsAny(d, ":/") {
+			l.fail("CLOUDFRONT_DOMAIN", "must be a host name, such as d111111abcdef8.cloudfront.net")
+		}
+		if cfg.CloudFront.KeyPairID == "" || cfg.CloudFront.PrivateKeyFile == "" {
+			l.fail("CLOUDFRONT_DOMAIN", "needs CLOUDFRONT_KEY_PAIR_ID and CLOUDFRONT_PRIVATE_KEY_FILE")
+		}
+		if cfg.Storage.Backend == "local" {
+			l.fail("CLOUDFRONT_DOMAIN", "needs a STORAGE_BACKEND other than local")
+		}
+	}
+
+	// S3 refuses multipart upload parts under 5MB, but the last.
+	if cfg.S3.PartSize < 5<<20 {
+		l.fail("S3_UPLOAD_PART_SIZE", "must be at least 5MB")
+	}
+	// SigV4 presigned URLs are capped at seven days by S3.
+	if cfg.S3.PresignExpiry > 7*24*time.Hour {
+		l.fail("S3_PRESIGN_EXPIRY", "must be at most 168h")
+	}
+
+	// A handler cut off by the server's WriteTimeout can no longer answer
+	// 504; it must give up first.
+	if w := cfg.HTTP.WriteTimeout; w > 0 && cfg.HTTP.HandlerTimeout >= w {
+		l.fail("HTTP_HANDLER_TIMEOUT", "must be less than HTTP_WRITE_TIMEOUT")
+	}
+	if w := cfg.HTTP.WriteTimeout; w > 0 && cfg.HTTP.UploadTimeout >= w {
+		l.fail("HTTP_UPLOAD_TIMEOUT", "must be less than HTTP_WRITE_TIMEOUT")
+	}
+
+	if (cfg.HTTP.TLSCertFile == "") != (cfg.HTTP.TLSKeyFile == "") {
+		l.fail("TLS_CERT_FILE", "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	cfg.Identity = IdentityConfig{
+		Source:  l.oneOf("INSTANCE_METADATA_SOURCE", "auto", "auto", "ec2", "ecs", "hostname"),
+		Timeout: l.duration("INSTANCE_METADATA_TIMEOUT", 2*time.Second),
+	}
+
+	cfg.Startup = StartupConfig{
+		CheckTimeout:  l.duration("STARTUP_CHECK_TIMEOUT", 10*time.Second),
+		RetryInterval: l.duration("STARTUP_CHECK_INTERVAL", 15*time.Second),
+		WriteProbe:    l.boolean("STARTUP_CHECK_WRITE_PROBE", true),
+	}
+	cfg.Flags = FlagsConfig{
+		SSMPath:              l.str("FLAGS_SSM_PATH", ""),
+		AppConfigApplication: l.str("FLAGS_APPCONFIG_APPLICATION", ""),
+		AppConfigEnvironment: l.str("FLAGS_APPCONFIG_ENVIRONMENT", ""),
+		AppConfigProfile:     l.str("FLAGS_APPCONFIG_PROFILE", ""),
+		RefreshInterval:      l.duration("FLAGS_REFRESH_INTERVAL", time.Minute),
+	}
+	cfg.Health = HealthConfig{
+		ReadyChecks:       l.list("READYZ_CHECKS", []string{"rds", "s3", "migrations"}, "rds", "s3", "migrations"),
+		RDSTimeout:        l.duration("READYZ_RDS_TIMEOUT", 2*time.Second),
+		S3Timeout:         l.duration("READYZ_S3_TIMEOUT", 2*time.Second),
+		MigrationsTimeout: l.duration("READYZ_MIGRATIONS_TIMEOUT", 2*time.Second),
+	}
+	cfg.Degraded = DegradedConfig{
+		Enabled:          l.boolean("DEGRADED_MODE", false),
+		SpoolBackend:     l.oneOf("SPOOL_BACKEND", "s3", "s3", "local"),
+		SpoolDir:         l.str("SPOOL_DIR", "/var/spool/go-app"),
+		SpoolPrefix:      l.str("SPOOL_S3_PREFIX", "spool/submissions"),
+		RecoveryInterval: l.duration("DB_RECOVERY_INTERVAL", 15*time.Second),
+	}
+	if cfg.Degraded.Enabled && cfg.Degraded.SpoolBackend == "s3" && !cfg.Storage.FullS3() {
+		l.fail("SPOOL_BACKEND", "must be local with STORAGE_BACKEND=%s", cfg.Storage.Backend)
+	}
+	cfg.Async = AsyncSubmitConfig{
+		Workers:         l.positive("ASYNC_SUBMIT_WORKERS", 2),
+		PollInterval:    l.duration("ASYNC_SUBMIT_POLL_INTERVAL", time.Second),
+		MaxAttempts:     l.positive("ASYNC_SUBMIT_MAX_ATTEMPTS", 8),
+		RetryBackoff:    l.duration("ASYNC_SUBMIT_RETRY_BACKOFF", 5*time.Second),
+		RetryMaxBackoff: l.duration("ASYNC_SUBMIT_RETRY_MAX_BACKOFF", 10*time.Minute),
+	}
+	cfg.Admin = AdminConfig{
+		Token:     l.str("ADMIN_TOKEN", ""),
+		Reviewers: l.pairs("ADMIN_REVIEWERS"),
+	}
+	cfg.Webhooks = WebhookConfig{
+		KYCProviderSecret: l.str("WEBHOOK_KYC_PROVIDER_SECRET", ""),
+		Tolerance:         l.duration("WEBHOOK_TOLERANCE", 5*time.Minute),
+	}
+	cfg.API = APIConfig{
+		Tokens: l.pairs("API_TOKENS"),
+	}
+	cfg.CORS = CORSConfig{
+		AllowedOrigins: l.origins("CORS_ALLOWED_ORIGINS"),
+		AllowedMethods: l.list("CORS_ALLOWED_METHODS", []string{"GET", "POST", "PUT", "PATCH", "DELETE"}, "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"),
+		AllowedHeaders: l.list("CORS_ALLOWED_HEADERS", []string{"Authorization", "Content-Type"}),
+		ExposedHeaders: l.list("CORS_EXPOSED_HEADERS", []string{"X-Request-ID", "Location", "Content-Disposition", "Retry-After"}),
+		MaxAge:         l.duration("CORS_MAX_AGE", 10*time.Minute),
+	}
+	cfg.Security = SecurityHeadersConfig{
+		ContentSecurityPolicy: l.str("SECURITY_CSP", ""),
+		FrameOptions:          l.oneOf("SECURITY_FRAME_OPTIONS", "DENY", "DENY", "SAMEORIGIN"),
+		ReferrerPolicy:        l.str("SECURITY_REFERRER_POLICY", "strict-origin-when-cross-origin"),
+		HSTSMaxAge:            l.duration("HSTS_MAX_AGE", l.prof.hstsMaxAge),
+	}
+	cfg.Phone = PhoneConfig{
+		DefaultRegion: l.oneOf("PHONE_DEFAULT_REGION", "IN", phone.Regions()...),
+	}
+	cfg.Docs = DocumentsConfig{
+		AllowedTypes:   l.list("DOCUMENT_TYPES", []string{"application/pdf", "image/jpeg", "image/png"}, DocumentTypes...),
+		MaxImageBytes:  l.sizeOrZero("DOCUMENT_MAX_IMAGE_SIZE", 0),
+		MaxPDFBytes:    l.sizeOrZero("DOCUMENT_MAX_PDF_SIZE", 0),
+		ImageMinSide:   l.positive("DOCUMENT_IMAGE_MIN_SIDE", 200),
+		ImageMaxSide:   l.positive("DOCUMENT_IMAGE_MAX_SIDE", 10000),
+		ImageMaxPixels: l.positive("DOCUMENT_IMAGE_MAX_PIXELS", 40_000_000),
+		Tier:           l.oneOf("KYC_TIER", "basic", KYCTiers...),
+	}
+	if len(cfg.Docs.AllowedTypes) == 0 {
+		l.fail("DOCUMENT_TYPES", "must allow at least one type")
+	}
+	if cfg.Docs.ImageMinSide > cfg.Docs.ImageMaxSide {
+		l.fail("DOCUMENT_IMAGE_MIN_SIDE", "must be at most DOCUMENT_IMAGE_MAX_SIDE")
+	}
+	cfg.Captcha = CaptchaConfig{
+		Provider: l.oneOf("CAPTCHA_PROVIDER", "none", CaptchaProviders...),
+		MinScore: l.fraction("CAPTCHA_MIN_SCORE", 0.5),
+		Timeout:  l.duration("CAPTCHA_TIMEOUT", 5*time.Second),
+	}
+	if cfg.Captcha.Provider != "none" {
+		cfg.Captcha.SiteKey = l.required("CAPTCHA_SITE_KEY")
+		cfg.Captcha.SecretKey = l.required("CAPTCHA_SECRET_KEY")
+	}
+	cfg.Spam = SpamConfig{
+		Honeypot:    l.boolean("SPAM_HONEYPOT", true),
+		MinFillTime: l.duration("SPAM_MIN_FILL_TIME", 3*time.Second),
+		Action:      l.oneOf("SPAM_ACTION", "drop", SpamActions...),
+	}
+	cfg.Disposable = DisposableEmailConfig{
+		Domains:         l.list("DISPOSABLE_EMAIL_DOMAINS", nil),
+		SourceURL:       l.url("DISPOSABLE_EMAIL_SOURCE_URL"),
+		RefreshInterval: l.duration("DISPOSABLE_EMAIL_REFRESH_INTERVAL", 24*time.Hour),
+		Action:          l.oneOf("DISPOSABLE_EMAIL_ACTION", "reject", DisposableEmailActions...),
+	}
+	cfg.Email = EmailConfig{
+		From:         l.str("SES_FROM_ADDRESS", ""),
+		Region:       l.str("SES_REGION", cfg.S3.Region),
+		TokenTTL:     l.duration("EMAIL_VERIFICATION_TTL", 72*time.Hour),
+		PollInterval: l.duration("EMAIL_POLL_INTERVAL", 5*time.Second),
+		MaxAttempts:  l.positive("EMAIL_MAX_ATTEMPTS", 5),
+	}
+	if cfg.Email.From != "" {
+		l.required("PUBLIC_BASE_URL")
+		cfg.Email.BaseURL = strings.TrimSuffix(l.url("PUBLIC_BASE_URL"), "/")
+	}
+	cfg.OTP = OTPConfig{
+		Enabled:     l.boolean("SMS_OTP", false),
+		Region:      l.str("SNS_REGION", cfg.S3.Region),
+		SenderID:    l.str("SMS_SENDER_ID", ""),
+		CodeTTL:     l.duration("OTP_CODE_TTL", 10*time.Minute),
+		MaxAttempts: l.positive("OTP_MAX_ATTEMPTS", 5),
+		MaxSends:    l.positive("OTP_MAX_SENDS", 3),
+		SendWindow:  l.duration("OTP_SEND_WINDOW", time.Hour),
+	}
+	cfg.Drafts = DraftsConfig{
+		TTL: l.duration("DRAFT_TTL", 72*time.Hour),
+	}
+	cfg.Scan = ScanConfig{
+		ClamAVAddr: l.str("CLAMAV_ADDR", ""),
+		Interval:   l.duration("SCAN_INTERVAL", 10*time.Second),
+		Timeout:    l.duration("SCAN_TIMEOUT", time.Minute),
+	}
+	if addr := cfg.Scan.ClamAVAddr; addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			l.fail("CLAMAV_ADDR", "must be host:port, got %q", addr)
+		}
+		if cfg.Scan.Interval <= 0 {
+			l.fail("SCAN_INTERVAL", "must be positive")
+		}
+	}
+	if b := cfg.S3.QuarantineBucket; b != "" {
+		// Releasing a document copies it out of quarantine, which needs
+		// the S3 API, once clamd has found it clean.
+		if cfg.Scan.ClamAVAddr == "" || !cfg.Storage.FullS3() {
+			l.fail("S3_QUARANTINE_BUCKET", "needs CLAMAV_ADDR and STORAGE_BACKEND=s3 or minio")
+		}
+		if b == cfg.S3.Bucket || b == cfg.S3.ArchiveBucket {
+			l.fail("S3_QUARANTINE_BUCKET", "must be a bucket of its own, not S3_BUCKET_NAME or S3_ARCHIVE_BUCKET")
+		}
+	}
+	cfg.Thumbnails = ThumbnailConfig{
+		Enabled:  l.boolean("THUMBNAILS", true),
+		Size:     l.positive("THUMBNAIL_SIZE", 320),
+		Interval: l.duration("THUMBNAIL_INTERVAL", 30*time.Second),
+	}
+	if cfg.Thumbnails.Enabled && cfg.Thumbnails.Interval <= 0 {
+		l.fail("THUMBNAIL_INTERVAL", "must be positive")
+	}
+	cfg.Reconcile = ReconcileConfig{
+		Interval: l.duration("RECONCILE_INTERVAL", 0),
+		MinAge:   l.duration("RECONCILE_MIN_AGE", 24*time.Hour),
+		Repair:   l.boolean("RECONCILE_REPAIR", false),
+	}
+	if cfg.Reconcile.MinAge < time.Hour {
+		l.fail("RECONCILE_MIN_AGE", "must be at least 1h, longer than any upload takes to be recorded")
+	}
+	cfg.Consent = ConsentConfig{
+		PolicyVersion: l.str("CONSENT_POLICY_VERSION", "1"),
+		PolicyURL:     l.url("CONSENT_POLICY_URL"),
+	}
+	cfg.Settings = l.settings(Settings{
+		LogLevel:       "INFO",
+		MaxUploadBytes: l.prof.maxUploadBytes,
+		RateLimitRPS:   1,
+		RateLimitBurst: 5,
+
+		MaintenanceRetryAfter: 5 * time.Minute,
+		MaintenanceReady:      true,
+	})
+	cfg.SettingsSources = SettingsSources{
+		File:         l.str("SETTINGS_FILE", ""),
+		SSMPath:      l.str("SETTINGS_SSM_PATH", ""),
+		PollInterval: l.duration("SETTINGS_POLL_INTERVAL", time.Minute),
+	}
+
+	if len(l.problems) > 0 {
+		return nil, &ValidationError{Problems: l.problems}
+	}
+	return cfg, nil
+}
+
+func (l *loader) db(prefix, secretKey, region string) DBConfig {
+	secretARN := l.str(secretKey, "")
+	if secretARN != "" && !strings.HasPrefix(secretARN, "arn:") {
+		l.fail(secretKey, "invalid ARN %q", secretARN)
+	}
+
+	iamAuth := l.boolean(prefix+"_IAM_AUTH", false)
+	if iamAuth && secretARN != "" {
+		l.fail(prefix+"_IAM_AUTH", "cannot be combined with %s", secretKey)
+	}
+
+	// With a secret configured, connection fields fall back to the secret's
+	// host/port/dbname and the credentials always come from it.
+	required, requiredPort := l.required, l.requiredPort
+	if secretARN != "" {
+		required = func(key string) string { return l.str(key, "") }
+		requiredPort = func(key string) int { return l.port(key, 0) }
+	}
+
+	cfg := DBConfig{
+		Host:           required(prefix + "_HOST"),
+		Port:           requiredPort(prefix + "_PORT"),
+		User:           required(prefix + "_USER"),
+		Name:           required(prefix + "_NAME"),
+		ConnectTimeout: l.duration(prefix+"_CONNECT_TIMEOUT", 5*time.Second),
+		SecretARN:      secretARN,
+		SecretRefresh:  l.duration(secretKey+"_REFRESH", 15*time.Minute),
+		IAMAuth:        iamAuth,
+		Region:         l.str(prefix+"_REGION", region),
+		SSLRootCert:    l.str(prefix+"_SSLROOTCERT", ""),
+		Retry: RetryConfig{
+			MaxAttempts:    l.positive(prefix+"_CONNECT_MAX_ATTEMPTS", 10),
+			InitialBackoff: l.duration(prefix+"_CONNECT_BACKOFF", time.Second),
+			MaxBackoff:     l.duration(prefix+"_CONNECT_MAX_BACKOFF", 30*time.Second),
+			Budget:         l.duration(prefix+"_CONNECT_BUDGET", 2*time.Minute),
+		},
+	}
+
+	if iamAuth {
+		// IAM tokens are only accepted over TLS; pin the server certificate
+		// to the RDS CA bundle rather than trusting whatever is presented.
+		cfg.SSLMode = "verify-full"
+		if cfg.SSLRootCert == "" {
+			cfg.SSLRootCert = DefaultRDSCABundle
+		}
+		return cfg
+	}
+
+	cfg.Password = required(prefix + "_PASSWORD")
+	cfg.SSLMode = l.oneOf(prefix+"_SSLMODE", l.prof.sslMode, "disable", "allow", "prefer", "require", "verify-ca", "verify-full")
+	if strings.HasPrefix(cfg.SSLMode, "verify-") && cfg.SSLRootCert == "" {
+		cfg.SSLRootCert = DefaultRDSCABundle
+	}
+	return cfg
+}
+
+// loader resolves individual variables and records problems instead of
+// aborting, so Load can report everything at once.
+type loader struct {
+	lookup   func(string) (string, bool)
+	prof     profile
+	problems []string
+}
+
+func (l *loader) fail(key, format string, args ...any) {
+	l.problems = append(l.problems, key+": "+fmt.Sprintf(format, args...))
+}
+
+func (l *loader) get(key string) (string, bool) {
+	val, ok := l.lookup(key)
+	val = strings.TrimSpace(val)
+	return val, ok && val != ""
+}
+
+func (l *loader) required(key string) string {
+	val, ok := l.get(key)
+	if !ok {
+		l.fail(key, "missing required variable")
+	}
+	return val
+}
+
+func (l *loader) str(key, def string) string {
+	if val, ok := l.get(key); ok {
+		return val
+	}
+	return def
+}
+
+// oneOf returns the allowed value matching the variable, ignoring case. An
+// empty def makes the variable required.
+func (l *loader) oneOf(key, def string, allowed ...string) string {
+	val, ok := l.get(key)
+	if !ok {
+		if def == "" {
+			l.fail(key, "missing required variable")
+		}
+		return def
+	}
+	for _, a := range allowed {
+		if strings.EqualFold(val, a) {
+			return a
+		}
+	}
+	l.fail(key, "must be one of %s, got %q", strings.Join(allowed, ", "), val)
+	return def
+}
+
+// url returns an optional absolute http(s) URL.
+func (l *loader) url(key string) string {
+	val, ok := l.get(key)
+	if !ok {
+		return ""
+	}
+	u, err := neturl.Parse(val)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		l.fail(key, "invalid URL %q", val)
+		return ""
+	}
+	return val
+}
+
+// list returns a comma-separated list whose entries must each be one of
+// allowed (any value when allowed is empty). An empty variable yields def.
+func (l *loader) list(key string, def []string, allowed ...string) []string {
+	val, ok := l.get(key)
+	if !ok {
+		return def
+	}
+
+	var out []string
+	for _, item := range strings.Split(val, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if len(allowed) > 0 && !slices.Contains(allowed, item) {
+			l.fail(key, "unknown entry %q, expected one of %s", item, strings.Join(allowed, ", "))
+			continue
+		}
+		out = append(out, item)
+	}
+	return out
+}
+
+// origins returns a list of browser origins such as https://app.example.com,
+// or "*" for any.
+func (l *loader) origins(key string) []string {
+	var out []string
+	for _, item := range l.list(key, nil) {
+		if item == "*" {
+			out = append(out, item)
+			continue
+		}
+		u, err := neturl.Parse(item)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			l.fail(key, "invalid origin %q, expected scheme://host[:port]", item)
+			continue
+		}
+		out = append(out, u.Scheme+"://"+u.Host)
+	}
+	return out
+}
+
+// prefixes returns a list of CIDR networks; a bare address is a /32 or /128.
+func (l *loader) prefixes(key string, def ...string) []netip.Prefix {
+	var out []netip.Prefix
+	for _, item := range l.list(key, def) {
+		p, err := netip.ParsePrefix(item)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(item)
+			if addrErr != nil {
+				l.fail(key, "invalid CIDR %q", item)
+				continue
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		out = append(out, p.Masked())
+	}
+	return out
+}
+
+// pairs parses "name:value,name:value" into a map.
+func (l *loader) pairs(key string) map[string]string {
+	out := map[string]string{}
+	for _, item := range l.list(key, nil) {
+		name, val, ok := strings.Cut(item, ":")
+		if !ok || name == "" || val == "" {
+			l.fail(key, "entries must look like name:value")
+			continue
+		}
+		out[name] = val
+	}
+	return out
+}
+
+func (l *loader) requiredPort(key string) int {
+	val, ok := l.get(key)
+	if !ok {
+		l.fail(key, "missing required variable")
+		return 0
+	}
+	return l.parsePort(key, val)
+}
+
+func (l *loader) port(key string, def int) int {
+	val, ok := l.get(key)
+	if !ok {
+		return def
+	}
+	return l.parsePort(key, val)
+}
+
+func (l *loader) parsePort(key, val string) int {
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 1 || n > 65535 {
+		l.fail(key, "invalid port %q", val)
+		return 0
+	}
+	return n
+}
+
+func (l *loader) positive(key string, def int) int {
+	val, ok := l.get(key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 1 {
+		l.fail(key, "must be a positive integer, got %q", val)
+		return def
+	}
+	return n
+}
+
+func (l *loader) boolean(key string, def bool) bool {
+	val, ok := l.get(key)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		l.fail(key, "invalid boolean %q", val)
+		return def
+	}
+	return b
+}
+
+func (l *loader) fraction(key string, def float64) float64 {
+	val, ok := l.get(key)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil || f < 0 || f > 1 {
+		l.fail(key, "must be a number from 0 to 1, got %q", val)
+		return def
+	}
+	return f
+}
+
+func (l *loader) duration(key string, def time.Duration) time.Duration {
+	val, ok := l.get(key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		l.fail(key, "invalid duration %q", val)
+		return def
+	}
+	return d
+}
+
+// keyTemplate returns an S3 key template using only KeyTemplateFields. It
+// must include {uuid}, so no two documents ever get the same key.
+func (l *loader) keyTemplate(key, def string) string {
+	val := l.str(key, def)
+	for rest := val; ; {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			l.fail(key, "unclosed { in %q", val)
+			return def
+		}
+		if name := rest[start+1 : start+end]; !slices.Contains(KeyTemplateFields, name) {
+			l.fail(key, "unknown field {%s}, must be one of %s", name, strings.Join(KeyTemplateFields, ", "))
+			return def
+		}
+		rest = rest[start+end+1:]
+	}
+	switch {
+	case !strings.Contains(val, "{uuid}"):
+		l.fail(key, "must include {uuid}")
+	case strings.HasPrefix(val, "/") || strings.HasSuffix(val, "/"):
+		l.fail(key, "must not begin or end with /")
+	}
+	return val
+}
+
+func (l *loader) size(key string, def int64) int64 {
+	val, ok := l.get(key)
+	if !ok {
+		return def
+	}
+	n, err := ParseSize(val)
+	if err != nil {
+		l.fail(key, "%v", err)
+		return def
+	}
+	return n
+}
+
+// sizeOrZero is size for settings that 0 turns off.
+func (l *loader) sizeOrZero(key string, def int64) int64 {
+	val, ok := l.get(key)
+	if !ok {
+		return def
+	}
+	n, err := parseSize(val, 0)
+	if err != nil {
+		l.fail(key, "%v", err)
+		return def
+	}
+	return n
+}
+
+// ParseSize parses a byte size such as "512", "64KB", "10MB" or "1GB".
+// Units are binary, so "10MB" equals 10<<20 bytes.
+func ParseSize(s string) (int64, error) {
+	return parseSize(s, 1)
+}
+
+// parseSize is ParseSize, refusing sizes below least bytes.
+func parseSize(s string, least int64) (int64, error) {
+	units := []struct {
+		suffix string
+		mult   int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+
+	num, mult := strings.ToUpper(strings.TrimSpace(s)), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num, mult = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.mult
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < least {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+/* EFFECTIVE CONFIGURATION */
+
+// Effective returns every resolved setting as "Section.Field=value", in
+// declaration order, with fields tagged `secret:"true"` redacted. It is
+// meant for logging at startup.
+func (c *Config) Effective() []string {
+	var out []string
+	walkConfig(reflect.ValueOf(*c), "", &out)
+	return out
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func walkConfig(v reflect.Value, prefix string, out *[]string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, val := t.Field(i), v.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := prefix + field.Name
+		if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+			walkConfig(val, name+".", out)
+			continue
+		}
+
+		switch {
+		case field.Tag.Get("secret") == "true" && !val.IsZero():
+			*out = append(*out, name+"=[REDACTED]")
+		case field.Type == durationType:
+			*out = append(*out, name+"="+time.Duration(val.Int()).String())
+		default:
+			*out = append(*out, fmt.Sprintf("%s=%v", name, val.Interface()))
+		}
+	}
+}
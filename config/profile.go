@@ -0,0 +1,27 @@
+package config
+
+import "time"
+
+/* ENVIRONMENT PROFILES */
+
+// profile holds the defaults APP_ENV selects. Any variable that is set
+// explicitly still wins over its profile default.
+type profile struct {
+	logFormat      string
+	keyPrefix      string
+	maxUploadBytes int64
+	sslMode        string
+	hstsMaxAge     time.Duration
+}
+
+// Envs lists the accepted APP_ENV values.
+var Envs = []string{"local", "dev", "stage", "prod"}
+
+// HSTS is kept short outside prod so a misconfigured test domain does not
+// stay pinned to HTTPS in browsers for a year.
+var profiles = map[string]profile{
+	"local": {logFormat: "text", keyPrefix: "local/kyc-docs/", maxUploadBytes: 50 << 20, sslMode: "disable"},
+	"dev":   {logFormat: "text", keyPrefix: "dev/kyc-docs/", maxUploadBytes: 20 << 20, sslMode: "require", hstsMaxAge: 5 * time.Minute},
+	"stage": {logFormat: "json", keyPrefix: "stage/kyc-docs/", maxUploadBytes: 10 << 20, sslMode: "verify-full", hstsMaxAge: 24 * time.Hour},
+	"prod":  {logFormat: "json", keyPrefix: "kyc-docs/", maxUploadBytes: 10 << 20, sslMode: "verify-full", hstsMaxAge: 365 * 24 * time.Hour},
+}
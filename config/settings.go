@@ -0,0 +1,76 @@
+package config
+
+import (
+	"strconv"
+	"time"
+)
+
+/* RUNTIME SETTINGS */
+
+// Settings are the values operators may change while the process runs.
+// They start from the environment and can be overridden by a settings file
+// re-read on SIGHUP and by SSM Parameter Store polling.
+type Settings struct {
+	LogLevel       string
+	MaxUploadBytes int64
+
+	// RateLimitRPS and RateLimitBurst size the per-client-IP token bucket
+	// on the submission routes. An RPS of 0 disables the limit.
+	RateLimitRPS   float64
+	RateLimitBurst int
+
+	// Maintenance makes /submit answer 503 with MaintenanceRetryAfter.
+	// MaintenanceReady keeps readiness passing meanwhile, so the ALB keeps
+	// routing users to the maintenance page instead of returning its own 503.
+	Maintenance           bool
+	MaintenanceRetryAfter time.Duration
+	MaintenanceReady      bool
+}
+
+// SettingsSources says where runtime overrides are read from. Both are
+// optional; with neither set the environment values never change.
+type SettingsSources struct {
+	File         string
+	SSMPath      string
+	PollInterval time.Duration
+}
+
+// LogLevels lists the accepted LOG_LEVEL values, most verbose first.
+var LogLevels = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func (l *loader) settings(def Settings) Settings {
+	return Settings{
+		LogLevel:       l.oneOf("LOG_LEVEL", def.LogLevel, LogLevels...),
+		MaxUploadBytes: l.size("MAX_UPLOAD_SIZE", def.MaxUploadBytes),
+		RateLimitRPS:   l.float("RATE_LIMIT_RPS", def.RateLimitRPS),
+		RateLimitBurst: l.positive("RATE_LIMIT_BURST", def.RateLimitBurst),
+		Maintenance:    l.boolean("MAINTENANCE_MODE", def.Maintenance),
+
+		MaintenanceRetryAfter: l.duration("MAINTENANCE_RETRY_AFTER", def.MaintenanceRetryAfter),
+		MaintenanceReady:      l.boolean("MAINTENANCE_READY", def.MaintenanceReady),
+	}
+}
+
+// ParseSettings overlays the settings found via lookup onto base, using the
+// same names and validation as the environment.
+func ParseSettings(base Settings, lookup func(string) (string, bool)) (Settings, error) {
+	l := &loader{lookup: lookup}
+	s := l.settings(base)
+	if len(l.problems) > 0 {
+		return base, &ValidationError{Problems: l.problems}
+	}
+	return s, nil
+}
+
+func (l *loader) float(key string, def float64) float64 {
+	val, ok := l.get(key)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil || f < 0 {
+		l.fail(key, "invalid number %q", val)
+		return def
+	}
+	return f
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+/* CONSENT */
+
+// The form asks the applicant to accept the privacy policy, naming the
+// version in CONSENT_POLICY_VERSION, and /submit refuses it unaccepted.
+// The form also carries the version it showed, so a submission started
+// before the policy changed is sent back to accept the new one rather
+// than being recorded against a version the applicant never saw.
+const (
+	consentField        = "consent"
+	policyVersionField  = "policy_version"
+	consentAcceptedText = "yes"
+)
+
+// consentRecord is an applicant's acceptance of the policy, stored with
+// their submission in the consents table.
+type consentRecord struct {
+	PolicyVersion string    `json:"policy_version"`
+	AcceptedAt    time.Time `json:"accepted_at"`
+	ClientIP      string    `json:"client_ip"`
+}
+
+// policyTerms is the policy the form asks the applicant to accept.
+type policyTerms struct {
+	Version string
+	URL     string
+}
+
+// checkConsent returns the consent given with the form post r, or what is
+// wrong with it.
+func (a *app) checkConsent(r *http.Request) (*consentRecord, *fieldError) {
+	version := a.cfg.Consent.PolicyVersion
+	if r.PostFormValue(consentField) != consentAcceptedText {
+		e := newFieldError(consentField, "consent.required")
+		return nil, &e
+	}
+	if r.PostFormValue(policyVersionField) != version {
+		e := newFieldError(consentField, "consent.changed")
+		return nil, &e
+	}
+	return &consentRecord{PolicyVersion: version, AcceptedAt: time.Now().UTC(), ClientIP: a.clientIP(r)}, nil
+}
+
+// insertConsent records c as given by user userID.
+func insertConsent(ctx context.Context, tx *sql.Tx, userID int64, c consentRecord) error {
+	_, err := tx.ExecContext(ctx, `
+	INSERT INTO consents(user_id, policy_version, accepted_at, client_ip)
+	VALUES ($1, $2, $3, $4)
+	`, userID, c.PolicyVersion, c.AcceptedAt.UTC(), c.ClientIP)
+	return err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"client_alb_go_s3_rds/storage"
+)
+
+/* DOCUMENT DEDUPLICATION */
+
+// Applicants who resubmit, and the same statement sent for several people,
+// would store identical copies of a document. With S3_DEDUPE on, a
+// document whose SHA-256 and size match one already in the documents table,
+// stored in S3_STORAGE_CLASS rather than archived and not found to carry
+// malware, is not uploaded again: the new row refers to the object that is
+// there. It is off by default, as it has one applicant's submission refer to
+// an object another's brought. Such an object is only deleted once nothing
+// refers to it, and keeps the tags of its first upload; see tagStatus. Its
+// Object Lock is extended to cover the new document.
+//
+// Deleting an object nobody refers to and adding a row that refers to it
+// both hold the object's advisory lock, so a deduplicated row is never
+// added for an object that is being deleted; see deleteUnreferenced.
+
+// errDeduplicatedGone fails the insert of a deduplicated document whose
+// object was deleted once the rows it was found through were.
+var errDeduplicatedGone = errors.New("deduplicated document is no longer stored")
+
+// existingDocument returns where a document of size bytes with SHA-256 sum
+// is already stored, and the lock it was given, reporting false when there
+// is none or it cannot be told.
+func (a *app) existingDocument(ctx context.Context, size int64, sum []byte) (submittedDocument, bool) {
+	if !a.cfg.S3.Dedupe || a.dbDown.Load() {
+		return submittedDocument{}, false
+	}
+	var d submittedDocument
+	var mode sql.NullString
+	var until sql.NullTime
+	err := a.db.QueryRowContext(ctx, `
+	SELECT bucket, object_key, COALESCE(version_id, ''), storage_class, retention_mode, retain_until FROM documents
+	WHERE sha256 = $1 AND size_bytes = $2 AND bucket = $3 AND storage_class = $4
+	  AND scan_status IS DISTINCT FROM 'infected'
+	ORDER BY id LIMIT 1
+	`, hex.EncodeToString(sum), size, a.cfg.S3.Bucket, a.cfg.S3.StorageClass).Scan(&d.Bucket, &d.Key, &d.VersionID, &d.StorageClass, &mode, &until)
+	if errors.Is(err, sql.ErrNoRows) {
+		return submittedDocument{}, false
+	}
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=dedupe_lookup_failed err=%v request_id=%s instance=%s", err, requestID(ctx), a.instanceID)
+		return submittedDocument{}, false
+	}
+	if until.Valid {
+		d.RetentionMode, d.RetainUntil = mode.String, &until.Time
+	}
+	d.Deduplicated = true
+
+	// The row may outlive its object when the object was removed by hand.
+	if _, err := a.store.Head(ctx, storage.Object{Bucket: d.Bucket, Key: d.Key, VersionID: d.VersionID}); err != nil {
+		log.Printf("level=WARN service=go-app event=dedupe_object_missing key=%s err=%v request_id=%s instance=%s", d.Key, err, requestID(ctx), a.instanceID)
+		return submittedDocument{}, false
+	}
+
+	metricDocumentsDeduplicated.Add(1)
+	log.Printf("level=INFO service=go-app event=document_deduplicated key=%s request_id=%s instance=%s", d.Key, requestID(ctx), a.instanceID)
+	return d, true
+}
+
+// lockObject takes the advisory lock of the object key in bucket until tx
+// ends.
+func lockObject(ctx context.Context, tx *sql.Tx, bucket, key string) error {
+	_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, "object:"+bucket+"/"+key)
+	return err
+}
+
+// lockedDeleteTimeout bounds the delete deleteUnreferenced makes while it
+// holds the object's lock, and with it a transaction, so a slow store
+// cannot hold up uploads of the same document for long. A delete that
+// times out is retried from the deletion queue.
+const lockedDeleteTimeout = 5 * time.Second
+
+// deleteUnreferenced deletes obj unless something refers to it, reporting
+// whether something did.
+func (a *app) deleteUnreferenced(ctx context.Context, obj storage.Object) (bool, error) {
+	var referenced bool
+	err := inTx(ctx, a.db, func(tx *sql.Tx) error {
+		if err := lockObject(ctx, tx, obj.Bucket, obj.Key); err != nil {
+			return err
+		}
+		var err error
+		referenced, err = documentReferenced(ctx, tx, obj.Bucket, obj.Key)
+		if err != nil || referenced {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(ctx, lockedDeleteTimeout)
+		defer cancel()
+		return a.store.Delete(ctx, obj)
+	})
+	return referenced, err
+}
+
+// documentReferenced reports whether a document row, as its object or its
+// preview, a user stored before the documents table, or a draft still
+// refers to the object key in bucket.
+func documentReferenced(ctx context.Context, db queryer, bucket, key string) (bool, error) {
+	var referenced bool
+	err := db.QueryRowContext(ctx, `
+	SELECT EXISTS(SELECT 1 FROM documents WHERE bucket = $1 AND object_key = $2)
+	    OR EXISTS(SELECT 1 FROM documents WHERE thumbnail_bucket = $1 AND thumbnail_key = $2)
+	    OR EXISTS(SELECT 1 FROM users WHERE document_bucket = $1 AND document_key = $2)
+	    OR EXISTS(SELECT 1 FROM drafts WHERE data->'documents' @> jsonb_build_array(jsonb_build_object('bucket', $1::text, 'key', $2::text)))
+	`, bucket, key).Scan(&referenced)
+	return referenced, err
+}
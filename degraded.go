@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"client_alb_go_s3_rds/config"
+)
+
+/* DEGRADED MODE */
+
+// startDegraded boots without a reachable database: the pool is opened
+// lazily, submissions are spooled, readiness reports not-ready, and a
+// background loop waits for RDS to come back.
+func (a *app) startDegraded(ctx context.Context, migrate bool, cause error) error {
+	db, err := openDB(ctx, a.cfg.DB, a.instanceID)
+	if err != nil {
+		return err
+	}
+	a.db = db
+	a.dbDown.Store(true)
+
+	log.Printf("level=WARN service=go-app event=degraded_mode_entered spool=%s err=%v instance=%s", a.cfg.Degraded.SpoolBackend, cause, a.instanceID)
+	a.background.Add(1)
+	go func() {
+		defer a.background.Done()
+		a.recoverDatabase(ctx, migrate)
+	}()
+	return nil
+}
+
+// recoverDatabase pings RDS every recovery interval until it answers,
+// applies migrations if requested, and leaves degraded mode.
+func (a *app) recoverDatabase(ctx context.Context, migrate bool) {
+	ticker := time.NewTicker(a.cfg.Degraded.RecoveryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, a.cfg.DB.ConnectTimeout)
+		err := a.db.PingContext(pingCtx)
+		cancel()
+		if err != nil {
+			log.Printf("level=DEBUG service=go-app event=db_still_down err=%v instance=%s", err, a.instanceID)
+			continue
+		}
+
+		if migrate {
+			applied, err := migrateUp(ctx, a.db)
+			for _, m := range applied {
+				log.Printf("level=INFO service=go-app event=migration_applied version=%d name=%s instance=%s", m.version, m.name, a.instanceID)
+			}
+			if err != nil {
+				log.Printf("level=ERROR service=go-app event=migrate_failed err=%v instance=%s", err, a.instanceID)
+				continue
+			}
+		}
+
+		a.dbDown.Store(false)
+		log.Printf("level=INFO service=go-app event=degraded_mode_exited instance=%s", a.instanceID)
+		return
+	}
+}
+
+// replaySpool periodically drains the spool into the database while it is
+// reachable. It also covers submissions spooled after a mid-flight outage.
+func (a *app) replaySpool(ctx context.Context) {
+	ticker := time.NewTicker(a.cfg.Degraded.RecoveryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if a.dbDown.Load() {
+			continue
+		}
+
+		entries, err := a.spool.list(ctx)
+		if err != nil {
+			log.Printf("level=ERROR service=go-app event=spool_list_failed err=%v instance=%s", err, a.instanceID)
+			continue
+		}
+
+		// An entry the database rejects is left in the spool for the next
+		// run, and the rest are replayed past it, unless the database went
+		// away again.
+		replayed := 0
+		for _, s := range entries {
+			if _, err := insertUser(ctx, a.db, s); err != nil {
+				log.Printf("level=ERROR service=go-app event=spool_replay_failed spool_id=%s err=%v instance=%s", s.SpoolID, err, a.instanceID)
+				pingCtx, cancel := context.WithTimeout(ctx, a.cfg.DB.ConnectTimeout)
+				err := a.db.PingContext(pingCtx)
+				cancel()
+				if err != nil {
+					break
+				}
+				continue
+			}
+			if err := a.spool.remove(ctx, s.SpoolID); err != nil {
+				log.Printf("level=ERROR service=go-app event=spool_remove_failed spool_id=%s err=%v instance=%s", s.SpoolID, err, a.instanceID)
+				continue
+			}
+			replayed++
+		}
+		if replayed > 0 {
+			log.Printf("level=INFO service=go-app event=spool_replayed count=%d remaining=%d instance=%s", replayed, len(entries)-replayed, a.instanceID)
+		}
+	}
+}
+
+// errDatabaseDown stands in for an insert error while in degraded mode.
+var errDatabaseDown = errors.New("database unavailable (degraded mode)")
+
+// trySpool spools sub when the insert failed because the database is
+// unreachable. A database that still answers a ping rejected the row for
+// another reason, and spooling it would only fail again on replay.
+func (a *app) trySpool(ctx context.Context, sub submission, insertErr error) bool {
+	if a.spool == nil {
+		return false
+	}
+
+	if !errors.Is(insertErr, errDatabaseDown) {
+		pingCtx, cancel := context.WithTimeout(ctx, a.cfg.DB.ConnectTimeout)
+		defer cancel()
+		if a.db.PingContext(pingCtx) == nil {
+			return false
+		}
+	}
+
+	sub.SpoolID = newUUID()
+	if err := a.spool.put(ctx, sub); err != nil {
+		log.Printf("level=ERROR service=go-app event=spool_put_failed err=%v request_id=%s instance=%s", err, requestID(ctx), a.instanceID)
+		return false
+	}
+
+	log.Printf("level=WARN service=go-app event=submission_spooled spool_id=%s request_id=%s instance=%s", sub.SpoolID, requestID(ctx), a.instanceID)
+	return true
+}
+
+/* SPOOL */
+
+// spool durably holds submissions that could not be written to RDS.
+type spool interface {
+	put(ctx context.Context, s submission) error
+	list(ctx context.Context) ([]submission, error)
+	remove(ctx context.Context, spoolID string) error
+}
+
+func newSpool(cfg config.DegradedConfig, s3cfg config.S3Config, client *s3.Client, instanceID string) (spool, error) {
+	if cfg.SpoolBackend == "local" {
+		if err := os.MkdirAll(cfg.SpoolDir, 0o700); err != nil {
+			return nil, err
+		}
+		return fileSpool{dir: cfg.SpoolDir, instanceID: instanceID}, nil
+	}
+	return &s3Spool{client: client, bucket: s3cfg.Bucket, prefix: cfg.SpoolPrefix, kmsKey: sseKMSKey(s3cfg), instanceID: instanceID}, nil
+}
+
+// fileSpool keeps one JSON file per submission on local disk. Entries only
+// survive as long as the instance's volume does.
+type fileSpool struct {
+	dir        string
+	instanceID string
+}
+
+func (f fileSpool) put(ctx context.Context, s submission) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so a crash never leaves a half-written entry.
+	tmp := filepath.Join(f.dir, s.SpoolID+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(f.dir, s.SpoolID+".json"))
+}
+
+func (f fileSpool) list(ctx context.Context) ([]submission, error) {
+	paths, err := filepath.Glob(filepath.Join(f.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var out []submission
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var s submission
+		if err := json.Unmarshal(data, &s); err != nil {
+			// Left for an operator, without holding up the rest.
+			log.Printf("level=ERROR service=go-app event=spool_entry_invalid path=%s err=%v instance=%s", p, err, f.instanceID)
+			continue
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func (f fileSpool) remove(ctx context.Context, spoolID string) error {
+	err := os.Remove(filepath.Join(f.dir, spoolID+".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// s3Spool keeps one JSON object per submission under a bucket prefix, so
+// entries outlive the instance and any instance can replay them.
+type s3Spool struct {
+	client     *s3.Client
+	bucket     string
+	prefix     string
+	kmsKey     *string
+	instanceID string
+}
+
+func (s *s3Spool) key(spoolID string) *string {
+	return aws.String(strings.TrimSuffix(s.prefix, "/") + "/" + spoolID + ".json")
+}
+
+func (s *s3Spool) put(ctx context.Context, sub submission) error {
+	data, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  s.key(sub.SpoolID),
+		Body:                 bytes.NewReader(data),
+		ServerSideEncryption: types.ServerSideEncryptionAwsKms,
+		SSEKMSKeyId:          s.kmsKey,
+	})
+	return err
+}
+
+func (s *s3Spool) list(ctx context.Context) ([]submission, error) {
+	var out []submission
+
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(strings.TrimSuffix(s.prefix, "/") + "/"),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range page.Contents {
+			got, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: obj.Key})
+			if err != nil {
+				return nil, err
+			}
+			data, err := io.ReadAll(got.Body)
+			got.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+
+			var sub submission
+			if err := json.Unmarshal(data, &sub); err != nil {
+				// Left for an operator, without holding up the rest.
+				log.Printf("level=ERROR service=go-app event=spool_entry_invalid key=%s err=%v instance=%s", aws.ToString(obj.Key), err, s.instanceID)
+				continue
+			}
+			out = append(out, sub)
+		}
+	}
+	return out, nil
+}
+
+func (s *s3Spool) remove(ctx context.Context, spoolID string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    s.key(spoolID),
+	})
+	return err
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"client_alb_go_s3_rds/config"
+)
+
+/* DISPOSABLE EMAIL DOMAINS */
+
+// Addresses at disposable email providers stop working within hours, so a
+// record that uses one can never be verified. The blocklist is
+// DISPOSABLE_EMAIL_DOMAINS plus the list at DISPOSABLE_EMAIL_SOURCE_URL,
+// fetched at startup and every refresh interval; a fetch that fails keeps
+// the previous list.
+
+// maxDisposableListBytes bounds the list fetched from the source URL.
+const maxDisposableListBytes = 16 << 20
+
+// disposableList holds the current set of blocked domains.
+type disposableList struct {
+	cfg        config.DisposableEmailConfig
+	instanceID string
+
+	domains atomic.Pointer[map[string]bool]
+}
+
+func newDisposableList(cfg config.DisposableEmailConfig, instanceID string) *disposableList {
+	l := &disposableList{cfg: cfg, instanceID: instanceID}
+	l.store(nil)
+	return l
+}
+
+// store makes the configured domains plus fetched the current list.
+func (l *disposableList) store(fetched []string) {
+	domains := make(map[string]bool, len(l.cfg.Domains)+len(fetched))
+	for _, list := range [][]string{l.cfg.Domains, fetched} {
+		for _, d := range list {
+			domains[strings.ToLower(strings.TrimSuffix(d, "."))] = true
+		}
+	}
+	l.domains.Store(&domains)
+}
+
+// blocked reports whether email is at a listed domain or a subdomain of one.
+func (l *disposableList) blocked(email string) bool {
+	domains := *l.domains.Load()
+	if len(domains) == 0 {
+		return false
+	}
+	_, domain, ok := strings.Cut(email, "@")
+	if !ok {
+		return false
+	}
+	domain = strings.ToLower(domain)
+	for {
+		if domains[domain] {
+			return true
+		}
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok || !strings.Contains(parent, ".") {
+			return false
+		}
+		domain = parent
+	}
+}
+
+// run fetches the source list now and every refresh interval until ctx is
+// done. Without a source URL only the configured domains are blocked.
+func (l *disposableList) run(ctx context.Context) {
+	if l.cfg.SourceURL == "" {
+		return
+	}
+	ticker := time.NewTicker(l.cfg.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		domains, err := fetchDisposableList(ctx, l.cfg.SourceURL)
+		if err != nil {
+			log.Printf("level=ERROR service=go-app event=disposable_list_fetch_failed url=%s err=%v instance=%s", l.cfg.SourceURL, err, l.instanceID)
+		} else {
+			l.store(domains)
+			log.Printf("level=INFO service=go-app event=disposable_list_loaded domains=%d instance=%s", len(*l.domains.Load()), l.instanceID)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetchDisposableList reads the list at url: one domain per line, blank
+// lines and lines starting with # ignored.
+func fetchDisposableList(ctx context.Context, url string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("source returned %s", resp.Status)
+	}
+
+	var domains []string
+	sc := bufio.NewScanner(io.LimitReader(resp.Body, maxDisposableListBytes))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains = append(domains, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("source lists no domains")
+	}
+	return domains, nil
+}
+
+// checkDisposableEmail reports whether email, from a form submission, is at
+// a disposable provider, returning the error refusing it with
+// DISPOSABLE_EMAIL_ACTION=reject.
+func (a *app) checkDisposableEmail(r *http.Request, email string) (bool, *fieldError) {
+	if !a.disposable.blocked(email) {
+		return false, nil
+	}
+	metricDisposableEmails.Add(1)
+	action := a.cfg.Disposable.Action
+	log.Printf("level=WARN service=go-app event=disposable_email action=%s client_ip=%s request_id=%s instance=%s", action, a.clientIP(r), requestID(r.Context()), a.instanceID)
+	if action == "flag" {
+		return true, nil
+	}
+	e := newFieldError("email", "email.disposable")
+	return true, &e
+}
@@ -0,0 +1,190 @@
+// Package doccheck verifies that a document of a known type is well formed,
+// so a corrupt scan is refused when it is uploaded rather than found by a
+// reviewer days later.
+//
+// JPEG and PNG images are decoded in full. The standard library has no WebP
+// decoder, so WebP images only have their container and frame header
+// checked. PDFs are checked for a complete cross-reference section, for
+// encryption and for at least one page.
+package doccheck
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	_ "image/jpeg" // registers the JPEG decoder
+	_ "image/png"  // registers the PNG decoder
+	"io"
+	"regexp"
+	"strconv"
+)
+
+// Limits bounds the dimensions of images, in pixels: each side, and with
+// MaxPixels above zero their product, which bounds what decoding allocates.
+type Limits struct {
+	MinSide   int
+	MaxSide   int
+	MaxPixels int
+}
+
+// Error explains why a document was refused. Check returns any other error
+// only when reading the document failed.
+type Error struct {
+	Msg string
+}
+
+func (e *Error) Error() string { return e.Msg }
+
+// Rejections returned by Check, besides images of the wrong size.
+var (
+	ErrCorrupt     = &Error{"file is damaged or incomplete"}
+	ErrEncrypted   = &Error{"PDF is password protected"}
+	ErrNoPages     = &Error{"PDF has no pages"}
+	ErrUnsupported = &Error{"documents of this type cannot be checked"}
+)
+
+// Check verifies the document of contentType held in the first size bytes
+// of r.
+func Check(r io.ReaderAt, size int64, contentType string, lim Limits) error {
+	switch contentType {
+	case "image/jpeg", "image/png":
+		return checkImage(io.NewSectionReader(r, 0, size), lim)
+	case "image/webp":
+		return checkWebP(io.NewSectionReader(r, 0, size), size, lim)
+	case "application/pdf":
+		data, err := io.ReadAll(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return err
+		}
+		return checkPDF(data)
+	}
+	return ErrUnsupported
+}
+
+// checkSides fails unless a w×h image is within lim.
+func checkSides(w, h int, lim Limits) error {
+	switch {
+	case w < lim.MinSide || h < lim.MinSide:
+		return &Error{fmt.Sprintf("image is %d×%d pixels; each side must be at least %d", w, h, lim.MinSide)}
+	case w > lim.MaxSide || h > lim.MaxSide:
+		return &Error{fmt.Sprintf("image is %d×%d pixels; each side must be at most %d", w, h, lim.MaxSide)}
+	case lim.MaxPixels > 0 && int64(w)*int64(h) > int64(lim.MaxPixels):
+		return &Error{fmt.Sprintf("image is %d×%d pixels; it must have at most %d", w, h, lim.MaxPixels)}
+	}
+	return nil
+}
+
+// checkImage decodes a JPEG or PNG image, once its header shows the
+// dimensions are within lim. Decoding allocates for every pixel, so the
+// memory it takes is bounded by lim.MaxPixels, not by the file's size.
+func checkImage(r io.ReadSeeker, lim Limits) error {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return ErrCorrupt
+	}
+	if err := checkSides(cfg.Width, cfg.Height, lim); err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, _, err := image.Decode(r); err != nil {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+// checkWebP checks the RIFF container of a WebP image against size and
+// reads the dimensions from its first chunk, which is VP8 (lossy), VP8L
+// (lossless) or VP8X (extended).
+func checkWebP(r io.Reader, size int64, lim Limits) error {
+	var hdr [30]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return ErrCorrupt
+	}
+	riffLen := int64(le32(hdr[4:8]))
+	if !bytes.Equal(hdr[0:4], []byte("RIFF")) || !bytes.Equal(hdr[8:12], []byte("WEBP")) || riffLen+8 != size {
+		return ErrCorrupt
+	}
+	chunk, data := string(hdr[12:16]), hdr[20:]
+	var w, h int
+	switch chunk {
+	case "VP8 ":
+		// A 3-byte frame tag, the start code, then 14-bit dimensions.
+		if !bytes.Equal(data[3:6], []byte{0x9d, 0x01, 0x2a}) {
+			return ErrCorrupt
+		}
+		w, h = int(le16(data[6:8])&0x3fff), int(le16(data[8:10])&0x3fff)
+	case "VP8L":
+		// A signature byte, then 14-bit dimensions less one.
+		if data[0] != 0x2f {
+			return ErrCorrupt
+		}
+		bits := le32(data[1:5])
+		w, h = int(bits&0x3fff)+1, int(bits>>14&0x3fff)+1
+	case "VP8X":
+		// Flags and reserved bytes, then 24-bit canvas dimensions less one.
+		w, h = int(le24(data[4:7]))+1, int(le24(data[7:10]))+1
+	default:
+		return ErrCorrupt
+	}
+	return checkSides(w, h, lim)
+}
+
+func le16(b []byte) uint16 { return uint16(b[0]) | uint16(b[1])<<8 }
+func le24(b []byte) uint32 { return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 }
+func le32(b []byte) uint32 { return le24(b) | uint32(b[3])<<24 }
+
+// maxInflated bounds how much of a PDF's object streams is decompressed
+// while looking for pages.
+const maxInflated = 64 << 20
+
+var (
+	pdfStartXref = regexp.MustCompile(`startxref\s+(\d+)\s+%%EOF\s*$`)
+	pdfXrefAt    = regexp.MustCompile(`^\s*(xref\s|\d+\s+\d+\s+obj\b)`)
+	pdfEncrypt   = regexp.MustCompile(`/Encrypt\s*(\d+\s+\d+\s+R|<<)`)
+	pdfPage      = regexp.MustCompile(`/Type\s*/Page\b`)
+	pdfObjStm    = regexp.MustCompile(`/Type\s*/ObjStm\b`)
+	pdfStream    = regexp.MustCompile(`stream\r?\n`)
+)
+
+// checkPDF checks that a PDF ends in a cross-reference section where its
+// last startxref says, which a truncated upload does not; that it is not
+// encrypted; and that it has a page. Pages are page objects found in the
+// file or in its compressed object streams.
+func checkPDF(data []byte) error {
+	tail := data[max(0, len(data)-1024):]
+	m := pdfStartXref.FindSubmatch(tail)
+	if m == nil {
+		return ErrCorrupt
+	}
+	off, err := strconv.Atoi(string(m[1]))
+	if err != nil || off >= len(data) || !pdfXrefAt.Match(data[off:]) {
+		return ErrCorrupt
+	}
+	if pdfEncrypt.Match(data) {
+		return ErrEncrypted
+	}
+	if pdfPage.Match(data) {
+		return nil
+	}
+
+	budget := int64(maxInflated)
+	for _, loc := range pdfObjStm.FindAllIndex(data, -1) {
+		start := pdfStream.FindIndex(data[loc[1]:])
+		if start == nil || budget <= 0 {
+			break
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(data[loc[1]+start[1]:]))
+		if err != nil {
+			continue
+		}
+		objs, _ := io.ReadAll(io.LimitReader(zr, budget))
+		budget -= int64(len(objs))
+		if pdfPage.Match(objs) {
+			return nil
+		}
+	}
+	return ErrNoPages
+}
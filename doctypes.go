@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"client_alb_go_s3_rds/i18n"
+)
+
+/* DOCUMENT CATEGORIES AND KYC TIERS */
+
+// A document's type is the form field it came in (id_front, id_back,
+// proof_of_address, selfie); its category is what it is. The applicant
+// says which identity document the id_ fields hold, in the id_document
+// field; the other fields each take a single category. A KYC tier names
+// the categories a submission must include: the form asks for KYC_TIER,
+// API clients may ask for another. Older clients send a single untyped
+// kyc_document, which has no category; a submission of nothing else is
+// taken as it always was, whatever the tier.
+
+// Document categories.
+const (
+	categoryPassport       = "passport"
+	categoryDriversLicense = "drivers_license"
+	categoryUtilityBill    = "utility_bill"
+	categorySelfie         = "selfie"
+)
+
+// idDocumentField is the form field naming the category of the id_ fields.
+const idDocumentField = "id_document"
+
+// categoryRule is what a document category requires. Fields are the
+// document types that make up one document of the category, all of them
+// required; ContentTypes, when set, narrows DOCUMENT_TYPES.
+type categoryRule struct {
+	Fields       []string
+	ContentTypes []string
+}
+
+// categoryRules lists the document categories by name.
+var categoryRules = map[string]categoryRule{
+	categoryPassport:       {Fields: []string{docIDFront}},
+	categoryDriversLicense: {Fields: []string{docIDFront, docIDBack}},
+	categoryUtilityBill:    {Fields: []string{docProofOfAddress}},
+	categorySelfie:         {Fields: []string{docSelfie}, ContentTypes: []string{"image/jpeg", "image/png", "image/webp"}},
+}
+
+// documentCategories lists the categories in a fixed order.
+var documentCategories = []string{categoryPassport, categoryDriversLicense, categoryUtilityBill, categorySelfie}
+
+// idCategories are the categories the id_document field may name, in the
+// order the form offers them.
+var idCategories = []string{categoryPassport, categoryDriversLicense}
+
+// kycTiers lists, for each tier, the categories a submission must include:
+// one category of each inner list.
+var kycTiers = map[string][][]string{
+	"basic":    {idCategories},
+	"standard": {idCategories, {categoryUtilityBill}},
+	"enhanced": {idCategories, {categoryUtilityBill}, {categorySelfie}},
+}
+
+// fieldCategories returns the categories a document of type field may be.
+func fieldCategories(field string) []string {
+	var out []string
+	for _, c := range documentCategories {
+		if slices.Contains(categoryRules[c].Fields, field) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// documentCategory returns the category of a document of type field, given
+// the category named for it, which may be left empty when field takes only
+// one. Untyped docKYC documents have none.
+func documentCategory(field, named string) (string, error) {
+	if field == docKYC {
+		return "", nil
+	}
+	categories := fieldCategories(field)
+	if named == "" && len(categories) == 1 {
+		return categories[0], nil
+	}
+	if !slices.Contains(categories, named) {
+		return "", fmt.Errorf("%s must be a %s", field, strings.Join(categories, " or "))
+	}
+	return named, nil
+}
+
+// categoryTypes returns the accepted types of a document of category.
+func (a *app) categoryTypes(category string) []string {
+	rule := categoryRules[category]
+	if rule.ContentTypes == nil {
+		return a.cfg.Docs.AllowedTypes
+	}
+	var out []string
+	for _, t := range a.cfg.Docs.AllowedTypes {
+		if slices.Contains(rule.ContentTypes, t) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// requiredCategories reports, for the form, which categories tier asks for.
+func requiredCategories(tier string) map[string]bool {
+	required := map[string]bool{}
+	for _, alternatives := range kycTiers[tier] {
+		for _, c := range alternatives {
+			required[c] = true
+		}
+	}
+	return required
+}
+
+// checkDocumentSet checks docs, with their categories set, against the
+// rules of their categories and the requirements of tier. A submission of
+// only the untyped document of older clients is not held to tier.
+func (a *app) checkDocumentSet(docs []submittedDocument, tier string) error {
+	if len(docs) > 0 && !slices.ContainsFunc(docs, func(d submittedDocument) bool { return d.Type != docKYC }) {
+		return nil
+	}
+	present := map[string][]string{}
+	for _, d := range docs {
+		if d.Category == "" {
+			continue
+		}
+		rule := categoryRules[d.Category]
+		if rule.ContentTypes != nil && d.ContentType != "" && !slices.Contains(rule.ContentTypes, d.ContentType) {
+			return &documentError{probUnsupportedType, fmt.Sprintf("%s: a %s must be a %s", d.Type, strings.ReplaceAll(d.Category, "_", " "), a.documentTypeListOf(i18n.Default, a.categoryTypes(d.Category)))}
+		}
+		present[d.Category] = append(present[d.Category], d.Type)
+	}
+	for category, fields := range present {
+		for _, f := range categoryRules[category].Fields {
+			if !slices.Contains(fields, f) {
+				return &documentError{probValidation, fmt.Sprintf("a %s needs %s", strings.ReplaceAll(category, "_", " "), strings.Join(categoryRules[category].Fields, " and "))}
+			}
+		}
+	}
+	for _, alternatives := range kycTiers[tier] {
+		found := slices.ContainsFunc(alternatives, func(c string) bool { return present[c] != nil })
+		if !found {
+			return &documentError{probValidation, fmt.Sprintf("the %s KYC tier requires a %s document", tier, strings.Join(alternatives, " or "))}
+		}
+	}
+	return nil
+}
+
+// kycTier returns the tier asked for, KYC_TIER if none, reporting false
+// for an unknown one.
+func (a *app) kycTier(asked string) (string, bool) {
+	if asked == "" {
+		return a.cfg.Docs.Tier, true
+	}
+	_, ok := kycTiers[asked]
+	return asked, ok
+}
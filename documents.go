@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+/* DOCUMENTS */
+
+// KYC document types. docKYC is the single, untyped document of
+// submissions made before several documents were accepted.
+const (
+	docIDFront        = "id_front"
+	docIDBack         = "id_back"
+	docProofOfAddress = "proof_of_address"
+	docSelfie         = "selfie"
+	docKYC            = "kyc_document"
+)
+
+// documentFields are the form fields a submission may carry documents in,
+// in the order they are stored. The first one present becomes the user's
+// primary document.
+var documentFields = []string{docIDFront, docIDBack, docProofOfAddress, docSelfie, docKYC}
+
+func validDocumentType(t string) bool {
+	for _, f := range documentFields {
+		if f == t {
+			return true
+		}
+	}
+	return false
+}
+
+// submittedDocument is one document of a submission, already in S3.
+// Category is empty for untyped documents; see doctypes.go. RetainUntil is
+// set on a document locked with Object Lock; see retention.go.
+// Deduplicated is set on one that refers to an object stored for another
+// document; see dedupe.go.
+type submittedDocument struct {
+	Type          string     `json:"type"`
+	Category      string     `json:"category,omitempty"`
+	Bucket        string     `json:"bucket"`
+	Key           string     `json:"key"`
+	Filename      string     `json:"filename,omitempty"`
+	ContentType   string     `json:"content_type,omitempty"`
+	Size          int64      `json:"size,omitempty"`
+	SHA256        string     `json:"sha256,omitempty"`
+	StorageClass  string     `json:"storage_class,omitempty"`
+	VersionID     string     `json:"version_id,omitempty"`
+	RetentionMode string     `json:"retention_mode,omitempty"`
+	RetainUntil   *time.Time `json:"retain_until,omitempty"`
+	Deduplicated  bool       `json:"deduplicated,omitempty"`
+}
+
+// document is a stored row of the documents table as exposed by the API.
+// ReplacedAt and ReplacedBy are set on a document a re-upload superseded,
+// which is kept for audit. ScanStatus is empty until the document is
+// scanned for malware; see scan.go. RetentionMode and RetainUntil describe
+// its Object Lock, when it has one.
+type document struct {
+	ID            int64      `json:"id"`
+	Type          string     `json:"type"`
+	Category      string     `json:"category,omitempty"`
+	Bucket        string     `json:"bucket"`
+	Key           string     `json:"key"`
+	Filename      string     `json:"filename,omitempty"`
+	ContentType   string     `json:"content_type,omitempty"`
+	Size          int64      `json:"size,omitempty"`
+	SHA256        string     `json:"sha256,omitempty"`
+	StorageClass  string     `json:"storage_class"`
+	VersionID     string     `json:"version_id,omitempty"`
+	ScanStatus    string     `json:"scan_status,omitempty"`
+	ScanSignature string     `json:"scan_signature,omitempty"`
+	RetentionMode string     `json:"retention_mode,omitempty"`
+	RetainUntil   *time.Time `json:"retain_until,omitempty"`
+	ThumbnailURL  string     `json:"thumbnail_url,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ReplacedAt    *time.Time `json:"replaced_at,omitempty"`
+	ReplacedBy    string     `json:"replaced_by,omitempty"`
+}
+
+// insertDocuments stores docs for userID inside tx, each under the lock of
+// its object. A deduplicated document must still be referred to by
+// something else; see dedupe.go.
+func insertDocuments(ctx context.Context, tx *sql.Tx, userID int64, docs []submittedDocument) error {
+	for _, d := range docs {
+		if err := lockObject(ctx, tx, d.Bucket, d.Key); err != nil {
+			return err
+		}
+		if d.Deduplicated {
+			referenced, err := documentReferenced(ctx, tx, d.Bucket, d.Key)
+			if err != nil {
+				return err
+			}
+			if !referenced {
+				return fmt.Errorf("%w: %s", errDeduplicatedGone, d.Key)
+			}
+		}
+		_, err := tx.ExecContext(ctx, `
+		INSERT INTO documents(user_id, doc_type, category, bucket, object_key, filename, content_type, size_bytes, sha256, storage_class, version_id, retention_mode, retain_until)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), COALESCE(NULLIF($10, ''), 'STANDARD'), NULLIF($11, ''), NULLIF($12, ''), $13)
+		`, userID, d.Type, d.Category, d.Bucket, d.Key, d.Filename, d.ContentType, d.Size, d.SHA256, d.StorageClass, d.VersionID, d.RetentionMode, d.RetainUntil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userDocuments returns the documents of userID in upload order.
+func userDocuments(ctx context.Context, db *sql.DB, userID int64) ([]document, error) {
+	rows, err := db.QueryContext(ctx, `
+	SELECT id, doc_type, category, bucket, object_key, filename, content_type, size_bytes, COALESCE(sha256, ''), storage_class, COALESCE(version_id, ''), COALESCE(scan_status, ''), COALESCE(scan_signature, ''), COALESCE(retention_mode, ''), retain_until, thumbnail_key IS NOT NULL, created_at, replaced_at, COALESCE(replaced_by, '')
+	FROM documents WHERE user_id = $1 ORDER BY id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := []document{}
+	for rows.Next() {
+		var d document
+		var retainUntil, replacedAt sql.NullTime
+		var thumbnail bool
+		if err := rows.Scan(&d.ID, &d.Type, &d.Category, &d.Bucket, &d.Key, &d.Filename, &d.ContentType, &d.Size, &d.SHA256, &d.StorageClass, &d.VersionID, &d.ScanStatus, &d.ScanSignature, &d.RetentionMode, &retainUntil, &thumbnail, &d.CreatedAt, &replacedAt, &d.ReplacedBy); err != nil {
+			return nil, err
+		}
+		if retainUntil.Valid {
+			d.RetainUntil = &retainUntil.Time
+		}
+		if thumbnail {
+			d.ThumbnailURL = thumbnailURL(userID, d.ID)
+		}
+		if replacedAt.Valid {
+			d.ReplacedAt = &replacedAt.Time
+		}
+		docs = append(docs, d)
+	}
+	return docs, rows.Err()
+}
+
+// documentVersion returns the S3 version of userID's document key in
+// bucket, or "" when it has none: the bucket is not versioned, or the
+// document predates version IDs.
+func documentVersion(ctx context.Context, db *sql.DB, userID int64, bucket, key string) (string, error) {
+	var version string
+	err := db.QueryRowContext(ctx, `
+	SELECT COALESCE(version_id, '') FROM documents
+	WHERE user_id = $1 AND bucket = $2 AND object_key = $3
+	ORDER BY id LIMIT 1
+	`, userID, bucket, key).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return version, err
+}
+
+// versionParam returns version as the VersionId of an S3 request: nil,
+// meaning the latest version, when it is "".
+func versionParam(version string) *string {
+	if version == "" {
+		return nil
+	}
+	return aws.String(version)
+}
+
+// documentError is a formDocuments failure to answer with a problem.
+type documentError struct {
+	kind   problemKind
+	detail string
+}
+
+func (e *documentError) Error() string { return e.detail }
+
+// formDocuments collects the documents of a form read by streamUploadForm.
+// Each field of documentFields may carry a file; with direct uploads
+// enabled, a "<field>_key" naming an object the browser already put in
+// S3; or with resumable uploads enabled, a "<field>_upload" naming a
+// finished resumable upload. At least one document is required, and
+// together they must make up the documents KYC tier tier asks for. Files
+// are uploaded, as documents of the submission reference, only once every
+// field has been checked.
+func (a *app) formDocuments(r *http.Request, tier, reference string) ([]submittedDocument, error) {
+	docs, err := a.checkFormDocuments(r, tier)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.uploadFormFiles(r, reference, docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// checkFormDocuments is the checking half of formDocuments. Documents that
+// came as files, whose type and size streamUploadForm already checked, are
+// returned with only their Type, Category and ContentType set.
+func (a *app) checkFormDocuments(r *http.Request, tier string) ([]submittedDocument, error) {
+	docs, err := a.collectFormDocuments(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, &documentError{probValidation, "at least one KYC document is required (id_front, id_back, proof_of_address or selfie)"}
+	}
+	if err := categorizeDocuments(docs, r.FormValue(idDocumentField)); err != nil {
+		return nil, err
+	}
+	if err := a.checkDocumentSet(docs, tier); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// collectFormDocuments returns the documents sent with r, in any of the
+// ways formDocuments takes them, uncategorized.
+func (a *app) collectFormDocuments(r *http.Request) ([]submittedDocument, error) {
+	ctx := r.Context()
+	direct := a.featureEnabled(ctx, flagPresignedUpload)
+	resumable := a.featureEnabled(ctx, flagResumableUpload)
+	files := formFiles(r)
+
+	var docs []submittedDocument
+	for _, field := range documentFields {
+		key := r.FormValue(field + "_key")
+		if field == docKYC && key == "" {
+			key = r.FormValue("document_key")
+		}
+		if key != "" && direct {
+			doc, err := a.directDocument(ctx, field, key)
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, doc)
+			continue
+		}
+		if id := r.FormValue(field + "_upload"); id != "" && resumable {
+			doc, err := a.resumableDocument(ctx, field, id)
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, doc)
+			continue
+		}
+		if f := files[field]; f != nil {
+			docs = append(docs, submittedDocument{Type: field, ContentType: f.ContentType})
+		}
+	}
+	return docs, nil
+}
+
+// categorizeDocuments sets the category of each of docs, taking the
+// identity documents to be idDocument.
+func categorizeDocuments(docs []submittedDocument, idDocument string) error {
+	for i := range docs {
+		var named string
+		if docs[i].Type == docIDFront || docs[i].Type == docIDBack {
+			named = idDocument
+		}
+		category, err := documentCategory(docs[i].Type, named)
+		if err != nil {
+			return &documentError{probValidation, err.Error()}
+		}
+		docs[i].Category = category
+	}
+	return nil
+}
+
+// uploadFormFiles files the documents checkFormDocuments left in docs that
+// came as files, stored as they arrived, as documents of the submission
+// reference, and fills in their details. A file identical to a document
+// already stored refers to that one instead; see dedupe.go.
+func (a *app) uploadFormFiles(r *http.Request, reference string, docs []submittedDocument) error {
+	ctx := r.Context()
+	files := formFiles(r)
+	for i := range docs {
+		if docs[i].Key != "" {
+			a.tagDocument(ctx, reference, docs[i])
+			continue
+		}
+		f := files[docs[i].Type]
+		stored, ok := a.existingDocument(ctx, f.Size, f.SHA256)
+		if !ok {
+			stored = submittedDocument{
+				Type:         docs[i].Type,
+				Category:     docs[i].Category,
+				Bucket:       f.Object.Bucket,
+				Key:          f.Object.Key,
+				StorageClass: a.cfg.S3.StorageClass,
+				VersionID:    f.Object.VersionID,
+			}
+			a.tagDocument(ctx, reference, stored)
+		}
+		if err := a.lockDocument(ctx, &stored); err != nil {
+			log.Printf("level=ERROR service=go-app event=document_lock_failed field=%s key=%s err=%v request_id=%s instance=%s", docs[i].Type, stored.Key, err, requestID(ctx), a.instanceID)
+			return &documentError{storageProblem(err), "failed to lock KYC document"}
+		}
+		if !ok {
+			f.claim()
+		}
+		docs[i] = submittedDocument{
+			Type:        docs[i].Type,
+			Category:    docs[i].Category,
+			Bucket:      stored.Bucket,
+			Key:         stored.Key,
+			Filename:    f.Filename,
+			ContentType: f.ContentType,
+			Size:        f.Size,
+			SHA256:      hex.EncodeToString(f.SHA256),
+
+			StorageClass:  stored.StorageClass,
+			VersionID:     stored.VersionID,
+			RetentionMode: stored.RetentionMode,
+			RetainUntil:   stored.RetainUntil,
+			Deduplicated:  stored.Deduplicated,
+		}
+	}
+	return nil
+}
+
+// directDocument verifies a direct upload and describes it as a document
+// of type docType. Storage backends other than S3 and MinIO take no direct
+// uploads.
+func (a *app) directDocument(ctx context.Context, docType, key string) (submittedDocument, error) {
+	if a.s3 == nil {
+		return submittedDocument{}, &documentError{probValidation, docType + ": direct uploads are not available with this storage backend"}
+	}
+	head, sum, err := a.verifyDirectUpload(ctx, key)
+	if err != nil {
+		if errors.Is(err, errUploadRejected) {
+			log.Printf("level=WARN service=go-app event=direct_upload_rejected field=%s key=%s err=%v request_id=%s instance=%s", docType, key, err, requestID(ctx), a.instanceID)
+			return submittedDocument{}, &documentError{probDocumentInvalid, docType + ": " + err.Error()}
+		}
+		if errors.Is(err, errS3Unavailable) {
+			return submittedDocument{}, &documentError{probStorageUnavailable, "failed to verify KYC document"}
+		}
+		log.Printf("level=ERROR service=go-app event=direct_upload_check_failed field=%s key=%s err=%v request_id=%s instance=%s", docType, key, err, requestID(ctx), a.instanceID)
+		return submittedDocument{}, &documentError{probInternal, "failed to verify KYC document"}
+	}
+	doc := submittedDocument{
+		Type:        docType,
+		Bucket:      a.uploadBucket(),
+		Key:         key,
+		Filename:    metadataFilename(head.Metadata),
+		ContentType: aws.ToString(head.ContentType),
+		Size:        aws.ToInt64(head.ContentLength),
+		SHA256:      sum,
+
+		StorageClass: objectStorageClass(head.StorageClass),
+		VersionID:    aws.ToString(head.VersionId),
+	}
+	if err := a.lockDocument(ctx, &doc); err != nil {
+		log.Printf("level=ERROR service=go-app event=document_lock_failed field=%s key=%s err=%v request_id=%s instance=%s", docType, key, err, requestID(ctx), a.instanceID)
+		return submittedDocument{}, &documentError{storageProblem(err), "failed to lock KYC document"}
+	}
+	return doc, nil
+}
+
+// writeDocumentError answers a formDocuments or directDocument failure.
+func writeDocumentError(w http.ResponseWriter, r *http.Request, err error) {
+	var de *documentError
+	if errors.As(err, &de) {
+		writeProblem(w, r, de.kind, de.detail)
+		return
+	}
+	writeProblem(w, r, probInternal, "failed to process KYC documents")
+}
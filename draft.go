@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"time"
+)
+
+/* MULTI-STEP FORM */
+
+// /apply splits the form into steps: personal details, documents, then a
+// review where the applicant gives consent and submits. Each step is saved
+// server-side in a draft, keyed by a random token in the draft cookie, and
+// documents go to S3 as soon as their step is posted, so an upload that
+// fails on a flaky mobile connection costs only that request. Only a hash
+// of the token is stored. Expired drafts are purged with their documents.
+
+// Draft steps, in order.
+const (
+	stepDetails   = "details"
+	stepDocuments = "documents"
+	stepReview    = "review"
+)
+
+var draftSteps = []string{stepDetails, stepDocuments, stepReview}
+
+const (
+	draftCookie = "draft"
+	// draftStepField tells otpHandler which page a code was asked from.
+	draftStepField = "step"
+)
+
+var errDraftNotFound = errors.New("draft not found or expired")
+
+// draft is what an applicant has entered so far. Reference is given out up
+// front so documents are stored under it; Step is the furthest step
+// reached; Documents are already in S3.
+type draft struct {
+	Reference  string              `json:"reference,omitempty"`
+	Step       string              `json:"step"`
+	Name       string              `json:"name,omitempty"`
+	Email      string              `json:"email,omitempty"`
+	Phone      string              `json:"phone,omitempty"`
+	PhoneRaw   string              `json:"phone_raw,omitempty"`
+	IDDocument string              `json:"id_document,omitempty"`
+	Documents  []submittedDocument `json:"documents,omitempty"`
+
+	DisposableEmail bool `json:"disposable_email,omitempty"`
+}
+
+// reached reports whether the applicant may go to step.
+func (d *draft) reached(step string) bool {
+	return slices.Index(draftSteps, step) <= slices.Index(draftSteps, d.Step)
+}
+
+// document returns the document of type docType, or nil.
+func (d *draft) document(docType string) *submittedDocument {
+	for i := range d.Documents {
+		if d.Documents[i].Type == docType {
+			return &d.Documents[i]
+		}
+	}
+	return nil
+}
+
+// draftToken returns the draft token r carries, or "".
+func draftToken(r *http.Request) string {
+	c, err := r.Cookie(draftCookie)
+	if err != nil {
+		return ""
+	}
+	if _, err := hex.DecodeString(c.Value); err != nil || len(c.Value) != 64 {
+		return ""
+	}
+	return c.Value
+}
+
+// loadDraft returns the draft of r's token.
+func (a *app) loadDraft(ctx context.Context, token string) (*draft, error) {
+	if token == "" {
+		return nil, errDraftNotFound
+	}
+	var data string
+	err := a.db.QueryRowContext(ctx, `
+	SELECT data FROM drafts WHERE token_hash = $1 AND expires_at > CURRENT_TIMESTAMP
+	`, hashToken(token)).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errDraftNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var d draft
+	return &d, json.Unmarshal([]byte(data), &d)
+}
+
+// saveDraft stores d under token, a new one if token is empty, and renews
+// the cookie and the draft's expiry. Documents d no longer holds, replaced
+// by newer uploads, are queued for deletion.
+func (a *app) saveDraft(ctx context.Context, w http.ResponseWriter, r *http.Request, token string, d *draft, replaced []submittedDocument) error {
+	if token == "" {
+		var b [32]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(err)
+		}
+		token = hex.EncodeToString(b[:])
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	err = inTx(ctx, a.db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+		INSERT INTO drafts(token_hash, data, expires_at)
+		VALUES ($1, $2, CURRENT_TIMESTAMP + make_interval(secs => $3))
+		ON CONFLICT (token_hash) DO UPDATE
+		SET data = EXCLUDED.data, expires_at = EXCLUDED.expires_at, updated_at = CURRENT_TIMESTAMP
+		`, hashToken(token), string(data), a.cfg.Drafts.TTL.Seconds())
+		if err != nil {
+			return err
+		}
+		for _, doc := range replaced {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO document_deletions(bucket, object_key, version_id) VALUES ($1, $2, NULLIF($3, ''))`, doc.Bucket, doc.Key, doc.VersionID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     draftCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(a.cfg.Drafts.TTL.Seconds()),
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// draftPage is what web/apply.html is rendered with: the form page of the
+// step, with the draft's documents by type.
+type draftPage struct {
+	formPage
+	Step          string
+	Steps         []string
+	Reached       string
+	Documents     map[string]submittedDocument
+	DocumentError string
+	// PhoneVerified says the draft's phone number already passed its SMS
+	// code, which is only asked for again if the number changes.
+	PhoneVerified bool
+}
+
+// CanGo reports whether the steps list links to step.
+func (p draftPage) CanGo(step string) bool {
+	return slices.Index(draftSteps, step) <= slices.Index(draftSteps, p.Reached)
+}
+
+// Uploaded names the document of type docType already in the draft, or is
+// "" when there is none.
+func (p draftPage) Uploaded(docType string) string {
+	doc, ok := p.Documents[docType]
+	if !ok {
+		return ""
+	}
+	if doc.Filename != "" {
+		return doc.Filename
+	}
+	return path.Base(doc.Key)
+}
+
+// newDraftPage returns the page of step for d, filled in from it.
+func (a *app) newDraftPage(w http.ResponseWriter, r *http.Request, d *draft, step string) draftPage {
+	key := r.FormValue("idempotency_key")
+	if key == "" {
+		key = newUUID()
+	}
+	page := draftPage{
+		formPage:  a.newFormPage(r, csrfToken(w, r), key),
+		Step:      step,
+		Steps:     draftSteps,
+		Reached:   d.Step,
+		Documents: map[string]submittedDocument{},
+
+		PhoneVerified: d.Step != stepDetails,
+	}
+	page.Values = contactFields{Name: d.Name, Email: d.Email, Phone: d.PhoneRaw}
+	if page.Values.Phone == "" {
+		page.Values.Phone = d.Phone
+	}
+	page.IDDocument = d.IDDocument
+	for _, doc := range d.Documents {
+		page.Documents[doc.Type] = doc
+	}
+	return page
+}
+
+// writeDraftPage renders p, rendered in full before anything is written.
+func (a *app) writeDraftPage(w http.ResponseWriter, r *http.Request, status int, p draftPage) {
+	t, _, err := a.pageTemplate(r, "apply.html")
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=form_unavailable page=apply err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		a.writeServerError(w, r)
+		return
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, p); err != nil {
+		log.Printf("level=ERROR service=go-app event=form_unavailable page=apply err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		a.writeServerError(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// currentDraft loads r's draft for a handler, answering the request itself
+// when there is none to work on: a missing or expired draft starts again at
+// the first step. A draft saved without a reference, as drafts were before
+// they had one, is given one here, and keeps it once saved again.
+func (a *app) currentDraft(w http.ResponseWriter, r *http.Request) (*draft, string, bool) {
+	if a.dbDown.Load() {
+		writeProblem(w, r, probDatabaseUnavailable, "drafts are unavailable; use the single-page form at /")
+		return nil, "", false
+	}
+	token := draftToken(r)
+	d, err := a.loadDraft(r.Context(), token)
+	if errors.Is(err, errDraftNotFound) {
+		return &draft{Reference: newReference(), Step: stepDetails}, "", true
+	}
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_query_failed op=draft err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "database error")
+		return nil, "", false
+	}
+	if d.Reference == "" {
+		d.Reference = newReference()
+	}
+	return d, token, true
+}
+
+// applyHandler handles GET /apply, showing the ?step= asked for if the
+// draft has reached it, otherwise the furthest step reached.
+func (a *app) applyHandler(w http.ResponseWriter, r *http.Request) {
+	d, _, ok := a.currentDraft(w, r)
+	if !ok {
+		return
+	}
+	step := r.URL.Query().Get("step")
+	if !slices.Contains(draftSteps, step) || !d.reached(step) {
+		step = d.Step
+	}
+	a.writeDraftPage(w, r, http.StatusOK, a.newDraftPage(w, r, d, step))
+}
+
+// redirectToStep sends the browser on to step.
+func redirectToStep(w http.ResponseWriter, r *http.Request, step string) {
+	http.Redirect(w, r, "/apply?step="+step, http.StatusSeeOther)
+}
+
+// applyDetailsHandler handles POST /apply/details, the first step. With
+// SMS codes on, the code is checked here, once.
+func (a *app) applyDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	d, token, ok := a.currentDraft(w, r)
+	if !ok {
+		return
+	}
+	contact, errs := validateContact(contactFields{Name: r.FormValue("name"), Email: r.FormValue("email"), Phone: r.FormValue("phone")}, a.cfg.Phone.DefaultRegion)
+	disposable, disposableErr := a.checkDisposableEmail(r, contact.Email)
+	if disposableErr != nil {
+		errs = append(errs, *disposableErr)
+	}
+	if len(errs) == 0 && (contact.Phone != d.Phone || d.Step == stepDetails) {
+		if e := a.checkPhoneOTP(r, contact.Phone); e != nil {
+			errs = append(errs, *e)
+		}
+	}
+	if len(errs) > 0 {
+		a.rejectDraftDetails(w, r, contact, errs)
+		return
+	}
+
+	d.Name, d.Email, d.Phone, d.PhoneRaw = contact.Name, contact.Email, contact.Phone, contact.PhoneRaw
+	d.DisposableEmail = disposable
+	if d.Step == stepDetails {
+		d.Step = stepDocuments
+	}
+	if err := a.saveDraft(r.Context(), w, r, token, d, nil); err != nil {
+		log.Printf("level=ERROR service=go-app event=db_insert_failed op=draft err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "failed to save draft")
+		return
+	}
+	log.Printf("level=INFO service=go-app event=draft_saved step=%s request_id=%s instance=%s", stepDetails, requestID(r.Context()), a.instanceID)
+	redirectToStep(w, r, stepDocuments)
+}
+
+// filledDetailsPage returns the details step of d after the post r, filled
+// in with c and with errs next to their fields.
+func (a *app) filledDetailsPage(w http.ResponseWriter, r *http.Request, d *draft, c contactFields, errs []fieldError) draftPage {
+	page := a.newDraftPage(w, r, d, stepDetails)
+	page.Values, page.Errors = c, localizeFieldErrors(page.Lang, errs)
+	if c.PhoneRaw != "" {
+		page.Values.Phone = c.PhoneRaw
+	}
+	page.OTPID = r.PostFormValue(otpIDField)
+	return page
+}
+
+// rejectDraftDetails is rejectSubmission for the details step.
+func (a *app) rejectDraftDetails(w http.ResponseWriter, r *http.Request, c contactFields, errs []fieldError) {
+	if !wantsHTML(r) {
+		writeFieldErrors(w, r, errs)
+		return
+	}
+	d, _, ok := a.currentDraft(w, r)
+	if !ok {
+		return
+	}
+	a.writeDraftPage(w, r, http.StatusBadRequest, a.filledDetailsPage(w, r, d, c, errs))
+}
+
+// applyDocumentsHandler handles POST /apply/documents. Documents sent are
+// stored in S3 and saved to the draft straight away, replacing any of the
+// same type, even when the set is not yet complete; the applicant moves on
+// to the review once it makes up what KYC_TIER asks for.
+func (a *app) applyDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+	d, token, ok := a.currentDraft(w, r)
+	if !ok {
+		return
+	}
+	if !d.reached(stepDocuments) {
+		redirectToStep(w, r, d.Step)
+		return
+	}
+
+	docs, err := a.collectFormDocuments(r)
+	idDocument := r.FormValue(idDocumentField)
+	if err == nil {
+		err = categorizeDocuments(docs, idDocument)
+	}
+	if err == nil {
+		err = a.uploadFormFiles(r, d.Reference, docs)
+	}
+	if err != nil {
+		a.rejectDraftDocuments(w, r, d, err)
+		return
+	}
+
+	var replaced []submittedDocument
+	for _, doc := range docs {
+		if old := d.document(doc.Type); old != nil {
+			if old.Key != doc.Key {
+				replaced = append(replaced, *old)
+			}
+			*old = doc
+			continue
+		}
+		d.Documents = append(d.Documents, doc)
+	}
+	// A different identity document recategorizes the sides already sent.
+	d.IDDocument = idDocument
+	setErr := categorizeDocuments(d.Documents, idDocument)
+	if setErr == nil {
+		setErr = a.checkDocumentSet(d.Documents, a.cfg.Docs.Tier)
+	}
+	if setErr == nil && d.Step == stepDocuments {
+		d.Step = stepReview
+	}
+	if err := a.saveDraft(r.Context(), w, r, token, d, replaced); err != nil {
+		log.Printf("level=ERROR service=go-app event=db_insert_failed op=draft err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "failed to save draft")
+		return
+	}
+	log.Printf("level=INFO service=go-app event=draft_saved step=%s documents=%d complete=%t request_id=%s instance=%s", stepDocuments, len(d.Documents), setErr == nil, requestID(r.Context()), a.instanceID)
+	if setErr != nil {
+		a.rejectDraftDocuments(w, r, d, setErr)
+		return
+	}
+	redirectToStep(w, r, stepReview)
+}
+
+// rejectDraftDocuments shows the documents step again with err, a
+// documentError or a failure to store the documents.
+func (a *app) rejectDraftDocuments(w http.ResponseWriter, r *http.Request, d *draft, err error) {
+	var de *documentError
+	if !errors.As(err, &de) || !wantsHTML(r) {
+		writeDocumentError(w, r, err)
+		return
+	}
+	page := a.newDraftPage(w, r, d, stepDocuments)
+	page.DocumentError = de.detail
+	status := de.kind.Status
+	if status >= http.StatusInternalServerError {
+		status = http.StatusBadRequest
+	}
+	a.writeDraftPage(w, r, status, page)
+}
+
+// applySubmitHandler handles POST /apply/submit, the review step: with the
+// applicant's consent, the draft becomes a user, and is deleted in the
+// same transaction.
+func (a *app) applySubmitHandler(w http.ResponseWriter, r *http.Request) {
+	claim, ok := a.claimIdempotency(w, r)
+	if !ok {
+		return
+	}
+	defer claim.release(r.Context())
+
+	d, token, ok := a.currentDraft(w, r)
+	if !ok {
+		return
+	}
+	if !d.reached(stepReview) {
+		redirectToStep(w, r, d.Step)
+		return
+	}
+	if err := a.checkDocumentSet(d.Documents, a.cfg.Docs.Tier); err != nil {
+		a.rejectDraftDocuments(w, r, d, err)
+		return
+	}
+	consent, consentErr := a.checkConsent(r)
+	if consentErr != nil {
+		page := a.newDraftPage(w, r, d, stepReview)
+		page.Errors = localizeFieldErrors(page.Lang, []fieldError{*consentErr})
+		a.writeDraftPage(w, r, http.StatusBadRequest, page)
+		return
+	}
+
+	sub := submission{
+		Reference: d.Reference,
+		Name:      d.Name,
+		Email:     d.Email,
+		Phone:     d.Phone,
+		PhoneRaw:  d.PhoneRaw,
+		Tier:      a.cfg.Docs.Tier,
+		Status:    statusUploaded,
+		CreatedAt: time.Now(),
+
+		VerifyEmail: a.emailVerification(),
+		Lang:        language(r.Context()),
+		Consent:     consent,
+
+		DisposableEmail: d.DisposableEmail,
+	}
+	sub.setDocuments(d.Documents)
+
+	var id int64
+	err := inTx(r.Context(), a.db, func(tx *sql.Tx) error {
+		var err error
+		if id, err = insertUserTx(r.Context(), tx, sub); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(r.Context(), `DELETE FROM drafts WHERE token_hash = $1`, hashToken(token))
+		return err
+	})
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_insert_failed op=draft_submit err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "failed to store submission")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: draftCookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: isHTTPS(r), SameSite: http.SameSiteLaxMode})
+	log.Printf("level=INFO service=go-app event=user_created reference=%s source=draft request_id=%s instance=%s", sub.Reference, requestID(r.Context()), a.instanceID)
+	a.writeReceipt(w, r, claim, id, http.StatusOK, submitReceipt{
+		Reference: sub.Reference,
+		Status:    sub.Status,
+		Message:   tr(r, "receipt.stored"),
+		StatusURL: statusURL(sub.Reference),
+		Instance:  a.identity.String(),
+	})
+}
+
+// expireDrafts purges expired drafts, queueing their documents, which no
+// user references, for deletion.
+func (a *app) expireDrafts(ctx context.Context) {
+	var n int
+	err := inTx(ctx, a.db, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `
+		DELETE FROM drafts WHERE token_hash IN (
+			SELECT token_hash FROM drafts WHERE expires_at <= CURRENT_TIMESTAMP LIMIT 100
+		)
+		RETURNING data
+		`)
+		if err != nil {
+			return err
+		}
+		var docs []submittedDocument
+		for rows.Next() {
+			var data string
+			var d draft
+			if err := rows.Scan(&data); err != nil {
+				rows.Close()
+				return err
+			}
+			if err := json.Unmarshal([]byte(data), &d); err != nil {
+				rows.Close()
+				return err
+			}
+			docs = append(docs, d.Documents...)
+			n++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO document_deletions(bucket, object_key, version_id) VALUES ($1, $2, NULLIF($3, ''))`, doc.Bucket, doc.Key, doc.VersionID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_delete_failed op=drafts err=%v instance=%s", err, a.instanceID)
+		return
+	}
+	if n > 0 {
+		log.Printf("level=INFO service=go-app event=drafts_expired count=%d instance=%s", n, a.instanceID)
+	}
+}
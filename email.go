@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sestypes "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+
+	"client_alb_go_s3_rds/config"
+	"client_alb_go_s3_rds/i18n"
+)
+
+/* EMAIL VERIFICATION */
+
+// With SES_FROM_ADDRESS set, a form submission queues an email in
+// email_verifications, in the transaction that stores the user, so it is
+// sent once whichever path stored the user: /submit, an async job or a
+// spool replay. Workers send the queue through SES, retrying failures, and
+// the applicant confirms their address at GET /verify. Only a hash of the
+// link's token is stored.
+
+// verificationSent is the state of an email SES accepted; queued and
+// failed ones share the job states.
+const verificationSent = "sent"
+
+// emailLease is how long a claimed email is hidden from other workers.
+const emailLease = time.Minute
+
+// emailRetry spaces out attempts to send an email SES refused.
+var emailRetry = config.RetryConfig{InitialBackoff: 30 * time.Second, MaxBackoff: 30 * time.Minute}
+
+// emailVerification reports whether form applicants are asked to confirm
+// their email address.
+func (a *app) emailVerification() bool {
+	return a.cfg.Email.From != ""
+}
+
+// queueEmailVerification queues the email asking user userID to confirm
+// email, written in lang.
+func queueEmailVerification(ctx context.Context, tx *sql.Tx, userID int64, email, lang string) error {
+	if !i18n.Supported(lang) {
+		lang = i18n.Default
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO email_verifications(user_id, email, lang) VALUES ($1, $2, $3)`, userID, email, lang)
+	return err
+}
+
+// hashToken is how a verification token is stored.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// runEmailWorker sends queued verification emails until ctx is done, and
+// purges those past use once an hour.
+func (a *app) runEmailWorker(ctx context.Context) {
+	if !a.emailVerification() {
+		return
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(a.cfg.Email.Region))
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=email_worker_disabled err=%v instance=%s", err, a.instanceID)
+		return
+	}
+	client := sesv2.NewFromConfig(awsCfg)
+
+	ticker := time.NewTicker(a.cfg.Email.PollInterval)
+	defer ticker.Stop()
+	purge := time.NewTicker(time.Hour)
+	defer purge.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-purge.C:
+			a.purgeEmailVerifications(ctx)
+			continue
+		case <-ticker.C:
+		}
+		if a.dbDown.Load() || a.draining.Load() {
+			continue
+		}
+		for ctx.Err() == nil {
+			worked, err := a.sendNextEmail(ctx, client)
+			if err != nil {
+				log.Printf("level=ERROR service=go-app event=email_claim_failed err=%v instance=%s", err, a.instanceID)
+			}
+			if !worked {
+				break
+			}
+		}
+	}
+}
+
+// sendNextEmail claims the oldest due email, gives it a fresh token and
+// sends it, reporting whether there was one. A retried email gets a new
+// token, so only the link in the email that was sent works.
+func (a *app) sendNextEmail(ctx context.Context, client *sesv2.Client) (bool, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	token := hex.EncodeToString(b[:])
+
+	var id, userID int64
+	var attempts int
+	var email, lang, name, reference string
+	err := a.db.QueryRowContext(ctx, `
+	UPDATE email_verifications v
+	SET attempts = v.attempts + 1, run_after = CURRENT_TIMESTAMP + make_interval(secs => $2),
+		token_hash = $3, expires_at = CURRENT_TIMESTAMP + make_interval(secs => $4)
+	FROM users u
+	WHERE v.id = (
+		SELECT id FROM email_verifications
+		WHERE state = $1 AND run_after <= CURRENT_TIMESTAMP
+		ORDER BY run_after
+		FOR UPDATE SKIP LOCKED
+		LIMIT 1
+	) AND u.id = v.user_id
+	RETURNING v.id, v.user_id, v.attempts, v.email, v.lang, u.name, COALESCE(u.reference, '')
+	`, jobQueued, emailLease.Seconds(), hashToken(token), a.cfg.Email.TokenTTL.Seconds()).Scan(&id, &userID, &attempts, &email, &lang, &name, &reference)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	link := a.cfg.Email.BaseURL + "/verify?token=" + url.QueryEscape(token)
+	hours := int(a.cfg.Email.TokenTTL.Hours())
+	sendCtx, cancel := context.WithTimeout(ctx, emailLease/2)
+	defer cancel()
+	_, err = client.SendEmail(sendCtx, &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(a.cfg.Email.From),
+		Destination:      &sestypes.Destination{ToAddresses: []string{email}},
+		Content: &sestypes.EmailContent{Simple: &sestypes.Message{
+			Subject: &sestypes.Content{Data: aws.String(i18n.T(lang, "email.verify.subject")), Charset: aws.String("UTF-8")},
+			Body: &sestypes.Body{Text: &sestypes.Content{
+				Data:    aws.String(i18n.T(lang, "email.verify.body", name, reference, link, hours)),
+				Charset: aws.String("UTF-8"),
+			}},
+		}},
+	})
+	if err == nil {
+		log.Printf("level=INFO service=go-app event=email_sent kind=verification id=%d user_id=%d attempts=%d instance=%s", id, userID, attempts, a.instanceID)
+		if _, err := a.db.ExecContext(ctx, `UPDATE email_verifications SET state = $2, sent_at = CURRENT_TIMESTAMP, last_error = NULL WHERE id = $1`, id, verificationSent); err != nil {
+			log.Printf("level=ERROR service=go-app event=db_update_failed op=email_verification id=%d err=%v instance=%s", id, err, a.instanceID)
+		}
+		return true, nil
+	}
+
+	state, wait := jobQueued, backoffDelay(emailRetry, attempts)
+	if attempts >= a.cfg.Email.MaxAttempts {
+		state = jobFailed
+	}
+	log.Printf("level=ERROR service=go-app event=email_send_failed kind=verification id=%d user_id=%d attempts=%d state=%s retry_in=%s err=%v instance=%s", id, userID, attempts, state, wait, err, a.instanceID)
+	_, dbErr := a.db.ExecContext(ctx, `
+	UPDATE email_verifications
+	SET state = $2, last_error = $3, run_after = CURRENT_TIMESTAMP + make_interval(secs => $4)
+	WHERE id = $1
+	`, id, state, err.Error(), wait.Seconds())
+	if dbErr != nil {
+		log.Printf("level=ERROR service=go-app event=db_update_failed op=email_verification id=%d err=%v instance=%s", id, dbErr, a.instanceID)
+	}
+	return true, nil
+}
+
+// purgeEmailVerifications drops emails whose links have expired, and
+// failed ones, after jobRetention.
+func (a *app) purgeEmailVerifications(ctx context.Context) {
+	if a.dbDown.Load() {
+		return
+	}
+	res, err := a.db.ExecContext(ctx, `
+	DELETE FROM email_verifications
+	WHERE state <> $1 AND COALESCE(expires_at, created_at) < CURRENT_TIMESTAMP - make_interval(secs => $2)
+	`, jobQueued, jobRetention.Seconds())
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_delete_failed op=email_verifications err=%v instance=%s", err, a.instanceID)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("level=INFO service=go-app event=email_verifications_purged count=%d instance=%s", n, a.instanceID)
+	}
+}
+
+// verifyPage is what web/verify.html is rendered with.
+type verifyPage struct {
+	Verified bool
+}
+
+// verifyEmailHandler handles GET /verify?token=, the link in the
+// verification email. Following it again is harmless. Unknown and expired
+// tokens, and tokens for an address the user has since changed, get the
+// same 404.
+func (a *app) verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var userID int64
+	err := errUserNotFound
+	if token := r.URL.Query().Get("token"); token != "" {
+		err = a.db.QueryRowContext(r.Context(), `
+		UPDATE users u SET email_verified = TRUE, email_verified_at = COALESCE(u.email_verified_at, CURRENT_TIMESTAMP)
+		FROM email_verifications v
+		WHERE v.token_hash = $1 AND v.user_id = u.id AND v.expires_at > CURRENT_TIMESTAMP AND lower(v.email) = lower(u.email)
+		RETURNING u.id
+		`, hashToken(token)).Scan(&userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errUserNotFound
+		}
+	}
+	switch {
+	case err == nil:
+		log.Printf("level=INFO service=go-app event=email_verified user_id=%d request_id=%s instance=%s", userID, requestID(r.Context()), a.instanceID)
+	case errors.Is(err, errUserNotFound):
+		log.Printf("level=WARN service=go-app event=email_verification_invalid client_ip=%s request_id=%s instance=%s", a.clientIP(r), requestID(r.Context()), a.instanceID)
+	default:
+		log.Printf("level=ERROR service=go-app event=db_update_failed op=email_verify err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "database error")
+		return
+	}
+
+	status := http.StatusOK
+	if err != nil {
+		status = http.StatusNotFound
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if t, _, tErr := a.pageTemplate(r, "verify.html"); tErr == nil && wantsHTML(r) {
+		var page bytes.Buffer
+		if tErr = t.Execute(&page, pageData{language(r.Context()), verifyPage{Verified: err == nil}}); tErr == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(status)
+			w.Write(page.Bytes())
+			return
+		}
+	}
+	if err != nil {
+		writeProblem(w, r, probNotFound, "unknown or expired verification link")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"email_verified": true})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+/* ERROR PAGES */
+
+// errorPages names the page in web/ served to browsers for each status.
+// The page may use {{request_id}}, {{path}} and {{allow}}.
+var errorPages = map[int]string{
+	http.StatusNotFound:            "404.html",
+	http.StatusMethodNotAllowed:    "405.html",
+	http.StatusInternalServerError: "500.html",
+}
+
+// writeError answers r with a problem of the given kind, or with the
+// matching error page when a browser is navigating outside /api/. The API
+// always gets problems, whatever its Accept header says.
+func (a *app) writeError(w http.ResponseWriter, r *http.Request, kind problemKind, detail string) {
+	if a.writeErrorPage(w, r, kind.Status) {
+		return
+	}
+	writeProblem(w, r, kind, detail)
+}
+
+// writeErrorPage writes the error page for status, reporting false, having
+// written nothing, when there is none or the client should get a problem.
+func (a *app) writeErrorPage(w http.ResponseWriter, r *http.Request, status int) bool {
+	name, ok := errorPages[status]
+	if !ok || strings.HasPrefix(r.URL.Path, "/api/") || !wantsHTML(r) {
+		return false
+	}
+	page, err := fs.ReadFile(a.web, name)
+	if err != nil {
+		return false
+	}
+	page = bytes.ReplaceAll(page, []byte("{{request_id}}"), []byte(html.EscapeString(requestID(r.Context()))))
+	page = bytes.ReplaceAll(page, []byte("{{path}}"), []byte(html.EscapeString(r.URL.Path)))
+	page = bytes.ReplaceAll(page, []byte("{{allow}}"), []byte(html.EscapeString(w.Header().Get("Allow"))))
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(page)
+	return true
+}
+
+// writeServerError answers with a generic 500: the error page for
+// browsers, a problem for everyone else.
+func (a *app) writeServerError(w http.ResponseWriter, r *http.Request) {
+	a.writeError(w, r, probInternal, "an unexpected error occurred")
+}
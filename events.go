@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/* STATUS EVENTS */
+
+// Status changes are read back from kyc_status_history rather than
+// broadcast in process, so a stream sees changes made on any instance.
+const (
+	eventPollInterval = 2 * time.Second
+	eventHeartbeat    = 15 * time.Second
+	eventRetry        = 5 * time.Second
+)
+
+// statusSnapshot is the data of the "status" event sent when a stream opens.
+type statusSnapshot struct {
+	KYCStatus string `json:"kyc_status"`
+}
+
+// apiStatusEvents handles GET /api/v1/users/{id}/events, a Server-Sent
+// Events stream. A fresh stream starts with a "status" event carrying the
+// current status, then sends a "status_change" event per change, with the
+// history row ID as event ID. A client reconnecting with Last-Event-ID gets
+// the changes it missed instead. Comments keep idle streams open through
+// the ALB, and the stream ends when the instance starts draining.
+func (a *app) apiStatusEvents(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r)
+	if !ok {
+		writeProblem(w, r, probValidation, "invalid user id")
+		return
+	}
+
+	u, err := getUser(r.Context(), a.db, id)
+	if err != nil {
+		a.writeUserResult(w, r, nil, err, id)
+		return
+	}
+	a.streamStatus(w, r, u, false)
+}
+
+// streamStatus runs the status event stream of u. A public stream carries
+// only statuses, leaving out who made each change and why.
+func (a *app) streamStatus(w http.ResponseWriter, r *http.Request, u *user, public bool) {
+	ctx := r.Context()
+	id := u.ID
+
+	var err error
+	lastID, resumed := int64(0), false
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		if lastID, err = strconv.ParseInt(v, 10, 64); err != nil || lastID < 0 {
+			writeProblem(w, r, probValidation, "invalid Last-Event-ID")
+			return
+		}
+		resumed = true
+	} else if err := a.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM kyc_status_history WHERE user_id = $1`, id).Scan(&lastID); err != nil {
+		log.Printf("level=ERROR service=go-app event=db_query_failed op=status_events id=%d err=%v request_id=%s instance=%s", id, err, requestID(ctx), a.instanceID)
+		writeProblem(w, r, probDatabase, "database error")
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	send := func(format string, args ...any) bool {
+		// The server's WriteTimeout would otherwise cut every stream.
+		rc.SetWriteDeadline(time.Now().Add(a.cfg.HTTP.WriteTimeout))
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	event := func(name string, eventID int64, data any) bool {
+		b, _ := json.Marshal(data)
+		return send("id: %d\nevent: %s\ndata: %s\n\n", eventID, name, b)
+	}
+
+	if !send("retry: %d\n\n", eventRetry.Milliseconds()) {
+		return
+	}
+	if !resumed && !event("status", lastID, statusSnapshot{KYCStatus: u.KYCStatus}) {
+		return
+	}
+	log.Printf("level=DEBUG service=go-app event=status_stream_opened id=%d last_event_id=%d request_id=%s instance=%s", id, lastID, requestID(ctx), a.instanceID)
+
+	poll := time.NewTicker(eventPollInterval)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			if !send(": keep-alive\n\n") {
+				return
+			}
+		case <-poll.C:
+			if a.draining.Load() {
+				return
+			}
+			changes, err := statusChangesSince(ctx, a.db, id, lastID)
+			if err != nil {
+				log.Printf("level=WARN service=go-app event=status_stream_poll_failed id=%d err=%v request_id=%s instance=%s", id, err, requestID(ctx), a.instanceID)
+				continue
+			}
+			for _, c := range changes {
+				var data any = c
+				if public {
+					data = statusSnapshot{KYCStatus: c.To}
+				}
+				if !event("status_change", c.ID, data) {
+					return
+				}
+				lastID = c.ID
+			}
+		}
+	}
+}
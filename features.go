@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/appconfigdata"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+
+	"client_alb_go_s3_rds/config"
+	"client_alb_go_s3_rds/flags"
+)
+
+/* FEATURE FLAGS */
+
+// Flag names used to gate behavior that is still being rolled out.
+const (
+	flagAsyncSubmit     = "async_submit"
+	flagPresignedUpload = "presigned_upload"
+	flagResumableUpload = "resumable_upload"
+)
+
+// featureEnabled reports whether the flag name is on. Presigned and
+// resumable uploads talk to S3 directly, so they stay off with storage
+// backends other than S3 and MinIO whatever their flags say.
+func (a *app) featureEnabled(ctx context.Context, name string) bool {
+	if (name == flagPresignedUpload || name == flagResumableUpload) && a.s3 == nil {
+		return false
+	}
+	return flags.Enabled(ctx, name)
+}
+
+// initFlags installs flags.Default with the configured sources, loads it
+// once and keeps it refreshed until ctx is done.
+func initFlags(ctx context.Context, cfg config.FlagsConfig, instanceID string) {
+	sources := []flags.Source{flags.EnvSource{Prefix: "FEATURE_"}}
+
+	if cfg.SSMPath != "" || cfg.AppConfigProfile != "" {
+		awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			log.Printf("level=ERROR service=go-app event=flags_aws_disabled err=%v instance=%s", err, instanceID)
+		} else {
+			if cfg.SSMPath != "" {
+				sources = append(sources, flags.SSMSource{Client: ssm.NewFromConfig(awsCfg), Path: cfg.SSMPath})
+			}
+			if cfg.AppConfigApplication != "" && cfg.AppConfigEnvironment != "" && cfg.AppConfigProfile != "" {
+				sources = append(sources, &flags.AppConfigSource{
+					Client:      appconfigdata.NewFromConfig(awsCfg),
+					Application: cfg.AppConfigApplication,
+					Environment: cfg.AppConfigEnvironment,
+					Profile:     cfg.AppConfigProfile,
+				})
+			}
+		}
+	}
+
+	flags.Default = flags.New(sources...)
+	flags.Default.Refresh(ctx)
+	log.Printf("level=INFO service=go-app event=flags_loaded flags=%v instance=%s", flags.Default.Snapshot(), instanceID)
+
+	go flags.Default.Run(ctx, cfg.RefreshInterval)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"client_alb_go_s3_rds/doccheck"
+	"client_alb_go_s3_rds/i18n"
+)
+
+/* DOCUMENT CONTENT TYPES */
+
+// A document's type is what its first bytes say it is. The declared
+// Content-Type and the filename extension are only checked against that:
+// a PNG named scan.pdf is refused rather than stored as either.
+
+// sniffLen is how much of a document is read to detect its type.
+const sniffLen = 512
+
+// documentTypeNames are the applicant-facing names of the detectable types.
+var documentTypeNames = map[string]string{
+	"application/pdf": "PDF",
+	"image/jpeg":      "JPEG",
+	"image/png":       "PNG",
+	"image/webp":      "WebP",
+}
+
+// documentExtensions maps filename extensions to the type they claim.
+var documentExtensions = map[string]string{
+	".pdf":  "application/pdf",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".jpe":  "image/jpeg",
+	".png":  "image/png",
+	".webp": "image/webp",
+}
+
+// sniffDocumentType returns the type of a document starting with b, or ""
+// when it is none of documentTypeNames.
+func sniffDocumentType(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte("%PDF-")):
+		return "application/pdf"
+	case bytes.HasPrefix(b, []byte{0xFF, 0xD8, 0xFF}):
+		return "image/jpeg"
+	case bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png"
+	case len(b) >= 12 && bytes.Equal(b[:4], []byte("RIFF")) && bytes.Equal(b[8:12], []byte("WEBP")):
+		return "image/webp"
+	}
+	return ""
+}
+
+// readSniffBytes reads the first sniffLen bytes of r, or all of a shorter r.
+func readSniffBytes(r io.Reader) ([]byte, error) {
+	b := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, b)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	return b[:n], err
+}
+
+// documentTypeAllowed reports whether DOCUMENT_TYPES accepts contentType.
+func (a *app) documentTypeAllowed(contentType string) bool {
+	return slices.Contains(a.cfg.Docs.AllowedTypes, contentType)
+}
+
+// documentTypesText lists the accepted types for messages, e.g. "a PDF,
+// JPEG or PNG".
+func (a *app) documentTypesText() string {
+	return "a " + a.documentTypeList(i18n.Default)
+}
+
+// documentTypeList names the accepted types in lang, e.g. "PDF, JPEG or
+// PNG".
+func (a *app) documentTypeList(lang string) string {
+	return a.documentTypeListOf(lang, a.cfg.Docs.AllowedTypes)
+}
+
+// documentTypeListOf is documentTypeList for the types in types.
+func (a *app) documentTypeListOf(lang string, types []string) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = documentTypeNames[t]
+	}
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return i18n.T(lang, "list.or", strings.Join(names[:len(names)-1], ", "), names[len(names)-1])
+}
+
+// checkDocumentContent detects the type of a document starting with head
+// and returns it, failing if the type is not allowed or disagrees with
+// the declared type or the extension of filename. Generic declared types,
+// such as the application/octet-stream browsers send when unsure, claim
+// nothing. Every error is the client's fault and says what is wrong.
+func (a *app) checkDocumentContent(head []byte, declared, filename string) (string, error) {
+	detected := sniffDocumentType(head)
+	if detected == "" || !a.documentTypeAllowed(detected) {
+		return "", errors.New("document must be " + a.documentTypesText())
+	}
+	if mt, _, err := mime.ParseMediaType(declared); err == nil {
+		switch mt {
+		case "", "application/octet-stream", "binary/octet-stream":
+		case "image/jpg", "image/pjpeg":
+			mt = "image/jpeg"
+			fallthrough
+		default:
+			if mt != detected {
+				return "", fmt.Errorf("document is sent as %s but is a %s", mt, documentTypeNames[detected])
+			}
+		}
+	}
+	if claimed, ok := documentExtensions[strings.ToLower(filepath.Ext(filename))]; ok && claimed != detected {
+		return "", fmt.Errorf("%s is a %s, not a %s", filepath.Base(filename), documentTypeNames[detected], documentTypeNames[claimed])
+	}
+	return detected, nil
+}
+
+// documentLimit returns the largest size allowed for a document of
+// contentType: DOCUMENT_MAX_PDF_SIZE or DOCUMENT_MAX_IMAGE_SIZE when set,
+// otherwise the MAX_UPLOAD_SIZE runtime setting.
+func (a *app) documentLimit(contentType string) int64 {
+	var limit int64
+	switch {
+	case contentType == "application/pdf":
+		limit = a.cfg.Docs.MaxPDFBytes
+	case strings.HasPrefix(contentType, "image/"):
+		limit = a.cfg.Docs.MaxImageBytes
+	}
+	if limit == 0 {
+		limit = a.settings.get().MaxUploadBytes
+	}
+	return limit
+}
+
+// maxDocumentLimit returns the largest documentLimit of the allowed types,
+// the limit of a document whose type is not yet known.
+func (a *app) maxDocumentLimit() int64 {
+	var limit int64
+	for _, t := range a.cfg.Docs.AllowedTypes {
+		limit = max(limit, a.documentLimit(t))
+	}
+	return limit
+}
+
+// documentLimitText says how large a document of contentType may be, e.g.
+// "PDF documents are limited to 5242880 bytes".
+func (a *app) documentLimitText(contentType string) string {
+	name, ok := documentTypeNames[contentType]
+	if !ok {
+		return fmt.Sprintf("documents are limited to %d bytes", a.maxDocumentLimit())
+	}
+	return fmt.Sprintf("%s documents are limited to %d bytes", name, a.documentLimit(contentType))
+}
+
+// checkDocumentStructure verifies that the document of contentType in the
+// first size bytes of r decodes, with images within the configured
+// dimensions. A *doccheck.Error is the client's fault and says what is
+// wrong; any other error is a failure to read r.
+func (a *app) checkDocumentStructure(r io.ReaderAt, size int64, contentType string) error {
+	return doccheck.Check(r, size, contentType, doccheck.Limits{MinSide: a.cfg.Docs.ImageMinSide, MaxSide: a.cfg.Docs.ImageMaxSide, MaxPixels: a.cfg.Docs.ImageMaxPixels})
+}
@@ -0,0 +1,132 @@
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/appconfigdata"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+/* ENVIRONMENT */
+
+// EnvSource reads flags from variables such as FEATURE_ASYNC_SUBMIT=true.
+type EnvSource struct {
+	Prefix string
+}
+
+func (s EnvSource) Name() string { return "env" }
+
+func (s EnvSource) Load(ctx context.Context) (map[string]bool, error) {
+	values := map[string]bool{}
+	for _, kv := range os.Environ() {
+		key, val, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(key, s.Prefix) {
+			continue
+		}
+		if b, ok := parseBool(val); ok {
+			values[strings.TrimPrefix(key, s.Prefix)] = b
+		}
+	}
+	return values, nil
+}
+
+/* SSM PARAMETER STORE */
+
+// SSMSource reads one parameter per flag under Path, e.g.
+// /kyc/prod/flags/async_submit = "true".
+type SSMSource struct {
+	Client *ssm.Client
+	Path   string
+}
+
+func (s SSMSource) Name() string { return "ssm" }
+
+func (s SSMSource) Load(ctx context.Context) (map[string]bool, error) {
+	values := map[string]bool{}
+
+	pages := ssm.NewGetParametersByPathPaginator(s.Client, &ssm.GetParametersByPathInput{
+		Path: aws.String(s.Path),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page.Parameters {
+			if b, ok := parseBool(aws.ToString(p.Value)); ok {
+				values[path.Base(aws.ToString(p.Name))] = b
+			}
+		}
+	}
+	return values, nil
+}
+
+/* AWS APPCONFIG */
+
+// AppConfigSource reads an AppConfig feature-flag configuration profile,
+// whose document looks like {"async_submit": {"enabled": true}}.
+type AppConfigSource struct {
+	Client      *appconfigdata.Client
+	Application string
+	Environment string
+	Profile     string
+
+	mu     sync.Mutex
+	token  *string
+	latest map[string]bool
+}
+
+func (s *AppConfigSource) Name() string { return "appconfig" }
+
+func (s *AppConfigSource) Load(ctx context.Context) (map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token == nil {
+		out, err := s.Client.StartConfigurationSession(ctx, &appconfigdata.StartConfigurationSessionInput{
+			ApplicationIdentifier:          aws.String(s.Application),
+			EnvironmentIdentifier:          aws.String(s.Environment),
+			ConfigurationProfileIdentifier: aws.String(s.Profile),
+		})
+		if err != nil {
+			return nil, err
+		}
+		s.token = out.InitialConfigurationToken
+	}
+
+	out, err := s.Client.GetLatestConfiguration(ctx, &appconfigdata.GetLatestConfigurationInput{
+		ConfigurationToken: s.token,
+	})
+	if err != nil {
+		// Tokens expire after 24h of disuse; start a new session next time.
+		s.token = nil
+		return nil, err
+	}
+	s.token = out.NextPollConfigurationToken
+
+	// An empty body means the configuration has not changed since the
+	// previous poll.
+	if len(out.Configuration) == 0 {
+		return s.latest, nil
+	}
+
+	var doc map[string]struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.Unmarshal(out.Configuration, &doc); err != nil {
+		return nil, fmt.Errorf("decode appconfig flags: %w", err)
+	}
+
+	s.latest = make(map[string]bool, len(doc))
+	for name, f := range doc {
+		s.latest[name] = f.Enabled
+	}
+	return s.latest, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"client_alb_go_s3_rds/i18n"
+)
+
+/* FORM PAGE */
+
+// formPage is what web/index.html, an html/template, is rendered with. The
+// template's t function translates message keys into Lang.
+type formPage struct {
+	Lang           string
+	Languages      []languageOption
+	CSRFToken      string
+	IdempotencyKey string
+	// Values are what the applicant entered, shown again with Errors after
+	// a rejected submission.
+	Values contactFields
+	Errors []fieldError
+	// DocumentTypes names the accepted types, e.g. "PDF, JPEG or PNG", and
+	// Accept lists them for the file inputs.
+	DocumentTypes string
+	Accept        string
+	Captcha       *captchaWidget
+	// IDCategories are the identity documents offered and IDDocument the
+	// one picked; Required marks the categories KYC_TIER asks for, and
+	// SelfieTypes and SelfieAccept are DocumentTypes and Accept for the
+	// selfie. See doctypes.go.
+	IDCategories []string
+	IDDocument   string
+	Required     map[string]bool
+	SelfieTypes  string
+	SelfieAccept string
+	// Honeypot adds the field only bots fill in; FormStarted is the signed
+	// time the form was served. See spam.go.
+	Honeypot    bool
+	FormStarted string
+	// OTP asks for a code sent to the phone number by SMS; OTPID names the
+	// code sent, and OTPSent says it was just sent. See otp.go.
+	OTP     bool
+	OTPID   string
+	OTPSent bool
+	// Policy is what the consent checkbox accepts; ConsentGiven ticks it.
+	Policy       policyTerms
+	ConsentGiven bool
+	// Flags tells upload.js which upload paths the server offers.
+	DirectUpload    bool
+	ResumableUpload bool
+	Instance        string
+}
+
+// FieldError returns the first error about field, or "".
+func (p formPage) FieldError(field string) string {
+	for _, e := range p.Errors {
+		if e.Field == field {
+			return e.Message
+		}
+	}
+	return ""
+}
+
+// formTemplate parses the form page for r's language. It is parsed per
+// request, like the other pages are read, so edits under WEB_DIR show on
+// reload.
+func (a *app) formTemplate(r *http.Request) (*template.Template, []byte, error) {
+	return a.pageTemplate(r, "index.html")
+}
+
+// pageData is what the receipt and status pages are rendered with: the
+// page's language and its content.
+type pageData struct {
+	Lang string
+	Page any
+}
+
+// pageTemplate parses the html/template name from the web assets, with a t
+// function translating message keys into r's language. It also returns
+// the template's source.
+func (a *app) pageTemplate(r *http.Request, name string) (*template.Template, []byte, error) {
+	src, err := fs.ReadFile(a.web, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	lang := language(r.Context())
+	t, err := template.New(name).Funcs(template.FuncMap{
+		"t": func(key string, args ...any) string { return i18n.T(lang, key, args...) },
+	}).Parse(string(src))
+	return t, src, err
+}
+
+// newFormPage returns the page data for r's browser, without values or
+// errors.
+func (a *app) newFormPage(r *http.Request, token, key string) formPage {
+	ctx := r.Context()
+	lang := language(ctx)
+	selfieTypes := a.categoryTypes(categorySelfie)
+	return formPage{
+		Lang:            lang,
+		Languages:       languageOptions(lang),
+		CSRFToken:       token,
+		IdempotencyKey:  key,
+		DocumentTypes:   a.documentTypeList(lang),
+		Accept:          strings.Join(a.cfg.Docs.AllowedTypes, ","),
+		IDCategories:    idCategories,
+		Required:        requiredCategories(a.cfg.Docs.Tier),
+		SelfieTypes:     a.documentTypeListOf(lang, selfieTypes),
+		SelfieAccept:    strings.Join(selfieTypes, ","),
+		Captcha:         a.captchaWidget(),
+		Honeypot:        a.cfg.Spam.Honeypot,
+		OTP:             a.cfg.OTP.Enabled,
+		Policy:          policyTerms{Version: a.cfg.Consent.PolicyVersion, URL: a.cfg.Consent.PolicyURL},
+		FormStarted:     formStarted(token, time.Now()),
+		DirectUpload:    a.featureEnabled(ctx, flagPresignedUpload),
+		ResumableUpload: a.featureEnabled(ctx, flagResumableUpload),
+		Instance:        a.identity.String(),
+	}
+}
+
+// version identifies what p renders to apart from its idempotency key, for
+// the form's ETag.
+func (p formPage) version(src []byte) string {
+	return contentHash(src, []byte(p.Lang), []byte(p.CSRFToken), []byte(p.Instance), []byte(strconv.FormatBool(p.Honeypot)), []byte(strconv.FormatBool(p.OTP)), []byte(p.Policy.Version), []byte(p.Policy.URL), []byte(fmt.Sprint(p.Required)), []byte(p.SelfieAccept),
+		[]byte(strconv.FormatBool(p.DirectUpload)), []byte(strconv.FormatBool(p.ResumableUpload)))
+}
+
+// writeForm renders the form page with p. The page is rendered in full
+// before anything is written, so a template error still gets a clean 500.
+func (a *app) writeForm(w http.ResponseWriter, r *http.Request, t *template.Template, status int, p formPage) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, p); err != nil {
+		log.Printf("level=ERROR service=go-app event=form_unavailable err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		a.writeServerError(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
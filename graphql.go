@@ -0,0 +1,757 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* GRAPHQL */
+
+// graphqlSchema documents what POST /graphql serves, for the review UI's
+// developers; GET /graphql/schema returns it. The resolvers below are the
+// implementation and must be kept in step.
+const graphqlSchema = `type Query {
+  # Exactly one of id and reference.
+  user(id: ID, reference: String): User
+  # Filters and paging as GET /api/v1/users; limit is 1-200 (default 50).
+  users(status: [String!], email: String, reference: String,
+        emailVerified: Boolean, disposableEmail: Boolean, createdAfter: String,
+        createdBefore: String, sort: String, limit: Int, cursor: String): UserPage!
+}
+
+type UserPage {
+  users: [User!]!
+  nextCursor: String
+}
+
+type User {
+  id: ID!
+  reference: String
+  name: String!
+  email: String!
+  emailVerified: Boolean!
+  emailVerifiedAt: String
+  disposableEmail: Boolean!
+  phone: String!
+  phoneRaw: String
+  kycTier: String
+  kycStatus: String!
+  createdAt: String!
+  documents: [Document!]!
+  history: [StatusChange!]!
+  reviews: [Review!]!
+}
+
+type Document {
+  id: ID!
+  type: String!
+  category: String
+  bucket: String!
+  key: String!
+  filename: String
+  contentType: String
+  size: Int
+  sha256: String
+  storageClass: String!
+  versionId: String
+  scanStatus: String
+  scanSignature: String
+  retentionMode: String
+  retainUntil: String
+  thumbnailUrl: String
+  createdAt: String!
+  replacedAt: String
+  replacedBy: String
+}
+
+type StatusChange {
+  id: ID!
+  from: String!
+  to: String!
+  actor: String!
+  reason: String
+  changedAt: String!
+}
+
+type Review {
+  id: ID!
+  decision: String!
+  reviewer: String!
+  reasonCode: String!
+  notes: String
+  reviewedAt: String!
+}
+`
+
+// graphqlRequest is a GraphQL-over-HTTP request.
+type graphqlRequest struct {
+	Query         string         `json:"query"`
+	Variables     map[string]any `json:"variables,omitempty"`
+	OperationName string         `json:"operationName,omitempty"`
+}
+
+// graphqlResponse is the body of every /graphql answer. Data is absent
+// when the request could not be executed at all.
+type graphqlResponse struct {
+	Data   any          `json:"data,omitempty"`
+	Errors []gqlProblem `json:"errors,omitempty"`
+}
+
+// gqlProblem is one entry of a response's errors.
+type gqlProblem struct {
+	Message   string        `json:"message"`
+	Locations []gqlLocation `json:"locations,omitempty"`
+	Path      []any         `json:"path,omitempty"`
+}
+
+// graphqlHandler serves /graphql: a query in the JSON body of a POST, in an
+// application/graphql body, or in the query string of a GET. Requests that
+// cannot be executed get 400; once execution starts the answer is 200,
+// with a failed field set to null and reported in errors.
+func (a *app) graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	var req graphqlRequest
+	switch {
+	case r.Method == http.MethodGet:
+		q := r.URL.Query()
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				writeGraphQLError(w, "variables must be a JSON object")
+				return
+			}
+		}
+	case mediaType(r) == "application/graphql":
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			a.writeBodyError(w, r, err, "failed to read body")
+			return
+		}
+		req.Query = string(b)
+	default:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			a.writeBodyError(w, r, err, "invalid JSON body: "+err.Error())
+			return
+		}
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		writeGraphQLError(w, "query is required")
+		return
+	}
+
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		var se *gqlSyntaxError
+		errors.As(err, &se)
+		writeJSON(w, http.StatusBadRequest, graphqlResponse{Errors: []gqlProblem{{Message: err.Error(), Locations: []gqlLocation{se.location}}}})
+		return
+	}
+	e, prob := newGQLExec(r.Context(), a, doc, req)
+	if prob != nil {
+		writeJSON(w, http.StatusBadRequest, graphqlResponse{Errors: []gqlProblem{*prob}})
+		return
+	}
+	if prob := e.validate(gqlQuery, e.op.selections, map[string]bool{}); prob != nil {
+		writeJSON(w, http.StatusBadRequest, graphqlResponse{Errors: []gqlProblem{*prob}})
+		return
+	}
+
+	start := time.Now()
+	data := e.object(gqlQuery, nil, e.op.selections, nil)
+	log.Printf("level=INFO service=go-app event=graphql_query operation=%q errors=%d duration_ms=%d actor=%s request_id=%s instance=%s", e.op.name, len(e.errors), time.Since(start).Milliseconds(), actorFrom(r.Context()), requestID(r.Context()), a.instanceID)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, graphqlResponse{Data: data, Errors: e.errors})
+}
+
+// graphqlSchemaHandler handles GET /graphql/schema.
+func (a *app) graphqlSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, graphqlSchema)
+}
+
+func writeGraphQLError(w http.ResponseWriter, msg string) {
+	writeJSON(w, http.StatusBadRequest, graphqlResponse{Errors: []gqlProblem{{Message: msg}}})
+}
+
+/* Execution */
+
+// gqlType is an object type of the schema.
+type gqlType struct {
+	name   string
+	fields map[string]*gqlField
+}
+
+// gqlField resolves one field of its type's values. typ is the object type
+// of the result, nil for scalars; list results are []any.
+type gqlField struct {
+	typ     *gqlType
+	args    []string
+	resolve func(e *gqlExec, parent any, args map[string]any) (any, error)
+}
+
+// gqlExec runs one operation. Related rows are loaded for every user the
+// operation has seen at once, so a page of users with their documents is
+// a fixed number of queries.
+type gqlExec struct {
+	ctx    context.Context
+	a      *app
+	doc    *gqlDocument
+	op     *gqlOperation
+	vars   map[string]any
+	errors []gqlProblem
+
+	userIDs []int64
+	loaded  map[string]map[int64][]any
+}
+
+// newGQLExec selects the operation to run and resolves its variables.
+func newGQLExec(ctx context.Context, a *app, doc *gqlDocument, req graphqlRequest) (*gqlExec, *gqlProblem) {
+	e := &gqlExec{ctx: ctx, a: a, doc: doc, vars: map[string]any{}, loaded: map[string]map[int64][]any{}}
+	for _, op := range doc.operations {
+		if req.OperationName == "" && len(doc.operations) > 1 {
+			return nil, &gqlProblem{Message: "operationName is required when the document has several operations"}
+		}
+		if req.OperationName == "" || op.name == req.OperationName {
+			e.op = op
+			break
+		}
+	}
+	if e.op == nil {
+		return nil, &gqlProblem{Message: fmt.Sprintf("unknown operation %q", req.OperationName)}
+	}
+	if e.op.kind != "query" {
+		return nil, &gqlProblem{Message: "only queries are supported; use the REST API to make changes"}
+	}
+
+	for _, v := range e.op.variables {
+		val, ok := req.Variables[v.name]
+		if !ok && v.hasDef {
+			val, ok = e.resolveValue(v.def), true
+		}
+		if v.nonNull && (!ok || val == nil) {
+			return nil, &gqlProblem{Message: fmt.Sprintf("variable $%s is required", v.name), Locations: []gqlLocation{v.location}}
+		}
+		if ok {
+			e.vars[v.name] = val
+		}
+	}
+	return e, nil
+}
+
+// validate checks sels against t before anything runs, so a mistyped
+// field fails the request instead of half-executing it.
+func (e *gqlExec) validate(t *gqlType, sels []gqlSelection, spreading map[string]bool) *gqlProblem {
+	for _, s := range sels {
+		switch {
+		case s.spread != "":
+			f, ok := e.doc.fragments[s.spread]
+			if !ok {
+				return &gqlProblem{Message: fmt.Sprintf("unknown fragment %q", s.spread), Locations: []gqlLocation{s.location}}
+			}
+			if spreading[s.spread] {
+				return &gqlProblem{Message: fmt.Sprintf("fragment %q spreads itself", s.spread), Locations: []gqlLocation{s.location}}
+			}
+			spreading[s.spread] = true
+			if p := e.validate(t, f.selections, spreading); p != nil {
+				return p
+			}
+			delete(spreading, s.spread)
+			continue
+		case s.inline:
+			if p := e.validate(t, s.selections, spreading); p != nil {
+				return p
+			}
+			continue
+		case s.name == "__typename":
+			continue
+		}
+
+		f, ok := t.fields[s.name]
+		if !ok {
+			return &gqlProblem{Message: fmt.Sprintf("cannot query field %q on type %q", s.name, t.name), Locations: []gqlLocation{s.location}}
+		}
+	args:
+		for _, arg := range s.args {
+			for _, name := range f.args {
+				if arg.name == name {
+					continue args
+				}
+			}
+			return &gqlProblem{Message: fmt.Sprintf("unknown argument %q on field %s.%s", arg.name, t.name, s.name), Locations: []gqlLocation{s.location}}
+		}
+		if f.typ == nil && s.selections != nil {
+			return &gqlProblem{Message: fmt.Sprintf("field %q is a scalar and takes no selection", s.name), Locations: []gqlLocation{s.location}}
+		}
+		if f.typ != nil {
+			if s.selections == nil {
+				return &gqlProblem{Message: fmt.Sprintf("field %q of type %q needs a selection of subfields", s.name, f.typ.name), Locations: []gqlLocation{s.location}}
+			}
+			if p := e.validate(f.typ, s.selections, spreading); p != nil {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// gqlObject is a response object; unlike a map it keeps fields in the
+// order the query asked for them.
+type gqlObject []gqlEntry
+
+type gqlEntry struct {
+	key   string
+	value any
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, e := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(e.key)
+		v, err := json.Marshal(e.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// collect flattens fragments and applies @include and @skip, grouping
+// fields by response key as the GraphQL spec requires.
+func (e *gqlExec) collect(sels []gqlSelection, keys *[]string, groups map[string][]gqlSelection) {
+	for _, s := range sels {
+		if !e.included(s.directives) {
+			continue
+		}
+		switch {
+		case s.spread != "":
+			e.collect(e.doc.fragments[s.spread].selections, keys, groups)
+		case s.inline:
+			e.collect(s.selections, keys, groups)
+		default:
+			k := s.key()
+			if _, ok := groups[k]; !ok {
+				*keys = append(*keys, k)
+			}
+			groups[k] = append(groups[k], s)
+		}
+	}
+}
+
+func (e *gqlExec) included(ds []gqlDirective) bool {
+	for _, d := range ds {
+		if d.name != "include" && d.name != "skip" {
+			continue
+		}
+		for _, arg := range d.args {
+			if arg.name == "if" {
+				cond, _ := e.resolveValue(arg.value).(bool)
+				if cond == (d.name == "skip") {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// object resolves sels on parent, a value of type t.
+func (e *gqlExec) object(t *gqlType, parent any, sels []gqlSelection, path []any) gqlObject {
+	var keys []string
+	groups := map[string][]gqlSelection{}
+	e.collect(sels, &keys, groups)
+
+	out := make(gqlObject, 0, len(keys))
+	for _, k := range keys {
+		fields := groups[k]
+		s := fields[0]
+		fieldPath := append(path[:len(path):len(path)], k)
+		if s.name == "__typename" {
+			out = append(out, gqlEntry{k, t.name})
+			continue
+		}
+
+		f := t.fields[s.name]
+		args := map[string]any{}
+		for _, arg := range s.args {
+			args[arg.name] = e.resolveValue(arg.value)
+		}
+		v, err := f.resolve(e, parent, args)
+		if err != nil {
+			e.errors = append(e.errors, gqlProblem{Message: err.Error(), Locations: []gqlLocation{s.location}, Path: fieldPath})
+			out = append(out, gqlEntry{k, nil})
+			continue
+		}
+
+		var sub []gqlSelection
+		for _, f := range fields {
+			sub = append(sub, f.selections...)
+		}
+		out = append(out, gqlEntry{k, e.complete(f.typ, v, sub, fieldPath)})
+	}
+	return out
+}
+
+// complete turns a resolved value into its response form.
+func (e *gqlExec) complete(t *gqlType, v any, sels []gqlSelection, path []any) any {
+	if t == nil || v == nil {
+		return v
+	}
+	if list, ok := v.([]any); ok {
+		out := make([]any, len(list))
+		for i, item := range list {
+			out[i] = e.complete(t, item, sels, append(path[:len(path):len(path)], i))
+		}
+		return out
+	}
+	return e.object(t, v, sels, path)
+}
+
+// resolveValue substitutes variables into an argument value.
+func (e *gqlExec) resolveValue(v any) any {
+	switch v := v.(type) {
+	case gqlVariableRef:
+		return e.vars[string(v)]
+	case gqlEnum:
+		return string(v)
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = e.resolveValue(item)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, item := range v {
+			out[k] = e.resolveValue(item)
+		}
+		return out
+	}
+	return v
+}
+
+// seeUsers registers users whose related rows may be asked for.
+func (e *gqlExec) seeUsers(users ...*user) {
+	for _, u := range users {
+		e.userIDs = append(e.userIDs, u.ID)
+	}
+}
+
+// related returns the rows of kind belonging to userID, loading them for
+// every user seen so far that has not had them loaded. query selects the
+// owning user_id first and takes the user IDs as a Postgres array in $1.
+func (e *gqlExec) related(kind string, userID int64, query string, scan func(*sql.Rows) (int64, any, error)) ([]any, error) {
+	cache := e.loaded[kind]
+	if cache == nil {
+		cache = map[int64][]any{}
+		e.loaded[kind] = cache
+	}
+	if rows, ok := cache[userID]; ok {
+		return rows, nil
+	}
+
+	var ids []string
+	pending := map[int64]bool{}
+	for _, id := range append(e.userIDs[:len(e.userIDs):len(e.userIDs)], userID) {
+		if _, done := cache[id]; done || pending[id] {
+			continue
+		}
+		pending[id] = true
+		ids = append(ids, strconv.FormatInt(id, 10))
+	}
+	rows, err := e.a.db.QueryContext(e.ctx, query, "{"+strings.Join(ids, ",")+"}")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for id := range pending {
+		cache[id] = []any{}
+	}
+	for rows.Next() {
+		owner, v, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		cache[owner] = append(cache[owner], v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return cache[userID], nil
+}
+
+/* Schema */
+
+var (
+	gqlQuery        = &gqlType{name: "Query"}
+	gqlUserPage     = &gqlType{name: "UserPage"}
+	gqlUser         = &gqlType{name: "User"}
+	gqlDocumentType = &gqlType{name: "Document"}
+	gqlStatusChange = &gqlType{name: "StatusChange"}
+	gqlReview       = &gqlType{name: "Review"}
+)
+
+func init() {
+	gqlQuery.fields = map[string]*gqlField{
+		"user":  {typ: gqlUser, args: []string{"id", "reference"}, resolve: resolveUser},
+		"users": {typ: gqlUserPage, args: []string{"status", "email", "reference", "emailVerified", "disposableEmail", "createdAfter", "createdBefore", "sort", "limit", "cursor"}, resolve: resolveUsers},
+	}
+	gqlUserPage.fields = map[string]*gqlField{
+		"users":      {typ: gqlUser, resolve: func(_ *gqlExec, p any, _ map[string]any) (any, error) { return p.(*gqlPage).users, nil }},
+		"nextCursor": {resolve: func(_ *gqlExec, p any, _ map[string]any) (any, error) { return p.(*gqlPage).nextCursor, nil }},
+	}
+
+	userProp := func(f func(*user) any) *gqlField {
+		return &gqlField{resolve: func(_ *gqlExec, p any, _ map[string]any) (any, error) { return f(p.(*user)), nil }}
+	}
+	gqlUser.fields = map[string]*gqlField{
+		"id":            userProp(func(u *user) any { return strconv.FormatInt(u.ID, 10) }),
+		"reference":     userProp(func(u *user) any { return nullIfEmpty(u.Reference) }),
+		"name":          userProp(func(u *user) any { return u.Name }),
+		"email":         userProp(func(u *user) any { return u.Email }),
+		"emailVerified": userProp(func(u *user) any { return u.EmailVerified }),
+		"emailVerifiedAt": userProp(func(u *user) any {
+			if u.EmailVerifiedAt == nil {
+				return nil
+			}
+			return u.EmailVerifiedAt.UTC().Format(time.RFC3339)
+		}),
+		"disposableEmail": userProp(func(u *user) any { return u.DisposableEmail }),
+		"phone":           userProp(func(u *user) any { return u.Phone }),
+		"phoneRaw":        userProp(func(u *user) any { return nullIfEmpty(u.PhoneRaw) }),
+		"kycTier":         userProp(func(u *user) any { return nullIfEmpty(u.KYCTier) }),
+		"kycStatus":       userProp(func(u *user) any { return u.KYCStatus }),
+		"createdAt":       userProp(func(u *user) any { return u.CreatedAt.UTC().Format(time.RFC3339) }),
+		"documents":       {typ: gqlDocumentType, resolve: resolveDocuments},
+		"history":         {typ: gqlStatusChange, resolve: resolveHistory},
+		"reviews":         {typ: gqlReview, resolve: resolveReviews},
+	}
+
+	docProp := func(f func(document) any) *gqlField {
+		return &gqlField{resolve: func(_ *gqlExec, p any, _ map[string]any) (any, error) { return f(p.(document)), nil }}
+	}
+	gqlDocumentType.fields = map[string]*gqlField{
+		"id":            docProp(func(d document) any { return strconv.FormatInt(d.ID, 10) }),
+		"type":          docProp(func(d document) any { return d.Type }),
+		"category":      docProp(func(d document) any { return nullIfEmpty(d.Category) }),
+		"bucket":        docProp(func(d document) any { return d.Bucket }),
+		"key":           docProp(func(d document) any { return d.Key }),
+		"filename":      docProp(func(d document) any { return nullIfEmpty(d.Filename) }),
+		"contentType":   docProp(func(d document) any { return nullIfEmpty(d.ContentType) }),
+		"size":          docProp(func(d document) any { return d.Size }),
+		"sha256":        docProp(func(d document) any { return nullIfEmpty(d.SHA256) }),
+		"storageClass":  docProp(func(d document) any { return d.StorageClass }),
+		"versionId":     docProp(func(d document) any { return nullIfEmpty(d.VersionID) }),
+		"scanStatus":    docProp(func(d document) any { return nullIfEmpty(d.ScanStatus) }),
+		"scanSignature": docProp(func(d document) any { return nullIfEmpty(d.ScanSignature) }),
+		"retentionMode": docProp(func(d document) any { return nullIfEmpty(d.RetentionMode) }),
+		"retainUntil": docProp(func(d document) any {
+			if d.RetainUntil == nil {
+				return nil
+			}
+			return d.RetainUntil.UTC().Format(time.RFC3339)
+		}),
+		"thumbnailUrl": docProp(func(d document) any { return nullIfEmpty(d.ThumbnailURL) }),
+		"createdAt":    docProp(func(d document) any { return d.CreatedAt.UTC().Format(time.RFC3339) }),
+		"replacedAt": docProp(func(d document) any {
+			if d.ReplacedAt == nil {
+				return nil
+			}
+			return d.ReplacedAt.UTC().Format(time.RFC3339)
+		}),
+		"replacedBy": docProp(func(d document) any { return nullIfEmpty(d.ReplacedBy) }),
+	}
+
+	changeProp := func(f func(statusChange) any) *gqlField {
+		return &gqlField{resolve: func(_ *gqlExec, p any, _ map[string]any) (any, error) { return f(p.(statusChange)), nil }}
+	}
+	gqlStatusChange.fields = map[string]*gqlField{
+		"id":        changeProp(func(c statusChange) any { return strconv.FormatInt(c.ID, 10) }),
+		"from":      changeProp(func(c statusChange) any { return c.From }),
+		"to":        changeProp(func(c statusChange) any { return c.To }),
+		"actor":     changeProp(func(c statusChange) any { return c.Actor }),
+		"reason":    changeProp(func(c statusChange) any { return nullIfEmpty(c.Reason) }),
+		"changedAt": changeProp(func(c statusChange) any { return c.ChangedAt.UTC().Format(time.RFC3339) }),
+	}
+
+	reviewProp := func(f func(review) any) *gqlField {
+		return &gqlField{resolve: func(_ *gqlExec, p any, _ map[string]any) (any, error) { return f(p.(review)), nil }}
+	}
+	gqlReview.fields = map[string]*gqlField{
+		"id":         reviewProp(func(rv review) any { return strconv.FormatInt(rv.ID, 10) }),
+		"decision":   reviewProp(func(rv review) any { return rv.Decision }),
+		"reviewer":   reviewProp(func(rv review) any { return rv.Reviewer }),
+		"reasonCode": reviewProp(func(rv review) any { return rv.ReasonCode }),
+		"notes":      reviewProp(func(rv review) any { return nullIfEmpty(rv.Notes) }),
+		"reviewedAt": reviewProp(func(rv review) any { return rv.ReviewedAt.UTC().Format(time.RFC3339) }),
+	}
+}
+
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// gqlPage is a resolved UserPage.
+type gqlPage struct {
+	users      []any
+	nextCursor any
+}
+
+// errGraphQLInternal hides database details from GraphQL clients; the
+// cause is logged.
+var errGraphQLInternal = errors.New("internal error; see the server log for this request ID")
+
+func (e *gqlExec) internal(op string, err error) error {
+	log.Printf("level=ERROR service=go-app event=db_query_failed op=graphql_%s err=%v request_id=%s instance=%s", op, err, requestID(e.ctx), e.a.instanceID)
+	return errGraphQLInternal
+}
+
+func resolveUser(e *gqlExec, _ any, args map[string]any) (any, error) {
+	id, ref := args["id"], args["reference"]
+	if (id == nil) == (ref == nil) {
+		return nil, errors.New("pass exactly one of id and reference")
+	}
+
+	var u *user
+	var err error
+	if id != nil {
+		n, perr := strconv.ParseInt(fmt.Sprint(id), 10, 64)
+		if perr != nil || n <= 0 {
+			return nil, errors.New("id must be a positive integer")
+		}
+		u, err = getUser(e.ctx, e.a.db, n)
+	} else {
+		s, _ := ref.(string)
+		if s = normalizeReference(s); s == "" {
+			return nil, errors.New("reference must look like KYC-XXXX-XXXX")
+		}
+		u, err = userByReference(e.ctx, e.a.db, s)
+	}
+	if errors.Is(err, errUserNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, e.internal("user", err)
+	}
+	e.seeUsers(u)
+	return u, nil
+}
+
+// resolveUsers runs the GET /api/v1/users query: the arguments are turned
+// into its query parameters so both share one set of rules.
+func resolveUsers(e *gqlExec, _ any, args map[string]any) (any, error) {
+	q := url.Values{}
+	for arg, param := range map[string]string{"email": "email", "reference": "reference", "emailVerified": "email_verified", "disposableEmail": "disposable_email", "createdAfter": "created_after", "createdBefore": "created_before", "sort": "sort", "limit": "limit", "cursor": "cursor"} {
+		if v, ok := args[arg]; ok && v != nil {
+			q.Set(param, fmt.Sprint(v))
+		}
+	}
+	switch v := args["status"].(type) {
+	case string:
+		q.Add("kyc_status", v)
+	case []any:
+		for _, s := range v {
+			q.Add("kyc_status", fmt.Sprint(s))
+		}
+	}
+	f, err := parseUserFilter(q)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := f.Limit
+	f.Limit++
+	users, err := listUsers(e.ctx, e.a.db, f)
+	if err != nil {
+		return nil, e.internal("users", err)
+	}
+	page := &gqlPage{users: []any{}}
+	if len(users) > limit {
+		users = users[:limit]
+		page.nextCursor = encodeCursor(f.SortBy, users[limit-1])
+	}
+	for i := range users {
+		e.seeUsers(&users[i])
+		page.users = append(page.users, &users[i])
+	}
+	return page, nil
+}
+
+func resolveDocuments(e *gqlExec, p any, _ map[string]any) (any, error) {
+	docs, err := e.related("documents", p.(*user).ID, `
+	SELECT user_id, id, doc_type, category, bucket, object_key, filename, content_type, size_bytes, COALESCE(sha256, ''), storage_class, COALESCE(version_id, ''), COALESCE(scan_status, ''), COALESCE(scan_signature, ''), COALESCE(retention_mode, ''), retain_until, thumbnail_key IS NOT NULL, created_at, replaced_at, COALESCE(replaced_by, '')
+	FROM documents WHERE user_id = ANY($1::bigint[]) ORDER BY id
+	`, func(rows *sql.Rows) (int64, any, error) {
+		var owner int64
+		var d document
+		var retainUntil, replacedAt sql.NullTime
+		var thumbnail bool
+		err := rows.Scan(&owner, &d.ID, &d.Type, &d.Category, &d.Bucket, &d.Key, &d.Filename, &d.ContentType, &d.Size, &d.SHA256, &d.StorageClass, &d.VersionID, &d.ScanStatus, &d.ScanSignature, &d.RetentionMode, &retainUntil, &thumbnail, &d.CreatedAt, &replacedAt, &d.ReplacedBy)
+		if retainUntil.Valid {
+			d.RetainUntil = &retainUntil.Time
+		}
+		if thumbnail {
+			d.ThumbnailURL = thumbnailURL(owner, d.ID)
+		}
+		if replacedAt.Valid {
+			d.ReplacedAt = &replacedAt.Time
+		}
+		return owner, d, err
+	})
+	if err != nil {
+		return nil, e.internal("documents", err)
+	}
+	return docs, nil
+}
+
+func resolveHistory(e *gqlExec, p any, _ map[string]any) (any, error) {
+	changes, err := e.related("history", p.(*user).ID, `
+	SELECT user_id, id, from_status, to_status, actor, COALESCE(reason, ''), changed_at
+	FROM kyc_status_history WHERE user_id = ANY($1::bigint[]) ORDER BY id
+	`, func(rows *sql.Rows) (int64, any, error) {
+		var owner int64
+		var c statusChange
+		err := rows.Scan(&owner, &c.ID, &c.From, &c.To, &c.Actor, &c.Reason, &c.ChangedAt)
+		return owner, c, err
+	})
+	if err != nil {
+		return nil, e.internal("history", err)
+	}
+	return changes, nil
+}
+
+func resolveReviews(e *gqlExec, p any, _ map[string]any) (any, error) {
+	reviews, err := e.related("reviews", p.(*user).ID, `
+	SELECT user_id, id, decision, reviewer, reason_code, notes, reviewed_at
+	FROM kyc_reviews WHERE user_id = ANY($1::bigint[]) ORDER BY id
+	`, func(rows *sql.Rows) (int64, any, error) {
+		var owner int64
+		var rv review
+		err := rows.Scan(&owner, &rv.ID, &rv.Decision, &rv.Reviewer, &rv.ReasonCode, &rv.Notes, &rv.ReviewedAt)
+		return owner, rv, err
+	})
+	if err != nil {
+		return nil, e.internal("reviews", err)
+	}
+	return reviews, nil
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/* GRAPHQL PARSER */
+
+// The parser accepts the query subset of GraphQL the review UI needs:
+// queries with variables, aliases, arguments, named and inline fragments,
+// and @include/@skip. Mutations and subscriptions are rejected.
+
+// gqlDocument is a parsed request document.
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	kind       string // "query", "mutation" or "subscription"
+	name       string
+	variables  []gqlVariable
+	selections []gqlSelection
+}
+
+// gqlVariable is a declared variable; its type is checked only by how the
+// resolvers use the value.
+type gqlVariable struct {
+	name     string
+	def      any
+	hasDef   bool
+	nonNull  bool
+	location gqlLocation
+}
+
+type gqlFragment struct {
+	name       string
+	selections []gqlSelection
+}
+
+// gqlSelection is a field, a fragment spread (spread set) or an inline
+// fragment (inline set).
+type gqlSelection struct {
+	alias      string
+	name       string
+	args       []gqlArgument
+	directives []gqlDirective
+	selections []gqlSelection
+	spread     string
+	inline     bool
+	location   gqlLocation
+}
+
+// key is the name the field's value has in the response.
+func (s *gqlSelection) key() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+type gqlArgument struct {
+	name  string
+	value any
+}
+
+type gqlDirective struct {
+	name string
+	args []gqlArgument
+}
+
+// gqlVariableRef is a $variable appearing as a value.
+type gqlVariableRef string
+
+// gqlEnum is an enum literal, which resolvers read like a string.
+type gqlEnum string
+
+type gqlLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// gqlSyntaxError reports where parsing stopped.
+type gqlSyntaxError struct {
+	msg      string
+	location gqlLocation
+}
+
+func (e *gqlSyntaxError) Error() string { return "Syntax Error: " + e.msg }
+
+// Token kinds.
+const (
+	tokEOF = iota
+	tokPunct
+	tokName
+	tokInt
+	tokFloat
+	tokString
+)
+
+type gqlToken struct {
+	kind     int
+	value    string
+	location gqlLocation
+}
+
+type gqlParser struct {
+	src  string
+	pos  int
+	line int
+	col  int
+	tok  gqlToken
+}
+
+// parseGraphQL parses src into a document.
+func parseGraphQL(src string) (doc *gqlDocument, err error) {
+	p := &gqlParser{src: src, line: 1, col: 1}
+	defer func() {
+		if v := recover(); v != nil {
+			se, ok := v.(*gqlSyntaxError)
+			if !ok {
+				panic(v)
+			}
+			doc, err = nil, se
+		}
+	}()
+
+	p.next()
+	doc = &gqlDocument{fragments: map[string]*gqlFragment{}}
+	for p.tok.kind != tokEOF {
+		switch {
+		case p.peek(tokPunct, "{"):
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", selections: p.selectionSet()})
+		case p.peek(tokName, "fragment"):
+			p.next()
+			f := &gqlFragment{name: p.expect(tokName, "").value}
+			p.expect(tokName, "on")
+			p.expect(tokName, "")
+			p.directives()
+			f.selections = p.selectionSet()
+			if _, dup := doc.fragments[f.name]; dup {
+				p.fail("there can be only one fragment named %q", f.name)
+			}
+			doc.fragments[f.name] = f
+		case p.peek(tokName, "query"), p.peek(tokName, "mutation"), p.peek(tokName, "subscription"):
+			op := &gqlOperation{kind: p.tok.value}
+			p.next()
+			if p.tok.kind == tokName {
+				op.name = p.tok.value
+				p.next()
+			}
+			if p.skip(tokPunct, "(") {
+				for !p.skip(tokPunct, ")") {
+					op.variables = append(op.variables, p.variableDefinition())
+				}
+			}
+			p.directives()
+			op.selections = p.selectionSet()
+			doc.operations = append(doc.operations, op)
+		default:
+			p.fail("unexpected %s", p.describe())
+		}
+	}
+	if len(doc.operations) == 0 {
+		p.fail("the document has no operation")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) variableDefinition() gqlVariable {
+	v := gqlVariable{location: p.tok.location}
+	p.expect(tokPunct, "$")
+	v.name = p.expect(tokName, "").value
+	p.expect(tokPunct, ":")
+	v.nonNull = p.typeRef()
+	if p.skip(tokPunct, "=") {
+		v.def, v.hasDef = p.value(true), true
+	}
+	p.directives()
+	return v
+}
+
+// typeRef skips a type reference, reporting whether it is non-null.
+func (p *gqlParser) typeRef() bool {
+	if p.skip(tokPunct, "[") {
+		p.typeRef()
+		p.expect(tokPunct, "]")
+	} else {
+		p.expect(tokName, "")
+	}
+	return p.skip(tokPunct, "!")
+}
+
+func (p *gqlParser) selectionSet() []gqlSelection {
+	p.expect(tokPunct, "{")
+	var sels []gqlSelection
+	for !p.skip(tokPunct, "}") {
+		sels = append(sels, p.selection())
+	}
+	if len(sels) == 0 {
+		p.fail("a selection set cannot be empty")
+	}
+	return sels
+}
+
+func (p *gqlParser) selection() gqlSelection {
+	s := gqlSelection{location: p.tok.location}
+	if p.skip(tokPunct, "...") {
+		if p.tok.kind == tokName && p.tok.value != "on" {
+			s.spread = p.tok.value
+			p.next()
+			s.directives = p.directives()
+			return s
+		}
+		s.inline = true
+		if p.skip(tokName, "on") {
+			p.expect(tokName, "")
+		}
+		s.directives = p.directives()
+		s.selections = p.selectionSet()
+		return s
+	}
+
+	s.name = p.expect(tokName, "").value
+	if p.skip(tokPunct, ":") {
+		s.alias, s.name = s.name, p.expect(tokName, "").value
+	}
+	s.args = p.arguments(false)
+	s.directives = p.directives()
+	if p.peek(tokPunct, "{") {
+		s.selections = p.selectionSet()
+	}
+	return s
+}
+
+func (p *gqlParser) arguments(constant bool) []gqlArgument {
+	var args []gqlArgument
+	if !p.skip(tokPunct, "(") {
+		return nil
+	}
+	for !p.skip(tokPunct, ")") {
+		name := p.expect(tokName, "").value
+		p.expect(tokPunct, ":")
+		for _, a := range args {
+			if a.name == name {
+				p.fail("there can be only one argument named %q", name)
+			}
+		}
+		args = append(args, gqlArgument{name: name, value: p.value(constant)})
+	}
+	return args
+}
+
+func (p *gqlParser) directives() []gqlDirective {
+	var ds []gqlDirective
+	for p.skip(tokPunct, "@") {
+		d := gqlDirective{name: p.expect(tokName, "").value}
+		d.args = p.arguments(false)
+		ds = append(ds, d)
+	}
+	return ds
+}
+
+// value parses a value literal. Constant values, such as variable
+// defaults, may not refer to variables.
+func (p *gqlParser) value(constant bool) any {
+	t := p.tok
+	switch t.kind {
+	case tokInt:
+		p.next()
+		n, err := strconv.ParseInt(t.value, 10, 64)
+		if err != nil {
+			p.failAt(t.location, "integer %s is out of range", t.value)
+		}
+		return n
+	case tokFloat:
+		p.next()
+		f, _ := strconv.ParseFloat(t.value, 64)
+		return f
+	case tokString:
+		p.next()
+		return t.value
+	case tokName:
+		p.next()
+		switch t.value {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		return gqlEnum(t.value)
+	case tokPunct:
+		switch t.value {
+		case "$":
+			if constant {
+				p.fail("unexpected variable in a constant value")
+			}
+			p.next()
+			return gqlVariableRef(p.expect(tokName, "").value)
+		case "[":
+			p.next()
+			list := []any{}
+			for !p.skip(tokPunct, "]") {
+				list = append(list, p.value(constant))
+			}
+			return list
+		case "{":
+			p.next()
+			obj := map[string]any{}
+			for !p.skip(tokPunct, "}") {
+				name := p.expect(tokName, "").value
+				p.expect(tokPunct, ":")
+				obj[name] = p.value(constant)
+			}
+			return obj
+		}
+	}
+	p.fail("unexpected %s", p.describe())
+	return nil
+}
+
+func (p *gqlParser) peek(kind int, value string) bool {
+	return p.tok.kind == kind && (value == "" || p.tok.value == value)
+}
+
+func (p *gqlParser) skip(kind int, value string) bool {
+	if p.peek(kind, value) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) expect(kind int, value string) gqlToken {
+	t := p.tok
+	if !p.peek(kind, value) {
+		want := map[int]string{tokName: "a name", tokPunct: "punctuation"}[kind]
+		if value != "" {
+			want = strconv.Quote(value)
+		}
+		p.fail("expected %s, found %s", want, p.describe())
+	}
+	p.next()
+	return t
+}
+
+func (p *gqlParser) describe() string {
+	switch p.tok.kind {
+	case tokEOF:
+		return "<EOF>"
+	case tokString:
+		return "string " + strconv.Quote(p.tok.value)
+	}
+	return strconv.Quote(p.tok.value)
+}
+
+func (p *gqlParser) fail(format string, args ...any) {
+	p.failAt(p.tok.location, format, args...)
+}
+
+func (p *gqlParser) failAt(loc gqlLocation, format string, args ...any) {
+	panic(&gqlSyntaxError{msg: fmt.Sprintf(format, args...), location: loc})
+}
+
+// advance moves past n bytes of the source on the current line.
+func (p *gqlParser) advance(n int) {
+	p.pos += n
+	p.col += n
+}
+
+// next reads the following token into p.tok, skipping whitespace, commas
+// and comments.
+func (p *gqlParser) next() {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '\n':
+			p.pos++
+			p.line, p.col = p.line+1, 1
+			continue
+		case c == ' ' || c == '\t' || c == '\r' || c == ',':
+			p.advance(1)
+			continue
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.advance(1)
+			}
+			continue
+		case strings.HasPrefix(p.src[p.pos:], "\ufeff"):
+			p.advance(len("\ufeff"))
+			continue
+		}
+		break
+	}
+
+	loc := gqlLocation{Line: p.line, Column: p.col}
+	if p.pos >= len(p.src) {
+		p.tok = gqlToken{kind: tokEOF, location: loc}
+		return
+	}
+
+	rest := p.src[p.pos:]
+	c := rest[0]
+	switch {
+	case strings.HasPrefix(rest, "..."):
+		p.tok = gqlToken{kind: tokPunct, value: "...", location: loc}
+		p.advance(3)
+	case strings.ContainsRune("!$():=@[]{|}&", rune(c)):
+		p.tok = gqlToken{kind: tokPunct, value: string(c), location: loc}
+		p.advance(1)
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		n := 1
+		for n < len(rest) && (rest[n] == '_' || rest[n] >= 'a' && rest[n] <= 'z' || rest[n] >= 'A' && rest[n] <= 'Z' || rest[n] >= '0' && rest[n] <= '9') {
+			n++
+		}
+		p.tok = gqlToken{kind: tokName, value: rest[:n], location: loc}
+		p.advance(n)
+	case c == '-' || c >= '0' && c <= '9':
+		n, kind := 1, tokInt
+		for n < len(rest) && (rest[n] >= '0' && rest[n] <= '9' || strings.ContainsRune(".eE+-", rune(rest[n]))) {
+			if !(rest[n] >= '0' && rest[n] <= '9') {
+				kind = tokFloat
+			}
+			n++
+		}
+		if _, err := strconv.ParseFloat(rest[:n], 64); err != nil {
+			p.failAt(loc, "invalid number %q", rest[:n])
+		}
+		p.tok = gqlToken{kind: kind, value: rest[:n], location: loc}
+		p.advance(n)
+	case c == '"':
+		p.tok = gqlToken{kind: tokString, value: p.readString(loc), location: loc}
+	default:
+		r, _ := utf8.DecodeRuneInString(rest)
+		p.failAt(loc, "unexpected character %q", r)
+	}
+}
+
+// readString reads a quoted string, or a """block string""" taken
+// verbatim, starting at p.pos.
+func (p *gqlParser) readString(loc gqlLocation) string {
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		end := strings.Index(p.src[p.pos+3:], `"""`)
+		if end < 0 {
+			p.failAt(loc, "unterminated string")
+		}
+		s := p.src[p.pos+3 : p.pos+3+end]
+		for _, c := range s + `"""` {
+			if c == '\n' {
+				p.line, p.col = p.line+1, 1
+			} else {
+				p.col++
+			}
+		}
+		p.pos += 3 + end + 3
+		return strings.TrimSpace(s)
+	}
+
+	var b strings.Builder
+	p.advance(1)
+	for {
+		if p.pos >= len(p.src) || p.src[p.pos] == '\n' {
+			p.failAt(loc, "unterminated string")
+		}
+		c := p.src[p.pos]
+		switch {
+		case c == '"':
+			p.advance(1)
+			return b.String()
+		case c == '\\' && p.pos+1 < len(p.src):
+			esc := p.src[p.pos+1]
+			if esc == 'u' && p.pos+6 <= len(p.src) {
+				n, err := strconv.ParseUint(p.src[p.pos+2:p.pos+6], 16, 16)
+				if err != nil {
+					p.failAt(loc, "invalid unicode escape")
+				}
+				b.WriteRune(rune(n))
+				p.advance(6)
+				continue
+			}
+			r, ok := map[byte]string{'"': `"`, '\\': `\`, '/': "/", 'b': "\b", 'f': "\f", 'n': "\n", 'r': "\r", 't': "\t"}[esc]
+			if !ok {
+				p.failAt(loc, "invalid escape \\%c", esc)
+			}
+			b.WriteString(r)
+			p.advance(2)
+		default:
+			b.WriteByte(c)
+			p.advance(1)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"client_alb_go_s3_rds/storage"
+)
+
+/* HEALTH ENDPOINTS */
+
+// livenessHandler answers /healthz. It only proves the process is serving
+// HTTP, so a dependency outage never makes the ALB or orchestrator replace
+// an otherwise healthy instance.
+func (a *app) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// readinessReport is the /readyz response body.
+type readinessReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// readinessHandler answers /readyz (and the legacy /health). It fails while
+// the startup self-check is pending, while draining, during maintenance
+// when MAINTENANCE_READY is off, or when any of the configured dependency
+// checks fails within its own timeout.
+func (a *app) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	report := readinessReport{Status: "ok", Checks: map[string]string{}}
+	fail := func(name string, err error) {
+		report.Status = "fail"
+		report.Checks[name] = "fail: " + err.Error()
+	}
+
+	settings := a.settings.get()
+
+	switch {
+	case a.draining.Load():
+		fail("lifecycle", errors.New("shutting down"))
+	case !a.ready.Load():
+		fail("lifecycle", errors.New("startup checks pending"))
+	case settings.Maintenance && !settings.MaintenanceReady:
+		fail("lifecycle", errors.New("maintenance mode"))
+	default:
+		for _, name := range a.cfg.Health.ReadyChecks {
+			if err := a.readinessCheck(r.Context(), name); err != nil {
+				fail(name, err)
+			} else {
+				report.Checks[name] = "ok"
+			}
+		}
+	}
+
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+func (a *app) readinessCheck(ctx context.Context, name string) error {
+	switch name {
+	case "rds":
+		ctx, cancel := context.WithTimeout(ctx, a.cfg.Health.RDSTimeout)
+		defer cancel()
+		return a.db.PingContext(ctx)
+
+	case "s3":
+		ctx, cancel := context.WithTimeout(ctx, a.cfg.Health.S3Timeout)
+		defer cancel()
+		if a.s3 == nil {
+			return a.probeStore(ctx)
+		}
+		_, err := a.s3.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(a.cfg.S3.Bucket)})
+		return err
+
+	case "migrations":
+		ctx, cancel := context.WithTimeout(ctx, a.cfg.Health.MigrationsTimeout)
+		defer cancel()
+		pending, err := pendingMigrations(ctx, a.db)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("%d pending", len(pending))
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown check %q", name)
+}
+
+// probeStore checks that the document store answers, where there is no S3
+// bucket to head, by asking after an object that does not exist.
+func (a *app) probeStore(ctx context.Context) error {
+	_, err := a.store.Head(ctx, storage.Object{Key: a.cfg.S3.KeyPrefix + ".selfcheck/probe"})
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+// Package i18n translates the text applicants read: the form, validation
+// messages and the receipt and status pages. Each language has a catalog,
+// locales/<code>.json, mapping message keys to text; catalogs are embedded
+// in the binary.
+//
+// Messages may hold fmt verbs, filled in from T's arguments. A message
+// missing from a catalog falls back to Default's.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Default is the language of clients that accept none of the others.
+const Default = "en"
+
+//go:embed locales/*.json
+var locales embed.FS
+
+// catalogs holds each language's messages by key.
+var catalogs = load()
+
+func load() map[string]map[string]string {
+	files, err := locales.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	out := map[string]map[string]string{}
+	for _, f := range files {
+		data, err := locales.ReadFile("locales/" + f.Name())
+		if err != nil {
+			panic(err)
+		}
+		msgs := map[string]string{}
+		if err := json.Unmarshal(data, &msgs); err != nil {
+			panic(fmt.Sprintf("i18n: %s: %v", f.Name(), err))
+		}
+		out[strings.TrimSuffix(f.Name(), path.Ext(f.Name()))] = msgs
+	}
+	if out[Default] == nil {
+		panic("i18n: no catalog for " + Default)
+	}
+	return out
+}
+
+// Languages returns the supported language codes, Default first and the
+// others sorted.
+func Languages() []string {
+	out := make([]string, 0, len(catalogs))
+	for lang := range catalogs {
+		if lang != Default {
+			out = append(out, lang)
+		}
+	}
+	sort.Strings(out)
+	return append([]string{Default}, out...)
+}
+
+// Supported reports whether there is a catalog for lang.
+func Supported(lang string) bool {
+	_, ok := catalogs[lang]
+	return ok
+}
+
+// Name returns the name of lang written in lang, e.g. "हिन्दी".
+func Name(lang string) string {
+	return T(lang, "language.name")
+}
+
+// T returns the message key in lang, formatted with args. Unknown keys
+// come back as the key itself, so a missing message shows up on the page
+// rather than as blank space.
+func T(lang, key string, args ...any) string {
+	msg, ok := catalogs[lang][key]
+	if !ok {
+		msg, ok = catalogs[Default][key]
+	}
+	if !ok {
+		return key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// Negotiate returns the supported language an Accept-Language header
+// prefers, matching "hi-IN" to "hi" when there is no catalog for the
+// region, or Default.
+func Negotiate(acceptLanguage string) string {
+	type choice struct {
+		tag string
+		q   float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = f
+		}
+		if tag != "" && q > 0 {
+			choices = append(choices, choice{strings.ToLower(tag), q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+
+	for _, c := range choices {
+		if c.tag == "*" {
+			return Default
+		}
+		if Supported(c.tag) {
+			return c.tag
+		}
+		if base, _, ok := strings.Cut(c.tag, "-"); ok && Supported(base) {
+			return base
+		}
+	}
+	return Default
+}
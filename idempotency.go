@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/* IDEMPOTENT SUBMISSIONS */
+
+// idempotencyTTL is how long a key and its result are kept. A key reused
+// after that starts a new submission.
+const idempotencyTTL = 24 * time.Hour
+
+// idempotencyAbandonAfter is when an unfinished claim, left behind by a
+// crashed instance, may be taken over.
+const idempotencyAbandonAfter = 10 * time.Minute
+
+// maxIdempotencyKeyLen bounds client-chosen keys.
+const maxIdempotencyKeyLen = 255
+
+// idempotencyKey returns the Idempotency-Key header, falling back to the
+// idempotency_key form field the submission page carries.
+func idempotencyKey(r *http.Request) string {
+	if k := r.Header.Get("Idempotency-Key"); k != "" {
+		return strings.TrimSpace(k)
+	}
+	return strings.TrimSpace(r.FormValue("idempotency_key"))
+}
+
+// idempotencyClaim is a key this request owns until it completes or
+// releases it.
+type idempotencyClaim struct {
+	a    *app
+	key  string
+	done bool
+}
+
+// claimIdempotency reserves the request's idempotency key. It returns a nil
+// claim with ok set when the request carries no key or the database is
+// down, in which case the submission proceeds unguarded. When the key was
+// already used it answers the request itself, replaying the stored result
+// or refusing with 409 while the first attempt is still in flight, and
+// returns ok false.
+func (a *app) claimIdempotency(w http.ResponseWriter, r *http.Request) (*idempotencyClaim, bool) {
+	key := idempotencyKey(r)
+	if key == "" || a.dbDown.Load() {
+		return nil, true
+	}
+	if len(key) > maxIdempotencyKeyLen {
+		writeProblem(w, r, probValidation, "Idempotency-Key is too long")
+		return nil, false
+	}
+	ctx := r.Context()
+
+	// An expired or abandoned entry is taken over as if it were new.
+	var claimed bool
+	err := a.db.QueryRowContext(ctx, `
+	INSERT INTO idempotency_keys(idempotency_key) VALUES ($1)
+	ON CONFLICT (idempotency_key) DO UPDATE
+	SET user_id = NULL, status_code = NULL, content_type = NULL, body = NULL, created_at = CURRENT_TIMESTAMP
+	WHERE idempotency_keys.created_at < CURRENT_TIMESTAMP - make_interval(secs => $2)
+	   OR (idempotency_keys.status_code IS NULL AND idempotency_keys.created_at < CURRENT_TIMESTAMP - make_interval(secs => $3))
+	RETURNING true
+	`, key, idempotencyTTL.Seconds(), idempotencyAbandonAfter.Seconds()).Scan(&claimed)
+	if err == nil {
+		return &idempotencyClaim{a: a, key: key}, true
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("level=ERROR service=go-app event=idempotency_claim_failed err=%v request_id=%s instance=%s", err, requestID(ctx), a.instanceID)
+		writeProblem(w, r, probDatabase, "failed to check Idempotency-Key")
+		return nil, false
+	}
+
+	var status sql.NullInt64
+	var contentType, body sql.NullString
+	err = a.db.QueryRowContext(ctx, `
+	SELECT status_code, content_type, body FROM idempotency_keys WHERE idempotency_key = $1
+	`, key).Scan(&status, &contentType, &body)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=idempotency_lookup_failed err=%v request_id=%s instance=%s", err, requestID(ctx), a.instanceID)
+		writeProblem(w, r, probDatabase, "failed to check Idempotency-Key")
+		return nil, false
+	}
+	if !status.Valid {
+		writeProblem(w, r, probInProgress, "a submission with this Idempotency-Key is still in progress")
+		return nil, false
+	}
+
+	log.Printf("level=INFO service=go-app event=idempotent_replay status=%d request_id=%s instance=%s", status.Int64, requestID(ctx), a.instanceID)
+	w.Header().Set("Content-Type", contentType.String)
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(int(status.Int64))
+	w.Write([]byte(body.String))
+	return nil, false
+}
+
+// idempotencyKeyUnused reports whether key has never been claimed, so a
+// cached form page carrying it may still be used. It errs towards false
+// when the database cannot say.
+func (a *app) idempotencyKeyUnused(ctx context.Context, key string) bool {
+	if a.dbDown.Load() {
+		return false
+	}
+	var used bool
+	err := a.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM idempotency_keys WHERE idempotency_key = $1)`, key).Scan(&used)
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=idempotency_lookup_failed err=%v request_id=%s instance=%s", err, requestID(ctx), a.instanceID)
+		return false
+	}
+	return !used
+}
+
+// complete stores the result a retry with the same key will receive.
+// userID is 0 when the submission was spooled rather than stored.
+func (c *idempotencyClaim) complete(ctx context.Context, userID int64, status int, contentType, body string) {
+	if c == nil {
+		return
+	}
+	c.done = true
+	// The response is decided; record it even if the deadline has passed.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	_, err := c.a.db.ExecContext(ctx, `
+	UPDATE idempotency_keys SET user_id = NULLIF($2, 0), status_code = $3, content_type = $4, body = $5
+	WHERE idempotency_key = $1
+	`, c.key, userID, status, contentType, body)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=idempotency_complete_failed err=%v request_id=%s instance=%s", err, requestID(ctx), c.a.instanceID)
+	}
+}
+
+// release frees a key whose request failed, so the client may retry it.
+// It does nothing once complete has run, which makes it safe to defer.
+func (c *idempotencyClaim) release(ctx context.Context) {
+	if c == nil || c.done {
+		return
+	}
+	c.done = true
+	// The request context may already be cancelled; the key must go anyway.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if _, err := c.a.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE idempotency_key = $1 AND status_code IS NULL`, c.key); err != nil {
+		log.Printf("level=ERROR service=go-app event=idempotency_release_failed err=%v request_id=%s instance=%s", err, requestID(ctx), c.a.instanceID)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+
+	"client_alb_go_s3_rds/config"
+)
+
+/* INSTANCE IDENTITY */
+
+// instanceIdentity says which compute unit is handling a request: an EC2
+// instance, an ECS task, or, outside AWS, just the hostname.
+type instanceIdentity struct {
+	ID     string
+	AZ     string
+	Source string
+}
+
+func (id instanceIdentity) String() string {
+	if id.AZ == "" {
+		return id.ID
+	}
+	return id.ID + " (" + id.AZ + ")"
+}
+
+// resolveIdentity queries the configured metadata source. In "auto" mode
+// the ECS task metadata endpoint wins when its env var is present, then
+// IMDSv2 is tried, and the hostname is the last resort.
+func resolveIdentity(ctx context.Context, cfg config.IdentityConfig) (instanceIdentity, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	var errs []error
+	ecsURI := os.Getenv("ECS_CONTAINER_METADATA_URI_V4")
+
+	if cfg.Source == "ecs" || (cfg.Source == "auto" && ecsURI != "") {
+		id, err := ecsIdentity(ctx, ecsURI)
+		if err == nil {
+			return id, nil
+		}
+		errs = append(errs, fmt.Errorf("ecs: %w", err))
+	}
+
+	if cfg.Source == "ec2" || (cfg.Source == "auto" && ecsURI == "") {
+		id, err := ec2Identity(ctx)
+		if err == nil {
+			return id, nil
+		}
+		errs = append(errs, fmt.Errorf("imds: %w", err))
+	}
+
+	return hostnameIdentity(), errors.Join(errs...)
+}
+
+// ec2Identity reads the instance identity document over IMDSv2; the SDK
+// client fetches and refreshes the session token itself.
+func ec2Identity(ctx context.Context) (instanceIdentity, error) {
+	client := imds.New(imds.Options{})
+
+	doc, err := client.GetInstanceIdentityDocument(ctx, &imds.GetInstanceIdentityDocumentInput{})
+	if err != nil {
+		return instanceIdentity{}, err
+	}
+
+	return instanceIdentity{ID: doc.InstanceID, AZ: doc.AvailabilityZone, Source: "ec2"}, nil
+}
+
+// ecsIdentity reads task metadata from the ECS task metadata endpoint v4.
+func ecsIdentity(ctx context.Context, uri string) (instanceIdentity, error) {
+	if uri == "" {
+		return instanceIdentity{}, errors.New("ECS_CONTAINER_METADATA_URI_V4 is not set")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri+"/task", nil)
+	if err != nil {
+		return instanceIdentity{}, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return instanceIdentity{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return instanceIdentity{}, fmt.Errorf("task metadata returned %s", resp.Status)
+	}
+
+	var task struct {
+		TaskARN          string `json:"TaskARN"`
+		AvailabilityZone string `json:"AvailabilityZone"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&task); err != nil {
+		return instanceIdentity{}, err
+	}
+
+	// The task ID is the last segment of the ARN and is what the console,
+	// the CLI and the ALB target list show.
+	return instanceIdentity{ID: path.Base(task.TaskARN), AZ: task.AvailabilityZone, Source: "ecs"}, nil
+}
+
+func hostnameIdentity() instanceIdentity {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown-instance"
+	}
+	return instanceIdentity{ID: host, Source: "hostname"}
+}
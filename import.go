@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+/* BULK IMPORT */
+
+// importBatchSize is how many rows share one transaction. A database
+// failure loses at most one batch, which the report marks as failed.
+const importBatchSize = 100
+
+// importReport is the POST /api/v1/users/import response.
+type importReport struct {
+	Total   int               `json:"total"`
+	Created int               `json:"created"`
+	Failed  int               `json:"failed"`
+	DryRun  bool              `json:"dry_run,omitempty"`
+	Rows    []importRowResult `json:"rows"`
+}
+
+// importRowResult reports one CSV row by its line number in the file.
+type importRowResult struct {
+	Line  int    `json:"line"`
+	ID    int64  `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// importColumns maps accepted CSV header names to document types; the
+// contact columns are handled separately.
+func importColumns() map[string]string {
+	cols := map[string]string{"document_key": docKYC}
+	for _, t := range documentFields {
+		cols[t+"_key"] = t
+	}
+	return cols
+}
+
+// apiImportUsers handles POST /api/v1/users/import. The body is a CSV with
+// a header row naming at least name, email and phone, and optionally the S3
+// keys of documents already in the bucket (document_key, id_front_key,
+// id_back_key, proof_of_address_key, selfie_key) and, with id_front_key or
+// id_back_key, the id_document they are (passport or drivers_license).
+// Imported records predate KYC tiers, so none is enforced, and identity
+// documents without an id_document are stored uncategorized. Every row is
+// validated first; valid rows are then inserted in batches and the report
+// gives each row's user ID or error. With ?dry_run=true nothing is stored.
+func (a *app) apiImportUsers(w http.ResponseWriter, r *http.Request) {
+	if mediaType(r) != "text/csv" {
+		writeProblem(w, r, probUnsupportedType, "send the users as text/csv")
+		return
+	}
+	if a.dbDown.Load() {
+		writeProblem(w, r, probDatabaseUnavailable, "database unavailable")
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	ctx := r.Context()
+
+	cr := csv.NewReader(r.Body)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		a.writeBodyError(w, r, err, "failed to read CSV header")
+		return
+	}
+	columns, msg := importHeader(header)
+	if msg != "" {
+		writeProblem(w, r, probValidation, msg)
+		return
+	}
+
+	report := importReport{DryRun: dryRun, Rows: []importRowResult{}}
+	var valid []int
+	var subs []submission
+	seenKeys := map[string]int{}
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				a.writeBodyError(w, r, err, "failed to read CSV")
+				return
+			}
+			report.Rows = append(report.Rows, importRowResult{Line: parseErr.Line, Error: parseErr.Err.Error()})
+			continue
+		}
+
+		line, _ := cr.FieldPos(0)
+		sub, msg := a.importRow(ctx, columns, record, line, seenKeys, dryRun)
+		report.Rows = append(report.Rows, importRowResult{Line: line, Error: msg})
+		if msg == "" {
+			valid = append(valid, len(report.Rows)-1)
+			subs = append(subs, sub)
+		}
+	}
+	report.Total = len(report.Rows)
+
+	for start := 0; start < len(subs) && !dryRun; start += importBatchSize {
+		end := min(start+importBatchSize, len(subs))
+		ids := make([]int64, 0, end-start)
+		err := inTx(ctx, a.db, func(tx *sql.Tx) error {
+			for _, sub := range subs[start:end] {
+				id, err := insertUserTx(ctx, tx, sub)
+				if err != nil {
+					return err
+				}
+				ids = append(ids, id)
+			}
+			return nil
+		})
+		for i, idx := range valid[start:end] {
+			if err != nil {
+				report.Rows[idx].Error = "database error; batch rolled back"
+				continue
+			}
+			report.Rows[idx].ID = ids[i]
+		}
+		if err != nil {
+			log.Printf("level=ERROR service=go-app event=import_batch_failed rows=%d err=%v request_id=%s instance=%s", end-start, err, requestID(ctx), a.instanceID)
+		}
+	}
+
+	for _, row := range report.Rows {
+		switch {
+		case row.Error != "":
+			report.Failed++
+		case !dryRun:
+			report.Created++
+		}
+	}
+	log.Printf("level=INFO service=go-app event=users_imported total=%d created=%d failed=%d dry_run=%t actor=%s request_id=%s instance=%s", report.Total, report.Created, report.Failed, dryRun, actorFrom(ctx), requestID(ctx), a.instanceID)
+	writeJSON(w, http.StatusOK, report)
+}
+
+// importHeader maps each CSV column to its header name and checks the
+// required ones are present.
+func importHeader(header []string) ([]string, string) {
+	docCols := importColumns()
+	columns := make([]string, len(header))
+	seen := map[string]bool{}
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+		if _, ok := docCols[h]; !ok && h != "name" && h != "email" && h != "phone" && h != idDocumentField {
+			return nil, "unknown CSV column " + strconv.Quote(h)
+		}
+		if seen[h] {
+			return nil, "duplicate CSV column " + strconv.Quote(h)
+		}
+		seen[h] = true
+		columns[i] = h
+	}
+	for _, req := range []string{"name", "email", "phone"} {
+		if !seen[req] {
+			return nil, "CSV header must include name, email and phone"
+		}
+	}
+	return columns, ""
+}
+
+// importRow turns one CSV record into a submission, or explains why it is
+// invalid. Document keys must name unclaimed objects under the configured
+// key prefix, each used once in the file. Unless dryRun, the documents are
+// locked with Object Lock; see retention.go.
+func (a *app) importRow(ctx context.Context, columns, record []string, line int, seenKeys map[string]int, dryRun bool) (submission, string) {
+	docCols := importColumns()
+	sub := submission{Status: statusUploaded, CreatedAt: time.Now()}
+
+	var docs []submittedDocument
+	var idDocument string
+	for i, col := range columns {
+		val := strings.TrimSpace(record[i])
+		switch col {
+		case idDocumentField:
+			idDocument = val
+		case "name":
+			sub.Name = val
+		case "email":
+			sub.Email = val
+		case "phone":
+			sub.Phone = val
+		default:
+			if val != "" {
+				docs = append(docs, submittedDocument{Type: docCols[col], Bucket: a.cfg.S3.Bucket, Key: val})
+			}
+		}
+	}
+
+	c, errs := validateContact(contactFields{Name: sub.Name, Email: sub.Email, Phone: sub.Phone}, a.cfg.Phone.DefaultRegion)
+	if len(errs) > 0 {
+		return sub, fieldErrorSummary(errs)
+	}
+	sub.Name, sub.Email, sub.Phone, sub.PhoneRaw = c.Name, c.Email, c.Phone, c.PhoneRaw
+	sub.DisposableEmail = a.disposable.blocked(sub.Email)
+
+	for i, d := range docs {
+		isID := d.Type == docIDFront || d.Type == docIDBack
+		if !isID || idDocument != "" {
+			var named string
+			if isID {
+				named = idDocument
+			}
+			category, err := documentCategory(d.Type, named)
+			if err != nil {
+				return sub, err.Error()
+			}
+			docs[i].Category = category
+		}
+		if !strings.HasPrefix(d.Key, a.cfg.S3.KeyPrefix) || strings.Contains(d.Key, "..") {
+			return sub, d.Type + ": key is outside the document prefix"
+		}
+		if prev, ok := seenKeys[d.Key]; ok {
+			return sub, d.Type + ": key already used on line " + strconv.Itoa(prev)
+		}
+		head, sum, err := a.verifyUnclaimedObject(ctx, d.Bucket, d.Key)
+		if errors.Is(err, errUploadRejected) {
+			return sub, d.Type + ": " + err.Error()
+		}
+		if err != nil {
+			log.Printf("level=ERROR service=go-app event=import_document_check_failed line=%d key=%s err=%v request_id=%s instance=%s", line, d.Key, err, requestID(ctx), a.instanceID)
+			return sub, d.Type + ": failed to verify document"
+		}
+		seenKeys[d.Key] = line
+		docs[i].ContentType = aws.ToString(head.ContentType)
+		docs[i].Size = aws.ToInt64(head.ContentLength)
+		docs[i].SHA256 = sum
+		docs[i].StorageClass = objectStorageClass(head.StorageClass)
+		docs[i].VersionID = aws.ToString(head.VersionId)
+		if dryRun {
+			continue
+		}
+		if err := a.lockDocument(ctx, &docs[i]); err != nil {
+			log.Printf("level=ERROR service=go-app event=document_lock_failed line=%d key=%s err=%v request_id=%s instance=%s", line, d.Key, err, requestID(ctx), a.instanceID)
+			return sub, d.Type + ": failed to lock document"
+		}
+	}
+	sub.setDocuments(docs)
+	return sub, ""
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+/* OBJECT KEYS */
+
+// Every document gets a key of its own: a random UUID, so two uploads of the
+// same name at the same moment never overwrite each other, and the
+// applicant's filename reduced to characters that are safe in a key. The
+// filename as sent is kept in the documents table and the object's
+// metadata. Documents the app uploads for a known submission are laid out
+// under S3_KEY_PREFIX by S3_KEY_TEMPLATE, which may also partition them by
+// upload date and reference; direct, resumable and form uploads, stored
+// before their submission is known, keep their own prefixes, which is how
+// they are told apart.
+
+// maxKeyFilename caps the filename part of a key, in bytes.
+const maxKeyFilename = 100
+
+// documentKey returns a new key under prefix for a document named filename.
+func documentKey(prefix, filename string) string {
+	return prefix + newUUID() + "/" + safeFilename(filename)
+}
+
+// templateKey returns a new key for a document named filename, of the
+// submission reference, uploaded at.
+func (a *app) templateKey(reference, filename string, at time.Time) string {
+	if reference == "" {
+		reference = "unreferenced"
+	}
+	at = at.UTC()
+	return a.cfg.S3.KeyPrefix + strings.NewReplacer(
+		"{yyyy}", at.Format("2006"),
+		"{mm}", at.Format("01"),
+		"{dd}", at.Format("02"),
+		"{reference}", reference,
+		"{uuid}", newUUID(),
+		"{filename}", safeFilename(filename),
+	).Replace(a.cfg.S3.KeyTemplate)
+}
+
+// safeFilename reduces filename to its base name in ASCII letters, digits,
+// '.', '-' and '_', every run of other characters replaced by one '_',
+// keeping its extension when it has to be shortened.
+func safeFilename(filename string) string {
+	// Some browsers send the client's full path, with either separator.
+	name := path.Base(strings.ReplaceAll(filename, `\`, "/"))
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			b.WriteRune(r)
+		case !strings.HasSuffix(b.String(), "_"):
+			b.WriteByte('_')
+		}
+	}
+	name = strings.TrimLeft(b.String(), ".")
+	if name == "" {
+		return "document"
+	}
+
+	if len(name) > maxKeyFilename {
+		ext := path.Ext(name)
+		if len(ext) > maxKeyFilename/4 {
+			ext = ""
+		}
+		name = name[:maxKeyFilename-len(ext)] + ext
+	}
+	return name
+}
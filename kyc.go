@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/* KYC STATUS */
+
+// KYC statuses, in the order a record normally moves through them.
+const (
+	statusInReview    = "KYC_IN_REVIEW"
+	statusApproved    = "KYC_APPROVED"
+	statusRejected    = "KYC_REJECTED"
+	statusReUploaded  = "KYC_RE_UPLOADED"
+	statusQuarantined = "KYC_QUARANTINED"
+)
+
+// kycTransitions lists the statuses each status may move to. Approved is
+// terminal; a rejected applicant re-uploads and goes back into review. A
+// submission with a document found to carry malware is quarantined until a
+// reviewer rejects it.
+var kycTransitions = map[string][]string{
+	statusUploaded:    {statusInReview, statusQuarantined},
+	statusInReview:    {statusApproved, statusRejected, statusQuarantined},
+	statusRejected:    {statusReUploaded, statusQuarantined},
+	statusReUploaded:  {statusInReview, statusQuarantined},
+	statusQuarantined: {statusRejected},
+	statusApproved:    {},
+}
+
+// transitionError explains why a status change was refused.
+type transitionError struct {
+	From, To string
+}
+
+func (e *transitionError) Error() string {
+	next := kycTransitions[e.From]
+	if len(next) == 0 {
+		return fmt.Sprintf("cannot move from %s to %s: %s is final", e.From, e.To, e.From)
+	}
+	return fmt.Sprintf("cannot move from %s to %s: allowed next statuses are %s", e.From, e.To, strings.Join(next, ", "))
+}
+
+func validStatus(s string) bool {
+	_, ok := kycTransitions[s]
+	return ok
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range kycTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// statusChange is one row of kyc_status_history.
+type statusChange struct {
+	ID        int64     `json:"id"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Actor     string    `json:"actor"`
+	Reason    string    `json:"reason,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// transitionStatus moves user id to status to, recording actor and reason.
+// The row is locked for the duration so concurrent reviewers cannot both
+// act on the same starting status. Illegal moves return *transitionError.
+func transitionStatus(ctx context.Context, db *sql.DB, id int64, to, actor, reason string) (*user, error) {
+	var u *user
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		u, err = transitionStatusTx(ctx, tx, id, to, actor, reason)
+		return err
+	})
+	return u, err
+}
+
+// transitionStatusTx is transitionStatus within tx, for callers that record
+// more alongside the change.
+func transitionStatusTx(ctx context.Context, tx *sql.Tx, id int64, to, actor, reason string) (*user, error) {
+	u, err := scanUser(tx.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1 FOR UPDATE`, id))
+	if err != nil {
+		return nil, err
+	}
+
+	// Rows written before statuses were enforced may have none.
+	from := u.KYCStatus
+	if from == "" {
+		from = statusUploaded
+	}
+	if !canTransition(from, to) {
+		return nil, &transitionError{From: from, To: to}
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET kyc_status = $2 WHERE id = $1`, id, to); err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `
+	INSERT INTO kyc_status_history(user_id, from_status, to_status, actor, reason)
+	VALUES ($1, $2, $3, $4, NULLIF($5, ''))
+	`, id, from, to, actor, reason)
+	if err != nil {
+		return nil, err
+	}
+
+	u.KYCStatus = to
+	return u, nil
+}
+
+// statusHistory returns the status changes of user id, oldest first.
+func statusHistory(ctx context.Context, db *sql.DB, id int64) ([]statusChange, error) {
+	return statusChangesSince(ctx, db, id, 0)
+}
+
+// statusChangesSince returns the status changes of user id recorded after
+// the change with ID afterID, oldest first.
+func statusChangesSince(ctx context.Context, db *sql.DB, id, afterID int64) ([]statusChange, error) {
+	rows, err := db.QueryContext(ctx, `
+	SELECT id, from_status, to_status, actor, COALESCE(reason, ''), changed_at
+	FROM kyc_status_history WHERE user_id = $1 AND id > $2 ORDER BY id
+	`, id, afterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []statusChange{}
+	for rows.Next() {
+		var c statusChange
+		if err := rows.Scan(&c.ID, &c.From, &c.To, &c.Actor, &c.Reason, &c.ChangedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, c)
+	}
+	return history, rows.Err()
+}
+
+func isTransitionError(err error) (*transitionError, bool) {
+	var te *transitionError
+	return te, errors.As(err, &te)
+}
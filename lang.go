@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"client_alb_go_s3_rds/i18n"
+)
+
+/* LANGUAGE */
+
+type languageKey struct{}
+
+// langCookie remembers a language picked with ?lang=, so the form's POST
+// and the pages after it stay in that language.
+const langCookie = "lang"
+
+// withLanguage picks the language of each request's pages and messages:
+// a supported ?lang= parameter, which is then remembered, else the
+// remembered choice, else the best match for Accept-Language.
+func withLanguage(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lang := r.URL.Query().Get("lang")
+		if i18n.Supported(lang) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     langCookie,
+				Value:    lang,
+				Path:     "/",
+				MaxAge:   int((365 * 24 * time.Hour).Seconds()),
+				HttpOnly: true,
+				Secure:   isHTTPS(r),
+				SameSite: http.SameSiteLaxMode,
+			})
+		} else if c, err := r.Cookie(langCookie); err == nil && i18n.Supported(c.Value) {
+			lang = c.Value
+		} else {
+			lang = i18n.Negotiate(r.Header.Get("Accept-Language"))
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), languageKey{}, lang)))
+	}
+}
+
+// language returns the language withLanguage picked, or i18n.Default
+// outside a request.
+func language(ctx context.Context) string {
+	if lang, ok := ctx.Value(languageKey{}).(string); ok {
+		return lang
+	}
+	return i18n.Default
+}
+
+// tr returns the message key in r's language.
+func tr(r *http.Request, key string, args ...any) string {
+	return i18n.T(language(r.Context()), key, args...)
+}
+
+// languageOption is a language offered on a page.
+type languageOption struct {
+	Code    string
+	Name    string
+	Current bool
+}
+
+// languageOptions lists the supported languages, marking lang.
+func languageOptions(lang string) []languageOption {
+	var out []languageOption
+	for _, code := range i18n.Languages() {
+		out = append(out, languageOption{Code: code, Name: i18n.Name(code), Current: code == lang})
+	}
+	return out
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+/* LOG LEVEL AND FORMAT */
+
+// logOutput is installed as the standard logger's output by main.
+var logOutput = newLevelWriter(os.Stderr, "INFO")
+
+var logLevelRank = map[string]int32{"DEBUG": 0, "INFO": 1, "WARN": 2, "ERROR": 3, "FATAL": 4}
+
+// levelWriter drops log lines whose level=X field ranks below the current
+// minimum. Every log line in this service carries that field, so filtering
+// at the writer keeps the plain log.Printf call sites unchanged.
+type levelWriter struct {
+	out  io.Writer
+	min  atomic.Int32
+	json atomic.Bool
+}
+
+func newLevelWriter(out io.Writer, level string) *levelWriter {
+	w := &levelWriter{out: out}
+	w.setLevel(level)
+	return w
+}
+
+func (w *levelWriter) setLevel(level string) {
+	if rank, ok := logLevelRank[level]; ok {
+		w.min.Store(rank)
+	}
+}
+
+// setFormat selects "text" (the key=value lines as written) or "json", which
+// re-encodes each line as one JSON object for log pipelines that expect it.
+func (w *levelWriter) setFormat(format string) {
+	w.json.Store(format == "json")
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	if i := bytes.Index(p, []byte("level=")); i >= 0 {
+		level := p[i+len("level="):]
+		if end := bytes.IndexByte(level, ' '); end >= 0 {
+			level = level[:end]
+		}
+		if rank, ok := logLevelRank[string(level)]; ok && rank < w.min.Load() {
+			return len(p), nil
+		}
+	}
+
+	if w.json.Load() {
+		if _, err := w.out.Write(logLineToJSON(p)); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return w.out.Write(p)
+}
+
+var logKeyPattern = regexp.MustCompile(`(?:^|\s)([a-z_][a-z0-9_]*)=`)
+
+// logLineToJSON converts "2006/01/02 15:04:05 file.go:12: level=INFO k=v ..."
+// into {"time":...,"caller":...,"level":"INFO","k":"v",...}. Values run up
+// to the next " key=", so unquoted values containing spaces survive, and
+// %q-quoted values are unquoted.
+func logLineToJSON(p []byte) []byte {
+	line := strings.TrimRight(string(p), "\n")
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+	field := func(key, val string) {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, _ := json.Marshal(val)
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+
+	start := strings.Index(line, "level=")
+	if start < 0 {
+		field("msg", line)
+		b.WriteString("}\n")
+		return b.Bytes()
+	}
+
+	// The standard logger prefix is "date time caller: ".
+	if prefix := strings.TrimSuffix(strings.TrimSpace(line[:start]), ":"); prefix != "" {
+		if i := strings.LastIndexByte(prefix, ' '); i >= 0 {
+			field("time", prefix[:i])
+			field("caller", prefix[i+1:])
+		} else {
+			field("time", prefix)
+		}
+	}
+
+	body := line[start:]
+	matches := logKeyPattern.FindAllStringSubmatchIndex(body, -1)
+	for i, m := range matches {
+		end := len(body)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		val := body[m[1]:end]
+		if unq, err := strconv.Unquote(val); err == nil {
+			val = unq
+		}
+		field(body[m[2]:m[3]], val)
+	}
+
+	b.WriteString("}\n")
+	return b.Bytes()
+}
@@ -1,204 +1,562 @@
 package main
 
-import(
+import (
+	"bytes"
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	_"github.com/lib/pq"
+	_ "github.com/lib/pq"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"client_alb_go_s3_rds/clamav"
+	"client_alb_go_s3_rds/config"
+	"client_alb_go_s3_rds/flags"
+	"client_alb_go_s3_rds/storage"
 )
 
-/* DATABASE CONNECTION */
-var rdsDB *sql.DB
-var instanceID string
-
-func getEnv(key string) string {
-	val := os.Getenv(key)
-	if val == "" {
-		log.Fatalf("level=FATAL service=go-app error=missing_env_var key=%s", key)
-	}
-	return val
+/* APPLICATION */
+
+// app carries the resolved configuration and shared dependencies into the
+// HTTP handlers.
+type app struct {
+	cfg        *config.Config
+	db         *sql.DB
+	identity   instanceIdentity
+	instanceID string
+	web        fs.FS
+	settings   *settingsStore
+	spool      spool
+	s3         *s3.Client
+	store      storage.Storage
+	sms        *sns.Client
+	disposable *disposableList
+	scanner    *clamav.Client
+
+	// ready is set once the startup self-check passes; draining is set once
+	// shutdown starts. Health checks fail unless ready and not draining, so
+	// the ALB only routes to instances that can actually serve.
+	ready    atomic.Bool
+	draining atomic.Bool
+
+	// dbDown is set while running in degraded mode; submissions are spooled
+	// instead of written to RDS until it clears.
+	dbDown atomic.Bool
+
+	// background counts the degraded-mode recovery and spool replay loops,
+	// which shutdown waits out before closing the database under them.
+	background sync.WaitGroup
 }
 
-func connectDB(prefix string) *sql.DB {
-	dsn := "host=" + getEnv(prefix+"_HOST") +
-	" port=" + getEnv(prefix+"_PORT") +
-	" user=" + getEnv(prefix+"_USER") +
-	" password=" + getEnv(prefix+"_PASSWORD") +
-	" dbname=" + getEnv(prefix+"_NAME") +
-	" sslmode=" + getEnv(prefix+"_SSLMODE")
-
+/* DATABASE CONNECTION */
 
-	db, err := sql.Open("postgres", dsn)
+// connectDB opens the pool and pings it, retrying with backoff within
+// cfg.Retry so a database that is briefly unreachable during a deploy does
+// not crash-loop the instance.
+func connectDB(ctx context.Context, prefix string, cfg config.DBConfig, instanceID string) (*sql.DB, error) {
+	db, err := openDB(ctx, cfg, instanceID)
 	if err != nil {
-		log.Fatalf("level=FATAL service=go-app error=db_open_failed db=%s err=%v", prefix, err)
+		return nil, err
 	}
 
-	if err := db.Ping(); err != nil {
-		log.Fatalf("level=FATAL service=go-app error=db_ping_failed db=%s err=%v", prefix, err)
+	ping := func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, cfg.ConnectTimeout)
+		defer cancel()
+		return db.PingContext(ctx)
+	}
+	onRetry := func(attempt int, err error, wait time.Duration) {
+		log.Printf("level=WARN service=go-app event=db_ping_retry db=%s attempt=%d wait=%s err=%v instance=%s", prefix, attempt, wait, err, instanceID)
+	}
+
+	if err := retry(ctx, cfg.Retry, ping, onRetry); err != nil {
+		db.Close()
+		return nil, err
 	}
 
 	log.Printf("level=INFO service=go-app event=db_connected db=%s instance=%s", prefix, instanceID)
-	return db
+	return db, nil
 }
 
-func initDatabase() {
-	rdsDB = connectDB("RDS_DB")
-	createTable(rdsDB)
+// openDB creates the connection pool, sourcing credentials from an RDS IAM
+// auth token or Secrets Manager when configured.
+func openDB(ctx context.Context, cfg config.DBConfig, instanceID string) (*sql.DB, error) {
+	var connector driver.Connector
+	var err error
+
+	switch {
+	case cfg.IAMAuth:
+		connector, err = newIAMConnector(ctx, cfg)
+	case cfg.SecretARN != "":
+		connector, err = newSecretConnector(ctx, cfg, instanceID)
+	default:
+		return sql.Open("postgres", cfg.DSN())
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(connector), nil
 }
 
-func createTable(db *sql.DB){
-	query := `
-	CREATE TABLE IF NOT EXISTS users(
-		id SERIAL PRIMARY KEY,
-		name TEXT NOT NULL,
-		email TEXT NOT NULL,
-		phone TEXT NOT NULL,
-		document_bucket TEXT NOT NULL,
-		document_key TEXT NOT NULL,
-		kyc_status TEXT,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	)
-	`
+// initDatabase connects to RDS and, when migrate is set, brings the schema
+// up to date. With degraded mode enabled, an unreachable database is not
+// fatal; see startDegraded.
+func (a *app) initDatabase(ctx context.Context, migrate bool) error {
+	db, err := connectDB(ctx, "RDS_DB", a.cfg.DB, a.instanceID)
+	if err != nil && a.spool != nil {
+		return a.startDegraded(ctx, migrate, err)
+	}
+	if err != nil {
+		return err
+	}
+	a.db = db
 
-	if _, err := db.Exec(query); err != nil {
-		log.Fatalf("level=FATAL service=go-app error=create_table_failed err=%v", err)
+	if !migrate {
+		return nil
 	}
 
-	log.Printf("level=INFO service=go-app event=table_ready table=users instance=%s", instanceID)
+	applied, err := migrateUp(ctx, db)
+	for _, m := range applied {
+		log.Printf("level=INFO service=go-app event=migration_applied version=%d name=%s instance=%s", m.version, m.name, a.instanceID)
+	}
+	return err
 }
 
 /* HTTP HANDLERS */
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// formHandler serves the form page. The page carries a per-browser CSRF
+// token and a per-render idempotency key, so it is private to the browser
+// and validated by ETag alone: a browser revalidating its copy gets 304 as
+// long as the page template and its CSRF cookie are unchanged and the key
+// in its copy has not been used for a submission yet. Once it has, a fresh
+// page with a new key is sent, so a second submission is not mistaken for
+// a retry of the first.
+func (a *app) formHandler(w http.ResponseWriter, r *http.Request) {
+	t, src, err := a.formTemplate(r)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=form_unavailable err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		a.writeServerError(w, r)
 		return
 	}
 
-	// Optional: check DB connectivity
-	if err := rdsDB.Ping(); err != nil {
-		http.Error(w, "Database connection failed", http.StatusServiceUnavailable)
-		return
+	page := a.newFormPage(r, csrfToken(w, r), "")
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	version := page.version(src)
+	for _, tag := range ifNoneMatch(r) {
+		key, ok := strings.CutPrefix(tag, "form-"+version+"-")
+		if ok && key != "" && a.idempotencyKeyUnused(r.Context(), key) {
+			w.Header().Set("ETag", `"`+tag+`"`)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	page.IdempotencyKey = newUUID()
+	w.Header().Set("ETag", `"form-`+version+"-"+page.IdempotencyKey+`"`)
+	a.writeForm(w, r, t, http.StatusOK, page)
 }
 
-func formHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		log.Printf("level=WARN service=go-app event=invalid_method path=/ method=%s instance=%s", r.Method, instanceID)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// rejectSubmission answers a submission whose fields are invalid: the form
+// again, filled in as it was sent and with each error next to its field,
+// for browsers, and a problem listing errs otherwise.
+func (a *app) rejectSubmission(w http.ResponseWriter, r *http.Request, c contactFields, errs []fieldError) {
+	t, _, err := a.formTemplate(r)
+	if err != nil || !wantsHTML(r) {
+		writeFieldErrors(w, r, errs)
 		return
 	}
+	w.Header().Set("Cache-Control", "no-store")
+	a.writeForm(w, r, t, http.StatusBadRequest, a.filledFormPage(w, r, c, errs))
+}
 
-	log.Printf("level=INFO service=go-app event=serve_form path=/ instance=%s", instanceID)
-	http.ServeFile(w, r, "index.html")
+// filledFormPage returns the page data for showing the form again after
+// the post r, filled in with c and with errs next to their fields.
+func (a *app) filledFormPage(w http.ResponseWriter, r *http.Request, c contactFields, errs []fieldError) formPage {
+	// The key was not claimed, so the corrected form may reuse it.
+	key := r.FormValue("idempotency_key")
+	if key == "" {
+		key = newUUID()
+	}
+	page := a.newFormPage(r, csrfToken(w, r), key)
+	page.Values, page.Errors = c, localizeFieldErrors(page.Lang, errs)
+	if c.PhoneRaw != "" {
+		page.Values.Phone = c.PhoneRaw
+	}
+	page.OTPID = r.PostFormValue(otpIDField)
+	page.IDDocument = r.PostFormValue(idDocumentField)
+	page.ConsentGiven = r.PostFormValue(consentField) == consentAcceptedText && r.PostFormValue(policyVersionField) == page.Policy.Version
+	return page
 }
 
-func submitHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		log.Printf("level=WARN service=go-app event=invalid_method path=/submit method=%s instance=%s", r.Method, instanceID)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+func (a *app) submitHandler(w http.ResponseWriter, r *http.Request) {
+	contact, errs := validateContact(contactFields{Name: r.FormValue("name"), Email: r.FormValue("email"), Phone: r.FormValue("phone")}, a.cfg.Phone.DefaultRegion)
+	disposable, disposableErr := a.checkDisposableEmail(r, contact.Email)
+	if disposableErr != nil {
+		errs = append(errs, *disposableErr)
+	}
+	consent, consentErr := a.checkConsent(r)
+	if consentErr != nil {
+		errs = append(errs, *consentErr)
+	}
+	if len(errs) > 0 {
+		a.rejectSubmission(w, r, contact, errs)
+		return
+	}
+	if e := a.checkPhoneOTP(r, contact.Phone); e != nil {
+		a.rejectSubmission(w, r, contact, []fieldError{*e})
 		return
 	}
 
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+	// A retried submission gets the first attempt's result and uploads
+	// nothing.
+	claim, ok := a.claimIdempotency(w, r)
+	if !ok {
 		return
 	}
+	defer claim.release(r.Context())
 
-	file, header, err := r.FormFile("kyc_document")
+	// With direct uploads the browser already put the documents in S3 and
+	// only sends their keys; otherwise the files come with the form.
+	docs, err := a.checkFormDocuments(r, a.cfg.Docs.Tier)
 	if err != nil {
-		http.Error(w, "Failed to read KYC document", http.StatusBadRequest)
+		writeDocumentError(w, r, err)
+		return
+	}
+
+	name, email, phone := contact.Name, contact.Email, contact.Phone
+
+	sub := submission{
+		Reference: newReference(),
+		Name:      name,
+		Email:     email,
+		Phone:     phone,
+		PhoneRaw:  contact.PhoneRaw,
+		Tier:      a.cfg.Docs.Tier,
+		Status:    statusUploaded,
+		CreatedAt: time.Now(),
+
+		VerifyEmail: a.emailVerification(),
+		Lang:        language(r.Context()),
+		Consent:     consent,
+
+		DisposableEmail: disposable,
+	}
+	sub.setDocuments(docs)
+
+	// In async mode the files are queued with the submission and workers
+	// upload them, so the browser does not wait on S3. Should queueing
+	// fail, the submission is processed here as usual.
+	if flags.Enabled(r.Context(), flagAsyncSubmit) && !a.dbDown.Load() {
+		err := a.enqueueSubmission(r, sub)
+		if err == nil {
+			log.Printf("level=INFO service=go-app event=submission_queued reference=%s request_id=%s instance=%s", sub.Reference, requestID(r.Context()), a.instanceID)
+			w.Header().Set("Location", statusURL(sub.Reference))
+			a.writeReceipt(w, r, claim, 0, http.StatusAccepted, submitReceipt{
+				Reference: sub.Reference,
+				Status:    jobQueued,
+				Message:   tr(r, "receipt.queued"),
+				StatusURL: statusURL(sub.Reference),
+				Instance:  a.identity.String(),
+			})
+			return
+		}
+		var de *documentError
+		if errors.As(err, &de) {
+			writeDocumentError(w, r, err)
+			return
+		}
+		log.Printf("level=ERROR service=go-app event=submission_queue_failed err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+	}
+
+	if err := a.uploadFormFiles(r, sub.Reference, sub.Documents); err != nil {
+		writeDocumentError(w, r, err)
 		return
 	}
-	defer file.Close()
+	sub.setDocuments(sub.Documents)
 
-	bucket, key, err := uploadToS3(file, header.Filename)
+	var id int64
+	err = errDatabaseDown
+	if !a.dbDown.Load() {
+		id, err = insertUser(r.Context(), a.db, sub)
+	}
 	if err != nil {
-    	log.Printf("level=ERROR service=go-app event=s3_upload_failed err=%v instance=%s", err, instanceID)
-    	http.Error(w, "Failed to upload document to S3", http.StatusInternalServerError)
-    	return
+		log.Printf("level=ERROR service=go-app event=db_insert_failed name=%s email=%s phone=%s err=%v request_id=%s instance=%s", name, email, phone, err, requestID(r.Context()), a.instanceID)
+		if a.trySpool(r.Context(), sub, err) {
+			a.writeReceipt(w, r, claim, 0, http.StatusAccepted, submitReceipt{
+				Reference: sub.Reference,
+				Status:    "pending",
+				Message:   tr(r, "receipt.spooled"),
+				StatusURL: statusURL(sub.Reference),
+				Instance:  a.identity.String(),
+			})
+			return
+		}
+		writeProblem(w, r, probDatabase, "failed to store submission")
+		return
 	}
 
-	name := r.FormValue("name")
-	email := r.FormValue("email")
-	phone := r.FormValue("phone")
+	log.Printf("level=INFO service=go-app event=user_created reference=%s name=%s email=%s phone=%s request_id=%s instance=%s", sub.Reference, name, email, phone, requestID(r.Context()), a.instanceID)
+	a.writeReceipt(w, r, claim, id, http.StatusOK, submitReceipt{
+		Reference: sub.Reference,
+		Status:    sub.Status,
+		Message:   tr(r, "receipt.stored"),
+		StatusURL: statusURL(sub.Reference),
+		Instance:  a.identity.String(),
+	})
+}
 
-	query := `
-	INSERT INTO users(name, email, phone, document_bucket, document_key, kyc_status)
-	VALUES ($1, $2, $3, $4, $5, $6)
-	`
+// submitReceipt is the /submit response: the reference number the
+// applicant keeps to follow up on their submission.
+type submitReceipt struct {
+	Reference string `json:"reference"`
+	Status    string `json:"status"`
+	Message   string `json:"message"`
+	StatusURL string `json:"status_url"`
+	Instance  string `json:"instance"`
+}
 
-	if _, err := rdsDB.Exec(query, name, email, phone, bucket, key, "KYC_UPLOADED"); err != nil {
-		log.Printf("level=ERROR service=go-app event=db_insert_failed name=%s email=%s phone=%s err=%v instance=%s", name, email, phone, err, instanceID)
-		http.Error(w, "Failed to store data in RDS", http.StatusInternalServerError)
-		return
+// writeReceipt answers a submission, as a page for browsers and JSON
+// otherwise, and records the answer against its idempotency key, if any.
+func (a *app) writeReceipt(w http.ResponseWriter, r *http.Request, claim *idempotencyClaim, userID int64, status int, receipt submitReceipt) {
+	contentType, body := "application/json", []byte(nil)
+	var page bytes.Buffer
+	if t, _, err := a.pageTemplate(r, "receipt.html"); err == nil && wantsHTML(r) && t.Execute(&page, pageData{language(r.Context()), receipt}) == nil {
+		contentType, body = "text/html; charset=utf-8", page.Bytes()
+	} else {
+		body, _ = json.Marshal(receipt)
 	}
 
-	log.Printf("level=INFO service=go-app event=user_created name=%s email=%s phone=%s instance=%s", name, email, phone, instanceID)
-	w.Write([]byte("User data stored by instance: "+instanceID))
+	claim.complete(r.Context(), userID, status, contentType, string(body))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(body)
 }
 
-func uploadToS3(file multipart.File, filename string) (string, string, error) {
-	bucket := getEnv("S3_BUCKET_NAME")
+// uploadDocument stores file, named filename and of the detected
+// contentType, as a document of the submission reference, and returns where
+// it went: its bucket, key, storage class, version ID in a versioned
+// bucket, and Object Lock.
+// The store checks what it receives against sum, the file's SHA-256, where
+// it can. A document that is already stored is not uploaded again; see
+// dedupe.go. What was stored is checked against what was sent; see
+// verify.go. While documents are scanned for malware it goes into
+// quarantine until found clean, and is locked only then; see scan.go.
+func (a *app) uploadDocument(ctx context.Context, file io.Reader, size int64, sum []byte, filename, contentType, reference, tagging string) (submittedDocument, error) {
+	if d, ok := a.existingDocument(ctx, size, sum); ok {
+		if err := a.lockDocument(ctx, &d); err != nil {
+			return submittedDocument{}, err
+		}
+		return d, nil
+	}
+
+	now := time.Now()
+	var bucket string
+	key := a.templateKey(reference, filename, now)
+	retainUntil := a.retainUntil(now)
+	if a.quarantining() {
+		bucket, key = a.uploadBucket(), a.quarantineKey(key)
+		retainUntil = time.Time{}
+	}
 
-	cfg, err := config.LoadDefaultConfig(
-    context.TODO(),
-    config.WithRegion("ap-south-1"),
-	)
+	obj, err := a.store.Put(ctx, storage.PutInput{
+		Bucket:             bucket,
+		Key:                key,
+		Body:               file,
+		Size:               size,
+		SHA256:             sum,
+		ContentType:        contentType,
+		ContentDisposition: documentDisposition(filename),
+		Metadata:           documentMetadata(reference, filename, now),
+		Tagging:            tagging,
+		StorageClass:       a.cfg.S3.StorageClass,
+		LockMode:           a.cfg.S3.ObjectLockMode,
+		RetainUntil:        retainUntil,
+	})
 	if err != nil {
-		return "", "", err
+		return submittedDocument{}, err
+	}
+	if err := a.verifyStored(ctx, obj, size, sum); err != nil {
+		return submittedDocument{}, err
 	}
 
-	client := s3.NewFromConfig(cfg)
+	d := submittedDocument{Bucket: obj.Bucket, Key: obj.Key, StorageClass: a.cfg.S3.StorageClass, VersionID: obj.VersionID}
+	a.setRetention(&d, retainUntil)
+	return d, nil
+}
 
-	key := "kyc-docs/" + time.Now().Format("20060102-150405") + "-" + filepath.Base(filename)
+// newS3Client returns a client for the S3 bucket of cfg in S3_REGION. It is
+// built once at startup and shared as app.s3: the client is safe for
+// concurrent use and keeps its credentials and connections between
+// requests. With S3_ROLE_ARN set, it assumes that role with the instance's
+// credentials, for a bucket in another account, and assumes it again
+// before the session ends.
+func newS3Client(ctx context.Context, cfg config.S3Config, instanceID string) (*s3.Client, error) {
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(cfg.Region))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RoleARN != "" {
+		role := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsCfg), cfg.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = roleSessionName(instanceID)
+			o.Duration = config.S3RoleSession
+			if cfg.RoleExternalID != "" {
+				o.ExternalID = aws.String(cfg.RoleExternalID)
+			}
+		})
+		// Renewed while a presigned URL's lifetime is left, so no URL
+		// outlives the credentials that signed it.
+		awsCfg.Credentials = aws.NewCredentialsCache(role, func(o *aws.CredentialsCacheOptions) {
+			o.ExpiryWindow = cfg.PresignExpiry
+		})
+	}
 
-	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(bucket),
-		Key: aws.String(key),
-		Body: file,
-	})
+	return s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.EndpointURL != "" {
+			o.BaseEndpoint = aws.String(cfg.EndpointURL)
+		}
+		o.UsePathStyle = cfg.UsePathStyle
+		o.Retryer = newS3Retryer(cfg)
+		o.HTTPClient = newS3Guard(awsCfg.HTTPClient, cfg, instanceID)
+	}), nil
+}
 
+// roleSessionName names the sessions of S3_ROLE_ARN after the instance, so
+// the bucket account's CloudTrail shows which instance made each call. STS
+// takes up to 64 letters, digits and +=,.@- characters.
+func roleSessionName(instanceID string) string {
+	name := []byte("kyc-app-" + instanceID)
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("+=,.@-_", c) >= 0) {
+			name[i] = '-'
+		}
+	}
+	return string(name[:min(len(name), 64)])
+}
+
+// accelerationEnabled reports whether bucket has Transfer Acceleration
+// enabled. When it has not, or S3 will not say, the app falls back to the
+// standard endpoint rather than failing every upload.
+func accelerationEnabled(ctx context.Context, client *s3.Client, bucket, instanceID string) bool {
+	out, err := client.GetBucketAccelerateConfiguration(ctx, &s3.GetBucketAccelerateConfigurationInput{Bucket: aws.String(bucket)})
 	if err != nil {
-		return "", "", err
+		log.Printf("level=WARN service=go-app event=s3_accelerate_fallback bucket=%s err=%v instance=%s", bucket, err, instanceID)
+		return false
+	}
+	if out.Status != types.BucketAccelerateStatusEnabled {
+		log.Printf("level=WARN service=go-app event=s3_accelerate_fallback bucket=%s status=%q instance=%s", bucket, out.Status, instanceID)
+		return false
+	}
+	log.Printf("level=INFO service=go-app event=s3_accelerate_enabled bucket=%s instance=%s", bucket, instanceID)
+	return true
+}
+
+// accelerated is a client option sending the call through the bucket's
+// Transfer Acceleration endpoint while S3_ACCELERATE is in effect.
+func (a *app) accelerated(o *s3.Options) {
+	o.UseAccelerate = a.cfg.S3.Accelerate
+}
+
+// newStorage returns the document store STORAGE_BACKEND selects and, for
+// the backends that speak the whole S3 API, the S3 client behind it, which
+// the features only S3 has use; it is nil otherwise. Documents larger than
+// S3_UPLOAD_PART_SIZE go up as multipart uploads, their parts in parallel.
+// With CLOUDFRONT_DOMAIN set, document URLs are CloudFront signed URLs.
+// S3_ACCELERATE is turned off in cfg when the bucket, or the quarantine
+// bucket uploads go to, does not have acceleration enabled, so every upload
+// uses the standard endpoint.
+func newStorage(ctx context.Context, cfg *config.Config, instanceID string) (storage.Storage, *s3.Client, error) {
+	if cfg.Storage.Backend == "local" {
+		return &storage.Local{Dir: cfg.Storage.LocalDir, Bucket: cfg.S3.Bucket}, nil, nil
 	}
 
-	return bucket, key, nil
+	client, err := newS3Client(ctx, cfg.S3, instanceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.S3.Accelerate {
+		for _, bucket := range []string{cfg.S3.Bucket, cfg.S3.QuarantineBucket} {
+			if bucket != "" && !accelerationEnabled(ctx, client, bucket, instanceID) {
+				cfg.S3.Accelerate = false
+				break
+			}
+		}
+	}
+	// GCS's XML API has no SSE-KMS, checksums, S3 storage classes or tags.
+	full := cfg.Storage.FullS3()
+	var store storage.Storage = storage.NewS3(client, storage.S3Options{
+		Bucket:         cfg.S3.Bucket,
+		PartSize:       cfg.S3.PartSize,
+		Concurrency:    cfg.S3.UploadConcurrency,
+		Encrypt:        full,
+		KMSKeyID:       cfg.S3.KMSKeyID,
+		Checksums:      full,
+		StorageClasses: full,
+		Tags:           full,
+		Accelerate:     cfg.S3.Accelerate,
+	})
+	if cfg.CloudFront.Domain != "" {
+		key, err := storage.LoadCloudFrontKey(cfg.CloudFront.PrivateKeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("CLOUDFRONT_PRIVATE_KEY_FILE: %w", err)
+		}
+		store = &storage.CloudFront{
+			Storage:   store,
+			Domain:    cfg.CloudFront.Domain,
+			Bucket:    cfg.S3.Bucket,
+			KeyPairID: cfg.CloudFront.KeyPairID,
+			Key:       key,
+		}
+	}
+	if !full {
+		return store, nil, nil
+	}
+	return store, client, nil
 }
 
 /* MAIN */
 func main() {
 	// log format: timestamp + file:line
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	log.SetOutput(logOutput)
 
-	host, err := os.Hostname()
-	if err != nil {
-		instanceID = "unknown-instance"
-	} else {
-		instanceID = host
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
 	}
 
-	log.Printf("level=INFO service=go-app event=app_start instance=%s", instanceID)
-
-	initDatabase()
-
-	http.HandleFunc("/", formHandler)
-	http.HandleFunc("/submit", submitHandler)
-	http.HandleFunc("/health", healthHandler)
-
-	log.Printf("level=INFO service=go-app event=server_started port=8080 instance=%s", instanceID)
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	switch cmd {
+	case "serve":
+		runServe(args)
+	case "migrate":
+		runMigrate(args)
+	case "healthcheck":
+		runHealthcheck(args)
+	case "reconcile":
+		runReconcile(args)
+	case "help", "-h", "-help", "--help":
+		usage()
+	default:
+		usage()
+		os.Exit(2)
+	}
 }
-
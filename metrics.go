@@ -0,0 +1,28 @@
+package main
+
+import (
+	"expvar"
+)
+
+/* METRICS */
+
+// Counters exported through expvar at /debug/vars.
+var (
+	metricPanics       = expvar.NewInt("http_panics_total")
+	metricThrottled    = expvar.NewInt("http_throttled_total")
+	metricBodyTooLarge = expvar.NewInt("http_body_too_large_total")
+
+	metricCaptchaFailures  = expvar.NewInt("captcha_failures_total")
+	metricSpamSubmissions  = expvar.NewInt("spam_submissions_total")
+	metricDisposableEmails = expvar.NewInt("disposable_emails_total")
+
+	metricUploadFailures        = expvar.NewInt("s3_upload_failures_total")
+	metricUploadMismatches      = expvar.NewInt("s3_upload_mismatches_total")
+	metricDocumentsDeduplicated = expvar.NewInt("documents_deduplicated_total")
+	metricDocumentsScanned      = expvar.NewInt("documents_scanned_total")
+	metricDocumentsInfected     = expvar.NewInt("documents_infected_total")
+	metricThumbnailsMade        = expvar.NewInt("thumbnails_made_total")
+
+	metricS3BreakerTrips = expvar.NewInt("s3_breaker_trips_total")
+	metricS3Rejected     = expvar.NewInt("s3_breaker_rejected_total")
+)
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* MIDDLEWARE */
+
+// routeGroup names a set of routes that share a middleware stack.
+type routeGroup string
+
+const (
+	groupForm  routeGroup = "form"
+	groupOps   routeGroup = "ops"
+	groupAPI   routeGroup = "api"
+	groupDocs  routeGroup = "docs"
+	groupAdmin routeGroup = "admin"
+	groupHooks routeGroup = "webhooks"
+)
+
+// globalMiddleware runs for every request, matched or not, first outermost.
+func (a *app) globalMiddleware() []middleware {
+	mws := []middleware{withRequestID, withLanguage, a.logAccess, a.securityHeaders, a.recoverPanics, a.cors}
+	if a.cfg.HTTP.CompressMinBytes > 0 {
+		mws = append(mws, a.compress)
+	}
+	return mws
+}
+
+// groupMiddleware returns the stack shared by every route in g. It runs
+// before the route's auth check, so limits apply to unauthenticated
+// requests too.
+func (a *app) groupMiddleware(g routeGroup) []middleware {
+	switch g {
+	case groupForm, groupAPI, groupAdmin, groupHooks:
+		return []middleware{a.limitBody}
+	default:
+		return nil
+	}
+}
+
+// closedForMaintenance rejects submissions while maintenance mode is on:
+// browsers get the maintenance page, API clients a problem, both with a
+// Retry-After hint.
+func (a *app) closedForMaintenance(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		settings := a.settings.get()
+		if !settings.Maintenance {
+			next(w, r)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			w.Header().Set("Retry-After", strconv.Itoa(int(settings.MaintenanceRetryAfter.Seconds())))
+			writeProblem(w, r, probMaintenance, "submissions are temporarily unavailable")
+			return
+		}
+		a.serveMaintenance(w, r, settings.MaintenanceRetryAfter)
+	}
+}
+
+// statusWriter records the status and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// logAccess writes one line per request. Health probes arrive every few
+// seconds per target group, so they are logged at DEBUG.
+func (a *app) logAccess(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next(sw, r)
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := "INFO"
+		switch {
+		case status >= 500:
+			level = "ERROR"
+		case r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || r.URL.Path == "/health":
+			level = "DEBUG"
+		}
+
+		log.Printf("level=%s service=go-app event=http_request method=%s path=%q status=%d bytes=%d duration_ms=%.1f client_ip=%s user_agent=%q request_id=%s instance=%s",
+			level, r.Method, r.URL.Path, status, sw.bytes, float64(time.Since(start).Microseconds())/1000, a.clientIP(r), r.UserAgent(), requestID(r.Context()), a.instanceID)
+	}
+}
+
+// clientIP returns the address of the client. Each proxy appends the
+// address it accepted the connection from to X-Forwarded-For, so walking it
+// from the right past trusted proxies finds the first hop nobody we trust
+// vouches for beyond; anything earlier is whatever the client sent.
+func (a *app) clientIP(r *http.Request) string {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0 && a.trustedProxy(addr); i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			break
+		}
+		addr = hop
+	}
+	return addr
+}
+
+func (a *app) trustedProxy(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, p := range a.cfg.HTTP.TrustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// recoverPanics turns a handler panic into a logged stack trace, a metric
+// and a 500, instead of an aborted connection with no diagnostics.
+func (a *app) recoverPanics(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw, ok := w.(*statusWriter)
+		if !ok {
+			sw = &statusWriter{ResponseWriter: w}
+		}
+
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// Deliberate abort; let net/http drop the connection quietly.
+				panic(v)
+			}
+
+			metricPanics.Add(1)
+			log.Printf("level=ERROR service=go-app event=panic method=%s path=%s err=%q stack=%q request_id=%s instance=%s", r.Method, r.URL.Path, fmt.Sprint(v), debug.Stack(), requestID(r.Context()), a.instanceID)
+
+			if sw.status != 0 {
+				// Headers are already out; all we can do is cut the response short.
+				panic(http.ErrAbortHandler)
+			}
+			a.writeServerError(sw, r)
+		}()
+
+		next(sw, r)
+	}
+}
+
+// wantsHTML reports whether the client is a browser navigating, judged by
+// text/html appearing in Accept ahead of any JSON type.
+func wantsHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	html := strings.Index(accept, "text/html")
+	if html < 0 {
+		return false
+	}
+	json := strings.Index(accept, "json")
+	return json < 0 || html < json
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strconv"
+)
+
+/* SCHEMA MIGRATIONS */
+
+// The schema is built by versioned, reversible migrations, each a pair of
+// SQL files in migrations/: NNNN_name.up.sql applies it and
+// NNNN_name.down.sql reverts it. Add a new pair with the next version
+// number; never edit one that has shipped. schema_migrations records the
+// versions applied. They are applied by "migrate up", or at startup unless
+// -migrate=false, under an advisory lock, so instances starting together
+// apply each migration once.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migration is one versioned, reversible schema change.
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// migrations lists the migrations in migrations/, in version order.
+var migrations = loadMigrations(migrationFiles)
+
+// migrationFile matches the name of a migration's SQL file.
+var migrationFile = regexp.MustCompile(`^(\d{4})_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// loadMigrations reads the migrations in the migrations directory of fsys.
+// The files are embedded in the binary, so a misnamed or missing one is a
+// build mistake and panics.
+func loadMigrations(fsys fs.FS) []migration {
+	entries, err := fs.ReadDir(fsys, "migrations")
+	if err != nil {
+		panic(err)
+	}
+	var list []migration
+	for _, e := range entries {
+		m := migrationFile.FindStringSubmatch(e.Name())
+		if m == nil {
+			panic(fmt.Sprintf("migrations/%s: not NNNN_name.up.sql or NNNN_name.down.sql", e.Name()))
+		}
+		version, _ := strconv.Atoi(m[1])
+		// Files are listed in name order, so a version's files follow
+		// one another and versions come in order.
+		if len(list) == 0 || list[len(list)-1].version != version {
+			if version != len(list)+1 {
+				panic(fmt.Sprintf("migrations/%s: version %d follows %d", e.Name(), version, len(list)))
+			}
+			list = append(list, migration{version: version, name: m[2]})
+		}
+		cur := &list[len(list)-1]
+		if cur.name != m[2] {
+			panic(fmt.Sprintf("migrations/%s: version %d is already named %s", e.Name(), version, cur.name))
+		}
+		data, err := fs.ReadFile(fsys, "migrations/"+e.Name())
+		if err != nil {
+			panic(err)
+		}
+		if m[3] == "up" {
+			cur.up = string(data)
+		} else {
+			cur.down = string(data)
+		}
+	}
+	for _, m := range list {
+		if m.up == "" || m.down == "" {
+			panic(fmt.Sprintf("migrations: version %d_%s needs both an up and a down file", m.version, m.name))
+		}
+	}
+	return list
+}
+
+// migrationLock is the name of the advisory lock migrations run under.
+const migrationLock = "schema_migrations"
+
+// withMigrationLock runs fn on a connection of db holding the migration
+// advisory lock, waiting for another instance's migrations to finish
+// first. The lock is a session lock, so a connection that cannot release
+// it is discarded rather than returned to the pool still holding it.
+func withMigrationLock(ctx context.Context, db *sql.DB, fn func(*sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock(hashtext($1))`, migrationLock); err != nil {
+		return fmt.Errorf("migration lock: %w", err)
+	}
+	err = fn(conn)
+	if _, unlockErr := conn.ExecContext(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock(hashtext($1))`, migrationLock); unlockErr != nil {
+		conn.Raw(func(any) error { return driver.ErrBadConn })
+	}
+	return err
+}
+
+// queryer is what reading the migration state needs: a *sql.DB, or the
+// *sql.Conn holding the migration lock.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func ensureMigrationsTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_migrations(
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)
+	`)
+	return err
+}
+
+// appliedVersions returns the set of migration versions recorded in the DB.
+// It is read-only, so readiness probes can call it; a database that has
+// never been migrated simply has no applied versions.
+func appliedVersions(ctx context.Context, db queryer) (map[int]bool, error) {
+	applied := map[int]bool{}
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return applied, nil
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		applied[v] = true
+	}
+	return applied, rows.Err()
+}
+
+// pendingMigrations lists migrations not yet applied, in order.
+func pendingMigrations(ctx context.Context, db queryer) ([]migration, error) {
+	applied, err := appliedVersions(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []migration
+	for _, m := range migrations {
+		if !applied[m.version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// migrateUp applies every pending migration, each in its own transaction,
+// and returns the ones it applied. Those pending are read once the lock is
+// held, so an instance that waited for another's finds none left.
+func migrateUp(ctx context.Context, db *sql.DB) ([]migration, error) {
+	var applied []migration
+	err := withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		if err := ensureMigrationsTable(ctx, conn); err != nil {
+			return err
+		}
+
+		pending, err := pendingMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range pending {
+			err := inTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, m.up); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations(version, name) VALUES ($1, $2)`, m.version, m.name)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.version, m.name, err)
+			}
+			applied = append(applied, m)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// migrateDown reverts up to steps of the most recently applied migrations
+// and returns the ones it reverted.
+func migrateDown(ctx context.Context, db *sql.DB, steps int) ([]migration, error) {
+	var reverted []migration
+	err := withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			m := migrations[i]
+			if !applied[m.version] {
+				continue
+			}
+
+			err := inTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, m.down); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("revert %d_%s: %w", m.version, m.name, err)
+			}
+			reverted = append(reverted, m)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// txBeginner is a *sql.DB or a *sql.Conn.
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// inTx runs fn in a transaction, committing on success.
+func inTx(ctx context.Context, db txBeginner, fn func(*sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS users(
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	email TEXT NOT NULL,
+	phone TEXT NOT NULL,
+	document_bucket TEXT NOT NULL,
+	document_key TEXT NOT NULL,
+	kyc_status TEXT,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS spool_id TEXT UNIQUE;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS users_lower_email_idx;
+DROP INDEX IF EXISTS users_kyc_status_created_at_id_idx;
+DROP INDEX IF EXISTS users_created_at_id_idx;
@@ -0,0 +1,3 @@
+CREATE INDEX IF NOT EXISTS users_created_at_id_idx ON users(created_at, id);
+CREATE INDEX IF NOT EXISTS users_kyc_status_created_at_id_idx ON users(kyc_status, created_at, id);
+CREATE INDEX IF NOT EXISTS users_lower_email_idx ON users(lower(email));
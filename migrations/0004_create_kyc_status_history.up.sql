@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS kyc_status_history(
+	id BIGSERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	from_status TEXT NOT NULL,
+	to_status TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	reason TEXT,
+	changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS kyc_status_history_user_id_idx ON kyc_status_history(user_id, id);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS document_deletions(
+	id BIGSERIAL PRIMARY KEY,
+	bucket TEXT NOT NULL,
+	object_key TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS document_access_log(
+	id BIGSERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	action TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	bucket TEXT NOT NULL,
+	object_key TEXT NOT NULL,
+	expires_at TIMESTAMP,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS document_access_log_user_id_idx ON document_access_log(user_id, created_at);
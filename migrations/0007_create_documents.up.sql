@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS documents(
+	id BIGSERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	doc_type TEXT NOT NULL,
+	bucket TEXT NOT NULL,
+	object_key TEXT NOT NULL,
+	filename TEXT NOT NULL DEFAULT '',
+	content_type TEXT NOT NULL DEFAULT '',
+	size_bytes BIGINT NOT NULL DEFAULT 0,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS documents_user_id_idx ON documents(user_id, id);
+CREATE INDEX IF NOT EXISTS documents_object_key_idx ON documents(object_key);
+INSERT INTO documents(user_id, doc_type, bucket, object_key, created_at)
+SELECT id, 'kyc_document', document_bucket, document_key, COALESCE(created_at, CURRENT_TIMESTAMP) FROM users;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys(
+	idempotency_key TEXT PRIMARY KEY,
+	user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	status_code INTEGER,
+	content_type TEXT,
+	body TEXT,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
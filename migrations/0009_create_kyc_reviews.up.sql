@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS kyc_reviews(
+	id BIGSERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	decision TEXT NOT NULL,
+	reviewer TEXT NOT NULL,
+	reason_code TEXT NOT NULL,
+	notes TEXT NOT NULL DEFAULT '',
+	reviewed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS kyc_reviews_user_id_idx ON kyc_reviews(user_id, id);
@@ -0,0 +1,5 @@
+-- pg_trgm ships with RDS; creating it needs the rds_superuser role.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX IF NOT EXISTS users_name_trgm_idx ON users USING gin (name gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS users_email_trgm_idx ON users USING gin (email gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS users_phone_digits_trgm_idx ON users USING gin ((regexp_replace(phone, '[^0-9]', '', 'g')) gin_trgm_ops);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS users_reference_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS reference;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS webhook_events(
+	id BIGSERIAL PRIMARY KEY,
+	provider TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	event_type TEXT NOT NULL,
+	user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	payload TEXT NOT NULL,
+	signature TEXT NOT NULL,
+	outcome TEXT NOT NULL,
+	received_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (provider, event_id)
+);
+CREATE INDEX IF NOT EXISTS webhook_events_user_id_idx ON webhook_events(user_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS submission_job_files;
+DROP TABLE IF EXISTS submission_jobs;
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS submission_jobs(
+	id TEXT PRIMARY KEY,
+	reference TEXT NOT NULL UNIQUE,
+	payload TEXT NOT NULL,
+	state TEXT NOT NULL DEFAULT 'queued',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	run_after TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS submission_jobs_queued_idx ON submission_jobs(run_after) WHERE state = 'queued';
+CREATE TABLE IF NOT EXISTS submission_job_files(
+	job_id TEXT NOT NULL REFERENCES submission_jobs(id) ON DELETE CASCADE,
+	doc_type TEXT NOT NULL,
+	filename TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	data BYTEA NOT NULL,
+	PRIMARY KEY (job_id, doc_type)
+);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS upload_progress(
+	token TEXT PRIMARY KEY,
+	bytes_received BIGINT NOT NULL DEFAULT 0,
+	bytes_total BIGINT,
+	state TEXT NOT NULL,
+	updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
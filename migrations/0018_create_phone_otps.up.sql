@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS phone_otps(
+	id TEXT PRIMARY KEY,
+	phone TEXT NOT NULL,
+	code_hash TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	expires_at TIMESTAMP NOT NULL,
+	verified_at TIMESTAMP,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS phone_otps_phone_created_at_idx ON phone_otps(phone, created_at);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS consents(
+	id BIGSERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	policy_version TEXT NOT NULL,
+	accepted_at TIMESTAMP NOT NULL,
+	client_ip TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS consents_user_id_idx ON consents(user_id);
@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN IF EXISTS kyc_tier;
+ALTER TABLE documents DROP COLUMN IF EXISTS category;
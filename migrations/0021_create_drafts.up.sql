@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS drafts(
+	token_hash TEXT PRIMARY KEY,
+	data JSONB NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS drafts_expires_at_idx ON drafts(expires_at);
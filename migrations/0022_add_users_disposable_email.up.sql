@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disposable_email BOOLEAN NOT NULL DEFAULT FALSE;
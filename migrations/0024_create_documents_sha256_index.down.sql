@@ -0,0 +1 @@
+DROP INDEX IF EXISTS documents_sha256_idx;
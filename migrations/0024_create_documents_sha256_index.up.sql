@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS documents_sha256_idx ON documents(sha256) WHERE sha256 IS NOT NULL;
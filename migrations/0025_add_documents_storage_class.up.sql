@@ -0,0 +1 @@
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS storage_class TEXT NOT NULL DEFAULT 'STANDARD';
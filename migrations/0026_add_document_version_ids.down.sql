@@ -0,0 +1,2 @@
+ALTER TABLE document_deletions DROP COLUMN IF EXISTS version_id;
+ALTER TABLE documents DROP COLUMN IF EXISTS version_id;
@@ -0,0 +1,2 @@
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS version_id TEXT;
+ALTER TABLE document_deletions ADD COLUMN IF NOT EXISTS version_id TEXT;
@@ -0,0 +1,2 @@
+ALTER TABLE documents DROP COLUMN IF EXISTS replaced_by;
+ALTER TABLE documents DROP COLUMN IF EXISTS replaced_at;
@@ -0,0 +1,2 @@
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS replaced_at TIMESTAMP;
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS replaced_by TEXT;
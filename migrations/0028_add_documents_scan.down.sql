@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS documents_unscanned_idx;
+ALTER TABLE documents DROP COLUMN IF EXISTS scanned_at;
+ALTER TABLE documents DROP COLUMN IF EXISTS scan_signature;
+ALTER TABLE documents DROP COLUMN IF EXISTS scan_status;
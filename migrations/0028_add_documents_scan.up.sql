@@ -0,0 +1,4 @@
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS scan_status TEXT;
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS scan_signature TEXT;
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS scanned_at TIMESTAMP;
+CREATE INDEX IF NOT EXISTS documents_unscanned_idx ON documents(id) WHERE scan_status IS NULL;
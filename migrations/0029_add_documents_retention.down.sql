@@ -0,0 +1,3 @@
+ALTER TABLE document_deletions DROP COLUMN IF EXISTS retained_until;
+ALTER TABLE documents DROP COLUMN IF EXISTS retain_until;
+ALTER TABLE documents DROP COLUMN IF EXISTS retention_mode;
@@ -0,0 +1,3 @@
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS retention_mode TEXT;
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS retain_until TIMESTAMP;
+ALTER TABLE document_deletions ADD COLUMN IF NOT EXISTS retained_until TIMESTAMP;
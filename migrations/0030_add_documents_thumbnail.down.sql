@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS documents_thumbnail_idx;
+DROP INDEX IF EXISTS documents_unthumbnailed_idx;
+ALTER TABLE documents DROP COLUMN IF EXISTS thumbnailed_at;
+ALTER TABLE documents DROP COLUMN IF EXISTS thumbnail_key;
+ALTER TABLE documents DROP COLUMN IF EXISTS thumbnail_bucket;
@@ -0,0 +1,5 @@
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS thumbnail_bucket TEXT;
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS thumbnail_key TEXT;
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS thumbnailed_at TIMESTAMP;
+CREATE INDEX IF NOT EXISTS documents_unthumbnailed_idx ON documents(id) WHERE thumbnailed_at IS NULL;
+CREATE INDEX IF NOT EXISTS documents_thumbnail_idx ON documents(thumbnail_bucket, thumbnail_key) WHERE thumbnail_key IS NOT NULL;
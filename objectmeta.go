@@ -0,0 +1,54 @@
+package main
+
+import (
+	"mime"
+	"path/filepath"
+	"time"
+)
+
+/* OBJECT METADATA */
+
+// Documents are stored with the type detected from their content, a
+// Content-Disposition naming the file as the applicant sent it, and user
+// metadata for processors reading the bucket directly: the submission's
+// reference, when it is known at upload time, the original filename and
+// when it was uploaded. Direct and resumable uploads are started before
+// there is a submission and carry no reference.
+
+// Object user metadata keys, sent as x-amz-meta-<key>.
+const (
+	metaReference        = "reference"
+	metaOriginalFilename = "original-filename"
+	metaUploadedAt       = "uploaded-at"
+)
+
+// documentMetadata returns the user metadata of a document named filename
+// uploaded at for the submission reference, which may be empty. S3 only
+// takes ASCII values, so a non-ASCII filename is RFC 2047 encoded, as S3
+// itself returns such values.
+func documentMetadata(reference, filename string, at time.Time) map[string]string {
+	meta := map[string]string{
+		metaOriginalFilename: mime.QEncoding.Encode("utf-8", filepath.Base(filename)),
+		metaUploadedAt:       at.UTC().Format(time.RFC3339),
+	}
+	if reference != "" {
+		meta[metaReference] = reference
+	}
+	return meta
+}
+
+// metadataFilename returns the original filename recorded in meta by
+// documentMetadata, or "" when there is none.
+func metadataFilename(meta map[string]string) string {
+	name, err := new(mime.WordDecoder).DecodeHeader(meta[metaOriginalFilename])
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// documentDisposition returns the Content-Disposition of a document named
+// filename: shown inline, and saved under its original name.
+func documentDisposition(filename string) string {
+	return mime.FormatMediaType("inline", map[string]string{"filename": filepath.Base(filename)})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* OPENAPI */
+
+// openAPIDocument builds the OpenAPI 3 description of every route in the
+// route table that is not Hidden.
+func (a *app) openAPIDocument() map[string]any {
+	paths := map[string]any{}
+	for _, rt := range a.routeTable() {
+		if rt.Hidden {
+			continue
+		}
+
+		path := strings.TrimSuffix(rt.Path, "{$}")
+		item, _ := paths[path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[path] = item
+		}
+		item[strings.ToLower(rt.Method)] = operation(rt)
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "KYC submission service",
+			"version": currentBuild().GitSHA,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"securitySchemes": map[string]any{
+				"apiToken":      map[string]any{"type": "http", "scheme": "bearer", "description": "A token from API_TOKENS"},
+				"adminToken":    map[string]any{"type": "http", "scheme": "bearer", "description": "ADMIN_TOKEN"},
+				"reviewerToken": map[string]any{"type": "http", "scheme": "bearer", "description": "A token from ADMIN_REVIEWERS"},
+			},
+		},
+	}
+}
+
+var pathParamRE = regexp.MustCompile(`\{(\w+)\}`)
+
+func operation(rt route) map[string]any {
+	op := map[string]any{
+		"summary":     rt.Summary,
+		"operationId": operationID(rt),
+	}
+	if rt.Tag != "" {
+		op["tags"] = []string{rt.Tag}
+	}
+
+	var params []any
+	for _, m := range pathParamRE.FindAllStringSubmatch(rt.Path, -1) {
+		typ := "string"
+		if m[1] == "id" || m[1] == "doc" {
+			typ = "integer"
+		}
+		params = append(params, map[string]any{"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": typ}})
+	}
+	for _, q := range rt.Query {
+		params = append(params, map[string]any{"name": q.Name, "in": "query", "description": q.Description, "schema": map[string]any{"type": q.Type}})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if rt.Body != nil {
+		mt := rt.BodyType
+		if mt == "" {
+			mt = "application/json"
+		}
+		op["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{mt: map[string]any{"schema": schemaOf(reflect.TypeOf(rt.Body))}},
+		}
+	}
+
+	responses := map[string]any{}
+	for _, resp := range rt.Responses {
+		r := map[string]any{"description": resp.Description}
+		mt := resp.Type
+		if mt == "" && resp.Body != nil {
+			mt = "application/json"
+		}
+		if mt != "" {
+			schema := map[string]any{"type": "string"}
+			if resp.Body != nil {
+				schema = schemaOf(reflect.TypeOf(resp.Body))
+			} else if mt == "application/octet-stream" {
+				schema["format"] = "binary"
+			}
+			r["content"] = map[string]any{mt: map[string]any{"schema": schema}}
+		}
+		responses[strconv.Itoa(resp.Status)] = r
+	}
+	if rt.Auth != authNone {
+		responses["401"] = map[string]any{
+			"description": "Missing or invalid bearer token",
+			"content":     map[string]any{"application/problem+json": map[string]any{"schema": schemaOf(reflect.TypeOf(problem{}))}},
+		}
+	}
+	op["responses"] = responses
+
+	switch rt.Auth {
+	case authAPI:
+		op["security"] = []any{map[string]any{"apiToken": []string{}}}
+	case authAdmin:
+		op["security"] = []any{map[string]any{"adminToken": []string{}}}
+	case authReviewer:
+		op["security"] = []any{map[string]any{"reviewerToken": []string{}}}
+	}
+	return op
+}
+
+// operationID derives a stable identifier such as get_api_v1_users_id.
+func operationID(rt route) string {
+	id := strings.ToLower(rt.Method) + strings.NewReplacer("/", "_", "{$}", "", "{", "", "}", "", "-", "_", ".", "_").Replace(rt.Path)
+	return strings.TrimSuffix(id, "_")
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf describes t as an OpenAPI schema, following encoding/json's
+// rules for field names, omitempty and embedded structs.
+func schemaOf(t reflect.Type) map[string]any {
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := schemaOf(t.Elem())
+		s["nullable"] = true
+		return s
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "binary"}
+		}
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		props := map[string]any{}
+		var required []string
+		addFields(t, props, &required)
+		s := map[string]any{"type": "object", "properties": props}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+	default:
+		return map[string]any{}
+	}
+}
+
+func addFields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			addFields(f.Type, props, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = schemaOf(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			*required = append(*required, name)
+		}
+	}
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  map[string]any
+)
+
+// openAPIHandler serves /api/docs/openapi.json.
+func (a *app) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() { openAPIDoc = a.openAPIDocument() })
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, http.StatusOK, openAPIDoc)
+}
+
+// docsHandler serves the Swagger UI page at /api/docs.
+func (a *app) docsHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := fs.ReadFile(a.web, "docs.html")
+	if err != nil {
+		writeProblem(w, r, probNotFound, "API documentation is not available")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Swagger UI loads from a CDN and boots from an inline script.
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'self' 'unsafe-inline' https://unpkg.com; "+
+		"style-src 'self' https://unpkg.com; img-src 'self' data:; object-src 'none'; frame-ancestors 'none'")
+	w.Write(page)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+
+	"client_alb_go_s3_rds/config"
+	"client_alb_go_s3_rds/i18n"
+)
+
+/* SMS ONE-TIME CODES */
+
+// With SMS_OTP on, the applicant asks for a code at POST /submit/otp,
+// which texts it to the phone number in the form, and /submit accepts the
+// form only with that code. Codes are stored in phone_otps as hashes. A
+// code that was entered correctly keeps working until it expires, so a
+// submission that is retried or rejected for another field need not wait
+// for a new one.
+const (
+	otpIDField   = "otp_id"
+	otpCodeField = "otp_code"
+)
+
+var (
+	errOTPWrong       = errors.New("wrong code")
+	errOTPExpired     = errors.New("code expired")
+	errOTPLocked      = errors.New("too many wrong codes")
+	errOTPUnknown     = errors.New("no such code for this number")
+	errOTPRateLimited = errors.New("too many codes sent to this number")
+)
+
+// newSMSClient returns the SNS client codes are sent with.
+func newSMSClient(ctx context.Context, cfg config.OTPConfig) (*sns.Client, error) {
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(cfg.Region))
+	if err != nil {
+		return nil, err
+	}
+	return sns.NewFromConfig(awsCfg), nil
+}
+
+// otpHash is how the code of the phone_otps row id is stored.
+func otpHash(id, code string) string {
+	return hashToken(id + ":" + code)
+}
+
+// otpResponse is the POST /submit/otp response.
+type otpResponse struct {
+	OTPID     string    `json:"otp_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// otpHandler handles POST /submit/otp: it texts a code to the phone field's
+// number. Browsers posting the form get it back, filled in, saying the
+// code was sent, or the details step of /apply if that is where they asked
+// from; otp.js asks for JSON instead.
+func (a *app) otpHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.cfg.OTP.Enabled {
+		writeProblem(w, r, probNotFound, "SMS codes are disabled")
+		return
+	}
+	c := contactFields{Name: r.FormValue("name"), Email: r.FormValue("email"), Phone: r.FormValue("phone")}
+	c.PhoneRaw = strings.TrimSpace(c.Phone)
+	reject := a.rejectSubmission
+	if r.PostFormValue(draftStepField) == stepDetails {
+		reject = a.rejectDraftDetails
+	}
+	if errs := validateFields(a.cfg.Phone.DefaultRegion, nil, nil, &c.Phone); len(errs) > 0 {
+		reject(w, r, c, errs)
+		return
+	}
+
+	id, expires, err := a.sendOTP(r.Context(), c.Phone, language(r.Context()))
+	if err != nil {
+		kind, code := probSMS, "otp.send_failed"
+		if errors.Is(err, errOTPRateLimited) {
+			kind, code = probTooManyRequests, "otp.rate_limited"
+			log.Printf("level=WARN service=go-app event=otp_rate_limited client_ip=%s request_id=%s instance=%s", a.clientIP(r), requestID(r.Context()), a.instanceID)
+		} else {
+			log.Printf("level=ERROR service=go-app event=otp_send_failed err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		}
+		errs := []fieldError{newFieldError("otp", code)}
+		if wantsHTML(r) {
+			reject(w, r, c, errs)
+			return
+		}
+		errs = localizeFieldErrors(language(r.Context()), errs)
+		writeProblemBody(w, r, kind, fieldErrorSummary(errs), errs)
+		return
+	}
+	log.Printf("level=INFO service=go-app event=otp_sent otp_id=%s request_id=%s instance=%s", id, requestID(r.Context()), a.instanceID)
+
+	w.Header().Set("Cache-Control", "no-store")
+	if r.PostFormValue(draftStepField) == stepDetails && wantsHTML(r) {
+		if d, _, ok := a.currentDraft(w, r); ok {
+			page := a.filledDetailsPage(w, r, d, c, nil)
+			page.OTPID, page.OTPSent = id, true
+			a.writeDraftPage(w, r, http.StatusOK, page)
+		}
+		return
+	}
+	if t, _, err := a.formTemplate(r); err == nil && wantsHTML(r) {
+		page := a.filledFormPage(w, r, c, nil)
+		page.OTPID, page.OTPSent = id, true
+		a.writeForm(w, r, t, http.StatusOK, page)
+		return
+	}
+	writeJSON(w, http.StatusOK, otpResponse{OTPID: id, ExpiresAt: expires.UTC()})
+}
+
+// sendOTP texts a new code to phone, in E.164 form, and returns the ID to
+// submit it with and when it expires. Holding an advisory lock on the
+// number while counting its recent codes keeps concurrent requests, on any
+// instance, within OTP_MAX_SENDS.
+func (a *app) sendOTP(ctx context.Context, phone, lang string) (string, time.Time, error) {
+	cfg := a.cfg.OTP
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		panic(err)
+	}
+	code := fmt.Sprintf("%06d", n)
+	id := newUUID()
+
+	var expires time.Time
+	err = inTx(ctx, a.db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, "phone_otp:"+phone); err != nil {
+			return err
+		}
+		var sent int
+		err := tx.QueryRowContext(ctx, `
+		SELECT count(*) FROM phone_otps WHERE phone = $1 AND created_at > CURRENT_TIMESTAMP - make_interval(secs => $2)
+		`, phone, cfg.SendWindow.Seconds()).Scan(&sent)
+		if err != nil {
+			return err
+		}
+		if sent >= cfg.MaxSends {
+			return errOTPRateLimited
+		}
+		return tx.QueryRowContext(ctx, `
+		INSERT INTO phone_otps(id, phone, code_hash, expires_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP + make_interval(secs => $4))
+		RETURNING expires_at
+		`, id, phone, otpHash(id, code), cfg.CodeTTL.Seconds()).Scan(&expires)
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	attrs := map[string]snstypes.MessageAttributeValue{
+		"AWS.SNS.SMS.SMSType": {DataType: aws.String("String"), StringValue: aws.String("Transactional")},
+	}
+	if cfg.SenderID != "" {
+		attrs["AWS.SNS.SMS.SenderID"] = snstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(cfg.SenderID)}
+	}
+	_, err = a.sms.Publish(ctx, &sns.PublishInput{
+		PhoneNumber:       aws.String(phone),
+		Message:           aws.String(i18n.T(lang, "sms.otp", code, int(cfg.CodeTTL.Minutes()))),
+		MessageAttributes: attrs,
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return id, expires, nil
+}
+
+// checkPhoneOTP checks the code posted with r against the one sent to
+// phone, returning what is wrong with it for the form, if anything.
+func (a *app) checkPhoneOTP(r *http.Request, phone string) *fieldError {
+	if !a.cfg.OTP.Enabled {
+		return nil
+	}
+	id, code := r.PostFormValue(otpIDField), strings.TrimSpace(r.PostFormValue(otpCodeField))
+	if id == "" || code == "" {
+		e := newFieldError("otp", "otp.required")
+		return &e
+	}
+
+	var key string
+	switch err := checkOTP(r.Context(), a.db, id, phone, code, a.cfg.OTP.MaxAttempts); {
+	case err == nil:
+		return nil
+	case errors.Is(err, errOTPWrong), errors.Is(err, errOTPUnknown):
+		key = "otp.invalid"
+	case errors.Is(err, errOTPExpired):
+		key = "otp.expired"
+	case errors.Is(err, errOTPLocked):
+		key = "otp.too_many_attempts"
+	default:
+		log.Printf("level=ERROR service=go-app event=db_query_failed op=otp_check err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		key = "otp.unavailable"
+	}
+	log.Printf("level=WARN service=go-app event=otp_rejected reason=%s client_ip=%s request_id=%s instance=%s", key, a.clientIP(r), requestID(r.Context()), a.instanceID)
+	e := newFieldError("otp", key)
+	return &e
+}
+
+// checkOTP checks code against the phone_otps row id sent to phone,
+// counting a wrong guess against the row.
+func checkOTP(ctx context.Context, db *sql.DB, id, phone, code string, maxAttempts int) error {
+	var outcome error
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		var hash string
+		var attempts int
+		var expired, verified bool
+		err := tx.QueryRowContext(ctx, `
+		SELECT code_hash, attempts, expires_at <= CURRENT_TIMESTAMP, verified_at IS NOT NULL
+		FROM phone_otps WHERE id = $1 AND phone = $2
+		FOR UPDATE
+		`, id, phone).Scan(&hash, &attempts, &expired, &verified)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			outcome = errOTPUnknown
+			return nil
+		case err != nil:
+			return err
+		case expired:
+			outcome = errOTPExpired
+			return nil
+		case attempts >= maxAttempts:
+			outcome = errOTPLocked
+			return nil
+		case hmac.Equal([]byte(hash), []byte(otpHash(id, code))):
+			if verified {
+				return nil
+			}
+			_, err := tx.ExecContext(ctx, `UPDATE phone_otps SET verified_at = CURRENT_TIMESTAMP WHERE id = $1`, id)
+			return err
+		}
+		outcome = errOTPWrong
+		_, err = tx.ExecContext(ctx, `UPDATE phone_otps SET attempts = attempts + 1 WHERE id = $1`, id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return outcome
+}
+
+// expireOTPs drops codes that neither work nor count towards a number's
+// limit any more.
+func (a *app) expireOTPs(ctx context.Context) {
+	if !a.cfg.OTP.Enabled {
+		return
+	}
+	keep := max(a.cfg.OTP.CodeTTL, a.cfg.OTP.SendWindow)
+	res, err := a.db.ExecContext(ctx, `
+	DELETE FROM phone_otps WHERE created_at < CURRENT_TIMESTAMP - make_interval(secs => $1)
+	`, keep.Seconds())
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_delete_failed op=phone_otps err=%v instance=%s", err, a.instanceID)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("level=DEBUG service=go-app event=phone_otps_expired count=%d instance=%s", n, a.instanceID)
+	}
+}
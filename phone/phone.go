@@ -0,0 +1,142 @@
+// Package phone normalizes phone numbers to E.164, the "+<country code>
+// <national number>" form SMS providers expect, so the same number typed
+// two ways is stored once.
+//
+// Only numbering plans the service deals with are known in detail; numbers
+// written in international form for other countries are accepted when
+// their length is plausible.
+package phone
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// plan describes a country's numbering: its calling code, the trunk prefix
+// dialled before national numbers at home, and how many digits its
+// national significant numbers have.
+type plan struct {
+	code      string
+	trunk     string
+	minDigits int
+	maxDigits int
+}
+
+// plans holds the known countries by ISO 3166-1 alpha-2 code.
+var plans = map[string]plan{
+	"IN": {code: "91", trunk: "0", minDigits: 10, maxDigits: 10},
+	"US": {code: "1", trunk: "1", minDigits: 10, maxDigits: 10},
+	"CA": {code: "1", trunk: "1", minDigits: 10, maxDigits: 10},
+	"GB": {code: "44", trunk: "0", minDigits: 9, maxDigits: 10},
+	"IE": {code: "353", trunk: "0", minDigits: 7, maxDigits: 9},
+	"AU": {code: "61", trunk: "0", minDigits: 9, maxDigits: 9},
+	"NZ": {code: "64", trunk: "0", minDigits: 8, maxDigits: 10},
+	"SG": {code: "65", minDigits: 8, maxDigits: 8},
+	"AE": {code: "971", trunk: "0", minDigits: 8, maxDigits: 9},
+	"SA": {code: "966", trunk: "0", minDigits: 8, maxDigits: 9},
+	"DE": {code: "49", trunk: "0", minDigits: 6, maxDigits: 13},
+	"FR": {code: "33", trunk: "0", minDigits: 9, maxDigits: 9},
+	"NL": {code: "31", trunk: "0", minDigits: 9, maxDigits: 9},
+	"ES": {code: "34", minDigits: 9, maxDigits: 9},
+	"IT": {code: "39", minDigits: 6, maxDigits: 11},
+	"JP": {code: "81", trunk: "0", minDigits: 9, maxDigits: 10},
+	"CN": {code: "86", trunk: "0", minDigits: 10, maxDigits: 11},
+	"HK": {code: "852", minDigits: 8, maxDigits: 8},
+	"MY": {code: "60", trunk: "0", minDigits: 8, maxDigits: 10},
+	"LK": {code: "94", trunk: "0", minDigits: 9, maxDigits: 9},
+	"NP": {code: "977", trunk: "0", minDigits: 8, maxDigits: 10},
+	"BD": {code: "880", trunk: "0", minDigits: 8, maxDigits: 10},
+	"ZA": {code: "27", trunk: "0", minDigits: 9, maxDigits: 9},
+	"BR": {code: "55", trunk: "0", minDigits: 10, maxDigits: 11},
+}
+
+// Errors returned by Parse.
+var (
+	ErrInvalid       = errors.New("not a phone number")
+	ErrLength        = errors.New("wrong number of digits")
+	ErrUnknownRegion = errors.New("unknown default region")
+)
+
+// Regions returns the known region codes, sorted.
+func Regions() []string {
+	out := make([]string, 0, len(plans))
+	for r := range plans {
+		out = append(out, r)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Parse returns raw in E.164 form. raw may use spaces, hyphens, periods
+// and parentheses as separators and be written internationally, with "+"
+// or "00", or nationally, when it is read as a number of region.
+func Parse(raw, region string) (string, error) {
+	home, ok := plans[strings.ToUpper(region)]
+	if !ok {
+		return "", ErrUnknownRegion
+	}
+
+	s := strings.TrimSpace(raw)
+	international := false
+	switch {
+	case strings.HasPrefix(s, "+"):
+		s, international = s[1:], true
+	case strings.HasPrefix(s, "00"):
+		s, international = s[2:], true
+	}
+	var digits strings.Builder
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			digits.WriteRune(c)
+		case c == ' ', c == '-', c == '.', c == '(', c == ')':
+		default:
+			return "", ErrInvalid
+		}
+	}
+	num := digits.String()
+	if num == "" {
+		return "", ErrInvalid
+	}
+
+	if !international {
+		// A national number, possibly written with the trunk prefix. No
+		// national significant number starts with its country's trunk
+		// prefix, so it is safe to drop.
+		num = strings.TrimPrefix(num, home.trunk)
+		if len(num) < home.minDigits || len(num) > home.maxDigits {
+			return "", ErrLength
+		}
+		return "+" + home.code + num, nil
+	}
+
+	if p, national, ok := lookup(num); ok {
+		// A trunk prefix written after the country code, as in
+		// +44 (0)20 ..., is dropped too.
+		national = strings.TrimPrefix(national, p.trunk)
+		if len(national) < p.minDigits || len(national) > p.maxDigits {
+			return "", ErrLength
+		}
+		return "+" + p.code + national, nil
+	}
+	// An unknown plan: E.164 allows 15 digits, and nothing much shorter
+	// than 8 is a real subscriber number anywhere.
+	if len(num) < 8 || len(num) > 15 || num[0] == '0' {
+		return "", ErrLength
+	}
+	return "+" + num, nil
+}
+
+// lookup finds the known plan whose calling code begins num, returning the
+// digits after it.
+func lookup(num string) (plan, string, bool) {
+	for n := 1; n <= 3 && n < len(num); n++ {
+		for _, p := range plans {
+			if p.code == num[:n] {
+				return p, num[n:], true
+			}
+		}
+	}
+	return plan{}, "", false
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+/* PROBLEM DETAILS */
+
+// problemKind is one class of failure reported as an RFC 7807 problem.
+// Code is stable and meant for clients to branch on; Title is its
+// human-readable summary.
+type problemKind struct {
+	Code   string
+	Status int
+	Title  string
+}
+
+// Problem kinds. Validation, storage and database failures are kept apart
+// so clients can tell "fix your input" from "retry later".
+var (
+	probMalformed           = problemKind{"malformed_request", http.StatusBadRequest, "Malformed request"}
+	probValidation          = problemKind{"validation_failed", http.StatusBadRequest, "Validation failed"}
+	probUnauthorized        = problemKind{"unauthorized", http.StatusUnauthorized, "Unauthorized"}
+	probForbidden           = problemKind{"forbidden", http.StatusForbidden, "Forbidden"}
+	probNotFound            = problemKind{"not_found", http.StatusNotFound, "Not found"}
+	probMethodNotAllowed    = problemKind{"method_not_allowed", http.StatusMethodNotAllowed, "Method not allowed"}
+	probConflict            = problemKind{"invalid_transition", http.StatusConflict, "Conflict"}
+	probInProgress          = problemKind{"request_in_progress", http.StatusConflict, "Request in progress"}
+	probOffsetMismatch      = problemKind{"offset_mismatch", http.StatusConflict, "Upload offset mismatch"}
+	probTooLarge            = problemKind{"too_large", http.StatusRequestEntityTooLarge, "Request too large"}
+	probUnsupportedType     = problemKind{"unsupported_media_type", http.StatusUnsupportedMediaType, "Unsupported media type"}
+	probRangeNotSatisfiable = problemKind{"range_not_satisfiable", http.StatusRequestedRangeNotSatisfiable, "Range not satisfiable"}
+	probDocumentInvalid     = problemKind{"document_invalid", http.StatusUnprocessableEntity, "Document invalid"}
+	probTooManyRequests     = problemKind{"rate_limited", http.StatusTooManyRequests, "Too many requests"}
+	probInternal            = problemKind{"internal_error", http.StatusInternalServerError, "Internal server error"}
+	probDatabase            = problemKind{"database_error", http.StatusInternalServerError, "Database error"}
+	probStorage             = problemKind{"storage_error", http.StatusBadGateway, "Document storage error"}
+	probStorageMismatch     = problemKind{"storage_mismatch", http.StatusBadGateway, "Stored document does not match upload"}
+	probSMS                 = problemKind{"sms_error", http.StatusBadGateway, "SMS delivery error"}
+	probTimeout             = problemKind{"timeout", http.StatusGatewayTimeout, "Request timed out"}
+	probMaintenance         = problemKind{"maintenance", http.StatusServiceUnavailable, "Down for maintenance"}
+	probDatabaseUnavailable = problemKind{"database_unavailable", http.StatusServiceUnavailable, "Database unavailable"}
+	probStorageUnavailable  = problemKind{"storage_unavailable", http.StatusServiceUnavailable, "Document storage unavailable"}
+)
+
+// problem is an application/problem+json body.
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id"`
+	// Errors lists each rejected field of a validation problem.
+	Errors []fieldError `json:"errors,omitempty"`
+}
+
+// problemTypeBase prefixes each kind's code to form its type URI.
+const problemTypeBase = "/problems/"
+
+// writeProblem answers r with a problem of the given kind.
+func writeProblem(w http.ResponseWriter, r *http.Request, kind problemKind, detail string) {
+	writeProblemBody(w, r, kind, detail, nil)
+}
+
+// writeProblemBody is writeProblem with per-field errors.
+func writeProblemBody(w http.ResponseWriter, r *http.Request, kind problemKind, detail string, errs []fieldError) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(kind.Status)
+	json.NewEncoder(w).Encode(problem{
+		Type:      problemTypeBase + kind.Code,
+		Title:     kind.Title,
+		Status:    kind.Status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      kind.Code,
+		RequestID: requestID(r.Context()),
+		Errors:    errs,
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+/* UPLOAD PROGRESS */
+
+// A browser submitting documents picks a random upload token, sends it as
+// the upload_token query parameter of /submit and polls
+// /uploads/{token}/progress meanwhile. Progress lives in RDS like upload
+// sessions, so the poll may reach any instance.
+
+// Upload progress states.
+const (
+	progressReceiving  = "receiving"
+	progressProcessing = "processing" // body read; storing the submission
+	progressDone       = "done"
+	progressFailed     = "failed"
+)
+
+// progressInterval is how often the bytes received are written while a
+// body is being read.
+const progressInterval = time.Second
+
+// progressRetention is how long progress is kept after its last update.
+const progressRetention = time.Hour
+
+// uploadProgress is the response of GET /uploads/{token}/progress.
+// BytesTotal is the request's Content-Length, multipart framing included,
+// and is left out when the client did not send one.
+type uploadProgress struct {
+	Token         string    `json:"token"`
+	State         string    `json:"state"`
+	BytesReceived int64     `json:"bytes_received"`
+	BytesTotal    int64     `json:"bytes_total,omitempty"`
+	Percent       int       `json:"percent"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// validUploadToken reports whether token is 16 to 128 URL-safe characters,
+// enough to be unguessable when chosen at random.
+func validUploadToken(token string) bool {
+	if len(token) < 16 || len(token) > 128 {
+		return false
+	}
+	for _, c := range token {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// trackProgress records how much of the request body has been read under
+// the upload_token query parameter, and how the request ended. Tracking is
+// best-effort: when RDS is unavailable the request goes ahead untracked.
+func (a *app) trackProgress(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("upload_token")
+		if token == "" || a.dbDown.Load() {
+			next(w, r)
+			return
+		}
+		if !validUploadToken(token) {
+			writeProblem(w, r, probValidation, "upload_token must be 16 to 128 letters, digits, - or _")
+			return
+		}
+
+		p := &progressReader{ReadCloser: r.Body, a: a, ctx: r.Context(), token: token, total: r.ContentLength}
+		p.save(progressReceiving)
+		r.Body = p
+		sw := &statusWriter{ResponseWriter: w}
+		next(sw, r)
+
+		state := progressDone
+		if sw.status >= http.StatusBadRequest {
+			state = progressFailed
+		}
+		// The request may have run out of time; its outcome is still news.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 5*time.Second)
+		defer cancel()
+		p.ctx = ctx
+		p.save(state)
+	}
+}
+
+// progressReader counts the bytes read from a request body, writing the
+// count at most every progressInterval.
+type progressReader struct {
+	io.ReadCloser
+	a        *app
+	ctx      context.Context
+	token    string
+	total    int64
+	received int64
+	state    string
+	saved    time.Time
+	failed   bool
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	p.received += int64(n)
+	switch {
+	case p.state == progressReceiving && (err == io.EOF || p.total >= 0 && p.received >= p.total):
+		p.save(progressProcessing)
+	case err == nil && time.Since(p.saved) >= progressInterval:
+		p.save(p.state)
+	}
+	return n, err
+}
+
+// save writes the progress with the given state. After a failed write the
+// upload continues untracked.
+func (p *progressReader) save(state string) {
+	p.state = state
+	if p.failed {
+		return
+	}
+	p.saved = time.Now()
+	total := sql.NullInt64{Int64: p.total, Valid: p.total >= 0}
+	_, err := p.a.db.ExecContext(p.ctx, `
+	INSERT INTO upload_progress(token, bytes_received, bytes_total, state) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (token) DO UPDATE
+	SET bytes_received = EXCLUDED.bytes_received, bytes_total = EXCLUDED.bytes_total, state = EXCLUDED.state, updated_at = CURRENT_TIMESTAMP
+	`, p.token, p.received, total, state)
+	if err != nil {
+		p.failed = true
+		log.Printf("level=WARN service=go-app event=upload_progress_failed err=%v request_id=%s instance=%s", err, requestID(p.ctx), p.a.instanceID)
+	}
+}
+
+// progressHandler handles GET /uploads/{token}/progress. Only the holder
+// of a token can know it, and the answer carries nothing but byte counts.
+func (a *app) progressHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	if !validUploadToken(token) {
+		writeProblem(w, r, probNotFound, "no upload with this token")
+		return
+	}
+	if a.dbDown.Load() {
+		writeProblem(w, r, probDatabaseUnavailable, "database unavailable")
+		return
+	}
+
+	p := uploadProgress{Token: token}
+	var total sql.NullInt64
+	err := a.db.QueryRowContext(r.Context(), `
+	SELECT state, bytes_received, bytes_total, updated_at FROM upload_progress WHERE token = $1
+	`, token).Scan(&p.State, &p.BytesReceived, &total, &p.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeProblem(w, r, probNotFound, "no upload with this token")
+		return
+	}
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_query_failed op=upload_progress err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "database error")
+		return
+	}
+
+	p.UpdatedAt = p.UpdatedAt.UTC()
+	if total.Valid && total.Int64 > 0 {
+		p.BytesTotal = total.Int64
+		p.Percent = int(min(100, p.BytesReceived*100/total.Int64))
+	}
+	if p.State == progressDone {
+		p.Percent = 100
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, p)
+}
+
+// expireProgress deletes progress no one has updated for progressRetention.
+func (a *app) expireProgress(ctx context.Context) {
+	res, err := a.db.ExecContext(ctx, `
+	DELETE FROM upload_progress WHERE updated_at < CURRENT_TIMESTAMP - make_interval(secs => $1)
+	`, progressRetention.Seconds())
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_delete_failed op=upload_progress err=%v instance=%s", err, a.instanceID)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("level=DEBUG service=go-app event=upload_progress_expired count=%d instance=%s", n, a.instanceID)
+	}
+}
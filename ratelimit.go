@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/* RATE LIMITING */
+
+// rateLimiter keeps one token bucket per key. Buckets that have refilled
+// completely carry no state worth keeping and are swept periodically.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*tokenBucket{}}
+}
+
+// allow takes a token from key's bucket, refilled at rps up to burst. When
+// the bucket is empty it returns how long until the next token.
+func (l *rateLimiter) allow(key string, rps float64, burst int, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > time.Minute {
+		l.sweep(rps, burst, now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rps)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rps * float64(time.Second))
+}
+
+func (l *rateLimiter) sweep(rps float64, burst int, now time.Time) {
+	full := time.Duration(float64(burst) / rps * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// rateLimit returns middleware throttling each client IP to the
+// RATE_LIMIT_RPS/RATE_LIMIT_BURST runtime settings, answering 429 with
+// Retry-After once its bucket in limiter is empty. Routes sharing limiter
+// share the budget. The limit is per instance; the fleet-wide rate is that
+// times the number of instances.
+func (a *app) rateLimit(limiter *rateLimiter) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return a.limited(limiter, next)
+	}
+}
+
+func (a *app) limited(limiter *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		settings := a.settings.get()
+		if settings.RateLimitRPS <= 0 {
+			next(w, r)
+			return
+		}
+
+		ip := a.clientIP(r)
+		ok, wait := limiter.allow(ip, settings.RateLimitRPS, settings.RateLimitBurst, time.Now())
+		if ok {
+			next(w, r)
+			return
+		}
+
+		metricThrottled.Add(1)
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		log.Printf("level=WARN service=go-app event=rate_limited path=%s client_ip=%s retry_after=%d request_id=%s instance=%s", r.URL.Path, ip, retryAfter, requestID(r.Context()), a.instanceID)
+
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeProblem(w, r, probTooManyRequests, "too many submissions from your address; try again in "+strconv.Itoa(retryAfter)+"s")
+	}
+}
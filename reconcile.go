@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"client_alb_go_s3_rds/storage"
+)
+
+/* RECONCILIATION */
+
+// The bucket and the database can drift apart: an upload that succeeded
+// before its rows failed to insert leaves an orphaned object, and an object
+// removed outside the app leaves dangling rows. Reconciliation lists every
+// object under S3_KEY_PREFIX, under S3_ARCHIVE_PREFIX in the archive bucket
+// and, while uploads are quarantined, under the quarantine prefix of
+// S3_QUARANTINE_BUCKET, and reports those nothing refers to: no document,
+// preview, user, draft, upload session or queued deletion, nor, for an
+// original kept after archiving, its archived copy. Objects younger than
+// RECONCILE_MIN_AGE may belong to an upload still being recorded and are
+// left alone, as are the self-check's probes and the submission spool. It
+// then looks up the object of every document row, and the document_key of
+// users without one, and reports those that are missing.
+//
+// With repair on, orphaned objects are queued for deletion, which checks
+// again that nothing refers to them, and a row whose version is missing
+// while the key's current version holds the same document, by size and
+// SHA-256, is pointed at that version. Other dangling rows are left for
+// someone to look into. It runs every RECONCILE_INTERVAL when that is set,
+// and on demand as the reconcile command.
+
+// reconcileBatch bounds the keys checked per query, and the rows looked up
+// per page.
+const reconcileBatch = 1000
+
+// reconcileReport counts what a reconciliation found. Unchecked counts
+// rows whose object could not be looked up.
+type reconcileReport struct {
+	Listed    int
+	Orphaned  int
+	Dangling  int
+	Repaired  int
+	Unchecked int
+}
+
+// unresolved reports whether the report found anything left unrepaired.
+func (r reconcileReport) unresolved() bool {
+	return r.Orphaned+r.Dangling > r.Repaired || r.Unchecked > 0
+}
+
+// reconcileDocuments reconciles the bucket with the database every
+// RECONCILE_INTERVAL. Instances running it at once find the same, and the
+// repairs are idempotent.
+func (a *app) reconcileDocuments(ctx context.Context) {
+	ticker := time.NewTicker(a.cfg.Reconcile.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if a.dbDown.Load() {
+			continue
+		}
+		if _, err := a.reconcile(ctx, a.cfg.Reconcile.Repair); err != nil {
+			log.Printf("level=ERROR service=go-app event=reconcile_failed err=%v instance=%s", err, a.instanceID)
+		}
+	}
+}
+
+// reconcile checks the bucket against the database, and with repair fixes
+// what it can, logging each finding and a summary.
+func (a *app) reconcile(ctx context.Context, repair bool) (reconcileReport, error) {
+	var report reconcileReport
+	start := time.Now()
+
+	for _, scope := range a.reconcileScopes() {
+		if err := a.reconcileObjects(ctx, scope[0], scope[1], repair, &report); err != nil {
+			return report, err
+		}
+	}
+	if err := a.reconcileRows(ctx, repair, &report); err != nil {
+		return report, err
+	}
+	if err := a.reconcileUsers(ctx, &report); err != nil {
+		return report, err
+	}
+
+	log.Printf("level=INFO service=go-app event=reconcile_complete listed=%d orphaned=%d dangling=%d repaired=%d unchecked=%d repair=%t duration=%s instance=%s",
+		report.Listed, report.Orphaned, report.Dangling, report.Repaired, report.Unchecked, repair, time.Since(start).Round(time.Millisecond), a.instanceID)
+	return report, nil
+}
+
+// reconcileScopes returns the bucket and prefix pairs whose objects are
+// reconciled, leaving out one under a prefix already listed, as the
+// quarantine prefix is in the document bucket.
+func (a *app) reconcileScopes() [][2]string {
+	candidates := [][2]string{{a.cfg.S3.Bucket, a.cfg.S3.KeyPrefix}}
+	if a.cfg.S3.ArchiveBucket != "" {
+		candidates = append(candidates, [2]string{a.cfg.S3.ArchiveBucket, a.cfg.S3.ArchivePrefix})
+	}
+	if a.quarantining() {
+		candidates = append(candidates, [2]string{a.quarantineBucket(), a.quarantinePrefix()})
+	}
+	var scopes [][2]string
+	for _, c := range candidates {
+		covered := slices.ContainsFunc(scopes, func(s [2]string) bool { return s[0] == c[0] && strings.HasPrefix(c[1], s[1]) })
+		if !covered {
+			scopes = append(scopes, c)
+		}
+	}
+	return scopes
+}
+
+// reconcileObjects lists the objects under prefix in bucket and reports,
+// and with repair queues for deletion, those nothing refers to.
+func (a *app) reconcileObjects(ctx context.Context, bucket, prefix string, repair bool, report *reconcileReport) error {
+	skip := []string{a.cfg.S3.KeyPrefix + ".selfcheck/", strings.TrimSuffix(a.cfg.Degraded.SpoolPrefix, "/") + "/"}
+	cutoff := time.Now().Add(-a.cfg.Reconcile.MinAge)
+
+	var batch []storage.Listed
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		orphans, err := a.unreferencedKeys(ctx, bucket, batch)
+		batch = batch[:0]
+		if err != nil {
+			return err
+		}
+		for _, o := range orphans {
+			report.Orphaned++
+			log.Printf("level=WARN service=go-app event=reconcile_orphaned_object bucket=%s key=%s size=%d last_modified=%s instance=%s", bucket, o.Key, o.Size, o.LastModified.UTC().Format(time.RFC3339), a.instanceID)
+			if !repair {
+				continue
+			}
+			if _, err := a.db.ExecContext(ctx, `INSERT INTO document_deletions(bucket, object_key) VALUES ($1, $2)`, bucket, o.Key); err != nil {
+				return err
+			}
+			report.Repaired++
+		}
+		return nil
+	}
+
+	err := a.store.List(ctx, bucket, prefix, func(o storage.Listed) error {
+		report.Listed++
+		if o.LastModified.After(cutoff) || hasAnyPrefix(o.Key, skip) {
+			return nil
+		}
+		batch = append(batch, o)
+		if len(batch) < reconcileBatch {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// hasAnyPrefix reports whether s starts with one of prefixes.
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// unreferencedKeys returns the objects of batch in bucket that nothing
+// refers to, checking them all in one query. An object already queued for
+// deletion is not orphaned.
+func (a *app) unreferencedKeys(ctx context.Context, bucket string, batch []storage.Listed) ([]storage.Listed, error) {
+	// An original kept after its copy to the archive bucket is not
+	// orphaned either.
+	keys, archived := make([]string, len(batch)), make([]string, len(batch))
+	for i, o := range batch {
+		keys[i] = o.Key
+		if a.cfg.S3.ArchiveBucket != "" && bucket == a.cfg.S3.Bucket {
+			archived[i] = a.archiveKey(o.Key)
+		}
+	}
+	rows, err := a.db.QueryContext(ctx, `
+	SELECT k FROM unnest($2::text[], $3::text[]) AS t(k, archived)
+	WHERE NOT EXISTS(SELECT 1 FROM documents WHERE bucket = $1 AND object_key = k)
+	  AND NOT EXISTS(SELECT 1 FROM documents WHERE bucket = $4 AND object_key = archived)
+	  AND NOT EXISTS(SELECT 1 FROM documents WHERE thumbnail_bucket = $1 AND thumbnail_key = k)
+	  AND NOT EXISTS(SELECT 1 FROM users WHERE document_bucket = $1 AND document_key = k)
+	  AND NOT EXISTS(SELECT 1 FROM drafts WHERE data->'documents' @> jsonb_build_array(jsonb_build_object('bucket', $1::text, 'key', k)))
+	  AND NOT EXISTS(SELECT 1 FROM upload_sessions WHERE bucket = $1 AND object_key = k)
+	  AND NOT EXISTS(SELECT 1 FROM document_deletions WHERE bucket = $1 AND object_key = k)
+	`, bucket, pq.Array(keys), pq.Array(archived), a.cfg.S3.ArchiveBucket)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	unreferenced := map[string]bool{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		unreferenced[key] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var orphans []storage.Listed
+	for _, o := range batch {
+		if unreferenced[o.Key] {
+			orphans = append(orphans, o)
+		}
+	}
+	return orphans, nil
+}
+
+// reconcileRows looks up the object of every document row, a page at a
+// time, and reports those missing. Rows sharing an object are looked up
+// once per page. Infected documents are left out, their objects being
+// expired in quarantine by design.
+func (a *app) reconcileRows(ctx context.Context, repair bool, report *reconcileReport) error {
+	var after int64
+	for {
+		rows, err := a.db.QueryContext(ctx, `
+		SELECT id, user_id, bucket, object_key, COALESCE(version_id, ''), size_bytes, COALESCE(sha256, '') FROM documents
+		WHERE id > $1 AND scan_status IS DISTINCT FROM $3 ORDER BY id LIMIT $2
+		`, after, reconcileBatch, scanInfected)
+		if err != nil {
+			return err
+		}
+		type row struct {
+			id, userID int64
+			obj        storage.Object
+			size       int64
+			sha256     string
+		}
+		var page []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.id, &r.userID, &r.obj.Bucket, &r.obj.Key, &r.obj.VersionID, &r.size, &r.sha256); err != nil {
+				rows.Close()
+				return err
+			}
+			page = append(page, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			return nil
+		}
+		after = page[len(page)-1].id
+
+		seen := map[storage.Object]bool{}
+		for _, r := range page {
+			if seen[r.obj] {
+				continue
+			}
+			seen[r.obj] = true
+
+			_, err := a.store.Head(ctx, r.obj)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, storage.ErrNotFound) {
+				report.Unchecked++
+				log.Printf("level=WARN service=go-app event=reconcile_row_unchecked document=%d bucket=%s key=%s err=%v instance=%s", r.id, r.obj.Bucket, r.obj.Key, err, a.instanceID)
+				continue
+			}
+			report.Dangling++
+			log.Printf("level=WARN service=go-app event=reconcile_dangling_row document=%d user_id=%d bucket=%s key=%s version=%s instance=%s", r.id, r.userID, r.obj.Bucket, r.obj.Key, r.obj.VersionID, a.instanceID)
+			if !repair || r.obj.VersionID == "" || r.sha256 == "" {
+				continue
+			}
+
+			// The version is gone, but the key may hold the same document
+			// under another.
+			latest := storage.Object{Bucket: r.obj.Bucket, Key: r.obj.Key}
+			info, err := a.store.Head(ctx, latest)
+			if err != nil || info.Size != r.size || hex.EncodeToString(info.SHA256) != r.sha256 || info.VersionID == "" {
+				continue
+			}
+			_, err = a.db.ExecContext(ctx, `
+			UPDATE documents SET version_id = $4
+			WHERE bucket = $1 AND object_key = $2 AND version_id = $3
+			`, r.obj.Bucket, r.obj.Key, r.obj.VersionID, info.VersionID)
+			if err != nil {
+				return err
+			}
+			report.Repaired++
+			log.Printf("level=INFO service=go-app event=reconcile_row_repaired bucket=%s key=%s version=%s new_version=%s instance=%s", r.obj.Bucket, r.obj.Key, r.obj.VersionID, info.VersionID, a.instanceID)
+		}
+	}
+}
+
+// reconcileUsers looks up the document of each user that no document row
+// records, as users stored before the documents table may have, and
+// reports those missing.
+func (a *app) reconcileUsers(ctx context.Context, report *reconcileReport) error {
+	rows, err := a.db.QueryContext(ctx, `
+	SELECT u.id, u.document_bucket, u.document_key FROM users u
+	WHERE NOT EXISTS(SELECT 1 FROM documents d WHERE d.user_id = u.id AND d.bucket = u.document_bucket AND d.object_key = u.document_key)
+	ORDER BY u.id
+	`)
+	if err != nil {
+		return err
+	}
+	type row struct {
+		id  int64
+		obj storage.Object
+	}
+	var users []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.obj.Bucket, &r.obj.Key); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range users {
+		_, err := a.store.Head(ctx, r.obj)
+		switch {
+		case err == nil:
+		case errors.Is(err, storage.ErrNotFound):
+			report.Dangling++
+			log.Printf("level=WARN service=go-app event=reconcile_dangling_row user_id=%d bucket=%s key=%s instance=%s", r.id, r.obj.Bucket, r.obj.Key, a.instanceID)
+		default:
+			report.Unchecked++
+			log.Printf("level=WARN service=go-app event=reconcile_row_unchecked user_id=%d bucket=%s key=%s err=%v instance=%s", r.id, r.obj.Bucket, r.obj.Key, err, a.instanceID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/rand"
+	"strings"
+)
+
+/* REFERENCE NUMBERS */
+
+// referenceAlphabet is Crockford's base32: no I, L, O or U, so a reference
+// read out over the phone or copied by hand survives.
+const referenceAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newReference returns a reference number such as KYC-7F3K-9Q2M. Its 40
+// random bits make collisions, which the unique index would reject,
+// vanishingly rare at this service's volume.
+func newReference() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	var sb strings.Builder
+	sb.WriteString("KYC-")
+	for i, c := range b {
+		if i == 4 {
+			sb.WriteByte('-')
+		}
+		sb.WriteByte(referenceAlphabet[c&31])
+	}
+	return sb.String()
+}
+
+// normalizeReference turns what an applicant typed into the stored form:
+// upper case, dashes where they belong, and the letters Crockford base32
+// leaves out read as the digits they resemble. It returns "" when s cannot
+// be a reference.
+func normalizeReference(s string) string {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "KYC"), "-")
+	s = strings.NewReplacer("-", "", " ", "", "O", "0", "I", "1", "L", "1").Replace(s)
+	if len(s) != 8 {
+		return ""
+	}
+	for _, c := range s {
+		if !strings.ContainsRune(referenceAlphabet, c) {
+			return ""
+		}
+	}
+	return "KYC-" + s[:4] + "-" + s[4:]
+}
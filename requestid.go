@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+/* REQUEST IDS */
+
+type requestIDKey struct{}
+
+// withRequestID gives every request an ID, echoed in X-Request-ID, logged
+// with each handler log line and included in problem responses. Behind an
+// ALB the ID is the Root of X-Amzn-Trace-Id, so a reported ID can be found
+// in the ALB access logs too.
+func withRequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := traceRoot(r.Header.Get("X-Amzn-Trace-Id"))
+		if id == "" {
+			id = newUUID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	}
+}
+
+// requestID returns the ID withRequestID assigned, or "-" outside a request.
+func requestID(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	return "-"
+}
+
+// traceRoot extracts Root from an X-Amzn-Trace-Id such as
+// "Self=1-...;Root=1-5759e988-bd862e3fe1be46a994272793;Sampled=1".
+func traceRoot(header string) string {
+	for _, field := range strings.Split(header, ";") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(field), "Root="); ok && validTraceID(v) {
+			return v
+		}
+	}
+	return ""
+}
+
+// validTraceID keeps client-supplied junk out of logs and headers.
+func validTraceID(s string) bool {
+	if s == "" || len(s) > 64 {
+		return false
+	}
+	for _, c := range s {
+		if !(c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
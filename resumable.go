@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+/* RESUMABLE UPLOADS */
+
+// A resumable upload is an S3 multipart upload fed one chunk per PATCH, in
+// the style of tus: the client creates an upload, sends chunks at the
+// offset the server reports, asks for that offset again after a dropped
+// connection and carries on from there. Once the last chunk arrives the
+// object is assembled, and the upload ID goes in the "<field>_upload" field
+// of /submit, which creates the user. Sessions live in RDS, so any instance
+// behind the ALB can take the next chunk.
+const (
+	resumableTTL = 24 * time.Hour
+
+	// minChunkBytes is S3's minimum part size; only the last chunk may be
+	// smaller.
+	minChunkBytes = 5 << 20
+
+	chunkContentType = "application/offset+octet-stream"
+)
+
+// resumablePrefix is where resumable uploads are assembled, in
+// uploadBucket.
+func (a *app) resumablePrefix() string {
+	prefix := a.cfg.S3.KeyPrefix + "resumable/"
+	if a.quarantining() {
+		return a.quarantineKey(prefix)
+	}
+	return prefix
+}
+
+// uploadSession is a row of the upload_sessions table.
+type uploadSession struct {
+	ID          string
+	Bucket      string
+	Key         string
+	UploadID    string
+	Filename    string
+	ContentType string
+	Size        int64
+	Offset      int64
+	Completed   bool
+	ExpiresAt   time.Time
+}
+
+// resumableUpload is the JSON view of an upload session.
+type resumableUpload struct {
+	ID           string    `json:"id"`
+	Offset       int64     `json:"offset"`
+	Size         int64     `json:"size"`
+	MinChunkSize int64     `json:"min_chunk_size"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+var errUploadNotFound = errors.New("upload not found or expired")
+
+func getUploadSession(ctx context.Context, db *sql.DB, id string) (*uploadSession, error) {
+	var s uploadSession
+	err := db.QueryRowContext(ctx, `
+	SELECT id, bucket, object_key, s3_upload_id, filename, content_type, total_size, upload_offset, completed_at IS NOT NULL, expires_at
+	FROM upload_sessions WHERE id = $1 AND expires_at > CURRENT_TIMESTAMP
+	`, id).Scan(&s.ID, &s.Bucket, &s.Key, &s.UploadID, &s.Filename, &s.ContentType, &s.Size, &s.Offset, &s.Completed, &s.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errUploadNotFound
+	}
+	return &s, err
+}
+
+// setUploadHeaders reports an upload's progress the way tus clients expect.
+func setUploadHeaders(w http.ResponseWriter, s *uploadSession) {
+	h := w.Header()
+	h.Set("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+	h.Set("Upload-Length", strconv.FormatInt(s.Size, 10))
+	h.Set("Upload-Expires", s.ExpiresAt.UTC().Format(http.TimeFormat))
+	h.Set("Cache-Control", "no-store")
+}
+
+// loadUpload fetches the {id} upload for a handler, answering the request
+// itself when it cannot.
+func (a *app) loadUpload(w http.ResponseWriter, r *http.Request) (*uploadSession, bool) {
+	if !a.featureEnabled(r.Context(), flagResumableUpload) {
+		writeProblem(w, r, probNotFound, "resumable upload is not enabled")
+		return nil, false
+	}
+	s, err := getUploadSession(r.Context(), a.db, r.PathValue("id"))
+	if errors.Is(err, errUploadNotFound) {
+		writeProblem(w, r, probNotFound, err.Error())
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_query_failed op=upload_session err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "database error")
+		return nil, false
+	}
+	return s, true
+}
+
+// createUploadHandler handles POST /submit/uploads, starting a resumable
+// upload of the announced document.
+func (a *app) createUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.featureEnabled(r.Context(), flagResumableUpload) {
+		writeProblem(w, r, probNotFound, "resumable upload is not enabled")
+		return
+	}
+
+	var req uploadURLRequest
+	if err := decodeJSON(r, &req); err != nil {
+		a.writeBodyError(w, r, err, "invalid JSON body: "+err.Error())
+		return
+	}
+	if !a.documentTypeAllowed(req.ContentType) {
+		writeProblem(w, r, probUnsupportedType, "document must be "+a.documentTypesText())
+		return
+	}
+	if limit := a.documentLimit(req.ContentType); req.Size <= 0 || req.Size > limit {
+		writeProblem(w, r, probTooLarge, fmt.Sprintf("document must be between 1 and %d bytes", limit))
+		return
+	}
+
+	s := &uploadSession{
+		ID:          newUUID(),
+		Bucket:      a.uploadBucket(),
+		Filename:    filepath.Base(req.Filename),
+		ContentType: req.ContentType,
+		Size:        req.Size,
+		ExpiresAt:   time.Now().Add(resumableTTL),
+	}
+	s.Key = a.resumablePrefix() + s.ID + "/" + safeFilename(s.Filename)
+
+	out, err := a.s3.CreateMultipartUpload(r.Context(), &s3.CreateMultipartUploadInput{
+		Bucket:             aws.String(s.Bucket),
+		Key:                aws.String(s.Key),
+		ContentType:        aws.String(s.ContentType),
+		ContentDisposition: aws.String(documentDisposition(s.Filename)),
+		Metadata:           documentMetadata("", s.Filename, time.Now()),
+		StorageClass:       types.StorageClass(a.cfg.S3.StorageClass),
+
+		ServerSideEncryption: types.ServerSideEncryptionAwsKms,
+		SSEKMSKeyId:          sseKMSKey(a.cfg.S3),
+	})
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=s3_multipart_create_failed err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, storageProblem(err), "failed to start upload")
+		return
+	}
+	s.UploadID = aws.ToString(out.UploadId)
+
+	_, err = a.db.ExecContext(r.Context(), `
+	INSERT INTO upload_sessions(id, bucket, object_key, s3_upload_id, filename, content_type, total_size, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, s.ID, s.Bucket, s.Key, s.UploadID, s.Filename, s.ContentType, s.Size, s.ExpiresAt.UTC())
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_insert_failed op=upload_session err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		a.abortUpload(context.WithoutCancel(r.Context()), s)
+		writeProblem(w, r, probDatabase, "failed to start upload")
+		return
+	}
+
+	log.Printf("level=INFO service=go-app event=resumable_upload_created upload=%s size=%d request_id=%s instance=%s", s.ID, s.Size, requestID(r.Context()), a.instanceID)
+	setUploadHeaders(w, s)
+	w.Header().Set("Location", "/submit/uploads/"+s.ID)
+	writeJSON(w, http.StatusCreated, resumableUpload{ID: s.ID, Size: s.Size, MinChunkSize: minChunkBytes, ExpiresAt: s.ExpiresAt.UTC()})
+}
+
+// uploadOffsetHandler handles HEAD /submit/uploads/{id}: the Upload-Offset
+// header says where the next chunk starts.
+func (a *app) uploadOffsetHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.loadUpload(w, r)
+	if !ok {
+		return
+	}
+	setUploadHeaders(w, s)
+	w.WriteHeader(http.StatusOK)
+}
+
+// uploadChunkHandler handles PATCH /submit/uploads/{id}. The body is the
+// next chunk, starting at the offset given in Upload-Offset, which must
+// match the server's; it becomes one part of the multipart upload. The
+// chunk that reaches the announced size completes the object.
+func (a *app) uploadChunkHandler(w http.ResponseWriter, r *http.Request) {
+	if mediaType(r) != chunkContentType {
+		writeProblem(w, r, probUnsupportedType, "send chunks as "+chunkContentType)
+		return
+	}
+	s, ok := a.loadUpload(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeProblem(w, r, probValidation, "Upload-Offset header is required")
+		return
+	}
+	if s.Completed || offset != s.Offset {
+		setUploadHeaders(w, s)
+		writeProblem(w, r, probOffsetMismatch, fmt.Sprintf("upload is at offset %d", s.Offset))
+		return
+	}
+	n, remaining := r.ContentLength, s.Size-s.Offset
+	switch {
+	case n <= 0:
+		writeProblem(w, r, probValidation, "chunks need a Content-Length")
+		return
+	case n > remaining:
+		writeProblem(w, r, probValidation, fmt.Sprintf("chunk exceeds the %d bytes left", remaining))
+		return
+	case n < minChunkBytes && n != remaining:
+		writeProblem(w, r, probValidation, fmt.Sprintf("chunks other than the last must be at least %d bytes", minChunkBytes))
+		return
+	}
+
+	var part int32
+	if err := a.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(part_number), 0) + 1 FROM upload_parts WHERE session_id = $1`, s.ID).Scan(&part); err != nil {
+		log.Printf("level=ERROR service=go-app event=db_query_failed op=upload_parts err=%v request_id=%s instance=%s", err, requestID(ctx), a.instanceID)
+		writeProblem(w, r, probDatabase, "database error")
+		return
+	}
+
+	out, err := a.s3.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(s.Bucket),
+		Key:           aws.String(s.Key),
+		UploadId:      aws.String(s.UploadID),
+		PartNumber:    aws.Int32(part),
+		Body:          r.Body,
+		ContentLength: aws.Int64(n),
+	}, a.accelerated)
+	if err != nil {
+		// A dropped connection lands here too; the offset is unchanged, so
+		// the client resends the same chunk.
+		log.Printf("level=WARN service=go-app event=s3_upload_part_failed upload=%s part=%d err=%v request_id=%s instance=%s", s.ID, part, err, requestID(ctx), a.instanceID)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			a.rejectTooLarge(w, r, tooLarge.Limit)
+			return
+		}
+		writeProblem(w, r, storageProblem(err), "failed to store chunk")
+		return
+	}
+
+	// Another request for the same offset may have won the race; its
+	// offset stands and this chunk is reported as a mismatch.
+	var advanced bool
+	err = inTx(ctx, a.db, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `UPDATE upload_sessions SET upload_offset = upload_offset + $3 WHERE id = $1 AND upload_offset = $2`, s.ID, offset, n)
+		if err != nil {
+			return err
+		}
+		if rows, _ := res.RowsAffected(); rows == 0 {
+			return nil
+		}
+		advanced = true
+		_, err = tx.ExecContext(ctx, `
+		INSERT INTO upload_parts(session_id, part_number, etag, size_bytes) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (session_id, part_number) DO UPDATE SET etag = EXCLUDED.etag, size_bytes = EXCLUDED.size_bytes
+		`, s.ID, part, aws.ToString(out.ETag), n)
+		return err
+	})
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_update_failed op=upload_offset upload=%s err=%v request_id=%s instance=%s", s.ID, err, requestID(ctx), a.instanceID)
+		writeProblem(w, r, probDatabase, "failed to record chunk")
+		return
+	}
+	if !advanced {
+		writeProblem(w, r, probOffsetMismatch, "another request already wrote this chunk")
+		return
+	}
+	s.Offset += n
+
+	if s.Offset == s.Size {
+		if err := a.completeUpload(ctx, s); err != nil {
+			metricUploadFailures.Add(1)
+			log.Printf("level=ERROR service=go-app event=s3_multipart_complete_failed upload=%s err=%v request_id=%s instance=%s", s.ID, err, requestID(ctx), a.instanceID)
+			writeProblem(w, r, storageProblem(err), "failed to assemble upload")
+			return
+		}
+		log.Printf("level=INFO service=go-app event=resumable_upload_completed upload=%s size=%d request_id=%s instance=%s", s.ID, s.Size, requestID(ctx), a.instanceID)
+	}
+
+	setUploadHeaders(w, s)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeUpload assembles the uploaded parts into the object.
+func (a *app) completeUpload(ctx context.Context, s *uploadSession) error {
+	rows, err := a.db.QueryContext(ctx, `SELECT part_number, etag FROM upload_parts WHERE session_id = $1 ORDER BY part_number`, s.ID)
+	if err != nil {
+		return err
+	}
+	var parts []types.CompletedPart
+	for rows.Next() {
+		var num int32
+		var etag string
+		if err := rows.Scan(&num, &etag); err != nil {
+			rows.Close()
+			return err
+		}
+		parts = append(parts, types.CompletedPart{PartNumber: aws.Int32(num), ETag: aws.String(etag)})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = a.s3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.Bucket),
+		Key:             aws.String(s.Key),
+		UploadId:        aws.String(s.UploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return err
+	}
+	s.Completed = true
+	_, err = a.db.ExecContext(ctx, `UPDATE upload_sessions SET completed_at = CURRENT_TIMESTAMP WHERE id = $1`, s.ID)
+	return err
+}
+
+// cancelUploadHandler handles DELETE /submit/uploads/{id}, discarding an
+// unfinished upload.
+func (a *app) cancelUploadHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.loadUpload(w, r)
+	if !ok {
+		return
+	}
+	if s.Completed {
+		writeProblem(w, r, probOffsetMismatch, "upload is already complete")
+		return
+	}
+	a.abortUpload(r.Context(), s)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// abortUpload discards s in S3 and RDS. Parts S3 keeps after a failed
+// abort are left to the bucket's AbortIncompleteMultipartUpload rule.
+func (a *app) abortUpload(ctx context.Context, s *uploadSession) {
+	_, err := a.s3.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(s.Key),
+		UploadId: aws.String(s.UploadID),
+	})
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=s3_multipart_abort_failed upload=%s err=%v request_id=%s instance=%s", s.ID, err, requestID(ctx), a.instanceID)
+	}
+	if _, err := a.db.ExecContext(ctx, `DELETE FROM upload_sessions WHERE id = $1`, s.ID); err != nil {
+		log.Printf("level=ERROR service=go-app event=db_delete_failed op=upload_session upload=%s err=%v request_id=%s instance=%s", s.ID, err, requestID(ctx), a.instanceID)
+	}
+}
+
+// resumableDocument resolves the upload ID sent in a "<field>_upload" form
+// field to the assembled document.
+func (a *app) resumableDocument(ctx context.Context, docType, id string) (submittedDocument, error) {
+	s, err := getUploadSession(ctx, a.db, id)
+	if errors.Is(err, errUploadNotFound) {
+		return submittedDocument{}, &documentError{probDocumentInvalid, docType + ": " + err.Error()}
+	}
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_query_failed op=upload_session err=%v request_id=%s instance=%s", err, requestID(ctx), a.instanceID)
+		return submittedDocument{}, &documentError{probInternal, "failed to verify KYC document"}
+	}
+	// The last chunk arrived but assembling failed; try again now.
+	if !s.Completed && s.Offset == s.Size {
+		if err := a.completeUpload(ctx, s); err != nil {
+			metricUploadFailures.Add(1)
+			log.Printf("level=ERROR service=go-app event=s3_multipart_complete_failed upload=%s err=%v request_id=%s instance=%s", s.ID, err, requestID(ctx), a.instanceID)
+			return submittedDocument{}, &documentError{storageProblem(err), "failed to assemble upload"}
+		}
+	}
+	if !s.Completed {
+		return submittedDocument{}, &documentError{probDocumentInvalid, fmt.Sprintf("%s: upload is incomplete (%d of %d bytes)", docType, s.Offset, s.Size)}
+	}
+
+	head, sum, err := a.verifyUnclaimedObject(ctx, s.Bucket, s.Key)
+	if err != nil {
+		if errors.Is(err, errUploadRejected) {
+			return submittedDocument{}, &documentError{probDocumentInvalid, docType + ": " + err.Error()}
+		}
+		if errors.Is(err, errS3Unavailable) {
+			return submittedDocument{}, &documentError{probStorageUnavailable, "failed to verify KYC document"}
+		}
+		log.Printf("level=ERROR service=go-app event=resumable_upload_check_failed upload=%s err=%v request_id=%s instance=%s", s.ID, err, requestID(ctx), a.instanceID)
+		return submittedDocument{}, &documentError{probInternal, "failed to verify KYC document"}
+	}
+	doc := submittedDocument{
+		Type:        docType,
+		Bucket:      s.Bucket,
+		Key:         s.Key,
+		Filename:    s.Filename,
+		ContentType: s.ContentType,
+		Size:        s.Size,
+		SHA256:      sum,
+
+		StorageClass: a.cfg.S3.StorageClass,
+		VersionID:    aws.ToString(head.VersionId),
+	}
+	if err := a.lockDocument(ctx, &doc); err != nil {
+		log.Printf("level=ERROR service=go-app event=document_lock_failed upload=%s err=%v request_id=%s instance=%s", s.ID, err, requestID(ctx), a.instanceID)
+		return submittedDocument{}, &documentError{storageProblem(err), "failed to lock KYC document"}
+	}
+	return doc, nil
+}
+
+// expireUploads discards expired upload sessions: unfinished ones are
+// aborted in S3, finished ones just forgotten, leaving their object alone
+// since it may belong to a user by now.
+func (a *app) expireUploads(ctx context.Context) {
+	rows, err := a.db.QueryContext(ctx, `
+	SELECT id, bucket, object_key, s3_upload_id, completed_at IS NOT NULL
+	FROM upload_sessions WHERE expires_at <= CURRENT_TIMESTAMP ORDER BY expires_at LIMIT 100
+	`)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_query_failed op=expired_uploads err=%v instance=%s", err, a.instanceID)
+		return
+	}
+	var expired []*uploadSession
+	for rows.Next() {
+		var s uploadSession
+		if err := rows.Scan(&s.ID, &s.Bucket, &s.Key, &s.UploadID, &s.Completed); err != nil {
+			log.Printf("level=ERROR service=go-app event=db_scan_failed op=expired_uploads err=%v instance=%s", err, a.instanceID)
+			break
+		}
+		expired = append(expired, &s)
+	}
+	rows.Close()
+
+	for _, s := range expired {
+		if s.Completed {
+			if _, err := a.db.ExecContext(ctx, `DELETE FROM upload_sessions WHERE id = $1`, s.ID); err != nil {
+				log.Printf("level=ERROR service=go-app event=db_delete_failed op=upload_session upload=%s err=%v instance=%s", s.ID, err, a.instanceID)
+			}
+			continue
+		}
+		a.abortUpload(ctx, s)
+		log.Printf("level=INFO service=go-app event=resumable_upload_expired upload=%s instance=%s", s.ID, a.instanceID)
+	}
+}
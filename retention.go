@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+/* OBJECT LOCK */
+
+// Regulators require KYC documents to stay unchanged for years. With
+// S3_OBJECT_LOCK_MODE set, every document is locked with S3 Object Lock for
+// S3_OBJECT_LOCK_DAYS from when it is stored: no one can overwrite or
+// delete its version before then, in GOVERNANCE mode but those allowed to
+// bypass governance retention. Documents are locked once released from
+// quarantine while malware scanning is on. Otherwise those the app uploads
+// are locked as they are written; direct, resumable and imported uploads
+// once they are verified, since an upload that fails verification is
+// thrown away. The lock is recorded in
+// documents.retention_mode and retain_until, which the API returns. An
+// archived document's copy keeps the lock, and a deleted user's locked
+// documents are deleted once it ends; see deleteDocument.
+
+// objectLocked reports whether documents are locked.
+func (a *app) objectLocked() bool {
+	return a.cfg.S3.ObjectLockMode != "none"
+}
+
+// retainUntil returns until when a document stored at now is locked, or the
+// zero time while documents are not locked.
+func (a *app) retainUntil(now time.Time) time.Time {
+	if !a.objectLocked() {
+		return time.Time{}
+	}
+	return now.AddDate(0, 0, a.cfg.S3.ObjectLockDays).UTC()
+}
+
+// setRetention records in d that it is locked until until, unless until is
+// zero.
+func (a *app) setRetention(d *submittedDocument, until time.Time) {
+	if until.IsZero() {
+		return
+	}
+	d.RetentionMode = a.cfg.S3.ObjectLockMode
+	d.RetainUntil = &until
+}
+
+// lockDocument locks the object version of d, extending a lock it already
+// has, and records the lock in d. A document in quarantine is left for its
+// release to lock.
+func (a *app) lockDocument(ctx context.Context, d *submittedDocument) error {
+	until := a.retainUntil(time.Now())
+	if until.IsZero() || (d.RetainUntil != nil && !d.RetainUntil.Before(until)) || a.inQuarantine(d.Bucket, d.Key) {
+		return nil
+	}
+	_, err := a.s3.PutObjectRetention(ctx, &s3.PutObjectRetentionInput{
+		Bucket:    aws.String(d.Bucket),
+		Key:       aws.String(d.Key),
+		VersionId: versionParam(d.VersionID),
+		Retention: &types.ObjectLockRetention{
+			Mode:            types.ObjectLockRetentionMode(a.cfg.S3.ObjectLockMode),
+			RetainUntilDate: aws.Time(until),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	a.setRetention(d, until)
+	return nil
+}
+
+// checkObjectLock checks that the bucket has Object Lock enabled, without
+// which every locked upload fails.
+func (a *app) checkObjectLock(ctx context.Context) error {
+	out, err := a.s3.GetObjectLockConfiguration(ctx, &s3.GetObjectLockConfigurationInput{Bucket: aws.String(a.cfg.S3.Bucket)})
+	if err != nil {
+		return err
+	}
+	if out.ObjectLockConfiguration == nil || out.ObjectLockConfiguration.ObjectLockEnabled != types.ObjectLockEnabledEnabled {
+		return errors.New("object lock is not enabled on the bucket")
+	}
+	return nil
+}
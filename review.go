@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* KYC REVIEW */
+
+// Review decisions and the status each one moves a submission to.
+const (
+	reviewApprove = "approve"
+	reviewReject  = "reject"
+)
+
+var reviewStatus = map[string]string{
+	reviewApprove: statusApproved,
+	reviewReject:  statusRejected,
+}
+
+// reviewReasons lists the reason codes each decision accepts. "other"
+// needs notes explaining it.
+var reviewReasons = map[string][]string{
+	reviewApprove: {"documents_verified", "manual_verification", "other"},
+	reviewReject:  {"document_unreadable", "document_expired", "details_mismatch", "suspected_fraud", "incomplete_submission", "other"},
+}
+
+// maxReviewNotes bounds the free-text notes of a review.
+const maxReviewNotes = 4000
+
+// requireReviewer admits requests bearing a personal reviewer token from
+// ADMIN_REVIEWERS and records the reviewer's name as the request's actor.
+// The shared admin token is not accepted: a review must name its reviewer.
+func (a *app) requireReviewer(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(a.cfg.Admin.Reviewers) == 0 {
+			writeProblem(w, r, probNotFound, "review endpoints are disabled")
+			return
+		}
+
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		for name, want := range a.cfg.Admin.Reviewers {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1 {
+				next(w, r.WithContext(context.WithValue(r.Context(), actorKey{}, name)))
+				return
+			}
+		}
+
+		log.Printf("level=WARN service=go-app event=reviewer_unauthorized path=%s request_id=%s instance=%s", r.URL.Path, requestID(r.Context()), a.instanceID)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="review"`)
+		writeProblem(w, r, probUnauthorized, "missing or invalid reviewer token")
+	}
+}
+
+// reviewRequest is the body of POST /admin/users/{id}/approve and /reject.
+type reviewRequest struct {
+	ReasonCode string `json:"reason_code"`
+	Notes      string `json:"notes,omitempty"`
+}
+
+// review is a stored row of the kyc_reviews table.
+type review struct {
+	ID         int64     `json:"id"`
+	Decision   string    `json:"decision"`
+	Reviewer   string    `json:"reviewer"`
+	ReasonCode string    `json:"reason_code"`
+	Notes      string    `json:"notes,omitempty"`
+	ReviewedAt time.Time `json:"reviewed_at"`
+}
+
+// reviewResponse is the body returned for a recorded review.
+type reviewResponse struct {
+	User   *user  `json:"user"`
+	Review review `json:"review"`
+}
+
+// recordReview moves user id to the status of rv.Decision and stores rv in
+// the same transaction, so a review never exists without its transition.
+func recordReview(ctx context.Context, db *sql.DB, id int64, rv *review) (*user, error) {
+	var u *user
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		u, err = transitionStatusTx(ctx, tx, id, reviewStatus[rv.Decision], rv.Reviewer, rv.ReasonCode)
+		if err != nil {
+			return err
+		}
+		return tx.QueryRowContext(ctx, `
+		INSERT INTO kyc_reviews(user_id, decision, reviewer, reason_code, notes)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, reviewed_at
+		`, id, rv.Decision, rv.Reviewer, rv.ReasonCode, rv.Notes).Scan(&rv.ID, &rv.ReviewedAt)
+	})
+	return u, err
+}
+
+// reviewHandler handles POST /admin/users/{id}/<decision>. The submission
+// must be in review; anything else is a 409.
+func (a *app) reviewHandler(decision string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(r)
+		if !ok {
+			writeProblem(w, r, probValidation, "invalid user id")
+			return
+		}
+
+		var req reviewRequest
+		if err := decodeJSON(r, &req); err != nil {
+			a.writeBodyError(w, r, err, "invalid JSON body: "+err.Error())
+			return
+		}
+		rv := review{
+			Decision:   decision,
+			Reviewer:   actorFrom(r.Context()),
+			ReasonCode: strings.TrimSpace(req.ReasonCode),
+			Notes:      strings.TrimSpace(req.Notes),
+		}
+		if msg := validReview(rv); msg != "" {
+			writeProblem(w, r, probValidation, msg)
+			return
+		}
+
+		if reviewStatus[decision] == statusApproved && !a.approvable(w, r, id) {
+			return
+		}
+
+		u, err := recordReview(r.Context(), a.db, id, &rv)
+		if te, ok := isTransitionError(err); ok {
+			writeProblem(w, r, probConflict, te.Error())
+			return
+		}
+		if err != nil {
+			a.writeUserResult(w, r, nil, err, id)
+			return
+		}
+
+		log.Printf("level=INFO service=go-app event=kyc_reviewed id=%d decision=%s reason=%s reviewer=%s request_id=%s instance=%s", id, decision, rv.ReasonCode, rv.Reviewer, requestID(r.Context()), a.instanceID)
+		a.tagStatus(r.Context(), u)
+		writeJSON(w, http.StatusOK, reviewResponse{User: u, Review: rv})
+	}
+}
+
+// validReview returns why rv cannot be recorded, or "".
+func validReview(rv review) string {
+	reasons := reviewReasons[rv.Decision]
+	known := false
+	for _, code := range reasons {
+		if code == rv.ReasonCode {
+			known = true
+		}
+	}
+	if !known {
+		sorted := append([]string(nil), reasons...)
+		sort.Strings(sorted)
+		return "reason_code must be one of " + strings.Join(sorted, ", ")
+	}
+	if rv.ReasonCode == "other" && rv.Notes == "" {
+		return `notes are required with reason_code "other"`
+	}
+	if len(rv.Notes) > maxReviewNotes {
+		return "notes may not exceed " + strconv.Itoa(maxReviewNotes) + " characters"
+	}
+	return ""
+}
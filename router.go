@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+)
+
+/* ROUTER */
+
+// middleware wraps a handler with cross-cutting behavior.
+type middleware func(http.HandlerFunc) http.HandlerFunc
+
+// chain wraps h so that mws run in the order given, the first outermost.
+func chain(h http.HandlerFunc, mws ...middleware) http.HandlerFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// router is a thin layer over http.ServeMux, which already matches methods
+// and {name} path parameters. It adds router-wide and per-route middleware
+// and answers unmatched paths and methods through its error writer.
+type router struct {
+	mux     *http.ServeMux
+	handler http.HandlerFunc
+	errors  errorWriter
+}
+
+// errorWriter answers a request with an error of the given kind.
+type errorWriter func(w http.ResponseWriter, r *http.Request, kind problemKind, detail string)
+
+// newRouter returns a router that answers unmatched requests with errors.
+func newRouter(errors errorWriter) *router {
+	rt := &router{mux: http.NewServeMux(), errors: errors}
+	rt.handler = rt.dispatch
+	return rt
+}
+
+// use adds middleware that runs for every request, including ones that
+// match no route. Call it before serving.
+func (rt *router) use(mws ...middleware) {
+	rt.handler = chain(rt.handler, mws...)
+}
+
+// handle registers h for method and path (ServeMux syntax) behind mws.
+// GET routes also answer HEAD.
+func (rt *router) handle(method, path string, h http.HandlerFunc, mws ...middleware) {
+	rt.mux.HandleFunc(method+" "+path, chain(h, mws...))
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.handler(w, r)
+}
+
+func (rt *router) dispatch(w http.ResponseWriter, r *http.Request) {
+	h, pattern := rt.mux.Handler(r)
+	if pattern == "" {
+		// No route matched: ServeMux's handler replies 404, or 405 with an
+		// Allow header. Let it set the headers but swap in our own body.
+		w = &muxErrorWriter{ResponseWriter: w, r: r, errors: rt.errors}
+	}
+	h.ServeHTTP(w, r)
+}
+
+// muxErrorWriter turns ServeMux's plain-text 404 and 405 replies into
+// problems or error pages.
+type muxErrorWriter struct {
+	http.ResponseWriter
+	r         *http.Request
+	errors    errorWriter
+	discarded bool
+}
+
+func (m *muxErrorWriter) WriteHeader(code int) {
+	switch code {
+	case http.StatusNotFound:
+		m.discarded = true
+		m.errors(m.ResponseWriter, m.r, probNotFound, "no route for "+m.r.URL.Path)
+	case http.StatusMethodNotAllowed:
+		m.discarded = true
+		m.errors(m.ResponseWriter, m.r, probMethodNotAllowed, "allowed methods: "+m.Header().Get("Allow"))
+	default:
+		m.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (m *muxErrorWriter) Write(b []byte) (int, error) {
+	if m.discarded {
+		return len(b), nil
+	}
+	return m.ResponseWriter.Write(b)
+}
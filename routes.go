@@ -0,0 +1,454 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"time"
+)
+
+/* ROUTES */
+
+// routeAuth names the credential a route requires.
+type routeAuth int
+
+const (
+	authNone routeAuth = iota
+	authAPI
+	authAdmin
+	authReviewer
+)
+
+// route is one entry of the route table. The same table registers the
+// handlers and generates the OpenAPI document, so the two cannot drift.
+type route struct {
+	Method  string
+	Path    string // ServeMux syntax, e.g. /api/v1/users/{id}
+	Group   routeGroup
+	Handler http.HandlerFunc
+	Auth    routeAuth
+	Hidden  bool // served but left out of the OpenAPI document
+
+	// Middleware runs after the group's stack and the auth check, first
+	// outermost.
+	Middleware []middleware
+	// Timeout bounds the handler: timeoutDefault, timeoutUpload,
+	// timeoutNone or a duration of its own.
+	Timeout time.Duration
+
+	Summary   string
+	Tag       string
+	Query     []queryParam
+	Body      any    // zero value of the request body type
+	BodyType  string // request media type; application/json when Body is set
+	Responses []response
+}
+
+type queryParam struct {
+	Name        string
+	Type        string // OpenAPI primitive type
+	Description string
+}
+
+type response struct {
+	Status      int
+	Description string
+	Body        any    // zero value of the response body type
+	Type        string // media type; application/json when Body is set
+}
+
+// submitForm documents the multipart fields of /submit. The documents
+// must make up those KYC_TIER asks for, with id_document saying which
+// identity document id_front and id_back hold; each file field may
+// instead be sent as "<field>_key" naming a direct upload or
+// "<field>_upload" naming a finished resumable upload.
+type submitForm struct {
+	Name           string `json:"name"`
+	Email          string `json:"email"`
+	Phone          string `json:"phone"`
+	IDFront        []byte `json:"id_front,omitempty"`
+	IDBack         []byte `json:"id_back,omitempty"`
+	ProofOfAddress []byte `json:"proof_of_address,omitempty"`
+	Selfie         []byte `json:"selfie,omitempty"`
+	KYCDocument    []byte `json:"kyc_document,omitempty"`
+	IDFrontKey     string `json:"id_front_key,omitempty"`
+	IDBackKey      string `json:"id_back_key,omitempty"`
+	ProofKey       string `json:"proof_of_address_key,omitempty"`
+	SelfieKey      string `json:"selfie_key,omitempty"`
+	IDDocument     string `json:"id_document,omitempty"`
+	DocumentKey    string `json:"document_key,omitempty"`
+	CSRFToken      string `json:"csrf_token"`
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	FormStarted    string `json:"form_started,omitempty"`
+	Website        string `json:"website,omitempty"`
+	OTPID          string `json:"otp_id,omitempty"`
+	OTPCode        string `json:"otp_code,omitempty"`
+	Consent        string `json:"consent"`
+	PolicyVersion  string `json:"policy_version"`
+}
+
+// replaceDocumentsForm documents the PUT /api/v1/users/{id}/document
+// fields: the document fields of submitForm, any of which may be left out
+// to keep the document already stored.
+type replaceDocumentsForm struct {
+	IDFront        []byte `json:"id_front,omitempty"`
+	IDBack         []byte `json:"id_back,omitempty"`
+	ProofOfAddress []byte `json:"proof_of_address,omitempty"`
+	Selfie         []byte `json:"selfie,omitempty"`
+	KYCDocument    []byte `json:"kyc_document,omitempty"`
+	IDFrontKey     string `json:"id_front_key,omitempty"`
+	IDBackKey      string `json:"id_back_key,omitempty"`
+	ProofKey       string `json:"proof_of_address_key,omitempty"`
+	SelfieKey      string `json:"selfie_key,omitempty"`
+	IDDocument     string `json:"id_document,omitempty"`
+}
+
+// draftDetailsForm documents the POST /apply/details fields.
+type draftDetailsForm struct {
+	Name        string `json:"name"`
+	Email       string `json:"email"`
+	Phone       string `json:"phone"`
+	OTPID       string `json:"otp_id,omitempty"`
+	OTPCode     string `json:"otp_code,omitempty"`
+	CSRFToken   string `json:"csrf_token"`
+	FormStarted string `json:"form_started,omitempty"`
+	Website     string `json:"website,omitempty"`
+}
+
+// draftDocumentsForm documents the POST /apply/documents fields. Documents
+// may be sent a few at a time; each replaces any of its type.
+type draftDocumentsForm struct {
+	IDDocument     string `json:"id_document"`
+	IDFront        []byte `json:"id_front,omitempty"`
+	IDBack         []byte `json:"id_back,omitempty"`
+	ProofOfAddress []byte `json:"proof_of_address,omitempty"`
+	Selfie         []byte `json:"selfie,omitempty"`
+	CSRFToken      string `json:"csrf_token"`
+}
+
+// draftSubmitForm documents the POST /apply/submit fields.
+type draftSubmitForm struct {
+	Consent        string `json:"consent"`
+	PolicyVersion  string `json:"policy_version"`
+	CSRFToken      string `json:"csrf_token"`
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+// otpRequest documents the POST /submit/otp body; browsers without
+// JavaScript post the whole form.
+type otpRequest struct {
+	Phone     string `json:"phone"`
+	CSRFToken string `json:"csrf_token"`
+}
+
+func (a *app) routeTable() []route {
+	text := func(status int, desc string) response {
+		return response{Status: status, Description: desc, Type: "text/plain"}
+	}
+	html := func(status int, desc string) response {
+		return response{Status: status, Description: desc, Type: "text/html"}
+	}
+	fail := func(status int, desc string) response {
+		return response{Status: status, Description: desc, Body: problem{}, Type: "application/problem+json"}
+	}
+	notFound := fail(http.StatusNotFound, "User not found")
+
+	// Both steps of a submission draw from one per-IP budget.
+	submitLimit := a.rateLimit(newRateLimiter())
+	// Status lookups get their own budget, kept apart from submissions, so
+	// guessing references is slow without getting in applicants' way.
+	statusLimit := a.rateLimit(newRateLimiter())
+
+	return []route{
+		// Browser form
+		{Method: "GET", Path: "/{$}", Group: groupForm, Handler: a.formHandler, Tag: "form", Summary: "KYC submission form",
+			Responses: []response{html(200, "The form page")}},
+		{Method: "GET", Path: "/static/", Group: groupForm, Handler: a.staticHandler().ServeHTTP, Hidden: true},
+		{Method: "POST", Path: "/submit", Group: groupForm, Handler: a.submitHandler, Middleware: []middleware{a.closedForMaintenance, submitLimit, a.trackProgress, a.streamUploadForm(a.requireCSRF, a.rejectSpam, a.requireCaptcha)}, Timeout: timeoutUpload, Tag: "form", Summary: "Submit the KYC form",
+			Query: []queryParam{{Name: "upload_token", Type: "string", Description: "Random token, 16-128 URL-safe characters, to follow the upload at /uploads/{token}/progress"}},
+			Body:  submitForm{}, BodyType: "multipart/form-data",
+			Responses: []response{
+				{Status: 200, Description: "Stored; a receipt page for browsers", Body: submitReceipt{}},
+				{Status: 202, Description: "Queued in async mode, or spooled while the database is unavailable", Body: submitReceipt{}},
+				fail(400, "Invalid form"),
+				fail(409, "Idempotency-Key still in progress"),
+				fail(413, "A document exceeds the size limit for its type"),
+				fail(415, "A document is not an accepted type"),
+				fail(422, "A document is damaged, password protected or of the wrong dimensions"),
+				html(503, "Maintenance mode"),
+			}},
+		{Method: "POST", Path: "/submit/uploads", Group: groupForm, Handler: a.createUploadHandler, Middleware: []middleware{a.closedForMaintenance, submitLimit, a.requireCSRF}, Tag: "form", Summary: "Start a resumable document upload",
+			Body: uploadURLRequest{},
+			Responses: []response{
+				{Status: 201, Description: "Upload created; Location names it", Body: resumableUpload{}},
+				fail(404, "Resumable upload disabled"),
+				fail(413, "Document too large"),
+				fail(415, "Unsupported document type"),
+			}},
+		{Method: "HEAD", Path: "/submit/uploads/{id}", Group: groupForm, Handler: a.uploadOffsetHandler, Tag: "form", Summary: "Get a resumable upload's offset",
+			Responses: []response{text(200, "Upload-Offset and Upload-Length headers"), notFound}},
+		{Method: "PATCH", Path: "/submit/uploads/{id}", Group: groupForm, Handler: a.uploadChunkHandler, Middleware: []middleware{a.closedForMaintenance, a.requireCSRF}, Timeout: timeoutUpload, Tag: "form", Summary: "Append a chunk to a resumable upload",
+			Body: []byte{}, BodyType: chunkContentType,
+			Responses: []response{
+				text(204, "Chunk stored; Upload-Offset gives the new offset"),
+				fail(400, "Invalid chunk"),
+				notFound,
+				fail(409, "Offset mismatch"),
+			}},
+		{Method: "DELETE", Path: "/submit/uploads/{id}", Group: groupForm, Handler: a.cancelUploadHandler, Middleware: []middleware{a.requireCSRF}, Tag: "form", Summary: "Cancel a resumable upload",
+			Responses: []response{text(204, "Cancelled"), notFound}},
+		{Method: "POST", Path: "/submit/upload-url", Group: groupForm, Handler: a.uploadURLHandler, Middleware: []middleware{a.closedForMaintenance, submitLimit, a.requireCSRF}, Tag: "form", Summary: "Presign a browser-direct document upload",
+			Body: uploadURLRequest{},
+			Responses: []response{
+				{Status: 200, Description: "Presigned POST", Body: uploadURLResponse{}},
+				fail(404, "Direct upload disabled"),
+				fail(413, "Document too large"),
+				fail(415, "Unsupported document type"),
+			}},
+		{Method: "POST", Path: "/submit/otp", Group: groupForm, Handler: a.otpHandler, Middleware: []middleware{a.closedForMaintenance, submitLimit, a.requireCSRF}, Tag: "form", Summary: "Text a one-time code to the applicant's phone",
+			Body: otpRequest{}, BodyType: "multipart/form-data",
+			Responses: []response{
+				{Status: 200, Description: "Code sent; the form again for browsers", Body: otpResponse{}},
+				fail(400, "Invalid phone number"),
+				fail(404, "SMS codes disabled"),
+				fail(429, "Too many codes sent to this number"),
+				fail(502, "The SMS could not be sent"),
+			}},
+		{Method: "GET", Path: "/apply", Group: groupForm, Handler: a.applyHandler, Tag: "form", Summary: "Multi-step KYC form, at the draft's step",
+			Query:     []queryParam{{Name: "step", Type: "string", Description: "details, documents or review; a step the draft has not reached shows the furthest one reached"}},
+			Responses: []response{html(200, "The step's page"), fail(503, "Database unavailable")}},
+		{Method: "POST", Path: "/apply/details", Group: groupForm, Handler: a.applyDetailsHandler, Middleware: []middleware{a.closedForMaintenance, submitLimit, a.requireCSRF, a.rejectSpam}, Tag: "form", Summary: "Save the personal details step of a draft",
+			Body: draftDetailsForm{}, BodyType: "application/x-www-form-urlencoded",
+			Responses: []response{
+				html(303, "Saved; on to the documents step"),
+				fail(400, "Invalid details"),
+				fail(503, "Database unavailable"),
+			}},
+		{Method: "POST", Path: "/apply/documents", Group: groupForm, Handler: a.applyDocumentsHandler, Middleware: []middleware{a.closedForMaintenance, submitLimit, a.trackProgress, a.streamUploadForm(a.requireCSRF)}, Timeout: timeoutUpload, Tag: "form", Summary: "Upload documents to a draft",
+			Body: draftDocumentsForm{}, BodyType: "multipart/form-data",
+			Responses: []response{
+				html(303, "Saved and complete; on to the review step"),
+				fail(400, "Invalid or incomplete documents; those that were valid are saved"),
+				fail(413, "A document exceeds the size limit for its type"),
+				fail(415, "A document is not an accepted type"),
+				fail(422, "A document is damaged, password protected or of the wrong dimensions"),
+			}},
+		{Method: "POST", Path: "/apply/submit", Group: groupForm, Handler: a.applySubmitHandler, Middleware: []middleware{a.closedForMaintenance, submitLimit, a.requireCSRF, a.requireCaptcha}, Tag: "form", Summary: "Submit a reviewed draft",
+			Body: draftSubmitForm{}, BodyType: "application/x-www-form-urlencoded",
+			Responses: []response{
+				{Status: 200, Description: "Stored; a receipt page for browsers", Body: submitReceipt{}},
+				html(303, "The draft has not reached the review step"),
+				fail(400, "Consent missing"),
+				fail(409, "Idempotency-Key still in progress"),
+				fail(503, "Database unavailable"),
+			}},
+		{Method: "GET", Path: "/uploads/{token}/progress", Group: groupForm, Handler: a.progressHandler, Tag: "form", Summary: "Follow the upload of a form submission",
+			Responses: []response{
+				{Status: 200, Description: "Bytes received so far and the submission's state", Body: uploadProgress{}},
+				fail(404, "No upload with this token"),
+				fail(503, "Database unavailable"),
+			}},
+		{Method: "GET", Path: "/status/{reference}", Group: groupForm, Handler: a.statusHandler, Middleware: []middleware{statusLimit}, Tag: "form", Summary: "Look up an application's status by reference number",
+			Responses: []response{
+				{Status: 200, Description: "Status only; a status page for browsers", Body: publicStatus{}},
+				fail(404, "No submission with this reference"),
+			}},
+		{Method: "GET", Path: "/verify", Group: groupForm, Handler: a.verifyEmailHandler, Middleware: []middleware{statusLimit}, Tag: "form", Summary: "Confirm an applicant's email address",
+			Query: []queryParam{{Name: "token", Type: "string", Description: "Token from the link in the verification email"}},
+			Responses: []response{
+				{Status: 200, Description: "Verified; a confirmation page for browsers"},
+				fail(404, "Unknown or expired link"),
+			}},
+		{Method: "GET", Path: "/status/{reference}/events", Group: groupForm, Handler: a.statusEventsHandler, Middleware: []middleware{statusLimit}, Timeout: timeoutNone, Tag: "form", Summary: "Stream an application's status changes (Server-Sent Events)",
+			Responses: []response{{Status: 200, Description: "status and status_change events", Type: "text/event-stream", Body: statusSnapshot{}}, fail(404, "No submission with this reference")}},
+
+		// Operations
+		{Method: "GET", Path: "/healthz", Group: groupOps, Handler: a.livenessHandler, Tag: "ops", Summary: "Liveness",
+			Responses: []response{text(200, "Serving")}},
+		{Method: "GET", Path: "/readyz", Group: groupOps, Handler: a.readinessHandler, Tag: "ops", Summary: "Readiness",
+			Responses: []response{{Status: 200, Description: "Ready", Body: readinessReport{}}, {Status: 503, Description: "Not ready", Body: readinessReport{}}}},
+		// /health predates the liveness/readiness split and keeps its original
+		// meaning (dependencies reachable) for target groups not yet migrated.
+		{Method: "GET", Path: "/health", Group: groupOps, Handler: a.readinessHandler, Tag: "ops", Summary: "Readiness (legacy alias of /readyz)",
+			Responses: []response{{Status: 200, Description: "Ready", Body: readinessReport{}}, {Status: 503, Description: "Not ready", Body: readinessReport{}}}},
+		{Method: "GET", Path: "/debug/vars", Group: groupOps, Handler: expvar.Handler().ServeHTTP, Auth: authAdmin, Tag: "ops", Summary: "Runtime metrics (expvar)",
+			Responses: []response{{Status: 200, Description: "Counters and runtime statistics", Type: "application/json"}}},
+		{Method: "GET", Path: "/version", Group: groupOps, Handler: a.versionHandler, Tag: "ops", Summary: "Build information",
+			Responses: []response{{Status: 200, Description: "Build", Body: versionResponse{}}}},
+
+		// Users API
+		{Method: "GET", Path: "/api/v1/users", Group: groupAPI, Handler: a.apiListUsers, Auth: authAPI, Tag: "users", Summary: "List users",
+			Query: []queryParam{
+				{"kyc_status", "string", "Filter by status; repeatable or comma-separated"},
+				{"email", "string", "Exact email, case-insensitive"},
+				{"reference", "string", "Submission reference number, e.g. KYC-7F3K-9Q2M"},
+				{"email_verified", "boolean", "Whether the applicant confirmed their email address"},
+				{"disposable_email", "boolean", "Whether the email address is at a disposable provider"},
+				{"created_after", "string", "RFC 3339, inclusive"},
+				{"created_before", "string", "RFC 3339, exclusive"},
+				{"sort", "string", "created_at, -created_at (default), id or -id"},
+				{"limit", "integer", "Page size, 1-200 (default 50)"},
+				{"cursor", "string", "next_cursor from the previous page"},
+			},
+			Responses: []response{{Status: 200, Description: "A page of users", Body: userPage{}}, fail(400, "Invalid query")}},
+		{Method: "POST", Path: "/api/v1/users", Group: groupAPI, Handler: a.apiCreateUser, Middleware: []middleware{a.closedForMaintenance, a.streamUploadForm()}, Auth: authAPI, Tag: "users", Summary: "Create a user",
+			Body: createUserRequest{},
+			Responses: []response{
+				{Status: 201, Description: "Created", Body: user{}},
+				fail(400, "Invalid request"),
+				fail(413, "A document exceeds the size limit for its type"),
+				fail(415, "A document is not an accepted type"),
+				fail(422, "Document not uploaded, damaged or password protected"),
+				fail(503, "Unavailable"),
+			}},
+		{Method: "GET", Path: "/api/v1/users/search", Group: groupAPI, Handler: a.apiSearchUsers, Auth: authAPI, Tag: "users", Summary: "Search users by name, email or phone",
+			Query: []queryParam{
+				{"q", "string", "Text to find; at least 2 characters, misspellings tolerated"},
+				{"limit", "integer", "Page size, 1-100 (default 20)"},
+				{"offset", "integer", "From next_offset of the previous page; at most 1000"},
+			},
+			Responses: []response{
+				{Status: 200, Description: "Matches, best first", Body: searchPage{}},
+				fail(400, "Invalid query"),
+			}},
+		{Method: "GET", Path: "/api/v1/users/export", Group: groupAPI, Handler: a.apiExportUsers, Auth: authAPI, Timeout: timeoutNone, Tag: "users", Summary: "Export users as CSV or JSON Lines",
+			Query: []queryParam{
+				{"kyc_status", "string", "Filter by status; repeatable or comma-separated"},
+				{"email", "string", "Exact email, case-insensitive"},
+				{"reference", "string", "Submission reference number, e.g. KYC-7F3K-9Q2M"},
+				{"email_verified", "boolean", "Whether the applicant confirmed their email address"},
+				{"disposable_email", "boolean", "Whether the email address is at a disposable provider"},
+				{"created_after", "string", "RFC 3339, inclusive"},
+				{"created_before", "string", "RFC 3339, exclusive"},
+				{"sort", "string", "created_at, -created_at (default), id or -id"},
+				{"format", "string", "csv (default) or jsonl"},
+				{"fields", "string", "Comma-separated columns; default all"},
+			},
+			Responses: []response{
+				{Status: 200, Description: "The users, streamed as CSV or application/x-ndjson", Type: "text/csv"},
+				fail(400, "Invalid filter, format or field"),
+			}},
+		{Method: "POST", Path: "/api/v1/users/import", Group: groupAPI, Handler: a.apiImportUsers, Middleware: []middleware{a.closedForMaintenance}, Auth: authAPI, Timeout: timeoutUpload, Tag: "users", Summary: "Import users from CSV",
+			Query: []queryParam{{"dry_run", "boolean", "Validate only; store nothing"}},
+			Body:  "", BodyType: "text/csv",
+			Responses: []response{
+				{Status: 200, Description: "Per-row import report", Body: importReport{}},
+				fail(400, "Invalid CSV header"),
+				fail(413, "CSV too large"),
+				fail(415, "Not text/csv"),
+				fail(503, "Unavailable"),
+			}},
+		{Method: "GET", Path: "/api/v1/users/{id}", Group: groupAPI, Handler: a.apiGetUser, Auth: authAPI, Tag: "users", Summary: "Get a user",
+			Responses: []response{{Status: 200, Description: "The user", Body: user{}}, notFound}},
+		{Method: "PATCH", Path: "/api/v1/users/{id}", Group: groupAPI, Handler: a.apiUpdateUser, Auth: authAPI, Tag: "users", Summary: "Update contact fields",
+			Body:      userPatch{},
+			Responses: []response{{Status: 200, Description: "The updated user", Body: user{}}, notFound}},
+		{Method: "DELETE", Path: "/api/v1/users/{id}", Group: groupAPI, Handler: a.apiDeleteUser, Auth: authAPI, Tag: "users", Summary: "Delete a user and their document",
+			Responses: []response{{Status: 204, Description: "Deleted"}, notFound}},
+		{Method: "GET", Path: "/api/v1/users/{id}/document", Group: groupAPI, Handler: a.apiDownloadDocument, Auth: authAPI, Timeout: timeoutUpload, Tag: "documents", Summary: "Download the KYC document",
+			Responses: []response{
+				{Status: 200, Description: "The document", Type: "application/octet-stream"},
+				{Status: 206, Description: "Part of the document", Type: "application/octet-stream"},
+				notFound,
+				fail(416, "Range not satisfiable"),
+			}},
+		{Method: "GET", Path: "/api/v1/users/{id}/documents.zip", Group: groupAPI, Handler: a.apiDownloadBundle, Auth: authAPI, Timeout: timeoutNone, Tag: "documents", Summary: "Download every document of a user as a zip",
+			Responses: []response{
+				{Status: 200, Description: "The documents, with a manifest.json listing them and any left out", Type: "application/zip"},
+				notFound,
+				fail(503, "Unavailable"),
+			}},
+		{Method: "GET", Path: "/api/v1/users/{id}/documents/{doc}/thumbnail", Group: groupAPI, Handler: a.apiDownloadThumbnail, Auth: authAPI, Tag: "documents", Summary: "Download the preview of an image document",
+			Responses: []response{
+				{Status: 200, Description: "A JPEG preview of the document", Type: "image/jpeg"},
+				fail(404, "No such document, or it has no preview"),
+				fail(409, "The document is quarantined"),
+			}},
+		{Method: "PUT", Path: "/api/v1/users/{id}/document", Group: groupAPI, Handler: a.apiReplaceDocuments, Middleware: []middleware{a.closedForMaintenance, a.streamUploadForm()}, Auth: authAPI, Timeout: timeoutUpload, Tag: "documents", Summary: "Re-upload the documents of a rejected submission",
+			Body: replaceDocumentsForm{}, BodyType: "multipart/form-data",
+			Responses: []response{
+				{Status: 200, Description: "The user, now KYC_RE_UPLOADED, with every document including those replaced", Body: user{}},
+				fail(400, "Invalid form"),
+				notFound,
+				fail(409, "The submission is not rejected"),
+				fail(413, "A document exceeds the size limit for its type"),
+				fail(415, "A document is not an accepted type"),
+				fail(422, "Document not uploaded, damaged or password protected"),
+				fail(503, "Unavailable"),
+			}},
+		{Method: "POST", Path: "/api/v1/users/{id}/document/url", Group: groupAPI, Handler: a.apiPresignDocument, Auth: authAPI, Tag: "documents", Summary: "Issue a presigned document URL",
+			Responses: []response{{Status: 200, Description: "Presigned GET URL", Body: presignedURL{}}, notFound}},
+		{Method: "PATCH", Path: "/api/v1/users/{id}/status", Group: groupAPI, Handler: a.apiUpdateStatus, Auth: authAPI, Tag: "users", Summary: "Change KYC status",
+			Body: statusRequest{},
+			Responses: []response{
+				{Status: 200, Description: "The updated user", Body: user{}},
+				notFound,
+				fail(409, "Transition not allowed"),
+			}},
+		{Method: "GET", Path: "/api/v1/users/{id}/status/history", Group: groupAPI, Handler: a.apiStatusHistory, Auth: authAPI, Tag: "users", Summary: "KYC status history",
+			Responses: []response{{Status: 200, Description: "Status changes, oldest first", Body: statusHistoryResponse{}}, notFound}},
+		{Method: "GET", Path: "/api/v1/users/{id}/events", Group: groupAPI, Handler: a.apiStatusEvents, Auth: authAPI, Timeout: timeoutNone, Tag: "users", Summary: "Stream KYC status changes (Server-Sent Events)",
+			Responses: []response{{Status: 200, Description: "status and status_change events", Type: "text/event-stream", Body: statusChange{}}, notFound}},
+
+		// Documentation
+		{Method: "GET", Path: "/api/docs", Group: groupDocs, Handler: a.docsHandler, Hidden: true},
+		{Method: "GET", Path: "/api/docs/openapi.json", Group: groupDocs, Handler: a.openAPIHandler, Hidden: true},
+
+		// Webhooks
+		{Method: "POST", Path: "/webhooks/kyc-provider", Group: groupHooks, Handler: a.webhookHandler, Tag: "webhooks", Summary: "Receive a verdict from the KYC provider",
+			Body: providerEvent{},
+			Responses: []response{
+				{Status: 200, Description: "Recorded; outcome says what was done", Body: webhookResult{}},
+				fail(400, "Invalid event"),
+				fail(401, "Missing, stale or wrong "+webhookSignatureHeader),
+				fail(404, "Webhooks disabled"),
+				fail(503, "Database unavailable; retry"),
+			}},
+
+		// Admin
+		{Method: "GET", Path: "/admin/maintenance", Group: groupAdmin, Handler: a.maintenanceHandler, Auth: authAdmin, Tag: "admin", Summary: "Get maintenance mode",
+			Responses: []response{{Status: 200, Description: "Current state", Body: maintenanceState{}}}},
+		{Method: "PUT", Path: "/admin/maintenance", Group: groupAdmin, Handler: a.maintenanceHandler, Auth: authAdmin, Tag: "admin", Summary: "Change maintenance mode",
+			Body:      maintenanceState{},
+			Responses: []response{{Status: 200, Description: "New state", Body: maintenanceState{}}, fail(400, "Invalid setting")}},
+		{Method: "GET", Path: "/admin/stats", Group: groupAdmin, Handler: a.adminStatsHandler, Auth: authAdmin, Tag: "admin", Summary: "Submission and review statistics",
+			Query:     []queryParam{{Name: "days", Type: "integer", Description: "Days covered by per_day and review_latency (1-366, default 30)"}},
+			Responses: []response{{Status: 200, Description: "Statistics", Body: adminStats{}}, fail(400, "Invalid days"), fail(503, "Database unavailable")}},
+		{Method: "POST", Path: "/graphql", Group: groupAdmin, Handler: a.graphqlHandler, Auth: authReviewer, Tag: "admin", Summary: "Query users, documents and status history (GraphQL)",
+			Body:      graphqlRequest{},
+			Responses: []response{{Status: 200, Description: "Data, with any field errors", Body: graphqlResponse{}}, {Status: 400, Description: "Query could not be executed", Body: graphqlResponse{}}}},
+		{Method: "GET", Path: "/graphql", Group: groupAdmin, Handler: a.graphqlHandler, Auth: authReviewer, Tag: "admin", Summary: "Run a GraphQL query from the query string",
+			Query: []queryParam{
+				{Name: "query", Type: "string", Description: "GraphQL query document"},
+				{Name: "variables", Type: "string", Description: "JSON object of variable values"},
+				{Name: "operationName", Type: "string", Description: "Operation to run when the document has several"},
+			},
+			Responses: []response{{Status: 200, Description: "Data, with any field errors", Body: graphqlResponse{}}, {Status: 400, Description: "Query could not be executed", Body: graphqlResponse{}}}},
+		{Method: "GET", Path: "/graphql/schema", Group: groupAdmin, Handler: a.graphqlSchemaHandler, Auth: authReviewer, Tag: "admin", Summary: "GraphQL schema (SDL)",
+			Responses: []response{text(200, "The schema")}},
+		{Method: "POST", Path: "/admin/users/{id}/approve", Group: groupAdmin, Handler: a.reviewHandler(reviewApprove), Auth: authReviewer, Tag: "admin", Summary: "Approve a KYC submission",
+			Body:      reviewRequest{},
+			Responses: []response{{Status: 200, Description: "The recorded review", Body: reviewResponse{}}, fail(400, "Invalid review"), notFound, fail(409, "Not in review")}},
+		{Method: "POST", Path: "/admin/users/{id}/reject", Group: groupAdmin, Handler: a.reviewHandler(reviewReject), Auth: authReviewer, Tag: "admin", Summary: "Reject a KYC submission",
+			Body:      reviewRequest{},
+			Responses: []response{{Status: 200, Description: "The recorded review", Body: reviewResponse{}}, fail(400, "Invalid review"), notFound, fail(409, "Not in review")}},
+	}
+}
+
+// middleware returns the stack a route's handler runs behind: its timeout,
+// its group's middleware, then authentication, then its own.
+func (rt route) middleware(a *app) []middleware {
+	var mws []middleware
+	if d := rt.timeout(a); d > 0 {
+		mws = append(mws, a.withTimeout(d))
+	}
+	mws = append(mws, a.groupMiddleware(rt.Group)...)
+	switch rt.Auth {
+	case authAPI:
+		mws = append(mws, a.requireAPIToken)
+	case authAdmin:
+		mws = append(mws, a.requireAdmin)
+	case authReviewer:
+		mws = append(mws, a.requireReviewer)
+	}
+	return append(mws, rt.Middleware...)
+}
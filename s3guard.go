@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsretry "github.com/aws/aws-sdk-go-v2/aws/retry"
+
+	"client_alb_go_s3_rds/config"
+)
+
+/* S3 CIRCUIT BREAKER */
+
+// Every request the S3 client sends goes through an s3Guard. It gives up
+// on a request S3 has not answered within S3_TIMEOUT, and counts requests
+// that failed with a 5xx, a timeout or a broken connection. After
+// S3_BREAKER_THRESHOLD such failures in a row the breaker opens: for
+// S3_BREAKER_COOLDOWN every request fails at once with errS3Unavailable,
+// which the handlers answer with 503, instead of each waiting out its own
+// timeouts and retries. The first request after the cooldown goes through;
+// one more failure opens the breaker again, a success closes it. The SDK's
+// retries, S3_MAX_ATTEMPTS in S3_RETRY_MODE, happen above the guard, so
+// each attempt counts.
+
+// errS3Unavailable is returned for S3 calls refused while the breaker is
+// open.
+var errS3Unavailable = errors.New("S3 is unavailable: too many recent failures")
+
+// errS3Timeout is returned for S3 requests not answered within S3_TIMEOUT.
+var errS3Timeout = errors.New("S3 did not answer in time")
+
+// s3Guard is the HTTP client of the S3 client: next with a timeout and a
+// circuit breaker around each request.
+type s3Guard struct {
+	next       aws.HTTPClient
+	timeout    time.Duration
+	threshold  int
+	cooldown   time.Duration
+	instanceID string
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func newS3Guard(next aws.HTTPClient, cfg config.S3Config, instanceID string) *s3Guard {
+	if next == nil {
+		next = http.DefaultClient
+	}
+	return &s3Guard{
+		next:       next,
+		timeout:    cfg.Timeout,
+		threshold:  cfg.BreakerThreshold,
+		cooldown:   cfg.BreakerCooldown,
+		instanceID: instanceID,
+	}
+}
+
+// newS3Retryer returns the retryer of the S3 client: S3_MAX_ATTEMPTS
+// attempts in S3_RETRY_MODE. Adaptive mode also slows the client down
+// while S3 throttles it. A call refused by the open breaker is not
+// retried.
+func newS3Retryer(cfg config.S3Config) aws.Retryer {
+	standard := func(o *awsretry.StandardOptions) {
+		o.MaxAttempts = cfg.MaxAttempts
+		o.Retryables = append([]awsretry.IsErrorRetryable{awsretry.IsErrorRetryableFunc(func(err error) aws.Ternary {
+			if errors.Is(err, errS3Unavailable) {
+				return aws.FalseTernary
+			}
+			return aws.UnknownTernary
+		})}, o.Retryables...)
+	}
+	if cfg.RetryMode == string(aws.RetryModeStandard) {
+		return awsretry.NewStandard(standard)
+	}
+	return awsretry.NewAdaptiveMode(func(o *awsretry.AdaptiveModeOptions) {
+		o.StandardOptions = append(o.StandardOptions, standard)
+	})
+}
+
+// Do sends req unless the breaker is open. The timeout runs until the
+// response headers arrive, so a download is not cut off while its body
+// streams. Requests uploading a document are exempt: how long they take
+// depends on the applicant's connection, and HTTP_UPLOAD_TIMEOUT bounds
+// them instead.
+func (g *s3Guard) Do(req *http.Request) (*http.Response, error) {
+	if g.open() {
+		metricS3Rejected.Add(1)
+		return nil, errS3Unavailable
+	}
+
+	parent := req.Context()
+	ctx, cancel := context.WithCancel(parent)
+	var timer *time.Timer
+	if g.timeout > 0 && !uploadsDocument(req) {
+		timer = time.AfterFunc(g.timeout, cancel)
+	}
+
+	resp, err := g.next.Do(req.WithContext(ctx))
+	// A timer that can no longer be stopped has canceled the request, or is
+	// about to.
+	switch {
+	case timer != nil && !timer.Stop():
+		cancel()
+		if resp != nil {
+			resp.Body.Close()
+		}
+		g.record(false)
+		return nil, errS3Timeout
+	case err != nil:
+		cancel()
+		// A caller that went away, such as a client disconnecting from a
+		// download, says nothing about S3.
+		if parent.Err() == nil {
+			g.record(false)
+		}
+		return nil, err
+	}
+	g.record(resp.StatusCode < 500)
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// uploadsDocument reports whether req is a PutObject or UploadPart, which
+// carry a document. Other PUTs with a body, such as PutObjectTagging, send
+// a short XML document.
+func uploadsDocument(req *http.Request) bool {
+	if req.Method != http.MethodPut || req.ContentLength == 0 {
+		return false
+	}
+	_, tagging := req.URL.Query()["tagging"]
+	return !tagging
+}
+
+// open reports whether the breaker refuses requests.
+func (g *s3Guard) open() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return time.Now().Before(g.openUntil)
+}
+
+// record counts the outcome of a request, opening or closing the breaker.
+func (g *s3Guard) record(ok bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if ok {
+		if g.failures >= g.threshold {
+			log.Printf("level=INFO service=go-app event=s3_breaker_closed instance=%s", g.instanceID)
+		}
+		g.failures = 0
+		return
+	}
+	g.failures++
+	if g.failures >= g.threshold && !time.Now().Before(g.openUntil) {
+		g.openUntil = time.Now().Add(g.cooldown)
+		metricS3BreakerTrips.Add(1)
+		log.Printf("level=WARN service=go-app event=s3_breaker_opened failures=%d cooldown=%s instance=%s", g.failures, g.cooldown, g.instanceID)
+	}
+}
+
+// cancelOnClose releases a request's context once its response body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// storageProblem is the problem kind of a failed S3 call: unavailable,
+// which tells the client to come back later, while the breaker is open,
+// and a mismatch when what was stored is not what was sent.
+func storageProblem(err error) problemKind {
+	switch {
+	case errors.Is(err, errS3Unavailable):
+		return probStorageUnavailable
+	case errors.Is(err, errStoredMismatch):
+		return probStorageMismatch
+	}
+	return probStorage
+}
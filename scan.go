@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/lib/pq"
+
+	"client_alb_go_s3_rds/config"
+	"client_alb_go_s3_rds/storage"
+)
+
+/* MALWARE SCANNING */
+
+// With CLAMAV_ADDR set, every document is scanned by clamd before its
+// submission can be approved. Every new upload, whether the app, a browser
+// or a resumable upload stores it, lands under the quarantine/ prefix of
+// S3_QUARANTINE_BUCKET, or of the document bucket when that is not set, and
+// is not handed out from there. Once its type and size are verified and
+// clamd finds it clean, it is copied to its key under S3_KEY_PREFIX in the
+// document bucket, which its rows then refer to. A document found infected
+// stays in quarantine, can no longer be downloaded, and every submission it
+// belongs to moves to KYC_QUARANTINED. Objects rejected in quarantine are
+// tagged for a lifecycle rule to expire; see rejectQuarantined.
+// documents.scan_status is NULL until a document has been scanned, then
+// "clean" or "infected", so documents stored while scanning was off are
+// scanned once it is on. Archived documents cannot be read without a
+// restore and are left unscanned.
+
+// Verdicts stored in documents.scan_status.
+const (
+	scanClean    = "clean"
+	scanInfected = "infected"
+)
+
+// scanActor records the scanner in the status history.
+const scanActor = "system:malware-scan"
+
+// scanBatch bounds the objects scanned per run.
+const scanBatch = 20
+
+// The tag objects rejected in quarantine are given, which the quarantine
+// bucket's lifecycle rule expires.
+const (
+	tagQuarantine      = "quarantine"
+	quarantineRejected = "rejected"
+)
+
+// quarantining reports whether new uploads wait in quarantine for their
+// scan. Releasing them copies them, which needs the S3 API.
+func (a *app) quarantining() bool {
+	return a.scanner != nil && a.s3 != nil
+}
+
+// quarantineBucket is the bucket of the quarantine prefix.
+func (a *app) quarantineBucket() string {
+	if b := a.cfg.S3.QuarantineBucket; b != "" {
+		return b
+	}
+	return a.cfg.S3.Bucket
+}
+
+// uploadBucket is where new uploads are stored.
+func (a *app) uploadBucket() string {
+	if a.quarantining() {
+		return a.quarantineBucket()
+	}
+	return a.cfg.S3.Bucket
+}
+
+// inQuarantine reports whether the object key in bucket is in quarantine,
+// waiting for its scan or rejected.
+func (a *app) inQuarantine(bucket, key string) bool {
+	return bucket == a.quarantineBucket() && strings.HasPrefix(key, a.quarantinePrefix())
+}
+
+// quarantinePrefix is where new uploads wait for their scan.
+func (a *app) quarantinePrefix() string {
+	return a.cfg.S3.KeyPrefix + "quarantine/"
+}
+
+// quarantineKey returns where key, a key under S3_KEY_PREFIX, waits for its
+// scan.
+func (a *app) quarantineKey(key string) string {
+	return a.quarantinePrefix() + strings.TrimPrefix(key, a.cfg.S3.KeyPrefix)
+}
+
+// scanDocuments scans a batch of unscanned documents every SCAN_INTERVAL.
+// A document scanned by several instances at once gets the same verdict
+// from each, so running it everywhere is harmless.
+func (a *app) scanDocuments(ctx context.Context) {
+	ticker := time.NewTicker(a.cfg.Scan.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if a.dbDown.Load() {
+			continue
+		}
+
+		rows, err := a.db.QueryContext(ctx, `
+		SELECT bucket, object_key, MIN(COALESCE(version_id, '')), MIN(storage_class) FROM documents
+		WHERE scan_status IS NULL AND storage_class <> ALL($1)
+		GROUP BY bucket, object_key
+		ORDER BY MIN(id)
+		LIMIT $2
+		`, pq.Array(config.ArchiveStorageClasses), scanBatch)
+		if err != nil {
+			log.Printf("level=ERROR service=go-app event=db_query_failed op=scan_documents err=%v instance=%s", err, a.instanceID)
+			continue
+		}
+		var queue []submittedDocument
+		for rows.Next() {
+			var d submittedDocument
+			if err := rows.Scan(&d.Bucket, &d.Key, &d.VersionID, &d.StorageClass); err != nil {
+				log.Printf("level=ERROR service=go-app event=db_scan_failed op=scan_documents err=%v instance=%s", err, a.instanceID)
+				break
+			}
+			queue = append(queue, d)
+		}
+		rows.Close()
+
+		for _, d := range queue {
+			a.scanDocument(ctx, d)
+		}
+	}
+}
+
+// scanDocument streams the object of d to clamd and acts on the verdict. A
+// document that could not be scanned is tried again on the next run.
+func (a *app) scanDocument(ctx context.Context, d submittedDocument) {
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.Scan.Timeout)
+	defer cancel()
+
+	obj, err := a.store.Get(ctx, storage.Object{Bucket: d.Bucket, Key: d.Key, VersionID: d.VersionID}, "")
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=document_scan_failed bucket=%s key=%s err=%v instance=%s", d.Bucket, d.Key, err, a.instanceID)
+		return
+	}
+	result, err := a.scanner.Scan(ctx, obj.Body)
+	obj.Close()
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=document_scan_failed bucket=%s key=%s err=%v instance=%s", d.Bucket, d.Key, err, a.instanceID)
+		return
+	}
+	metricDocumentsScanned.Add(1)
+
+	if result.Infected {
+		a.quarantineDocument(ctx, d, result.Signature)
+		return
+	}
+	a.releaseDocument(ctx, d)
+}
+
+// releaseDocument records d as clean. A document waiting in quarantine is
+// first copied to its key under S3_KEY_PREFIX in the document bucket,
+// locked with Object Lock when documents are, which its rows then refer to;
+// the quarantined object is queued for deletion.
+func (a *app) releaseDocument(ctx context.Context, d submittedDocument) {
+	if !a.inQuarantine(d.Bucket, d.Key) {
+		_, err := a.db.ExecContext(ctx, `
+		UPDATE documents SET scan_status = $3, scanned_at = CURRENT_TIMESTAMP
+		WHERE bucket = $1 AND object_key = $2
+		`, d.Bucket, d.Key, scanClean)
+		if err != nil {
+			log.Printf("level=ERROR service=go-app event=db_update_failed op=release_document key=%s err=%v instance=%s", d.Key, err, a.instanceID)
+			return
+		}
+		log.Printf("level=INFO service=go-app event=document_scanned verdict=clean bucket=%s key=%s instance=%s", d.Bucket, d.Key, a.instanceID)
+		return
+	}
+
+	bucket, key := a.cfg.S3.Bucket, a.cfg.S3.KeyPrefix+strings.TrimPrefix(d.Key, a.quarantinePrefix())
+	source := (&url.URL{Path: d.Bucket + "/" + d.Key}).EscapedPath()
+	if d.VersionID != "" {
+		source += "?versionId=" + url.QueryEscape(d.VersionID)
+	}
+	in := &s3.CopyObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(source),
+		StorageClass:      types.StorageClass(d.StorageClass),
+		MetadataDirective: types.MetadataDirectiveCopy,
+		TaggingDirective:  types.TaggingDirectiveCopy,
+
+		ServerSideEncryption: types.ServerSideEncryptionAwsKms,
+		SSEKMSKeyId:          sseKMSKey(a.cfg.S3),
+	}
+	// The quarantined object is deleted, so only the released one is locked.
+	var mode *string
+	var retainUntil *time.Time
+	if until := a.retainUntil(time.Now()); !until.IsZero() {
+		in.ObjectLockMode = types.ObjectLockMode(a.cfg.S3.ObjectLockMode)
+		in.ObjectLockRetainUntilDate = aws.Time(until)
+		mode, retainUntil = &a.cfg.S3.ObjectLockMode, &until
+	}
+	out, err := a.s3.CopyObject(ctx, in)
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=document_release_failed bucket=%s key=%s err=%v instance=%s", d.Bucket, d.Key, err, a.instanceID)
+		return
+	}
+
+	err = inTx(ctx, a.db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+		UPDATE documents SET bucket = $3, object_key = $4, version_id = $5, scan_status = $6, scanned_at = CURRENT_TIMESTAMP, retention_mode = $7, retain_until = $8
+		WHERE bucket = $1 AND object_key = $2
+		`, d.Bucket, d.Key, bucket, key, out.VersionId, scanClean, mode, retainUntil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET document_bucket = $3, document_key = $4 WHERE document_bucket = $1 AND document_key = $2`, d.Bucket, d.Key, bucket, key); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO document_deletions(bucket, object_key, version_id) VALUES ($1, $2, NULLIF($3, ''))`, d.Bucket, d.Key, d.VersionID)
+		return err
+	})
+	if err != nil {
+		// The copy is left behind; the next run copies over it.
+		log.Printf("level=ERROR service=go-app event=db_update_failed op=release_document key=%s err=%v instance=%s", d.Key, err, a.instanceID)
+		return
+	}
+	log.Printf("level=INFO service=go-app event=document_scanned verdict=clean bucket=%s key=%s released_to=%s/%s instance=%s", d.Bucket, d.Key, bucket, key, a.instanceID)
+}
+
+// quarantineDocument records d as infected with the malware signature and
+// quarantines the submissions it belongs to. A submission that cannot be,
+// such as one already approved, is logged for someone to act on.
+func (a *app) quarantineDocument(ctx context.Context, d submittedDocument, signature string) {
+	metricDocumentsInfected.Add(1)
+	rows, err := a.db.QueryContext(ctx, `
+	UPDATE documents SET scan_status = $3, scan_signature = $4, scanned_at = CURRENT_TIMESTAMP
+	WHERE bucket = $1 AND object_key = $2
+	RETURNING user_id
+	`, d.Bucket, d.Key, scanInfected, signature)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_update_failed op=quarantine_document key=%s err=%v instance=%s", d.Key, err, a.instanceID)
+		return
+	}
+	var users []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("level=ERROR service=go-app event=db_scan_failed op=quarantine_document err=%v instance=%s", err, a.instanceID)
+			break
+		}
+		users = append(users, id)
+	}
+	rows.Close()
+	log.Printf("level=WARN service=go-app event=document_scanned verdict=infected bucket=%s key=%s signature=%q users=%d instance=%s", d.Bucket, d.Key, signature, len(users), a.instanceID)
+	a.rejectQuarantined(ctx, d.Bucket, d.Key, "malware found: "+signature)
+
+	for _, id := range users {
+		u, err := transitionStatus(ctx, a.db, id, statusQuarantined, scanActor, "malware found: "+signature)
+		if te, ok := isTransitionError(err); ok {
+			if te.From != statusQuarantined {
+				log.Printf("level=ERROR service=go-app event=infected_document_unquarantined id=%d status=%s key=%s instance=%s", id, te.From, d.Key, a.instanceID)
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("level=ERROR service=go-app event=db_update_failed op=quarantine_user id=%d err=%v instance=%s", id, err, a.instanceID)
+			continue
+		}
+		log.Printf("level=INFO service=go-app event=kyc_status_changed id=%d status=%s actor=%s instance=%s", id, statusQuarantined, scanActor, a.instanceID)
+		a.tagStatus(ctx, u)
+	}
+}
+
+// rejectQuarantined tags the object key in bucket, if it is in quarantine,
+// as rejected for the reason given, which is logged, so the quarantine
+// bucket's lifecycle rule expires it. Its other tags are kept. The rows of
+// an infected document stay for reviewers to see once its object is gone.
+func (a *app) rejectQuarantined(ctx context.Context, bucket, key, reason string) {
+	if !a.inQuarantine(bucket, key) || a.s3 == nil {
+		return
+	}
+	log.Printf("level=WARN service=go-app event=quarantine_rejected bucket=%s key=%s reason=%q request_id=%s instance=%s", bucket, key, reason, requestID(ctx), a.instanceID)
+	a.putTags(ctx, bucket, key, []types.Tag{{Key: aws.String(tagQuarantine), Value: aws.String(quarantineRejected)}})
+}
+
+// checkQuarantineExpiry checks that S3_QUARANTINE_BUCKET has an enabled
+// lifecycle rule expiring the objects rejectQuarantined tags, without
+// which they are kept forever.
+func (a *app) checkQuarantineExpiry(ctx context.Context) error {
+	bucket := a.quarantineBucket()
+	out, err := a.s3.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		return err
+	}
+	for _, rule := range out.Rules {
+		if rule.Status != types.ExpirationStatusEnabled || rule.Expiration == nil || rule.Filter == nil {
+			continue
+		}
+		var tags []types.Tag
+		if rule.Filter.Tag != nil {
+			tags = append(tags, *rule.Filter.Tag)
+		}
+		if rule.Filter.And != nil {
+			tags = append(tags, rule.Filter.And.Tags...)
+		}
+		for _, t := range tags {
+			if aws.ToString(t.Key) == tagQuarantine && aws.ToString(t.Value) == quarantineRejected {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("bucket %s has no enabled lifecycle rule expiring objects tagged %s=%s", bucket, tagQuarantine, quarantineRejected)
+}
+
+// scanPending reports whether a current document of user id has yet to be
+// scanned, which holds back approval.
+func (a *app) scanPending(ctx context.Context, id int64) (bool, error) {
+	if a.scanner == nil {
+		return false, nil
+	}
+	var pending bool
+	err := a.db.QueryRowContext(ctx, `
+	SELECT EXISTS(SELECT 1 FROM documents WHERE user_id = $1 AND replaced_at IS NULL AND scan_status IS NULL)
+	`, id).Scan(&pending)
+	return pending, err
+}
+
+// approvable answers the request with 409 and returns false while a
+// document of user id awaits its scan.
+func (a *app) approvable(w http.ResponseWriter, r *http.Request, id int64) bool {
+	pending, err := a.scanPending(r.Context(), id)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_query_failed op=scan_pending id=%d err=%v request_id=%s instance=%s", id, err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "database error")
+		return false
+	}
+	if pending {
+		writeProblem(w, r, probConflict, "documents are still being scanned for malware")
+		return false
+	}
+	return true
+}
+
+// documentInfected reports whether the object key in bucket was found to
+// carry malware.
+func documentInfected(ctx context.Context, db *sql.DB, bucket, key string) (bool, error) {
+	var infected bool
+	err := db.QueryRowContext(ctx, `
+	SELECT EXISTS(SELECT 1 FROM documents WHERE bucket = $1 AND object_key = $2 AND scan_status = $3)
+	`, bucket, key, scanInfected).Scan(&infected)
+	return infected, err
+}
+
+// servable answers the request with 409 and returns false when the
+// document key in bucket was found to carry malware, which is never handed
+// out, or is still in quarantine, which is not handed out yet.
+func (a *app) servable(w http.ResponseWriter, r *http.Request, bucket, key string) bool {
+	infected, err := documentInfected(r.Context(), a.db, bucket, key)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_query_failed op=document_infected key=%s err=%v request_id=%s instance=%s", key, err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "database error")
+		return false
+	}
+	if infected {
+		writeProblem(w, r, probConflict, "document is quarantined: malware was found in it")
+		return false
+	}
+	if a.inQuarantine(bucket, key) {
+		writeProblem(w, r, probConflict, "document is still being checked for malware")
+		return false
+	}
+	return true
+}
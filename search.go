@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/* SEARCH */
+
+// Search paging bounds and the shortest query worth running; trigram
+// matching needs a few characters to be selective.
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	maxSearchOffset    = 1000
+	minSearchQuery     = 2
+)
+
+// searchHit is a user matching a search, with its relevance from 0 to 1.
+type searchHit struct {
+	user
+	Score float64 `json:"score"`
+}
+
+// searchPage is the GET /api/v1/users/search response. NextOffset is 0 on
+// the last page.
+type searchPage struct {
+	Users      []searchHit `json:"users"`
+	NextOffset int         `json:"next_offset,omitempty"`
+}
+
+// searchUsers ranks users by how well q matches their name, email or phone,
+// tolerating misspellings through pg_trgm word similarity. Substring
+// matches always qualify; phone numbers are compared on digits only, so
+// "+44 20" finds "020 7946". Ties are broken newest first.
+func searchUsers(ctx context.Context, db *sql.DB, q string, limit, offset int) ([]searchHit, error) {
+	digits := strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, q)
+	like := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q) + "%"
+
+	rows, err := db.QueryContext(ctx, `
+	SELECT `+userColumns+`, score FROM (
+		SELECT *, GREATEST(
+			word_similarity($1::text, name),
+			word_similarity($1, email),
+			CASE WHEN name ILIKE $3 OR email ILIKE $3 THEN 1 ELSE 0 END,
+			CASE WHEN length($2::text) >= 3 AND regexp_replace(phone, '[^0-9]', '', 'g') LIKE '%' || $2 || '%' THEN 1 ELSE 0 END
+		) AS score
+		FROM users
+		WHERE $1 <% name OR $1 <% email OR name ILIKE $3 OR email ILIKE $3
+		   OR (length($2) >= 3 AND regexp_replace(phone, '[^0-9]', '', 'g') LIKE '%' || $2 || '%')
+	) AS matches
+	ORDER BY score DESC, created_at DESC, id DESC
+	LIMIT $4 OFFSET $5
+	`, q, digits, like, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hits := []searchHit{}
+	for rows.Next() {
+		var h searchHit
+		var verifiedAt sql.NullTime
+		err := rows.Scan(&h.ID, &h.Reference, &h.Name, &h.Email, &h.EmailVerified, &verifiedAt, &h.DisposableEmail, &h.Phone, &h.PhoneRaw, &h.Document.Bucket, &h.Document.Key, &h.KYCTier, &h.KYCStatus, &h.CreatedAt, &h.Score)
+		if err != nil {
+			return nil, err
+		}
+		if verifiedAt.Valid {
+			h.EmailVerifiedAt = &verifiedAt.Time
+		}
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
+
+// apiSearchUsers handles GET /api/v1/users/search. Query parameters:
+//
+//	q       text to look for in name, email and phone (required)
+//	limit   page size, 1-100 (default 20)
+//	offset  position of the first result; from next_offset of the previous page
+//
+// Results are ranked, so paging is by offset rather than keyset and stops
+// after the first 1000 results; narrow the query instead.
+func (a *app) apiSearchUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if len([]rune(q)) < minSearchQuery {
+		writeProblem(w, r, probValidation, "q must be at least "+strconv.Itoa(minSearchQuery)+" characters")
+		return
+	}
+
+	limit, offset := defaultSearchLimit, 0
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			writeProblem(w, r, probValidation, "limit must be between 1 and "+strconv.Itoa(maxSearchLimit))
+			return
+		}
+		limit = n
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxSearchOffset {
+			writeProblem(w, r, probValidation, "offset must be between 0 and "+strconv.Itoa(maxSearchOffset))
+			return
+		}
+		offset = n
+	}
+
+	// Fetch one extra row to learn whether another page follows.
+	hits, err := searchUsers(r.Context(), a.db, q, limit+1, offset)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_query_failed op=search_users err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "database error")
+		return
+	}
+
+	page := searchPage{Users: hits}
+	if len(hits) > limit {
+		page.Users = hits[:limit]
+		if next := offset + limit; next <= maxSearchOffset {
+			page.NextOffset = next
+		}
+	}
+	writeJSON(w, http.StatusOK, page)
+}
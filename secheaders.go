@@ -0,0 +1,111 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/* SECURITY HEADERS */
+
+// contentSecurityPolicy returns the configured policy, or one that only
+// allows this origin plus the S3 endpoint the form uploads to directly and
+// the CAPTCHA provider, if any.
+func (a *app) contentSecurityPolicy() string {
+	if a.cfg.Security.ContentSecurityPolicy != "" {
+		return a.cfg.Security.ContentSecurityPolicy
+	}
+	policy := "default-src 'self'; img-src 'self' data:; object-src 'none'; base-uri 'none'; " +
+		"form-action 'self'; frame-ancestors 'none'; connect-src 'self' " + a.s3Origin()
+	if p, ok := a.captcha(); ok {
+		origins := strings.Join(p.origins, " ")
+		policy += " " + origins + "; script-src 'self' " + origins + "; frame-src " + origins + "; style-src 'self' " + origins
+	}
+	return policy
+}
+
+// s3Origin is the origin presigned POSTs to the documents bucket go to.
+func (a *app) s3Origin() string {
+	s3cfg := a.cfg.S3
+	if s3cfg.EndpointURL != "" {
+		u, err := url.Parse(s3cfg.EndpointURL)
+		if err == nil {
+			if s3cfg.UsePathStyle {
+				return u.Scheme + "://" + u.Host
+			}
+			return u.Scheme + "://" + s3cfg.Bucket + "." + u.Host
+		}
+	}
+	return "https://" + s3cfg.Bucket + ".s3." + s3cfg.Region + ".amazonaws.com"
+}
+
+// securityHeaders adds the browser hardening headers. CSP, framing and
+// referrer rules go on HTML responses only, and a handler that sets its
+// own (the API docs page) keeps it. HSTS is sent only over HTTPS, as
+// browsers ignore it otherwise.
+func (a *app) securityHeaders(next http.HandlerFunc) http.HandlerFunc {
+	csp := a.contentSecurityPolicy()
+	cfg := a.cfg.Security
+	hsts := ""
+	if cfg.HSTSMaxAge > 0 {
+		hsts = "max-age=" + strconv.Itoa(int(cfg.HSTSMaxAge.Seconds())) + "; includeSubDomains"
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		secure := isHTTPS(r)
+		next(&headerHookWriter{ResponseWriter: w, hook: func(h http.Header) {
+			h.Set("X-Content-Type-Options", "nosniff")
+			if secure && hsts != "" {
+				h.Set("Strict-Transport-Security", hsts)
+			}
+
+			if mt, _, _ := mime.ParseMediaType(h.Get("Content-Type")); mt != "text/html" {
+				return
+			}
+			setDefault(h, "Content-Security-Policy", csp)
+			setDefault(h, "X-Frame-Options", cfg.FrameOptions)
+			setDefault(h, "Referrer-Policy", cfg.ReferrerPolicy)
+		}}, r)
+	}
+}
+
+func setDefault(h http.Header, key, value string) {
+	if h.Get(key) == "" && value != "" {
+		h.Set(key, value)
+	}
+}
+
+// headerHookWriter runs hook on the headers just before they are sent.
+type headerHookWriter struct {
+	http.ResponseWriter
+	hook  func(http.Header)
+	fired bool
+}
+
+func (hw *headerHookWriter) WriteHeader(code int) {
+	if !hw.fired {
+		hw.fired = true
+		hw.hook(hw.Header())
+	}
+	hw.ResponseWriter.WriteHeader(code)
+}
+
+func (hw *headerHookWriter) Write(b []byte) (int, error) {
+	if !hw.fired {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(b)
+}
+
+func (hw *headerHookWriter) Flush() {
+	if !hw.fired {
+		hw.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(hw.ResponseWriter).Flush()
+}
+
+func (hw *headerHookWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+
+	"client_alb_go_s3_rds/config"
+)
+
+/* SECRETS MANAGER CREDENTIALS */
+
+// rdsSecret is the JSON document RDS and Secrets Manager rotation use for
+// database credentials.
+type rdsSecret struct {
+	Username string      `json:"username"`
+	Password string      `json:"password"`
+	Engine   string      `json:"engine"`
+	Host     string      `json:"host"`
+	Port     json.Number `json:"port"`
+	DBName   string      `json:"dbname"`
+}
+
+func parseRDSSecret(raw string) (*rdsSecret, error) {
+	var s rdsSecret
+	if err := json.Unmarshal([]byte(raw), &s); err != nil {
+		return nil, fmt.Errorf("decode secret: %w", err)
+	}
+	if s.Username == "" || s.Password == "" {
+		return nil, errors.New("secret has no username/password")
+	}
+	if s.Engine != "" && !strings.HasPrefix(s.Engine, "postgres") {
+		return nil, fmt.Errorf("secret is for engine %q, not postgres", s.Engine)
+	}
+	return &s, nil
+}
+
+// apply fills cfg with the secret's credentials and any connection fields
+// the environment left empty.
+func (s *rdsSecret) apply(cfg config.DBConfig) (config.DBConfig, error) {
+	cfg.User, cfg.Password = s.Username, s.Password
+	if cfg.Host == "" {
+		cfg.Host = s.Host
+	}
+	if cfg.Name == "" {
+		cfg.Name = s.DBName
+	}
+	if cfg.Port == 0 && s.Port != "" {
+		port, err := strconv.Atoi(s.Port.String())
+		if err != nil {
+			return cfg, fmt.Errorf("secret has invalid port %q", s.Port)
+		}
+		cfg.Port = port
+	}
+	if cfg.Host == "" || cfg.Port == 0 || cfg.Name == "" {
+		return cfg, errors.New("host, port and dbname must be set in the environment or the secret")
+	}
+	return cfg, nil
+}
+
+// secretConnector is a driver.Connector that resolves credentials from
+// Secrets Manager for every new pooled connection. The secret is cached for
+// cfg.SecretRefresh and re-fetched immediately when Postgres rejects the
+// cached password, which is what happens right after a rotation.
+type secretConnector struct {
+	cfg        config.DBConfig
+	client     *secretsmanager.Client
+	instanceID string
+
+	mu      sync.Mutex
+	secret  *rdsSecret
+	version string
+	fetched time.Time
+}
+
+func newSecretConnector(ctx context.Context, cfg config.DBConfig, instanceID string) (*secretConnector, error) {
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(arnRegion(cfg.SecretARN)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &secretConnector{
+		cfg:        cfg,
+		client:     secretsmanager.NewFromConfig(awsCfg),
+		instanceID: instanceID,
+	}, nil
+}
+
+func (c *secretConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	cfg, err := c.resolve(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialPostgres(ctx, cfg)
+	if isAuthFailure(err) {
+		log.Printf("level=WARN service=go-app event=db_auth_failed action=refresh_secret instance=%s", c.instanceID)
+		if cfg, err = c.resolve(ctx, true); err != nil {
+			return nil, err
+		}
+		conn, err = dialPostgres(ctx, cfg)
+	}
+	return conn, err
+}
+
+func (c *secretConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// resolve returns the connection settings, re-reading the secret when the
+// cached copy is stale or force is set.
+func (c *secretConnector) resolve(ctx context.Context, force bool) (config.DBConfig, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if force || c.secret == nil || time.Since(c.fetched) > c.cfg.SecretRefresh {
+		out, err := c.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+			SecretId: aws.String(c.cfg.SecretARN),
+		})
+		if err != nil {
+			return c.cfg, fmt.Errorf("get secret: %w", err)
+		}
+
+		secret, err := parseRDSSecret(aws.ToString(out.SecretString))
+		if err != nil {
+			return c.cfg, err
+		}
+
+		version := aws.ToString(out.VersionId)
+		if version != c.version {
+			log.Printf("level=INFO service=go-app event=db_secret_loaded version=%s instance=%s", version, c.instanceID)
+		}
+		c.secret, c.version, c.fetched = secret, version, time.Now()
+	}
+
+	return c.secret.apply(c.cfg)
+}
+
+func dialPostgres(ctx context.Context, cfg config.DBConfig) (driver.Conn, error) {
+	connector, err := pq.NewConnector(cfg.DSN())
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+// isAuthFailure reports whether err is Postgres rejecting the password.
+func isAuthFailure(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "28P01"
+}
+
+// arnRegion extracts the region from an ARN such as
+// arn:aws:secretsmanager:ap-south-1:123456789012:secret:name.
+func arnRegion(arn string) string {
+	parts := strings.SplitN(arn, ":", 5)
+	if len(parts) < 5 {
+		return ""
+	}
+	return parts[3]
+}
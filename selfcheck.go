@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"client_alb_go_s3_rds/storage"
+)
+
+/* STARTUP SELF-CHECK */
+
+// checkResult is the outcome of one dependency probe.
+type checkResult struct {
+	Name    string
+	Err     error
+	Latency time.Duration
+}
+
+// selfCheck probes every dependency the submit path needs: the database,
+// the bucket, its default encryption and Object Lock, the quarantine
+// bucket and its expiry rule, or the document store where there is no
+// bucket, and (unless disabled) the ability to write and
+// delete objects, which is where missing IAM permissions show up.
+func (a *app) selfCheck(ctx context.Context) []checkResult {
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.Startup.CheckTimeout)
+	defer cancel()
+
+	var results []checkResult
+	check := func(name string, fn func(context.Context) error) {
+		start := time.Now()
+		err := fn(ctx)
+		results = append(results, checkResult{Name: name, Err: err, Latency: time.Since(start)})
+	}
+
+	check("rds", func(ctx context.Context) error {
+		if a.db == nil {
+			return errors.New("not connected")
+		}
+		return a.db.PingContext(ctx)
+	})
+
+	if a.store == nil {
+		return append(results, checkResult{Name: "s3_client", Err: errors.New("not configured")})
+	}
+	if client := a.s3; client != nil {
+		check("s3_head_bucket", func(ctx context.Context) error {
+			_, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(a.cfg.S3.Bucket)})
+			return err
+		})
+		check("s3_bucket_encryption", a.checkBucketEncryption)
+		if bucket := a.cfg.S3.ArchiveBucket; bucket != "" && bucket != a.cfg.S3.Bucket {
+			check("s3_archive_bucket", func(ctx context.Context) error {
+				_, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+				return err
+			})
+			check("s3_archive_bucket_encryption", a.checkArchiveEncryption)
+		}
+		if bucket := a.cfg.S3.QuarantineBucket; bucket != "" {
+			check("s3_quarantine_bucket", func(ctx context.Context) error {
+				_, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+				return err
+			})
+			check("s3_quarantine_bucket_encryption", func(ctx context.Context) error {
+				return a.checkEncryption(ctx, bucket, a.cfg.S3.KMSKeyID, "S3_KMS_KEY_ID")
+			})
+			check("s3_quarantine_expiry", a.checkQuarantineExpiry)
+		}
+		if a.objectLocked() {
+			check("s3_object_lock", a.checkObjectLock)
+		}
+	} else {
+		check("storage_probe", a.probeStore)
+	}
+
+	if a.cfg.Startup.WriteProbe {
+		obj := storage.Object{Key: a.cfg.S3.KeyPrefix + ".selfcheck/" + a.instanceID}
+		check("s3_put_object", func(ctx context.Context) error {
+			_, err := a.store.Put(ctx, storage.PutInput{Key: obj.Key, Body: strings.NewReader("ok"), Size: 2, ContentType: "text/plain"})
+			return err
+		})
+		check("s3_delete_object", func(ctx context.Context) error {
+			return a.store.Delete(ctx, obj)
+		})
+	}
+
+	return results
+}
+
+// logReport writes one line per check plus a summary line, and reports
+// whether every check passed.
+func (a *app) logReport(results []checkResult) bool {
+	passed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			log.Printf("level=ERROR service=go-app event=selfcheck check=%s status=fail latency=%s err=%q instance=%s", r.Name, r.Latency, r.Err, a.instanceID)
+			continue
+		}
+		passed++
+		log.Printf("level=INFO service=go-app event=selfcheck check=%s status=ok latency=%s instance=%s", r.Name, r.Latency, a.instanceID)
+	}
+
+	ready := passed == len(results)
+	log.Printf("level=INFO service=go-app event=selfcheck_report ready=%t passed=%d total=%d instance=%s", ready, passed, len(results), a.instanceID)
+	return ready
+}
+
+// awaitReady repeats the self-check until it passes, then marks the
+// instance ready so /health starts returning 200 to the ALB.
+func (a *app) awaitReady(ctx context.Context) {
+	for {
+		if a.logReport(a.selfCheck(ctx)) {
+			a.ready.Store(true)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(a.cfg.Startup.RetryInterval):
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+/* HTTP SERVER */
+
+func (a *app) routes() http.Handler {
+	router := newRouter(a.writeError)
+	router.use(a.globalMiddleware()...)
+	for _, rt := range a.routeTable() {
+		router.handle(rt.Method, rt.Path, rt.Handler, rt.middleware(a)...)
+	}
+	return router
+}
+
+// serve runs the HTTP server until ctx is cancelled, then drains in-flight
+// requests for up to the configured drain timeout and closes the DB pool.
+func (a *app) serve(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:              a.cfg.HTTP.Addr(),
+		Handler:           a.routes(),
+		ReadTimeout:       a.cfg.HTTP.ReadTimeout,
+		ReadHeaderTimeout: a.cfg.HTTP.ReadHeaderTimeout,
+		WriteTimeout:      a.cfg.HTTP.WriteTimeout,
+		IdleTimeout:       a.cfg.HTTP.IdleTimeout,
+		MaxHeaderBytes:    a.cfg.HTTP.MaxHeaderBytes,
+	}
+
+	listen := srv.ListenAndServe
+	if a.cfg.HTTP.TLSEnabled() {
+		certs, err := newCertReloader(a.cfg.HTTP.TLSCertFile, a.cfg.HTTP.TLSKeyFile, a.instanceID)
+		if err != nil {
+			return err
+		}
+		go certs.watch(ctx, a.cfg.HTTP.TLSReloadInterval)
+
+		srv.TLSConfig = serverTLSConfig(certs.getCertificate)
+		listen = func() error { return srv.ListenAndServeTLS("", "") }
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("level=INFO service=go-app event=server_started addr=%s tls=%t instance=%s", srv.Addr, a.cfg.HTTP.TLSEnabled(), a.instanceID)
+		errCh <- listen()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("level=INFO service=go-app event=shutdown_started drain_timeout=%s instance=%s", a.cfg.HTTP.DrainTimeout, a.instanceID)
+	a.draining.Store(true)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), a.cfg.HTTP.DrainTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("level=WARN service=go-app event=drain_incomplete err=%v instance=%s", err, a.instanceID)
+		srv.Close()
+	}
+
+	// ctx is done, so the loops are already on their way out.
+	a.background.Wait()
+	if err := a.db.Close(); err != nil {
+		log.Printf("level=ERROR service=go-app event=db_close_failed err=%v instance=%s", err, a.instanceID)
+	}
+
+	log.Printf("level=INFO service=go-app event=shutdown_complete instance=%s", a.instanceID)
+	return nil
+}
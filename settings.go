@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+
+	"client_alb_go_s3_rds/config"
+)
+
+/* HOT-RELOADABLE SETTINGS */
+
+// settingsStore holds the current runtime settings. Readers call get on
+// every use so a reload takes effect on the next request without a restart.
+type settingsStore struct {
+	base       config.Settings
+	sources    config.SettingsSources
+	ssm        *ssm.Client
+	logs       *levelWriter
+	instanceID string
+
+	current  atomic.Pointer[config.Settings]
+	reloadMu sync.Mutex
+	local    map[string]string
+}
+
+func newSettingsStore(cfg *config.Config, logs *levelWriter, instanceID string) *settingsStore {
+	s := &settingsStore{
+		base:       cfg.Settings,
+		sources:    cfg.SettingsSources,
+		logs:       logs,
+		instanceID: instanceID,
+		local:      map[string]string{},
+	}
+
+	if s.sources.SSMPath != "" {
+		awsCfg, err := awsconfig.LoadDefaultConfig(context.Background())
+		if err != nil {
+			log.Printf("level=ERROR service=go-app event=settings_ssm_disabled err=%v instance=%s", err, instanceID)
+		} else {
+			s.ssm = ssm.NewFromConfig(awsCfg)
+		}
+	}
+
+	initial := cfg.Settings
+	s.current.Store(&initial)
+	logs.setLevel(initial.LogLevel)
+	return s
+}
+
+func (s *settingsStore) get() config.Settings {
+	return *s.current.Load()
+}
+
+// run reloads on SIGHUP and, when an SSM path is configured, on every poll
+// interval, until ctx is done.
+func (s *settingsStore) run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if s.ssm != nil {
+		ticker := time.NewTicker(s.sources.PollInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	s.reload(ctx, "startup")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			s.reload(ctx, "sighup")
+		case <-tick:
+			s.reload(ctx, "ssm_poll")
+		}
+	}
+}
+
+// set changes one setting, validating it first. With an SSM path the
+// parameter is written there so every instance picks it up on its next
+// poll; otherwise the change applies to this instance only.
+func (s *settingsStore) set(ctx context.Context, key, value string) error {
+	if _, err := config.ParseSettings(s.get(), func(k string) (string, bool) {
+		return value, k == key
+	}); err != nil {
+		return err
+	}
+
+	if s.ssm != nil {
+		_, err := s.ssm.PutParameter(ctx, &ssm.PutParameterInput{
+			Name:      aws.String(path.Join(s.sources.SSMPath, strings.ToLower(key))),
+			Value:     aws.String(value),
+			Type:      ssmtypes.ParameterTypeString,
+			Overwrite: aws.Bool(true),
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		s.reloadMu.Lock()
+		s.local[key] = value
+		s.reloadMu.Unlock()
+	}
+
+	s.reload(ctx, "admin")
+	return nil
+}
+
+// reload rebuilds the settings as env < file < SSM < local admin changes.
+// An invalid or unreadable source keeps the previous settings in place.
+func (s *settingsStore) reload(ctx context.Context, trigger string) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	overrides := map[string]string{}
+
+	if s.sources.File != "" {
+		vars, err := config.ReadDotEnv(s.sources.File)
+		if err != nil {
+			log.Printf("level=ERROR service=go-app event=settings_reload_failed source=file trigger=%s err=%v instance=%s", trigger, err, s.instanceID)
+			return
+		}
+		for k, v := range vars {
+			overrides[k] = v
+		}
+	}
+
+	if s.ssm != nil {
+		vars, err := s.fetchSSM(ctx)
+		if err != nil {
+			log.Printf("level=ERROR service=go-app event=settings_reload_failed source=ssm trigger=%s err=%v instance=%s", trigger, err, s.instanceID)
+			return
+		}
+		for k, v := range vars {
+			overrides[k] = v
+		}
+	}
+
+	for k, v := range s.local {
+		overrides[k] = v
+	}
+
+	next, err := config.ParseSettings(s.base, func(key string) (string, bool) {
+		v, ok := overrides[key]
+		return v, ok
+	})
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=settings_reload_failed trigger=%s err=%q instance=%s", trigger, err, s.instanceID)
+		return
+	}
+
+	prev := s.get()
+	if next == prev {
+		return
+	}
+
+	s.current.Store(&next)
+	s.logs.setLevel(next.LogLevel)
+	log.Printf("level=INFO service=go-app event=settings_reloaded trigger=%s log_level=%s max_upload_bytes=%d rate_limit_rps=%g rate_limit_burst=%d maintenance=%t maintenance_ready=%t instance=%s",
+		trigger, next.LogLevel, next.MaxUploadBytes, next.RateLimitRPS, next.RateLimitBurst, next.Maintenance, next.MaintenanceReady, s.instanceID)
+}
+
+// fetchSSM reads every parameter under the configured path. The last path
+// segment, upper-cased, is the setting name, so /kyc/prod/log_level sets
+// LOG_LEVEL.
+func (s *settingsStore) fetchSSM(ctx context.Context) (map[string]string, error) {
+	vars := map[string]string{}
+
+	pages := ssm.NewGetParametersByPathPaginator(s.ssm, &ssm.GetParametersByPathInput{
+		Path:           aws.String(s.sources.SSMPath),
+		Recursive:      aws.Bool(false),
+		WithDecryption: aws.Bool(true),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page.Parameters {
+			name := strings.ToUpper(path.Base(aws.ToString(p.Name)))
+			vars[name] = aws.ToString(p.Value)
+		}
+	}
+	return vars, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* SPAM */
+
+// The form carries two cheap bot checks. The honeypot is a text field
+// people never see, which bots filling in every field fill in too. The
+// form_started field records when the form was served, so that a
+// submission sent sooner than a person could fill it in stands out. It is
+// signed with the CSRF token, so only a client that loaded the form has a
+// valid one, and is checked after requireCSRF has vouched for the token.
+const (
+	honeypotField    = "website"
+	formStartedField = "form_started"
+)
+
+// formStarted returns the form_started value for a form served now to
+// the holder of the CSRF token.
+func formStarted(token string, now time.Time) string {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	return ts + "." + formStartedMAC(token, ts)
+}
+
+func formStartedMAC(token, ts string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(formStartedField + ":" + ts))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// spamReason returns why the form post r looks automated, or "" if it
+// does not.
+func (a *app) spamReason(r *http.Request) string {
+	cfg := a.cfg.Spam
+	if cfg.Honeypot && r.PostFormValue(honeypotField) != "" {
+		return "honeypot"
+	}
+	if cfg.MinFillTime <= 0 {
+		return ""
+	}
+	cookie, err := r.Cookie(csrfCookie)
+	ts, sig, ok := strings.Cut(r.PostFormValue(formStartedField), ".")
+	if err != nil || !ok || !hmac.Equal([]byte(sig), []byte(formStartedMAC(cookie.Value, ts))) {
+		return "no_start_time"
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "no_start_time"
+	}
+	if time.Since(time.Unix(sec, 0)) < cfg.MinFillTime {
+		return "too_fast"
+	}
+	return ""
+}
+
+// rejectSpam drops form posts that fail the honeypot or fill-time check,
+// answering with a receipt like a stored submission gets so bots learn
+// nothing, or with SPAM_ACTION=flag only logs them. It must run after
+// requireCSRF.
+func (a *app) rejectSpam(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reason := a.spamReason(r)
+		if reason == "" {
+			next(w, r)
+			return
+		}
+
+		metricSpamSubmissions.Add(1)
+		action := a.cfg.Spam.Action
+		log.Printf("level=WARN service=go-app event=spam_detected reason=%s action=%s client_ip=%s user_agent=%q request_id=%s instance=%s", reason, action, a.clientIP(r), r.UserAgent(), requestID(r.Context()), a.instanceID)
+		if action == "flag" {
+			next(w, r)
+			return
+		}
+		ref := newReference()
+		a.writeReceipt(w, r, nil, 0, http.StatusOK, submitReceipt{
+			Reference: ref,
+			Status:    statusUploaded,
+			Message:   tr(r, "receipt.stored"),
+			StatusURL: statusURL(ref),
+			Instance:  a.identity.String(),
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"client_alb_go_s3_rds/config"
+)
+
+/* SERVER-SIDE ENCRYPTION */
+
+// KYC documents are encrypted at rest with SSE-KMS under the customer
+// managed key S3_KMS_KEY_ID, or the account's aws/s3 key when it is unset;
+// those copied to S3_ARCHIVE_BUCKET under S3_ARCHIVE_KMS_KEY_ID.
+// Every write the app makes asks for it, and the self-check keeps an
+// instance out of service unless the bucket's default encryption is
+// SSE-KMS under the same key, so objects written any other way are
+// encrypted alike.
+
+// sseKMSKey returns the KMS key objects are encrypted under, or nil for the
+// aws/s3 key.
+func sseKMSKey(cfg config.S3Config) *string {
+	if cfg.KMSKeyID == "" {
+		return nil
+	}
+	return aws.String(cfg.KMSKeyID)
+}
+
+// objectKMSKey returns the KMS key the object key in bucket is encrypted
+// under: S3_ARCHIVE_KMS_KEY_ID once archived, S3_KMS_KEY_ID before.
+func (a *app) objectKMSKey(bucket, key string) *string {
+	if a.archived(bucket, key) {
+		return sseKMSKey(config.S3Config{KMSKeyID: a.cfg.S3.ArchiveKMSKeyID})
+	}
+	return sseKMSKey(a.cfg.S3)
+}
+
+// checkBucketEncryption fails unless the bucket encrypts new objects with
+// SSE-KMS by default, under S3_KMS_KEY_ID when it is set.
+func (a *app) checkBucketEncryption(ctx context.Context) error {
+	return a.checkEncryption(ctx, a.cfg.S3.Bucket, a.cfg.S3.KMSKeyID, "S3_KMS_KEY_ID")
+}
+
+// checkArchiveEncryption is checkBucketEncryption for S3_ARCHIVE_BUCKET and
+// S3_ARCHIVE_KMS_KEY_ID.
+func (a *app) checkArchiveEncryption(ctx context.Context) error {
+	return a.checkEncryption(ctx, a.cfg.S3.ArchiveBucket, a.cfg.S3.ArchiveKMSKeyID, "S3_ARCHIVE_KMS_KEY_ID")
+}
+
+// checkEncryption fails unless bucket encrypts new objects with SSE-KMS by
+// default, under keyID, named by the variable keyVar, when it is set.
+func (a *app) checkEncryption(ctx context.Context, bucket, keyID, keyVar string) error {
+	out, err := a.s3.GetBucketEncryption(ctx, &s3.GetBucketEncryptionInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		return err
+	}
+	if out.ServerSideEncryptionConfiguration != nil {
+		for _, rule := range out.ServerSideEncryptionConfiguration.Rules {
+			def := rule.ApplyServerSideEncryptionByDefault
+			if def == nil || (def.SSEAlgorithm != types.ServerSideEncryptionAwsKms && def.SSEAlgorithm != types.ServerSideEncryptionAwsKmsDsse) {
+				continue
+			}
+			if keyID == "" || kmsKeyName(aws.ToString(def.KMSMasterKeyID)) == kmsKeyName(keyID) {
+				return nil
+			}
+			return fmt.Errorf("bucket %s encrypts with KMS key %s, not %s", bucket, aws.ToString(def.KMSMasterKeyID), keyVar)
+		}
+	}
+	return fmt.Errorf("bucket %s does not enforce SSE-KMS by default", bucket)
+}
+
+// kmsKeyName reduces a KMS key ARN to the key ID, and an alias ARN to
+// alias/name, so a key named either way compares equal.
+func kmsKeyName(id string) string {
+	if strings.HasPrefix(id, "arn:") {
+		id = id[strings.LastIndex(id, ":")+1:]
+	}
+	return strings.TrimPrefix(id, "key/")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/* ADMIN STATISTICS */
+
+// Bounds of the ?days window of GET /admin/stats. Hourly counts always
+// cover the last day.
+const (
+	defaultStatsDays = 30
+	maxStatsDays     = 366
+	statsHours       = 24
+)
+
+// adminStats is the GET /admin/stats response.
+type adminStats struct {
+	GeneratedAt    time.Time        `json:"generated_at"`
+	Total          int64            `json:"total"`
+	ByStatus       map[string]int64 `json:"by_status"`
+	PerDay         []statsBucket    `json:"per_day"`
+	PerHour        []statsBucket    `json:"per_hour"`
+	ReviewLatency  reviewLatency    `json:"review_latency"`
+	UploadFailures uploadFailures   `json:"upload_failures"`
+}
+
+// statsBucket counts the submissions made in the period starting at Start.
+// Periods without submissions are included with a zero count.
+type statsBucket struct {
+	Start time.Time `json:"start"`
+	Count int64     `json:"count"`
+}
+
+// reviewLatency is the time from submission to first review decision,
+// over the users first reviewed inside the window.
+type reviewLatency struct {
+	Reviewed       int64   `json:"reviewed"`
+	AverageSeconds float64 `json:"average_seconds"`
+}
+
+// uploadFailures counts failed S3 uploads. Failures are not stored, so the
+// count is this instance's since it started.
+type uploadFailures struct {
+	Instance string `json:"instance"`
+	Count    int64  `json:"count"`
+}
+
+// adminStatsHandler handles GET /admin/stats?days=N: submission counts by
+// status, per day over the last N days (default 30) and per hour over the
+// last day, the average review latency over the same N days, and upload
+// failures. Every figure is one aggregate query served by an index.
+func (a *app) adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	days := defaultStatsDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxStatsDays {
+			writeProblem(w, r, probValidation, "days must be between 1 and "+strconv.Itoa(maxStatsDays))
+			return
+		}
+		days = n
+	}
+	if a.dbDown.Load() {
+		writeProblem(w, r, probDatabaseUnavailable, "database unavailable")
+		return
+	}
+
+	stats, err := collectStats(r.Context(), a.db, time.Now().UTC(), days)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_query_failed op=admin_stats err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "database error")
+		return
+	}
+	stats.UploadFailures = uploadFailures{Instance: a.instanceID, Count: metricUploadFailures.Value()}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// collectStats computes the database figures of adminStats as of now.
+func collectStats(ctx context.Context, db *sql.DB, now time.Time, days int) (*adminStats, error) {
+	stats := &adminStats{GeneratedAt: now, ByStatus: map[string]int64{}}
+
+	rows, err := db.QueryContext(ctx, `SELECT COALESCE(kyc_status, $1), COUNT(*) FROM users GROUP BY 1`, statusUploaded)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		var n int64
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		stats.ByStatus[status] += n
+		stats.Total += n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	today := now.Truncate(24 * time.Hour)
+	if stats.PerDay, err = countSubmissions(ctx, db, "day", today.AddDate(0, 0, 1-days), days, 24*time.Hour); err != nil {
+		return nil, err
+	}
+	hour := now.Truncate(time.Hour)
+	if stats.PerHour, err = countSubmissions(ctx, db, "hour", hour.Add(-(statsHours-1)*time.Hour), statsHours, time.Hour); err != nil {
+		return nil, err
+	}
+
+	var avg sql.NullFloat64
+	err = db.QueryRowContext(ctx, `
+	SELECT COUNT(*), AVG(EXTRACT(EPOCH FROM r.reviewed_at - u.created_at))
+	FROM (SELECT user_id, MIN(reviewed_at) AS reviewed_at FROM kyc_reviews GROUP BY user_id) r
+	JOIN users u ON u.id = r.user_id
+	WHERE r.reviewed_at >= $1
+	`, today.AddDate(0, 0, 1-days)).Scan(&stats.ReviewLatency.Reviewed, &avg)
+	if err != nil {
+		return nil, err
+	}
+	stats.ReviewLatency.AverageSeconds = avg.Float64
+	return stats, nil
+}
+
+// countSubmissions counts users created in n periods of length step from
+// since, truncating created_at to unit ("day" or "hour").
+func countSubmissions(ctx context.Context, db *sql.DB, unit string, since time.Time, n int, step time.Duration) ([]statsBucket, error) {
+	buckets := make([]statsBucket, n)
+	for i := range buckets {
+		buckets[i].Start = since.Add(time.Duration(i) * step)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+	SELECT date_trunc($1, created_at), COUNT(*) FROM users
+	WHERE created_at >= $2
+	GROUP BY 1
+	`, unit, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var start time.Time
+		var count int64
+		if err := rows.Scan(&start, &count); err != nil {
+			return nil, err
+		}
+		if i := int(start.Sub(since) / step); i >= 0 && i < n {
+			buckets[i].Count = count
+		}
+	}
+	return buckets, rows.Err()
+}
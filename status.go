@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+/* PUBLIC STATUS */
+
+// statusLabels are the message keys of the applicant-facing wording of
+// each KYC status.
+var statusLabels = map[string]string{
+	statusUploaded:    "status.uploaded",
+	statusInReview:    "status.in_review",
+	statusApproved:    "status.approved",
+	statusRejected:    "status.rejected",
+	statusReUploaded:  "status.re_uploaded",
+	statusQuarantined: "status.quarantined",
+}
+
+// publicStatus is the JSON body of GET /status/{reference}. It carries
+// nothing that identifies the applicant.
+type publicStatus struct {
+	Reference string    `json:"reference"`
+	Status    string    `json:"status"`
+	Label     string    `json:"label"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// userByReference returns the user with reference ref.
+func userByReference(ctx context.Context, db *sql.DB, ref string) (*user, error) {
+	return scanUser(db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE reference = $1`, ref))
+}
+
+// lookupReference resolves the {reference} path parameter, answering the
+// request itself when it cannot. Unknown and malformed references get the
+// same 404, so the endpoint says nothing about which references exist.
+// With pending set, a submission still queued in async mode is reported
+// instead of the 404.
+func (a *app) lookupReference(w http.ResponseWriter, r *http.Request, pending bool) (*user, bool) {
+	ref := normalizeReference(r.PathValue("reference"))
+	var u *user
+	err := errUserNotFound
+	if ref != "" {
+		u, err = userByReference(r.Context(), a.db, ref)
+	}
+	if errors.Is(err, errUserNotFound) {
+		if pending && ref != "" && a.writePendingStatus(w, r, ref) {
+			return nil, false
+		}
+		if !a.writeStatusPage(w, r, http.StatusNotFound, r.PathValue("reference"), tr(r, "status.not_found"), tr(r, "status.not_found_detail")) {
+			writeProblem(w, r, probNotFound, "no submission with this reference")
+		}
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_query_failed op=status_lookup err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probDatabase, "database error")
+		return nil, false
+	}
+	return u, true
+}
+
+// statusHandler handles GET /status/{reference}: a page for browsers and
+// JSON otherwise, giving an applicant the status of their submission.
+func (a *app) statusHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.lookupReference(w, r, true)
+	if !ok {
+		return
+	}
+
+	st := publicStatus{Reference: u.Reference, Status: u.KYCStatus, UpdatedAt: u.CreatedAt.UTC()}
+	if st.Status == "" {
+		st.Status = statusUploaded
+	}
+	st.Label = tr(r, statusLabels[st.Status])
+	var changed sql.NullTime
+	if err := a.db.QueryRowContext(r.Context(), `SELECT MAX(changed_at) FROM kyc_status_history WHERE user_id = $1`, u.ID).Scan(&changed); err != nil {
+		log.Printf("level=WARN service=go-app event=db_query_failed op=status_updated_at err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+	} else if changed.Valid {
+		st.UpdatedAt = changed.Time.UTC()
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if a.writeStatusPage(w, r, http.StatusOK, st.Reference, st.Label, tr(r, "status.updated_at", st.UpdatedAt.Format("2 January 2006, 15:04 UTC"))) {
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// writePendingStatus answers for a submission queued under ref that has
+// no user yet, reporting false when there is none. Why a job failed stays
+// in the logs; the applicant is only asked to submit again.
+func (a *app) writePendingStatus(w http.ResponseWriter, r *http.Request, ref string) bool {
+	state, err := queuedSubmission(r.Context(), a.db, ref)
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=db_query_failed op=status_job_lookup err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		return false
+	}
+	st := publicStatus{Reference: ref, UpdatedAt: time.Now().UTC()}
+	detail := ""
+	switch state {
+	case jobQueued:
+		st.Status, st.Label = "processing", tr(r, "status.processing")
+		detail = tr(r, "status.processing_detail")
+	case jobFailed:
+		st.Status, st.Label = jobFailed, tr(r, "status.failed")
+		detail = tr(r, "status.failed_detail")
+	default:
+		return false
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if !a.writeStatusPage(w, r, http.StatusOK, ref, st.Label, detail) {
+		writeJSON(w, http.StatusOK, st)
+	}
+	return true
+}
+
+// statusEventsHandler handles GET /status/{reference}/events, the public
+// status stream the status page listens to.
+func (a *app) statusEventsHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.lookupReference(w, r, false)
+	if !ok {
+		return
+	}
+	a.streamStatus(w, r, u, true)
+}
+
+// statusPage is what web/status.html is rendered with.
+type statusPage struct {
+	Reference string
+	Label     string
+	Detail    string
+}
+
+// writeStatusPage renders web/status.html for browsers. It reports false,
+// having written nothing, for other clients.
+func (a *app) writeStatusPage(w http.ResponseWriter, r *http.Request, status int, ref, label, detail string) bool {
+	if !wantsHTML(r) {
+		return false
+	}
+	t, _, err := a.pageTemplate(r, "status.html")
+	if err != nil {
+		return false
+	}
+	var page bytes.Buffer
+	if err := t.Execute(&page, pageData{language(r.Context()), statusPage{ref, label, detail}}); err != nil {
+		log.Printf("level=ERROR service=go-app event=status_page_unavailable err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		return false
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(page.Bytes())
+	return true
+}
@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Local stores blobs as files under Dir, one directory per bucket. What S3
+// keeps with an object, its content type, disposition, metadata and
+// checksum, is kept in a JSON file of the same path under Dir/.meta. It has
+// no versions, storage classes or tags, and cannot presign URLs.
+type Local struct {
+	Dir    string
+	Bucket string
+}
+
+// localMeta is the JSON file kept with each blob.
+type localMeta struct {
+	ContentType        string            `json:"content_type,omitempty"`
+	ContentDisposition string            `json:"content_disposition,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	SHA256             []byte            `json:"sha256,omitempty"`
+}
+
+// Put writes in to a temporary file first and renames it into place, so a
+// reader never sees half a blob. The SHA-256 of what was written is kept
+// with it.
+func (l *Local) Put(ctx context.Context, in PutInput) (Object, error) {
+	obj := Object{Bucket: in.Bucket, Key: in.Key}
+	if obj.Bucket == "" {
+		obj.Bucket = l.Bucket
+	}
+	path, metaPath, err := l.paths(obj)
+	if err != nil {
+		return Object{}, err
+	}
+	sum := sha256.New()
+	if err := writeFile(path, io.TeeReader(in.Body, sum)); err != nil {
+		return Object{}, err
+	}
+	meta, err := json.Marshal(localMeta{ContentType: in.ContentType, ContentDisposition: in.ContentDisposition, Metadata: in.Metadata, SHA256: sum.Sum(nil)})
+	if err != nil {
+		return Object{}, err
+	}
+	if err := writeFile(metaPath, bytes.NewReader(meta)); err != nil {
+		return Object{}, err
+	}
+	return obj, nil
+}
+
+// Get opens obj. rng may name one range of bytes, as "bytes=first-last",
+// "bytes=first-" or "bytes=-suffix".
+func (l *Local) Get(ctx context.Context, obj Object, rng string) (*Blob, error) {
+	info, err := l.Head(ctx, obj)
+	if err != nil {
+		return nil, err
+	}
+	path, _, _ := l.paths(obj)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, localError(err)
+	}
+	if rng == "" {
+		return &Blob{Info: *info, Body: f}, nil
+	}
+
+	first, last, ok := parseRange(rng, info.Size)
+	if !ok {
+		f.Close()
+		return nil, ErrInvalidRange
+	}
+	if _, err := f.Seek(first, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	blob := &Blob{
+		Info: *info,
+		Body: struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(f, last-first+1), f},
+		ContentRange: fmt.Sprintf("bytes %d-%d/%d", first, last, info.Size),
+	}
+	blob.Size = last - first + 1
+	return blob, nil
+}
+
+// Head describes obj from its file and the JSON file kept with it.
+func (l *Local) Head(ctx context.Context, obj Object) (*Info, error) {
+	if obj.VersionID != "" {
+		return nil, fmt.Errorf("%w: version %s", ErrNotFound, obj.VersionID)
+	}
+	path, metaPath, err := l.paths(obj)
+	if err != nil {
+		return nil, err
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, localError(err)
+	}
+	var meta localMeta
+	if data, err := os.ReadFile(metaPath); err == nil {
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, err
+		}
+	}
+	return &Info{
+		Size:               st.Size(),
+		ContentType:        meta.ContentType,
+		ContentDisposition: meta.ContentDisposition,
+		Metadata:           meta.Metadata,
+		SHA256:             meta.SHA256,
+		ETag:               strconv.Quote(strconv.FormatInt(st.ModTime().UnixNano(), 36)),
+		LastModified:       st.ModTime(),
+	}, nil
+}
+
+// Presign is not supported: nothing serves the directory.
+func (l *Local) Presign(ctx context.Context, obj Object, in PresignInput) (string, error) {
+	return "", ErrUnsupported
+}
+
+// Delete removes obj and the JSON file kept with it.
+func (l *Local) Delete(ctx context.Context, obj Object) error {
+	path, metaPath, err := l.paths(obj)
+	if err != nil {
+		return err
+	}
+	for _, p := range []string{path, metaPath} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// List walks the bucket's directory, leaving out the temporary files of
+// writes in progress.
+func (l *Local) List(ctx context.Context, bucket, prefix string, fn func(Listed) error) error {
+	if bucket == "" {
+		bucket = l.Bucket
+	}
+	root := filepath.Join(l.Dir, bucket)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(Listed{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// paths returns the files of obj, refusing keys that would leave its
+// bucket's directory.
+func (l *Local) paths(obj Object) (path, metaPath string, err error) {
+	bucket := obj.Bucket
+	if bucket == "" {
+		bucket = l.Bucket
+	}
+	rel := filepath.Join(bucket, filepath.FromSlash(obj.Key))
+	if !filepath.IsLocal(rel) || !strings.HasPrefix(rel, bucket+string(filepath.Separator)) {
+		return "", "", fmt.Errorf("invalid key %q", obj.Key)
+	}
+	return filepath.Join(l.Dir, rel), filepath.Join(l.Dir, ".meta", rel+".json"), nil
+}
+
+// writeFile writes r to path through a temporary file in the same
+// directory.
+func writeFile(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// localError wraps a missing file in ErrNotFound.
+func localError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	return err
+}
+
+// parseRange returns the first and last byte of a single-range Range header
+// value over size bytes.
+func parseRange(rng string, size int64) (first, last int64, ok bool) {
+	spec, found := strings.CutPrefix(rng, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	from, to, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, 0, false
+	}
+	if from == "" {
+		n, err := strconv.ParseInt(to, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		return max(size-n, 0), size - 1, size > 0
+	}
+	first, err := strconv.ParseInt(from, 10, 64)
+	if err != nil || first < 0 || first >= size {
+		return 0, 0, false
+	}
+	last = size - 1
+	if to != "" {
+		n, err := strconv.ParseInt(to, 10, 64)
+		if err != nil || n < first {
+			return 0, 0, false
+		}
+		last = min(n, size-1)
+	}
+	return first, last, true
+}
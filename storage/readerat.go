@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// readAtChunk is how much a ReaderAt fetches with each ranged Get, so a
+// sequential reader asking for a few kilobytes at a time does not make a
+// request for each.
+const readAtChunk = 1 << 20
+
+// ReaderAt reads a stored blob of known size through ranged Gets, keeping
+// only the last chunk fetched in memory.
+type ReaderAt struct {
+	ctx   context.Context
+	store Storage
+	obj   Object
+	size  int64
+	buf   []byte
+	off   int64
+}
+
+// NewReaderAt returns a ReaderAt for the size bytes of obj in store.
+func NewReaderAt(ctx context.Context, store Storage, obj Object, size int64) *ReaderAt {
+	return &ReaderAt{ctx: ctx, store: store, obj: obj, size: size}
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("read %s: negative offset", r.obj.Key)
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+		if pos < r.off || pos >= r.off+int64(len(r.buf)) {
+			if err := r.fetch(pos); err != nil {
+				return n, err
+			}
+		}
+		n += copy(p[n:], r.buf[pos-r.off:])
+	}
+	return n, nil
+}
+
+// fetch reads the chunk starting at off into the buffer.
+func (r *ReaderAt) fetch(off int64) error {
+	last := min(off+readAtChunk, r.size) - 1
+	blob, err := r.store.Get(r.ctx, r.obj, fmt.Sprintf("bytes=%d-%d", off, last))
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	if cap(r.buf) < readAtChunk {
+		r.buf = make([]byte, readAtChunk)
+	}
+	r.buf = r.buf[:last-off+1]
+	if _, err := io.ReadFull(blob.Body, r.buf); err != nil {
+		r.buf = r.buf[:0]
+		return fmt.Errorf("read %s: %w", r.obj.Key, err)
+	}
+	r.off = off
+	return nil
+}
@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3Options configures an S3 backend. Bucket is where new blobs go. Blobs
+// larger than PartSize are uploaded in parts of that size, Concurrency at
+// a time. Stores that only speak part of the S3 API turn off what they
+// lack: Encrypt asks for SSE-KMS under KMSKeyID, or the account's aws/s3
+// key when it is empty; Checksums has the store verify each upload's
+// SHA-256; StorageClasses and Tags pass PutInput's through. Accelerate
+// sends uploads through the bucket's Transfer Acceleration endpoint.
+type S3Options struct {
+	Bucket         string
+	PartSize       int64
+	Concurrency    int
+	Encrypt        bool
+	KMSKeyID       string
+	Checksums      bool
+	StorageClasses bool
+	Tags           bool
+	Accelerate     bool
+}
+
+// S3 stores blobs in an S3 bucket, or in a store with an S3-compatible API.
+type S3 struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	opts     S3Options
+}
+
+// NewS3 returns a backend storing blobs through client.
+func NewS3(client *s3.Client, opts S3Options) *S3 {
+	return &S3{
+		client: client,
+		uploader: manager.NewUploader(client, func(u *manager.Uploader) {
+			u.PartSize = opts.PartSize
+			u.Concurrency = opts.Concurrency
+			if opts.Accelerate {
+				u.ClientOptions = append(u.ClientOptions, func(o *s3.Options) { o.UseAccelerate = true })
+			}
+		}),
+		opts: opts,
+	}
+}
+
+// Put uploads in, in one request or, past PartSize, as a multipart upload
+// whose parts are sent in parallel and each retried on its own. A Body
+// that is an io.ReaderAt is read in place rather than buffered per part.
+func (b *S3) Put(ctx context.Context, in PutInput) (Object, error) {
+	bucket := b.bucket(Object{Bucket: in.Bucket})
+	put := &s3.PutObjectInput{
+		Bucket:             aws.String(bucket),
+		Key:                aws.String(in.Key),
+		Body:               in.Body,
+		ContentType:        aws.String(in.ContentType),
+		ContentDisposition: optional(in.ContentDisposition),
+		Metadata:           in.Metadata,
+	}
+	if b.opts.Tags && in.Tagging != "" {
+		put.Tagging = aws.String(in.Tagging)
+	}
+	if b.opts.Encrypt {
+		put.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		put.SSEKMSKeyId = optional(b.opts.KMSKeyID)
+	}
+	if b.opts.StorageClasses {
+		put.StorageClass = types.StorageClass(in.StorageClass)
+	}
+	if !in.RetainUntil.IsZero() {
+		put.ObjectLockMode = types.ObjectLockMode(in.LockMode)
+		put.ObjectLockRetainUntilDate = aws.Time(in.RetainUntil)
+	}
+	if b.opts.Checksums {
+		put.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+		// A whole-object checksum only fits a single PutObject; a
+		// multipart upload's checksum is one of its parts' checksums.
+		if len(in.SHA256) > 0 && in.Size < b.opts.PartSize {
+			put.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(in.SHA256))
+		}
+	}
+	out, err := b.uploader.Upload(ctx, put)
+	if err != nil {
+		return Object{}, err
+	}
+	return Object{Bucket: bucket, Key: in.Key, VersionID: aws.ToString(out.VersionID)}, nil
+}
+
+// Get opens obj.
+func (b *S3) Get(ctx context.Context, obj Object, rng string) (*Blob, error) {
+	out, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:    aws.String(b.bucket(obj)),
+		Key:       aws.String(obj.Key),
+		VersionId: optional(obj.VersionID),
+		Range:     optional(rng),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return &Blob{
+		Info: Info{
+			Size:               aws.ToInt64(out.ContentLength),
+			ContentType:        aws.ToString(out.ContentType),
+			ContentDisposition: aws.ToString(out.ContentDisposition),
+			Metadata:           out.Metadata,
+			StorageClass:       string(out.StorageClass),
+			VersionID:          aws.ToString(out.VersionId),
+			ETag:               aws.ToString(out.ETag),
+			LastModified:       aws.ToTime(out.LastModified),
+			LockMode:           string(out.ObjectLockMode),
+			RetainUntil:        aws.ToTime(out.ObjectLockRetainUntilDate),
+		},
+		Body:         out.Body,
+		ContentRange: aws.ToString(out.ContentRange),
+	}, nil
+}
+
+// Head describes obj, with its checksum when the store keeps checksums.
+func (b *S3) Head(ctx context.Context, obj Object) (*Info, error) {
+	in := &s3.HeadObjectInput{
+		Bucket:    aws.String(b.bucket(obj)),
+		Key:       aws.String(obj.Key),
+		VersionId: optional(obj.VersionID),
+	}
+	if b.opts.Checksums {
+		in.ChecksumMode = types.ChecksumModeEnabled
+	}
+	out, err := b.client.HeadObject(ctx, in)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return &Info{
+		Size:               aws.ToInt64(out.ContentLength),
+		ContentType:        aws.ToString(out.ContentType),
+		ContentDisposition: aws.ToString(out.ContentDisposition),
+		Metadata:           out.Metadata,
+		StorageClass:       string(out.StorageClass),
+		VersionID:          aws.ToString(out.VersionId),
+		ETag:               aws.ToString(out.ETag),
+		LastModified:       aws.ToTime(out.LastModified),
+		SHA256:             wholeChecksum(aws.ToString(out.ChecksumSHA256)),
+		LockMode:           string(out.ObjectLockMode),
+		RetainUntil:        aws.ToTime(out.ObjectLockRetainUntilDate),
+	}, nil
+}
+
+// wholeChecksum decodes the base64 checksum S3 reports for an object. The
+// checksum of a multipart upload, a checksum of its parts' checksums
+// suffixed with their count, is not the object's and yields nil.
+func wholeChecksum(sum string) []byte {
+	if sum == "" || strings.Contains(sum, "-") {
+		return nil
+	}
+	b, err := base64.StdEncoding.DecodeString(sum)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// Presign returns a SigV4 presigned GET URL for obj.
+func (b *S3) Presign(ctx context.Context, obj Object, in PresignInput) (string, error) {
+	req, err := s3.NewPresignClient(b.client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket:                     aws.String(b.bucket(obj)),
+		Key:                        aws.String(obj.Key),
+		VersionId:                  optional(obj.VersionID),
+		ResponseContentType:        optional(in.ContentType),
+		ResponseContentDisposition: optional(in.ContentDisposition),
+	}, s3.WithPresignExpires(in.Expiry))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// Delete removes obj, or just its version when it names one.
+func (b *S3) Delete(ctx context.Context, obj Object) error {
+	_, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:    aws.String(b.bucket(obj)),
+		Key:       aws.String(obj.Key),
+		VersionId: optional(obj.VersionID),
+	})
+	return err
+}
+
+// List pages through the keys under prefix, a thousand at a time.
+func (b *S3) List(ctx context.Context, bucket, prefix string, fn func(Listed) error) error {
+	if bucket == "" {
+		bucket = b.opts.Bucket
+	}
+	pages := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			err := fn(Listed{Key: aws.ToString(obj.Key), Size: aws.ToInt64(obj.Size), LastModified: aws.ToTime(obj.LastModified)})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// bucket is the bucket of obj, which documents stored before the bucket
+// was configured may name; the configured one otherwise.
+func (b *S3) bucket(obj Object) string {
+	if obj.Bucket == "" {
+		return b.opts.Bucket
+	}
+	return obj.Bucket
+}
+
+// apiErrorCoder matches smithy.APIError without importing it.
+type apiErrorCoder interface {
+	ErrorCode() string
+}
+
+// s3Error wraps the S3 errors callers act on in this package's.
+func s3Error(err error) error {
+	var noKey *types.NoSuchKey
+	var notFound *types.NotFound
+	var coded apiErrorCoder
+	switch {
+	case errors.As(err, &noKey), errors.As(err, &notFound):
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case errors.As(err, &coded) && coded.ErrorCode() == "InvalidRange":
+		return fmt.Errorf("%w: %w", ErrInvalidRange, err)
+	}
+	return err
+}
+
+// optional returns s as an optional S3 parameter, nil when it is "".
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
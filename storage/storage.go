@@ -0,0 +1,123 @@
+// Package storage keeps KYC documents in a blob store behind one small
+// interface, so the handlers work the same whether documents live in S3,
+// an S3-compatible store such as MinIO or Google Cloud Storage, or a local
+// directory for tests and on-prem deployments without AWS.
+//
+// A blob is addressed by an Object: the bucket and key it was stored
+// under, and the version a versioned store gave it. Backends without
+// buckets or versions keep the bucket as a directory and report no
+// versions.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// Errors the backends return, possibly wrapped.
+var (
+	// ErrNotFound is returned for an object that does not exist.
+	ErrNotFound = errors.New("object not found")
+	// ErrInvalidRange is returned by Get for a range the object cannot
+	// satisfy.
+	ErrInvalidRange = errors.New("requested range not satisfiable")
+	// ErrUnsupported is returned for an operation the backend cannot do.
+	ErrUnsupported = errors.New("not supported by this storage backend")
+)
+
+// Storage is a blob store.
+type Storage interface {
+	// Put stores in.Body under in.Key and returns where it went.
+	Put(ctx context.Context, in PutInput) (Object, error)
+	// Get opens obj, or the part of it a Range header value rng names.
+	// The caller closes the returned Blob.
+	Get(ctx context.Context, obj Object, rng string) (*Blob, error)
+	// Head describes obj without reading it.
+	Head(ctx context.Context, obj Object) (*Info, error)
+	// Presign returns a URL anyone holding it can read obj from until
+	// in.Expiry has passed.
+	Presign(ctx context.Context, obj Object, in PresignInput) (string, error)
+	// Delete removes obj. Removing an object that does not exist is not an
+	// error.
+	Delete(ctx context.Context, obj Object) error
+	// List calls fn with each object whose key starts with prefix in
+	// bucket, the configured one when it is "", stopping at the first
+	// error fn returns.
+	List(ctx context.Context, bucket, prefix string, fn func(Listed) error) error
+}
+
+// Object is where a blob is stored. VersionID is empty for the latest
+// version, or where the store does not version objects.
+type Object struct {
+	Bucket    string
+	Key       string
+	VersionID string
+}
+
+// PutInput is a blob to store, in Bucket or the store's own bucket when it
+// is empty. Size is the length of Body, -1 when it is not known, and SHA256
+// its digest, which backends that can have the store verify it.
+// StorageClass and Tagging, a URL-encoded query of tags, are ignored by
+// backends without them. A RetainUntil that is set locks the blob in
+// LockMode, "GOVERNANCE" or "COMPLIANCE", until then where the store has
+// Object Lock.
+type PutInput struct {
+	Bucket             string
+	Key                string
+	Body               io.Reader
+	Size               int64
+	SHA256             []byte
+	ContentType        string
+	ContentDisposition string
+	Metadata           map[string]string
+	Tagging            string
+	StorageClass       string
+	LockMode           string
+	RetainUntil        time.Time
+}
+
+// Info describes a stored blob. SHA256 is the digest the store keeps of
+// the whole blob, nil where it keeps none, as for an S3 multipart upload,
+// whose checksum covers its parts. RetainUntil is zero for a blob that is
+// not locked.
+type Info struct {
+	Size               int64
+	ContentType        string
+	ContentDisposition string
+	Metadata           map[string]string
+	StorageClass       string
+	VersionID          string
+	ETag               string
+	LastModified       time.Time
+	SHA256             []byte
+	LockMode           string
+	RetainUntil        time.Time
+}
+
+// Blob is an opened blob. Size is the length of Body, which for a range
+// is the length of the range, named by ContentRange.
+type Blob struct {
+	Info
+	Body         io.ReadCloser
+	ContentRange string
+}
+
+// Close closes the blob's body.
+func (b *Blob) Close() error { return b.Body.Close() }
+
+// Listed is an object as List reports it.
+type Listed struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// PresignInput is how a presigned URL serves its blob: for Expiry, with
+// ContentType and ContentDisposition when they are set.
+type PresignInput struct {
+	Expiry             time.Duration
+	ContentType        string
+	ContentDisposition string
+}
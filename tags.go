@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+/* OBJECT TAGS */
+
+// Every document is tagged with what it is, whose it is, the APP_ENV it
+// was uploaded from, and the KYC status of its submission, so lifecycle
+// rules on the bucket can archive or expire objects by tag. Objects start
+// out KYC_UPLOADED; the kyc-status tag follows each status change made
+// through the API, a review or the provider's webhook.
+
+// Object tag keys.
+const (
+	tagDocumentType     = "document-type"
+	tagDocumentCategory = "document-category"
+	tagReference        = "reference"
+	tagEnvironment      = "environment"
+	tagKYCStatus        = "kyc-status"
+)
+
+// documentTags are the S3 tags of d, a document of the submission
+// reference in status.
+func (a *app) documentTags(reference, status string, d submittedDocument) []types.Tag {
+	tags := []types.Tag{{Key: aws.String(tagDocumentType), Value: aws.String(d.Type)}}
+	if d.Category != "" {
+		tags = append(tags, types.Tag{Key: aws.String(tagDocumentCategory), Value: aws.String(d.Category)})
+	}
+	if reference != "" {
+		tags = append(tags, types.Tag{Key: aws.String(tagReference), Value: aws.String(reference)})
+	}
+	if a.cfg.Env != "" {
+		tags = append(tags, types.Tag{Key: aws.String(tagEnvironment), Value: aws.String(a.cfg.Env)})
+	}
+	return append(tags, types.Tag{Key: aws.String(tagKYCStatus), Value: aws.String(status)})
+}
+
+// documentTagging is documentTags of a new upload in the form PutObject
+// takes.
+func (a *app) documentTagging(reference string, d submittedDocument) string {
+	v := url.Values{}
+	for _, t := range a.documentTags(reference, statusUploaded, d) {
+		v.Set(aws.ToString(t.Key), aws.ToString(t.Value))
+	}
+	return v.Encode()
+}
+
+// tagDocument tags d, an object uploaded before its category or submission
+// was known. Tags only describe the object, so failing to set them is
+// logged and otherwise ignored.
+func (a *app) tagDocument(ctx context.Context, reference string, d submittedDocument) {
+	a.putTags(ctx, d.Bucket, d.Key, a.documentTags(reference, statusUploaded, d))
+}
+
+// tagStatus retags the documents of u, whose status just changed, with its
+// new status. It goes on after a failure, so one missing object does not
+// leave the others behind. A deduplicated object other users' documents
+// also refer to is left alone: a lifecycle rule acting on one user's
+// status must not archive or expire another's document.
+func (a *app) tagStatus(ctx context.Context, u *user) {
+	if a.s3 == nil {
+		return
+	}
+	rows, err := a.db.QueryContext(ctx, `
+	SELECT doc_type, category, bucket, object_key FROM documents d
+	WHERE user_id = $1 AND NOT EXISTS(
+		SELECT 1 FROM documents o
+		WHERE o.bucket = d.bucket AND o.object_key = d.object_key AND o.user_id <> d.user_id
+	)
+	ORDER BY id
+	`, u.ID)
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=s3_tagging_failed id=%d err=%v request_id=%s instance=%s", u.ID, err, requestID(ctx), a.instanceID)
+		return
+	}
+	var docs []submittedDocument
+	for rows.Next() {
+		var d submittedDocument
+		if err := rows.Scan(&d.Type, &d.Category, &d.Bucket, &d.Key); err != nil {
+			log.Printf("level=WARN service=go-app event=s3_tagging_failed id=%d err=%v request_id=%s instance=%s", u.ID, err, requestID(ctx), a.instanceID)
+			break
+		}
+		docs = append(docs, d)
+	}
+	rows.Close()
+
+	for _, d := range docs {
+		a.putTags(ctx, d.Bucket, d.Key, a.documentTags(u.Reference, u.KYCStatus, d))
+	}
+}
+
+// putTags sets tags on the object key in bucket, replacing those with the
+// same keys and keeping the rest, such as the quarantine tag. Storage
+// backends other than S3 and MinIO have no tags.
+func (a *app) putTags(ctx context.Context, bucket, key string, tags []types.Tag) {
+	if a.s3 == nil {
+		return
+	}
+	out, err := a.s3.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=s3_tagging_failed key=%s err=%v request_id=%s instance=%s", key, err, requestID(ctx), a.instanceID)
+		return
+	}
+	merged := slices.DeleteFunc(out.TagSet, func(t types.Tag) bool {
+		return slices.ContainsFunc(tags, func(n types.Tag) bool { return aws.ToString(n.Key) == aws.ToString(t.Key) })
+	})
+	_, err = a.s3.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(bucket),
+		Key:     aws.String(key),
+		Tagging: &types.Tagging{TagSet: append(merged, tags...)},
+	})
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=s3_tagging_failed key=%s err=%v request_id=%s instance=%s", key, err, requestID(ctx), a.instanceID)
+	}
+}
@@ -0,0 +1,87 @@
+// Package thumbnail makes small JPEG previews of image documents, so a
+// reviewer's list of submissions can show what each document is without
+// downloading full-resolution scans.
+//
+// JPEG and PNG images are decoded with the standard library, which has no
+// WebP decoder, and scaled down with a box filter: each pixel of the
+// preview is the average of the pixels of the image it covers.
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	_ "image/png" // registers the PNG decoder
+	"io"
+)
+
+// Quality is the JPEG quality of previews.
+const Quality = 80
+
+// Errors Make returns for images it makes no preview of.
+var (
+	ErrCorrupt  = errors.New("image cannot be decoded")
+	ErrTooLarge = errors.New("image has too many pixels to decode")
+)
+
+// Make decodes the JPEG or PNG image in r and returns it as a JPEG whose
+// longer side is at most size pixels. A smaller image keeps its size. An
+// image of more than maxPixels pixels, as its header says, is not decoded.
+func Make(r io.Reader, size, maxPixels int) ([]byte, error) {
+	var header bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > int64(maxPixels) {
+		return nil, ErrTooLarge
+	}
+	src, _, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scale(src, size), &jpeg.Options{Quality: Quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scale returns src shrunk to fit a size×size square, keeping its aspect
+// ratio.
+func scale(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := sw, sh
+	switch {
+	case sw >= sh && sw > size:
+		dw, dh = size, max(1, sh*size/sw)
+	case sh > sw && sh > size:
+		dw, dh = max(1, sw*size/sh), size
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*sh/dh, b.Min.Y+(y+1)*sh/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*sw/dw, b.Min.X+(x+1)*sw/dw
+			var r, g, bl, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					// JPEG has no transparency: transparent pixels are
+					// laid over white, like a scan's paper.
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, bl = r+uint64(pr+0xffff-pa), g+uint64(pg+0xffff-pa), bl+uint64(pb+0xffff-pa)
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = 0xff
+		}
+	}
+	return dst
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"client_alb_go_s3_rds/config"
+	"client_alb_go_s3_rds/storage"
+	"client_alb_go_s3_rds/thumbnail"
+)
+
+/* THUMBNAILS */
+
+// With THUMBNAILS on, every JPEG and PNG document gets a JPEG preview at
+// most THUMBNAIL_SIZE pixels on its longer side, stored under the
+// thumbnails/ prefix, so the reviewer list can show documents without
+// downloading full-resolution scans. Previews are made in the background:
+// documents.thumbnailed_at is NULL until a document has been looked at,
+// and thumbnail_bucket and thumbnail_key name its preview, if one could be
+// made. While scanning is on, only documents found clean get one. WebP
+// images, which the standard library cannot decode, PDFs and archived
+// documents get none.
+
+// thumbnailTypes lists the content types previews are made of.
+var thumbnailTypes = []string{"image/jpeg", "image/png"}
+
+// thumbnailBatch bounds the objects previewed per run.
+const thumbnailBatch = 20
+
+// thumbnailTimeout bounds reading a document and storing its preview.
+const thumbnailTimeout = time.Minute
+
+// thumbnailKey returns where the preview of key, a key under
+// S3_KEY_PREFIX, is stored.
+func (a *app) thumbnailKey(key string) string {
+	return a.cfg.S3.KeyPrefix + "thumbnails/" + strings.TrimPrefix(key, a.cfg.S3.KeyPrefix) + ".jpg"
+}
+
+// thumbnailURL is the API path of the preview of document docID of userID.
+func thumbnailURL(userID, docID int64) string {
+	return "/api/v1/users/" + strconv.FormatInt(userID, 10) + "/documents/" + strconv.FormatInt(docID, 10) + "/thumbnail"
+}
+
+// makeThumbnails previews a batch of documents every THUMBNAIL_INTERVAL.
+// Instances previewing the same document at once write the same preview
+// to the same key, so running it everywhere is harmless.
+func (a *app) makeThumbnails(ctx context.Context) {
+	ticker := time.NewTicker(a.cfg.Thumbnails.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if a.dbDown.Load() {
+			continue
+		}
+
+		rows, err := a.db.QueryContext(ctx, `
+		SELECT bucket, object_key, MIN(COALESCE(version_id, '')) FROM documents
+		WHERE thumbnailed_at IS NULL AND content_type = ANY($1) AND storage_class <> ALL($2)
+		  AND (scan_status = $3 OR ($4 AND scan_status IS NULL))
+		GROUP BY bucket, object_key
+		ORDER BY MIN(id)
+		LIMIT $5
+		`, pq.Array(thumbnailTypes), pq.Array(config.ArchiveStorageClasses), scanClean, a.scanner == nil, thumbnailBatch)
+		if err != nil {
+			log.Printf("level=ERROR service=go-app event=db_query_failed op=make_thumbnails err=%v instance=%s", err, a.instanceID)
+			continue
+		}
+		var queue []submittedDocument
+		for rows.Next() {
+			var d submittedDocument
+			if err := rows.Scan(&d.Bucket, &d.Key, &d.VersionID); err != nil {
+				log.Printf("level=ERROR service=go-app event=db_scan_failed op=make_thumbnails err=%v instance=%s", err, a.instanceID)
+				break
+			}
+			queue = append(queue, d)
+		}
+		rows.Close()
+
+		for _, d := range queue {
+			a.makeThumbnail(ctx, d)
+		}
+	}
+}
+
+// makeThumbnail stores a preview of the object of d and records it on
+// every document row of the object. An image that cannot be decoded, or
+// has more pixels than DOCUMENT_IMAGE_MAX_PIXELS, is recorded as having
+// none; any other failure is tried again on the next run.
+func (a *app) makeThumbnail(ctx context.Context, d submittedDocument) {
+	ctx, cancel := context.WithTimeout(ctx, thumbnailTimeout)
+	defer cancel()
+
+	blob, err := a.store.Get(ctx, storage.Object{Bucket: d.Bucket, Key: d.Key, VersionID: d.VersionID}, "")
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=thumbnail_failed bucket=%s key=%s err=%v instance=%s", d.Bucket, d.Key, err, a.instanceID)
+		return
+	}
+	preview, err := thumbnail.Make(blob.Body, a.cfg.Thumbnails.Size, a.cfg.Docs.ImageMaxPixels)
+	blob.Close()
+	if errors.Is(err, thumbnail.ErrCorrupt) {
+		log.Printf("level=WARN service=go-app event=thumbnail_skipped reason=undecodable bucket=%s key=%s instance=%s", d.Bucket, d.Key, a.instanceID)
+		a.recordThumbnail(ctx, d, nil)
+		return
+	}
+	if errors.Is(err, thumbnail.ErrTooLarge) {
+		log.Printf("level=WARN service=go-app event=thumbnail_skipped reason=too_large bucket=%s key=%s instance=%s", d.Bucket, d.Key, a.instanceID)
+		a.recordThumbnail(ctx, d, nil)
+		return
+	}
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=thumbnail_failed bucket=%s key=%s err=%v instance=%s", d.Bucket, d.Key, err, a.instanceID)
+		return
+	}
+
+	obj, err := a.store.Put(ctx, storage.PutInput{
+		Key:          a.thumbnailKey(d.Key),
+		Body:         bytes.NewReader(preview),
+		Size:         int64(len(preview)),
+		ContentType:  "image/jpeg",
+		StorageClass: a.cfg.S3.StorageClass,
+	})
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=thumbnail_failed bucket=%s key=%s err=%v instance=%s", d.Bucket, d.Key, err, a.instanceID)
+		return
+	}
+	metricThumbnailsMade.Add(1)
+	a.recordThumbnail(ctx, d, &obj)
+}
+
+// recordThumbnail records obj as the preview of the rows of d, or that
+// they have none when obj is nil. A preview whose rows were deleted while
+// it was made, with their user, is deleted in turn.
+func (a *app) recordThumbnail(ctx context.Context, d submittedDocument, obj *storage.Object) {
+	var bucket, key *string
+	if obj != nil {
+		bucket, key = &obj.Bucket, &obj.Key
+	}
+	res, err := a.db.ExecContext(ctx, `
+	UPDATE documents SET thumbnail_bucket = $3, thumbnail_key = $4, thumbnailed_at = CURRENT_TIMESTAMP
+	WHERE bucket = $1 AND object_key = $2 AND thumbnailed_at IS NULL
+	`, d.Bucket, d.Key, bucket, key)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=db_update_failed op=record_thumbnail key=%s err=%v instance=%s", d.Key, err, a.instanceID)
+		return
+	}
+	if obj == nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		if _, err := a.deleteUnreferenced(ctx, storage.Object{Bucket: obj.Bucket, Key: obj.Key}); err != nil {
+			log.Printf("level=WARN service=go-app event=thumbnail_orphaned bucket=%s key=%s err=%v instance=%s", obj.Bucket, obj.Key, err, a.instanceID)
+		}
+		return
+	}
+	log.Printf("level=INFO service=go-app event=thumbnail_made bucket=%s key=%s thumbnail=%s instance=%s", d.Bucket, d.Key, obj.Key, a.instanceID)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+/* REQUEST TIMEOUTS */
+
+// Route timeouts. A route's Timeout is one of these or an explicit
+// duration.
+const (
+	// timeoutDefault gives the route HTTP_HANDLER_TIMEOUT.
+	timeoutDefault time.Duration = 0
+	// timeoutUpload gives the route HTTP_UPLOAD_TIMEOUT, for routes that
+	// move documents between the client and S3.
+	timeoutUpload time.Duration = -1
+	// timeoutNone leaves the route unbounded, for streams that are meant
+	// to stay open and set their own write deadlines.
+	timeoutNone time.Duration = -2
+)
+
+// timeout returns the deadline rt's handler runs under, or 0 for none.
+func (rt route) timeout(a *app) time.Duration {
+	switch rt.Timeout {
+	case timeoutDefault:
+		return a.cfg.HTTP.HandlerTimeout
+	case timeoutUpload:
+		return a.cfg.HTTP.UploadTimeout
+	case timeoutNone:
+		return 0
+	}
+	return rt.Timeout
+}
+
+// withTimeout runs the handler under a context that ends after d. Every SQL
+// and S3 call made with r.Context() gives up at the deadline instead of
+// holding the goroutine as long as a hung dependency does. The handler
+// still answers the request itself: if it fails with a server error after
+// the deadline, or writes nothing at all, the client gets a 504 instead.
+// A response that succeeded just past the deadline is left alone, since
+// whatever it reports has happened.
+func (a *app) withTimeout(d time.Duration) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			r = r.WithContext(ctx)
+
+			tw := &timeoutWriter{ResponseWriter: w, a: a, r: r, limit: d}
+			next(tw, r)
+			if !tw.wroteHeader && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				tw.timedOut()
+			}
+		}
+	}
+}
+
+// timeoutWriter swaps a handler's server error for a 504 once the request's
+// deadline has passed.
+type timeoutWriter struct {
+	http.ResponseWriter
+	a           *app
+	r           *http.Request
+	limit       time.Duration
+	wroteHeader bool
+	discarded   bool
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	if tw.wroteHeader {
+		return
+	}
+	if code >= http.StatusInternalServerError && errors.Is(tw.r.Context().Err(), context.DeadlineExceeded) {
+		tw.timedOut()
+		tw.discarded = true
+		return
+	}
+	tw.wroteHeader = true
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	if tw.discarded {
+		return len(b), nil
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// timedOut answers the request with a 504 problem.
+func (tw *timeoutWriter) timedOut() {
+	tw.wroteHeader = true
+	r := tw.r
+	log.Printf("level=WARN service=go-app event=handler_timeout method=%s path=%q timeout=%s request_id=%s instance=%s", r.Method, r.URL.Path, tw.limit, requestID(r.Context()), tw.a.instanceID)
+	h := tw.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Disposition")
+	h.Set("Cache-Control", "no-store")
+	writeProblem(tw.ResponseWriter, r, probTimeout, "the request took longer than "+tw.limit.String())
+}
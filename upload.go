@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"client_alb_go_s3_rds/doccheck"
+)
+
+/* DIRECT UPLOADS */
+
+// directUploadTTL is how long a browser has to start its upload to S3.
+const directUploadTTL = 10 * time.Minute
+
+// uploadURLRequest is the body of POST /submit/upload-url.
+type uploadURLRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+// uploadURLResponse carries a presigned POST: the browser sends Fields plus
+// the file as multipart form data to URL, then submits Key with the form.
+type uploadURLResponse struct {
+	URL       string            `json:"url"`
+	Fields    map[string]string `json:"fields"`
+	Key       string            `json:"key"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// directUploadPrefix is where browser-direct uploads land, in uploadBucket.
+// Keeping them apart from server-side uploads lets /submit refuse keys it
+// did not issue.
+func (a *app) directUploadPrefix() string {
+	prefix := a.cfg.S3.KeyPrefix + "direct/"
+	if a.quarantining() {
+		return a.quarantineKey(prefix)
+	}
+	return prefix
+}
+
+// uploadURLHandler handles POST /submit/upload-url, the first step of the
+// presigned upload flow. The policy pins the content type and caps the size
+// so the browser cannot upload anything the form would have rejected. The
+// upload bucket, S3_QUARANTINE_BUCKET when set, needs a CORS rule allowing
+// POST from the form's origin.
+func (a *app) uploadURLHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.featureEnabled(r.Context(), flagPresignedUpload) {
+		writeProblem(w, r, probNotFound, "direct upload is not enabled")
+		return
+	}
+
+	var req uploadURLRequest
+	if err := decodeJSON(r, &req); err != nil {
+		a.writeBodyError(w, r, err, "invalid JSON body: "+err.Error())
+		return
+	}
+	if !a.documentTypeAllowed(req.ContentType) {
+		writeProblem(w, r, probUnsupportedType, "document must be "+a.documentTypesText())
+		return
+	}
+	limit := a.documentLimit(req.ContentType)
+	if req.Size <= 0 || req.Size > limit {
+		writeProblem(w, r, probTooLarge, fmt.Sprintf("document must be between 1 and %d bytes", limit))
+		return
+	}
+
+	key := documentKey(a.directUploadPrefix(), req.Filename)
+
+	// The policy only admits the upload with the SSE-KMS, metadata and
+	// storage class fields, which the browser sends along with the others.
+	fields := map[string]string{
+		"x-amz-server-side-encryption": string(types.ServerSideEncryptionAwsKms),
+		"Content-Disposition":          documentDisposition(req.Filename),
+		"x-amz-storage-class":          a.cfg.S3.StorageClass,
+	}
+	if a.cfg.S3.KMSKeyID != "" {
+		fields["x-amz-server-side-encryption-aws-kms-key-id"] = a.cfg.S3.KMSKeyID
+	}
+	for k, v := range documentMetadata("", req.Filename, time.Now()) {
+		fields["x-amz-meta-"+k] = v
+	}
+	presigner := s3.NewPresignClient(a.s3, func(o *s3.PresignOptions) {
+		o.ClientOptions = append(o.ClientOptions, a.accelerated)
+	})
+	post, err := presigner.PresignPostObject(r.Context(), &s3.PutObjectInput{
+		Bucket:      aws.String(a.uploadBucket()),
+		Key:         aws.String(key),
+		ContentType: aws.String(req.ContentType),
+	}, func(o *s3.PresignPostOptions) {
+		o.Expires = directUploadTTL
+		o.Conditions = []interface{}{
+			[]interface{}{"content-length-range", 1, limit},
+			map[string]string{"Content-Type": req.ContentType},
+		}
+		for field, value := range fields {
+			o.Conditions = append(o.Conditions, map[string]string{field: value})
+		}
+	})
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=s3_presign_failed op=post err=%v request_id=%s instance=%s", err, requestID(r.Context()), a.instanceID)
+		writeProblem(w, r, probStorage, "failed to prepare upload")
+		return
+	}
+
+	log.Printf("level=INFO service=go-app event=upload_url_issued key=%s size=%d request_id=%s instance=%s", key, req.Size, requestID(r.Context()), a.instanceID)
+	w.Header().Set("Cache-Control", "no-store")
+	for field, value := range fields {
+		post.Values[field] = value
+	}
+	writeJSON(w, http.StatusOK, uploadURLResponse{
+		URL:       post.URL,
+		Fields:    post.Values,
+		Key:       key,
+		ExpiresAt: time.Now().Add(directUploadTTL).UTC(),
+	})
+}
+
+// errUploadRejected wraps every verifyDirectUpload failure that is the
+// client's fault, as opposed to S3 or database trouble.
+var errUploadRejected = errors.New("direct upload rejected")
+
+var (
+	errForeignKey      = fmt.Errorf("%w: document key was not issued for a direct upload", errUploadRejected)
+	errDocumentMissing = fmt.Errorf("%w: document has not been uploaded", errUploadRejected)
+	errDocumentEmpty   = fmt.Errorf("%w: document is empty", errUploadRejected)
+	errDocumentClaimed = fmt.Errorf("%w: document already belongs to a submission", errUploadRejected)
+)
+
+// verifyDirectUpload checks that key is a direct upload this app issued,
+// that the object exists within the size limit, and that no other user
+// already references it. It returns the object's metadata and the hex
+// SHA-256 of its content.
+func (a *app) verifyDirectUpload(ctx context.Context, key string) (*s3.HeadObjectOutput, string, error) {
+	if !strings.HasPrefix(key, a.directUploadPrefix()) || strings.Contains(key, "..") {
+		return nil, "", errForeignKey
+	}
+	return a.verifyUnclaimedObject(ctx, a.uploadBucket(), key)
+}
+
+// verifyUnclaimedObject checks that key exists in bucket, that its content
+// is an accepted type matching the object's Content-Type, within that
+// type's size limit and well formed, and that no user references it yet.
+// The returned metadata carries the detected type; the hex SHA-256 of the
+// content is returned with it. An object in quarantine that is refused for
+// its content is marked for expiry; see rejectQuarantined.
+func (a *app) verifyUnclaimedObject(ctx context.Context, bucket, key string) (*s3.HeadObjectOutput, string, error) {
+	reject := func(reason string) error {
+		a.rejectQuarantined(ctx, bucket, key, reason)
+		return fmt.Errorf("%w: %s", errUploadRejected, reason)
+	}
+
+	head, err := a.s3.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if errors.Is(err, errS3Unavailable) {
+		return nil, "", err
+	}
+	if err != nil {
+		log.Printf("level=WARN service=go-app event=document_not_found key=%s err=%v request_id=%s instance=%s", key, err, requestID(ctx), a.instanceID)
+		return nil, "", errDocumentMissing
+	}
+	size := aws.ToInt64(head.ContentLength)
+	switch {
+	case size == 0:
+		a.rejectQuarantined(ctx, bucket, key, "empty")
+		return nil, "", errDocumentEmpty
+	case size > a.maxDocumentLimit():
+		return nil, "", reject(a.documentLimitText(""))
+	}
+
+	// The whole object is needed to check that it decodes; the limit above
+	// bounds what is held in memory.
+	obj, err := a.s3.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := io.ReadAll(io.LimitReader(obj.Body, size))
+	obj.Body.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	digest := sha256.Sum256(body)
+	sum := hex.EncodeToString(digest[:])
+	detected, err := a.checkDocumentContent(body[:min(sniffLen, len(body))], aws.ToString(head.ContentType), key)
+	if err != nil {
+		return nil, "", reject(err.Error())
+	}
+	if size > a.documentLimit(detected) {
+		return nil, "", reject(a.documentLimitText(detected))
+	}
+	err = a.checkDocumentStructure(bytes.NewReader(body), int64(len(body)), detected)
+	var invalid *doccheck.Error
+	if errors.As(err, &invalid) {
+		return nil, "", reject(err.Error())
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if aws.ToString(head.ContentType) != detected {
+		// The object was stored with a generic type; give it the real one,
+		// so downloads are served as what they are. In a versioned bucket
+		// the copy is the version the document refers to.
+		out, err := a.s3.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:             aws.String(bucket),
+			Key:                aws.String(key),
+			CopySource:         aws.String((&url.URL{Path: bucket + "/" + key}).EscapedPath()),
+			ContentType:        aws.String(detected),
+			ContentDisposition: head.ContentDisposition,
+			Metadata:           head.Metadata,
+			MetadataDirective:  types.MetadataDirectiveReplace,
+			StorageClass:       head.StorageClass,
+
+			ServerSideEncryption: types.ServerSideEncryptionAwsKms,
+			SSEKMSKeyId:          sseKMSKey(a.cfg.S3),
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		head.ContentType = aws.String(detected)
+		head.VersionId = out.VersionId
+	}
+
+	// The claim check needs RDS; in degraded mode the spool replay's
+	// insert is the only thing left to catch a reused key.
+	if a.dbDown.Load() {
+		return head, sum, nil
+	}
+	var claimed bool
+	err = a.db.QueryRowContext(ctx, `
+	SELECT EXISTS(SELECT 1 FROM users WHERE document_key = $1)
+	    OR EXISTS(SELECT 1 FROM documents WHERE object_key = $1)
+	`, key).Scan(&claimed)
+	if err != nil {
+		return nil, "", err
+	}
+	if claimed {
+		return nil, "", errDocumentClaimed
+	}
+	return head, sum, nil
+}
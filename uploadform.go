@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"time"
+
+	"client_alb_go_s3_rds/doccheck"
+	"client_alb_go_s3_rds/storage"
+)
+
+/* STREAMED UPLOAD FORMS */
+
+// Forms carrying documents are read part by part instead of with
+// ParseMultipartForm, so each file is held to the size limit of its type
+// as it arrives: a PDF over DOCUMENT_MAX_PDF_SIZE is refused at the first
+// byte past the limit, not once the whole body has been buffered. Nothing
+// but the plain fields is held in memory, and nothing is written to local
+// disk. A file is stored as it arrives, under the form/ prefix of
+// uploadBucket since its submission is not known yet, with its SHA-256
+// computed on the way; once stored it is read back and checked to decode
+// in full, as direct uploads are. The submission then takes the object as
+// its document, tagging and locking it as it does direct uploads; objects
+// it does not take, such as those of a form that failed validation, are
+// deleted once the request is handled.
+
+// errFormFileTooLarge stops the upload of a file past its size limit.
+var errFormFileTooLarge = errors.New("form file exceeds its size limit")
+
+// formFile is a document file sent with a form, stored while the request
+// is read.
+type formFile struct {
+	Field       string
+	Filename    string
+	ContentType string // detected from the content
+	Size        int64
+	SHA256      []byte
+	Object      storage.Object // where it was stored, once it was
+	claimed     bool
+}
+
+// claim records that a document refers to the stored file, so it is kept
+// after the request.
+func (f *formFile) claim() { f.claimed = true }
+
+type formFilesKey struct{}
+
+// formFiles returns the document files of r by form field, as read by
+// streamUploadForm.
+func formFiles(r *http.Request) map[string]*formFile {
+	files, _ := r.Context().Value(formFilesKey{}).(map[string]*formFile)
+	return files
+}
+
+// streamUploadForm returns middleware that reads a multipart/form-data
+// body before the handler runs. Plain fields end up where
+// ParseMultipartForm would put them, so FormValue works as usual; document
+// files are checked for type and size while they stream in and are
+// available from formFiles. The fields before the first file are read
+// first and checks run on them alone: files are stored only once the
+// checks pass the request on, so a post they turn away, for a bad CSRF
+// token, spam or an unsolved CAPTCHA, stores nothing. The fields checks
+// read must therefore come before the files, as they do in the form pages.
+// Other bodies are passed through checks untouched.
+func (a *app) streamUploadForm(checks ...middleware) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		checked := chain(next, checks...)
+		return func(w http.ResponseWriter, r *http.Request) {
+			if mediaType(r) != "multipart/form-data" {
+				checked(w, r)
+				return
+			}
+
+			mr, err := r.MultipartReader()
+			if err != nil {
+				a.writeFormError(w, r, err)
+				return
+			}
+			form := &uploadForm{mr: mr, values: url.Values{}}
+			if err := form.readFields(); err != nil {
+				a.writeFormError(w, r, err)
+				return
+			}
+			setForm(r, form.values)
+
+			files := map[string]*formFile{}
+			defer a.discardFormFiles(r.Context(), files)
+			store := func(w http.ResponseWriter, r *http.Request) {
+				if err := a.readFormFiles(r.Context(), form, files); err != nil {
+					a.writeFormError(w, r, err)
+					return
+				}
+				setForm(r, form.values)
+				next(w, r.WithContext(context.WithValue(r.Context(), formFilesKey{}, files)))
+			}
+			chain(store, checks...)(w, r)
+		}
+	}
+}
+
+// discardFormFiles deletes the stored files no document claimed. One that
+// cannot be deleted is left to reconciliation, or in quarantine marked for
+// expiry.
+func (a *app) discardFormFiles(ctx context.Context, files map[string]*formFile) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	for _, f := range files {
+		if f.claimed || f.Object.Key == "" {
+			continue
+		}
+		if err := a.store.Delete(ctx, f.Object); err != nil {
+			log.Printf("level=WARN service=go-app event=document_delete_failed bucket=%s key=%s err=%v request_id=%s instance=%s", f.Object.Bucket, f.Object.Key, err, requestID(ctx), a.instanceID)
+			a.rejectQuarantined(ctx, f.Object.Bucket, f.Object.Key, "unclaimed form upload")
+		}
+	}
+}
+
+// writeFormError answers a readUploadForm failure.
+func (a *app) writeFormError(w http.ResponseWriter, r *http.Request, err error) {
+	var de *documentError
+	if !errors.As(err, &de) {
+		a.writeBodyError(w, r, err, "failed to parse form")
+		return
+	}
+	if de.kind == probTooLarge {
+		// The rest of the body is not worth reading.
+		metricBodyTooLarge.Add(1)
+		w.Header().Set("Connection", "close")
+	}
+	writeProblem(w, r, de.kind, de.detail)
+}
+
+// setForm makes values the form of r, where ParseMultipartForm would have
+// put them, with the URL query as usual.
+func setForm(r *http.Request, values url.Values) {
+	r.MultipartForm = &multipart.Form{Value: values, File: map[string][]*multipart.FileHeader{}}
+	r.PostForm = values
+	r.Form = url.Values{}
+	for k, vs := range values {
+		r.Form[k] = append(r.Form[k], vs...)
+	}
+	for k, vs := range r.URL.Query() {
+		r.Form[k] = append(r.Form[k], vs...)
+	}
+}
+
+// uploadForm is a multipart body being read part by part. values holds
+// the plain fields read so far, which may take up multipartOverhead bytes
+// in all, and file the file part reading stopped at, if any.
+type uploadForm struct {
+	mr         *multipart.Reader
+	values     url.Values
+	valueBytes int64
+	file       *multipart.Part
+}
+
+// readFields reads plain fields up to the next file part, left in f.file,
+// or to the end of the body. Failures the client can fix are
+// documentErrors.
+func (f *uploadForm) readFields() error {
+	f.file = nil
+	for {
+		p, err := f.mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		field := p.FormName()
+		switch {
+		case field == "":
+		case p.FileName() != "":
+			f.file = p
+			return nil
+		default:
+			b, err := io.ReadAll(io.LimitReader(p, multipartOverhead-f.valueBytes+1))
+			if err != nil {
+				return err
+			}
+			f.valueBytes += int64(len(b))
+			if f.valueBytes > multipartOverhead {
+				return &documentError{probTooLarge, fmt.Sprintf("form fields are limited to %d bytes", multipartOverhead)}
+			}
+			f.values[field] = append(f.values[field], string(b))
+		}
+		p.Close()
+	}
+}
+
+// readFormFiles reads the rest of form, from the file part it stopped at,
+// adding each document file to files and the plain fields among them to
+// its values. Failures the client can fix are documentErrors.
+func (a *app) readFormFiles(ctx context.Context, form *uploadForm, files map[string]*formFile) error {
+	for form.file != nil {
+		p := form.file
+		field := p.FormName()
+		switch {
+		case !validDocumentType(field):
+			return &documentError{probValidation, field + " does not take a file"}
+		case files[field] != nil:
+			return &documentError{probValidation, field + " takes a single file"}
+		}
+		f, err := a.receiveFormFile(ctx, p)
+		if f != nil {
+			files[field] = f
+		}
+		if err != nil {
+			return err
+		}
+		p.Close()
+		if err := form.readFields(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readUploadForm reads the parts of r's body, a form that takes no files,
+// returning its plain fields. Failures the client can fix are
+// documentErrors.
+func (a *app) readUploadForm(r *http.Request) (url.Values, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	form := &uploadForm{mr: mr, values: url.Values{}}
+	if err := form.readFields(); err != nil {
+		return nil, err
+	}
+	if form.file != nil {
+		return nil, &documentError{probValidation, form.file.FormName() + " does not take a file"}
+	}
+	return form.values, nil
+}
+
+// formUploadPrefix is where files sent with forms are stored, in
+// uploadBucket, until a submission takes them.
+func (a *app) formUploadPrefix() string {
+	prefix := a.cfg.S3.KeyPrefix + "form/"
+	if a.quarantining() {
+		return a.quarantineKey(prefix)
+	}
+	return prefix
+}
+
+// receiveFormFile checks the type of the document in p from its first
+// bytes, then stores it, stopping as soon as it exceeds the limit for that
+// type, and checks what was stored; see checkFormFile. Its SHA-256 is
+// computed as it is stored. The file is returned, for its object to be
+// deleted, even when receiving it failed.
+func (a *app) receiveFormFile(ctx context.Context, p *multipart.Part) (*formFile, error) {
+	field := p.FormName()
+	start, err := readSniffBytes(p)
+	if err != nil {
+		return nil, err
+	}
+	contentType, err := a.checkDocumentContent(start, p.Header.Get("Content-Type"), p.FileName())
+	if err != nil {
+		return nil, &documentError{probUnsupportedType, field + ": " + err.Error()}
+	}
+	f := &formFile{Field: field, Filename: p.FileName(), ContentType: contentType}
+
+	limit := a.documentLimit(contentType)
+	sum := sha256.New()
+	body := &cappedReader{r: io.TeeReader(io.MultiReader(bytes.NewReader(start), p), sum), limit: limit}
+	obj, err := a.store.Put(ctx, storage.PutInput{
+		Bucket:             a.uploadBucket(),
+		Key:                documentKey(a.formUploadPrefix(), f.Filename),
+		Body:               body,
+		Size:               -1,
+		ContentType:        contentType,
+		ContentDisposition: documentDisposition(f.Filename),
+		Metadata:           documentMetadata("", f.Filename, time.Now()),
+		Tagging:            a.documentTagging("", submittedDocument{Type: field}),
+		StorageClass:       a.cfg.S3.StorageClass,
+	})
+	switch {
+	case errors.Is(body.err, errFormFileTooLarge):
+		log.Printf("level=WARN service=go-app event=document_too_large field=%s content_type=%s limit=%d request_id=%s instance=%s", field, contentType, limit, requestID(ctx), a.instanceID)
+		return f, &documentError{probTooLarge, field + ": " + a.documentLimitText(contentType)}
+	case body.err != nil:
+		// The client's body, not the store, failed.
+		return f, body.err
+	case err != nil:
+		metricUploadFailures.Add(1)
+		log.Printf("level=ERROR service=go-app event=s3_upload_failed field=%s err=%v request_id=%s instance=%s", field, err, requestID(ctx), a.instanceID)
+		return f, &documentError{storageProblem(err), "failed to upload document to S3"}
+	}
+	f.Object, f.Size, f.SHA256 = obj, body.n, sum.Sum(nil)
+
+	err = a.checkFormFile(ctx, f)
+	var invalid *doccheck.Error
+	switch {
+	case errors.As(err, &invalid):
+		log.Printf("level=WARN service=go-app event=document_invalid field=%s content_type=%s err=%v request_id=%s instance=%s", field, contentType, err, requestID(ctx), a.instanceID)
+		a.rejectQuarantined(ctx, obj.Bucket, obj.Key, err.Error())
+		return f, &documentError{probDocumentInvalid, field + ": " + err.Error()}
+	case err != nil:
+		log.Printf("level=ERROR service=go-app event=document_check_failed field=%s key=%s err=%v request_id=%s instance=%s", field, obj.Key, err, requestID(ctx), a.instanceID)
+		return f, &documentError{storageProblem(err), "failed to verify KYC document"}
+	}
+	return f, nil
+}
+
+// checkFormFile checks that the store holds what was sent of f, then that
+// the whole of it decodes, reading it back in ranges rather than into
+// memory.
+func (a *app) checkFormFile(ctx context.Context, f *formFile) error {
+	if err := a.verifyStored(ctx, f.Object, f.Size, f.SHA256); err != nil {
+		return err
+	}
+	return a.checkDocumentStructure(storage.NewReaderAt(ctx, a.store, f.Object, f.Size), f.Size, f.ContentType)
+}
+
+// readFormFile returns the content of f as stored, for a queued submission
+// to keep. The size limit f was held to bounds what is read into memory.
+func (a *app) readFormFile(ctx context.Context, f *formFile) ([]byte, error) {
+	blob, err := a.store.Get(ctx, f.Object, "")
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	data, err := io.ReadAll(io.LimitReader(blob.Body, f.Size+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != f.Size {
+		metricUploadMismatches.Add(1)
+		return nil, fmt.Errorf("%w: %s: read %d bytes, sent %d", errStoredMismatch, f.Object.Key, len(data), f.Size)
+	}
+	return data, nil
+}
+
+// cappedReader reads r, failing with errFormFileTooLarge once more than
+// limit bytes come from it. It keeps the count read and the error it
+// returned, so a failed upload can be put down to the body or the store.
+type cappedReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+	err   error
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if c.n > c.limit {
+		err = errFormFileTooLarge
+	}
+	if err != nil && err != io.EOF {
+		c.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+/* USERS */
+
+// statusUploaded is the KYC status of a freshly submitted record.
+const statusUploaded = "KYC_UPLOADED"
+
+var errUserNotFound = errors.New("user not found")
+
+// submission is a KYC record ready to be written to the users table.
+// SpoolID is set when the record passed through the degraded-mode spool
+// and makes replaying it idempotent. Bucket and Key name the primary
+// document, the first of Documents. Phone is in E.164 form and PhoneRaw
+// is the number as the applicant typed it. VerifyEmail queues an email,
+// in Lang, asking the applicant to confirm their address. Consent, from
+// the form, is the applicant's acceptance of the privacy policy.
+// DisposableEmail marks an Email at a disposable provider.
+type submission struct {
+	SpoolID   string              `json:"spool_id,omitempty"`
+	Reference string              `json:"reference,omitempty"`
+	Name      string              `json:"name"`
+	Email     string              `json:"email"`
+	Phone     string              `json:"phone"`
+	PhoneRaw  string              `json:"phone_raw,omitempty"`
+	Bucket    string              `json:"document_bucket"`
+	Key       string              `json:"document_key"`
+	Documents []submittedDocument `json:"documents,omitempty"`
+	Tier      string              `json:"kyc_tier,omitempty"`
+	Status    string              `json:"kyc_status"`
+	CreatedAt time.Time           `json:"created_at"`
+
+	VerifyEmail bool           `json:"verify_email,omitempty"`
+	Lang        string         `json:"lang,omitempty"`
+	Consent     *consentRecord `json:"consent,omitempty"`
+
+	DisposableEmail bool `json:"disposable_email,omitempty"`
+}
+
+// setDocuments attaches docs to s and makes the first one primary.
+func (s *submission) setDocuments(docs []submittedDocument) {
+	s.Documents = docs
+	if len(docs) > 0 {
+		s.Bucket, s.Key = docs[0].Bucket, docs[0].Key
+	}
+}
+
+// user is a stored row of the users table as exposed by the API.
+// Document is the primary document; Documents, when loaded, lists them all.
+// PhoneRaw is empty for users stored before phone numbers were normalized.
+// EmailVerified is set once the applicant follows the link emailed to
+// Email; DisposableEmail marks an Email at a disposable provider.
+type user struct {
+	ID              int64        `json:"id"`
+	Reference       string       `json:"reference,omitempty"`
+	Name            string       `json:"name"`
+	Email           string       `json:"email"`
+	EmailVerified   bool         `json:"email_verified"`
+	EmailVerifiedAt *time.Time   `json:"email_verified_at,omitempty"`
+	DisposableEmail bool         `json:"disposable_email"`
+	Phone           string       `json:"phone"`
+	PhoneRaw        string       `json:"phone_raw,omitempty"`
+	Document        userDocument `json:"document"`
+	Documents       []document   `json:"documents,omitempty"`
+	KYCTier         string       `json:"kyc_tier,omitempty"`
+	KYCStatus       string       `json:"kyc_status"`
+	CreatedAt       time.Time    `json:"created_at"`
+}
+
+type userDocument struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+// insertUser stores s and its documents and returns its ID. A record whose
+// SpoolID is already present is skipped and returns ID 0, so a spool entry
+// replayed twice is stored once. Records spooled before submissions carried
+// several documents store their single document as docKYC.
+func insertUser(ctx context.Context, db *sql.DB, s submission) (int64, error) {
+	var id int64
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		id, err = insertUserTx(ctx, tx, s)
+		return err
+	})
+	return id, err
+}
+
+// insertUserTx is insertUser within tx. A submission without a reference
+// number gets one.
+func insertUserTx(ctx context.Context, tx *sql.Tx, s submission) (int64, error) {
+	query := `
+	INSERT INTO users(name, email, phone, document_bucket, document_key, kyc_status, created_at, spool_id, reference, phone_raw, kyc_tier, disposable_email)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), $9, NULLIF($10, ''), NULLIF($11, ''), $12)
+	ON CONFLICT (spool_id) DO NOTHING
+	RETURNING id
+	`
+	if s.Reference == "" {
+		s.Reference = newReference()
+	}
+
+	docs := s.Documents
+	if len(docs) == 0 && s.Key != "" {
+		docs = []submittedDocument{{Type: docKYC, Bucket: s.Bucket, Key: s.Key}}
+	}
+
+	var id int64
+	err := tx.QueryRowContext(ctx, query, s.Name, s.Email, s.Phone, s.Bucket, s.Key, s.Status, s.CreatedAt.UTC(), s.SpoolID, s.Reference, s.PhoneRaw, s.Tier, s.DisposableEmail).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if s.Consent != nil {
+		if err := insertConsent(ctx, tx, id, *s.Consent); err != nil {
+			return 0, err
+		}
+	}
+	if s.VerifyEmail {
+		if err := queueEmailVerification(ctx, tx, id, s.Email, s.Lang); err != nil {
+			return 0, err
+		}
+	}
+	return id, insertDocuments(ctx, tx, id, docs)
+}
+
+const userColumns = `id, COALESCE(reference, ''), name, email, email_verified, email_verified_at, disposable_email, phone, COALESCE(phone_raw, ''), document_bucket, document_key, COALESCE(kyc_tier, ''), COALESCE(kyc_status, ''), created_at`
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner) (*user, error) {
+	var u user
+	var verifiedAt sql.NullTime
+	err := row.Scan(&u.ID, &u.Reference, &u.Name, &u.Email, &u.EmailVerified, &verifiedAt, &u.DisposableEmail, &u.Phone, &u.PhoneRaw, &u.Document.Bucket, &u.Document.Key, &u.KYCTier, &u.KYCStatus, &u.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if verifiedAt.Valid {
+		u.EmailVerifiedAt = &verifiedAt.Time
+	}
+	return &u, nil
+}
+
+func getUser(ctx context.Context, db *sql.DB, id int64) (*user, error) {
+	return scanUser(db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, id))
+}
+
+// userPatch lists the contact fields a PATCH may change; nil means keep.
+// PhoneRaw is set along with Phone, from the number as sent, and
+// DisposableEmail along with Email, from the disposable domain list.
+type userPatch struct {
+	Name            *string `json:"name"`
+	Email           *string `json:"email"`
+	Phone           *string `json:"phone"`
+	PhoneRaw        *string `json:"-"`
+	DisposableEmail *bool   `json:"-"`
+}
+
+// updateUser applies p. Changing the email address clears its
+// verification.
+func updateUser(ctx context.Context, db *sql.DB, id int64, p userPatch) (*user, error) {
+	query := `
+	UPDATE users SET
+		name = COALESCE($2, name),
+		email_verified = email_verified AND lower(COALESCE($3, email)) = lower(email),
+		email_verified_at = CASE WHEN lower(COALESCE($3, email)) = lower(email) THEN email_verified_at END,
+		email = COALESCE($3, email),
+		phone = COALESCE($4, phone),
+		phone_raw = COALESCE($5, phone_raw),
+		disposable_email = COALESCE($6, disposable_email)
+	WHERE id = $1
+	RETURNING ` + userColumns
+
+	return scanUser(db.QueryRowContext(ctx, query, id, p.Name, p.Email, p.Phone, p.PhoneRaw, p.DisposableEmail))
+}
+
+// deleteUser removes the row and returns it as it was, together with the
+// document_deletions entries queued in the same transaction for its S3
+// objects. The object is removed afterwards; see cleanup.go.
+func deleteUser(ctx context.Context, db *sql.DB, id int64) (*user, []pendingDeletion, error) {
+	var u *user
+	var pending []pendingDeletion
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		u, err = scanUser(tx.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1 FOR UPDATE`, id))
+		if err != nil {
+			return err
+		}
+
+		// Queue every document of the user and its preview, and the primary
+		// one for rows stored before the documents table existed.
+		rows, err := tx.QueryContext(ctx, `
+		INSERT INTO document_deletions(bucket, object_key, version_id)
+		SELECT bucket, object_key, version_id FROM documents WHERE user_id = $1
+		UNION
+		SELECT thumbnail_bucket, thumbnail_key, NULL FROM documents WHERE user_id = $1 AND thumbnail_key IS NOT NULL
+		UNION
+		SELECT $2::text, $3::text, NULL
+		WHERE NOT EXISTS(SELECT 1 FROM documents WHERE user_id = $1 AND bucket = $2 AND object_key = $3)
+		RETURNING id, bucket, object_key, COALESCE(version_id, '')
+		`, id, u.Document.Bucket, u.Document.Key)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var p pendingDeletion
+			if err := rows.Scan(&p.ID, &p.Bucket, &p.Key, &p.VersionID); err != nil {
+				rows.Close()
+				return err
+			}
+			pending = append(pending, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id)
+		return err
+	})
+	return u, pending, err
+}
+
+// pendingDeletion is a queued document_deletions row. VersionID, when set,
+// is the one version of the object to delete.
+type pendingDeletion struct {
+	ID        int64
+	Bucket    string
+	Key       string
+	VersionID string
+}
+
+// userFilter narrows and orders a listUsers query. Zero fields do not
+// filter. After, when set, is the keyset position of the last row of the
+// previous page.
+type userFilter struct {
+	Statuses      []string
+	Email         string
+	Reference     string
+	EmailVerified *bool
+	Disposable    *bool
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	SortBy        string // "created_at" or "id"
+	Desc          bool
+	After         *userCursor
+	Limit         int
+}
+
+// userCursor is the (sort key, id) pair a page ended on.
+type userCursor struct {
+	CreatedAt time.Time `json:"c,omitempty"`
+	ID        int64     `json:"i"`
+}
+
+// listUsers returns up to f.Limit users matching f, using keyset pagination
+// so deep pages cost the same as the first one.
+func listUsers(ctx context.Context, db *sql.DB, f userFilter) ([]user, error) {
+	users := []user{}
+	err := eachUser(ctx, db, f, func(u *user) error {
+		users = append(users, *u)
+		return nil
+	})
+	return users, err
+}
+
+// eachUser calls fn for every user matching f, in order, as rows arrive
+// from the database rather than after loading them all. A zero f.Limit
+// means no limit. An error from fn stops the iteration and is returned.
+func eachUser(ctx context.Context, db *sql.DB, f userFilter, fn func(*user) error) error {
+	var where []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if len(f.Statuses) > 0 {
+		where = append(where, "kyc_status = ANY("+arg(pq.Array(f.Statuses))+")")
+	}
+	if f.Email != "" {
+		where = append(where, "lower(email) = lower("+arg(f.Email)+")")
+	}
+	if f.Reference != "" {
+		where = append(where, "reference = "+arg(f.Reference))
+	}
+	if f.EmailVerified != nil {
+		where = append(where, "email_verified = "+arg(*f.EmailVerified))
+	}
+	if f.Disposable != nil {
+		where = append(where, "disposable_email = "+arg(*f.Disposable))
+	}
+	if !f.CreatedAfter.IsZero() {
+		where = append(where, "created_at >= "+arg(f.CreatedAfter.UTC()))
+	}
+	if !f.CreatedBefore.IsZero() {
+		where = append(where, "created_at < "+arg(f.CreatedBefore.UTC()))
+	}
+
+	cmp, dir := ">", "ASC"
+	if f.Desc {
+		cmp, dir = "<", "DESC"
+	}
+	order := "id " + dir
+	if f.SortBy == "created_at" {
+		order = "created_at " + dir + ", id " + dir
+	}
+	if f.After != nil {
+		if f.SortBy == "created_at" {
+			where = append(where, "(created_at, id) "+cmp+" ("+arg(f.After.CreatedAt.UTC())+", "+arg(f.After.ID)+")")
+		} else {
+			where = append(where, "id "+cmp+" "+arg(f.After.ID))
+		}
+	}
+
+	query := `SELECT ` + userColumns + ` FROM users`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY ` + order
+	if f.Limit > 0 {
+		query += ` LIMIT ` + arg(f.Limit)
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
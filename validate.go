@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"client_alb_go_s3_rds/i18n"
+	"client_alb_go_s3_rds/phone"
+)
+
+/* CONTACT FIELD VALIDATION */
+
+// Length limits of the contact fields, in characters.
+const (
+	maxNameLen  = 100
+	maxEmailLen = 254 // RFC 5321 path limit
+	maxPhoneLen = 32
+)
+
+// fieldError explains why one field was rejected. Code is the i18n message
+// key of Message, for clients that word errors themselves.
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// newFieldError returns the error code about field, worded in the default
+// language until localized.
+func newFieldError(field, code string) fieldError {
+	return fieldError{Field: field, Code: code, Message: i18n.T(i18n.Default, code)}
+}
+
+// localizeFieldErrors returns errs worded in lang.
+func localizeFieldErrors(lang string, errs []fieldError) []fieldError {
+	out := make([]fieldError, len(errs))
+	for i, e := range errs {
+		e.Message = i18n.T(lang, e.Code)
+		out[i] = e
+	}
+	return out
+}
+
+// contactFields are the applicant's details as submitted. Once validated,
+// Phone is in E.164 form and PhoneRaw keeps the number as typed.
+type contactFields struct {
+	Name     string
+	Email    string
+	Phone    string
+	PhoneRaw string
+}
+
+// validateContact checks every field of c, reading a phone number without
+// a country code as one of region, and returns the cleaned values and an
+// error for each field that is unacceptable.
+func validateContact(c contactFields, region string) (contactFields, []fieldError) {
+	c.PhoneRaw = strings.TrimSpace(c.Phone)
+	errs := validateFields(region, &c.Name, &c.Email, &c.Phone)
+	return c, errs
+}
+
+// validateFields checks the contact fields that are not nil, cleaning them
+// in place, and returns an error for each that is unacceptable. Each check
+// returns the cleaned value and the message key of what is wrong, if
+// anything.
+func validateFields(region string, name, email, phone *string) []fieldError {
+	var errs []fieldError
+	for _, f := range []struct {
+		name  string
+		val   *string
+		check func(string) (string, string)
+	}{
+		{"name", name, checkName},
+		{"email", email, checkEmail},
+		{"phone", phone, phoneCheck(region)},
+	} {
+		if f.val == nil {
+			continue
+		}
+		v, code := f.check(*f.val)
+		*f.val = v
+		if code != "" {
+			errs = append(errs, newFieldError(f.name, code))
+		}
+	}
+	return errs
+}
+
+// checkName trims and collapses the spaces of a name, which may hold
+// letters of any script, combining marks, spaces, apostrophes, hyphens and
+// periods.
+func checkName(v string) (string, string) {
+	v = strings.Join(strings.Fields(v), " ")
+	switch {
+	case v == "":
+		return v, "name.required"
+	case !utf8.ValidString(v):
+		return v, "name.encoding"
+	case utf8.RuneCountInString(v) > maxNameLen:
+		return v, "name.too_long"
+	}
+	letters := 0
+	for _, c := range v {
+		switch {
+		case unicode.IsLetter(c):
+			letters++
+		case unicode.Is(unicode.Mn, c), c == ' ', c == '\'', c == '’', c == '-', c == '.':
+		default:
+			return v, "name.characters"
+		}
+	}
+	if letters == 0 {
+		return v, "name.required"
+	}
+	return v, ""
+}
+
+// checkEmail accepts a bare RFC 5322 address, with no display name or
+// comments, whose domain has at least two labels.
+func checkEmail(v string) (string, string) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return v, "email.required"
+	}
+	if len(v) > maxEmailLen {
+		return v, "email.too_long"
+	}
+	addr, err := mail.ParseAddress(v)
+	if err != nil || addr.Name != "" || addr.Address != v {
+		return v, "email.invalid"
+	}
+	at := strings.LastIndexByte(v, '@')
+	local, domain := v[:at], v[at+1:]
+	if len(local) > 64 || !strings.Contains(domain, ".") || strings.HasSuffix(domain, ".") || strings.HasPrefix(domain, "[") {
+		return v, "email.invalid"
+	}
+	return v, ""
+}
+
+// phoneCheck returns the check of phone numbers, which normalizes them to
+// E.164, reading numbers without a country code as ones of region. Digits
+// may be separated by spaces, hyphens, periods and parentheses.
+func phoneCheck(region string) func(string) (string, string) {
+	return func(v string) (string, string) {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			return v, "phone.required"
+		}
+		if len(v) > maxPhoneLen {
+			return v, "phone.too_long"
+		}
+		e164, err := phone.Parse(v, region)
+		switch {
+		case errors.Is(err, phone.ErrInvalid):
+			return v, "phone.characters"
+		case err != nil:
+			return v, "phone.invalid"
+		}
+		return e164, ""
+	}
+}
+
+// fieldErrorSummary joins errs into one line for a problem's detail.
+func fieldErrorSummary(errs []fieldError) string {
+	parts := make([]string, len(errs))
+	for i, e := range errs {
+		parts[i] = e.Field + ": " + e.Message
+	}
+	return strings.Join(parts, "; ")
+}
+
+// writeFieldErrors answers r with a validation problem listing errs in r's
+// language.
+func writeFieldErrors(w http.ResponseWriter, r *http.Request, errs []fieldError) {
+	errs = localizeFieldErrors(language(r.Context()), errs)
+	writeProblemBody(w, r, probValidation, fieldErrorSummary(errs), errs)
+}
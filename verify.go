@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"client_alb_go_s3_rds/storage"
+)
+
+/* UPLOAD VERIFICATION */
+
+// A successful PutObject has not always left what was sent: empty objects
+// have turned up that no one can explain. So every document the app uploads
+// is looked up again before a row refers to it, and its size, and its
+// SHA-256 where the store keeps one for the whole object, compared with
+// what was sent. A mismatch fails the upload with errStoredMismatch, which
+// clients see as storage_mismatch, and the object is removed.
+
+// errStoredMismatch wraps a document the store holds differently from how
+// it was sent.
+var errStoredMismatch = errors.New("stored document does not match the upload")
+
+// verifyStored checks that obj, just stored, holds size bytes with SHA-256
+// sum.
+func (a *app) verifyStored(ctx context.Context, obj storage.Object, size int64, sum []byte) error {
+	info, err := a.store.Head(ctx, obj)
+	if err != nil {
+		return fmt.Errorf("verify stored document: %w", err)
+	}
+	var mismatch string
+	switch {
+	case info.Size != size:
+		mismatch = fmt.Sprintf("size is %d bytes, sent %d", info.Size, size)
+	case info.SHA256 != nil && !bytes.Equal(info.SHA256, sum):
+		mismatch = fmt.Sprintf("SHA-256 is %x, sent %x", info.SHA256, sum)
+	default:
+		return nil
+	}
+
+	metricUploadMismatches.Add(1)
+	log.Printf("level=ERROR service=go-app event=document_upload_mismatch bucket=%s key=%s version=%s mismatch=%q request_id=%s instance=%s", obj.Bucket, obj.Key, obj.VersionID, mismatch, requestID(ctx), a.instanceID)
+	// No row refers to it yet. Object Lock may keep it anyway.
+	if err := a.store.Delete(ctx, obj); err != nil {
+		log.Printf("level=WARN service=go-app event=document_delete_failed bucket=%s key=%s err=%v request_id=%s instance=%s", obj.Bucket, obj.Key, err, requestID(ctx), a.instanceID)
+	}
+	return fmt.Errorf("%w: %s: %s", errStoredMismatch, obj.Key, mismatch)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+/* BUILD INFO */
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.gitSHA=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	gitSHA    = ""
+	buildTime = ""
+)
+
+// buildInfo identifies the running binary.
+type buildInfo struct {
+	GitSHA    string `json:"git_sha"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+// currentBuild returns the ldflags values, falling back to the VCS stamp
+// the Go toolchain embeds when the binary was built from a checkout.
+func currentBuild() buildInfo {
+	b := buildInfo{GitSHA: gitSHA, BuildTime: buildTime, GoVersion: runtime.Version()}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.GitSHA == "":
+				b.GitSHA = s.Value
+			case s.Key == "vcs.time" && b.BuildTime == "":
+				b.BuildTime = s.Value
+			}
+		}
+	}
+
+	if b.GitSHA == "" {
+		b.GitSHA = "unknown"
+	}
+	if b.BuildTime == "" {
+		b.BuildTime = "unknown"
+	}
+	return b
+}
+
+// versionResponse is the /version body.
+type versionResponse struct {
+	buildInfo
+	Instance string `json:"instance"`
+}
+
+func (a *app) versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versionResponse{currentBuild(), a.instanceID})
+}
@@ -0,0 +1,38 @@
+// SMS code: "Send code" asks /submit/otp to text a code to the phone field's
+// number without leaving the page, and keeps the code's ID for the
+// submission. Without JavaScript the button posts the form there instead.
+(function () {
+    var button = document.getElementById("otp-send");
+    if (!button || !window.fetch || !window.FormData) {
+        return;
+    }
+    var form = button.form;
+    var status = document.getElementById("otp-status");
+
+    button.addEventListener("click", function (event) {
+        event.preventDefault();
+        var body = new FormData();
+        body.append("phone", form.elements["phone"].value);
+        button.disabled = true;
+        fetch("/submit/otp", {
+            method: "POST",
+            headers: {"Accept": "application/json", "X-CSRF-Token": form.elements["csrf_token"].value},
+            body: body
+        }).then(function (resp) {
+            return resp.json().then(function (body) {
+                if (!resp.ok) {
+                    throw new Error(body.errors && body.errors.length ? body.errors[0].message : body.detail);
+                }
+                return body;
+            });
+        }).then(function (sent) {
+            form.elements["otp_id"].value = sent.otp_id;
+            status.textContent = button.dataset.sent;
+            form.elements["otp_code"].focus();
+        }).catch(function (err) {
+            status.textContent = err.message || button.dataset.failed;
+        }).then(function () {
+            button.disabled = false;
+        });
+    });
+})();
@@ -0,0 +1,27 @@
+// Live status: follow the page's status stream and update the label when a
+// reviewer acts, so the applicant need not refresh.
+(function () {
+    var label = document.getElementById("status-label");
+    var detail = document.getElementById("status-detail");
+    if (!label || !window.EventSource || !window.fetch) {
+        return;
+    }
+
+    var events = new EventSource(window.location.pathname.replace(/\/$/, "") + "/events");
+    events.addEventListener("status_change", function () {
+        fetch(window.location.pathname, {headers: {"Accept": "application/json"}})
+            .then(function (resp) { return resp.ok ? resp.json() : null; })
+            .then(function (status) {
+                if (!status) {
+                    return;
+                }
+                label.textContent = status.label;
+                detail.textContent = detail.dataset.updatedNow;
+            });
+    });
+    events.onerror = function () {
+        if (events.readyState === EventSource.CLOSED) {
+            events = null;
+        }
+    };
+})();
@@ -0,0 +1,112 @@
+// Direct upload: when the page says the server offers presigned POSTs
+// (data-direct-upload), send each KYC document straight to S3 and submit
+// only their keys with the form, in the hidden "<field>_key" inputs.
+// Otherwise, or if the server declines after all, the form is submitted as
+// usual, with a progress bar following the upload.
+(function () {
+    var form = document.querySelector("form[action='/submit']");
+    if (!form || !window.fetch || !window.FormData) {
+        return;
+    }
+
+    function upload(input) {
+        var file = input.files[0];
+        return fetch("/submit/upload-url", {
+            method: "POST",
+            headers: {"Content-Type": "application/json", "X-CSRF-Token": form.elements["csrf_token"].value},
+            body: JSON.stringify({filename: file.name, content_type: file.type, size: file.size})
+        }).then(function (resp) {
+            if (resp.status === 404) {
+                return null;
+            }
+            if (!resp.ok) {
+                return resp.json().then(function (body) { throw new Error(body.detail || body.title); });
+            }
+            return resp.json();
+        }).then(function (presigned) {
+            if (!presigned) {
+                return false;
+            }
+            var body = new FormData();
+            Object.keys(presigned.fields).forEach(function (name) {
+                body.append(name, presigned.fields[name]);
+            });
+            body.append("file", file);
+            return fetch(presigned.url, {method: "POST", body: body}).then(function (resp) {
+                if (!resp.ok) {
+                    throw new Error("Upload to storage failed (" + resp.status + ")");
+                }
+                form.elements[input.name + "_key"].value = presigned.key;
+                input.disabled = true;
+                return true;
+            });
+        });
+    }
+
+    // Progress: documents still sent with the form are followed through
+    // /uploads/{token}/progress while the browser posts it.
+    function newToken() {
+        var bytes = new Uint8Array(16);
+        window.crypto.getRandomValues(bytes);
+        return Array.prototype.map.call(bytes, function (b) {
+            return ("0" + b.toString(16)).slice(-2);
+        }).join("");
+    }
+
+    function followProgress() {
+        var bar = document.getElementById("upload-progress");
+        if (!bar || !window.crypto) {
+            return;
+        }
+        var token = newToken();
+        form.action = "/submit?upload_token=" + token;
+        bar.hidden = false;
+        var timer = setInterval(function () {
+            fetch("/uploads/" + token + "/progress", {headers: {"Accept": "application/json"}}).then(function (resp) {
+                return resp.ok ? resp.json() : null;
+            }).then(function (progress) {
+                if (!progress) {
+                    return;
+                }
+                bar.value = progress.percent;
+                if (progress.state === "done" || progress.state === "failed") {
+                    clearInterval(timer);
+                }
+            }).catch(function () {});
+        }, 500);
+    }
+
+    function sendsFiles() {
+        return Array.prototype.some.call(form.querySelectorAll("input[type=file]"), function (input) {
+            return input.files.length > 0 && !input.disabled;
+        });
+    }
+
+    form.addEventListener("submit", function (event) {
+        if (form.dataset.direct === "done") {
+            return;
+        }
+        var inputs = Array.prototype.filter.call(form.querySelectorAll("input[type=file]"), function (input) {
+            return input.files.length > 0 && !input.disabled;
+        });
+        if (inputs.length === 0) {
+            return;
+        }
+        event.preventDefault();
+
+        // Upload one at a time; stop early once the server declines.
+        inputs.reduce(function (prev, input) {
+            return prev.then(function (direct) {
+                return direct ? upload(input) : false;
+            });
+        }, Promise.resolve(form.dataset.directUpload === "true")).then(function () {
+            form.dataset.direct = "done";
+            if (sendsFiles()) {
+                followProgress();
+            }
+            form.submit();
+        }).catch(function (err) {
+            alert(err.message || "Upload failed, please try again.");
+        });
+    });
+})();
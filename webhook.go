@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* KYC PROVIDER WEBHOOK */
+
+// kycProvider names the provider in webhook_events and as the actor of the
+// status changes its callbacks make.
+const kycProvider = "kyc-provider"
+
+// webhookSignatureHeader carries "t=<unix seconds>,v1=<hex HMAC-SHA256 of
+// "<t>.<body>">", keyed with WEBHOOK_KYC_PROVIDER_SECRET. Several v1 values
+// may be sent while the provider rotates its key.
+const webhookSignatureHeader = "X-KYC-Signature"
+
+// providerVerdicts maps provider verdicts onto our statuses. A request to
+// resubmit is a rejection here: the applicant re-uploads either way.
+var providerVerdicts = map[string]string{
+	"approved":               statusApproved,
+	"declined":               statusRejected,
+	"rejected":               statusRejected,
+	"resubmission_requested": statusRejected,
+	"review":                 statusInReview,
+	"manual_review":          statusInReview,
+}
+
+// providerEvent is the part of a provider callback we act on. Reference is
+// the submission reference we gave the provider.
+type providerEvent struct {
+	EventID   string `json:"event_id"`
+	Type      string `json:"type"`
+	Reference string `json:"reference"`
+	Verdict   string `json:"verdict"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// webhookResult is the response to a callback. Outcome is also stored
+// with the event:
+//
+//	applied    the status changed
+//	unchanged  the user already had the verdict's status
+//	ignored    the verdict cannot apply from the user's current status
+//	unmatched  no user has the reference
+//	duplicate  the event was received before; nothing was done
+type webhookResult struct {
+	EventID string `json:"event_id"`
+	Outcome string `json:"outcome"`
+	Status  string `json:"kyc_status,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// webhookHandler handles POST /webhooks/kyc-provider. Only a correctly
+// signed, recent request is read; every such event is stored with its raw
+// payload before anything else happens, in the same transaction as the
+// status change it causes, so an event is applied at most once however
+// often the provider redelivers it. Outcomes the provider cannot fix by
+// retrying are answered 200.
+func (a *app) webhookHandler(w http.ResponseWriter, r *http.Request) {
+	secret := a.cfg.Webhooks.KYCProviderSecret
+	if secret == "" {
+		writeProblem(w, r, probNotFound, "webhooks are disabled")
+		return
+	}
+	ctx := r.Context()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		a.writeBodyError(w, r, err, "failed to read body")
+		return
+	}
+	signature := r.Header.Get(webhookSignatureHeader)
+	if msg := verifyWebhookSignature(secret, signature, body, time.Now(), a.cfg.Webhooks.Tolerance); msg != "" {
+		log.Printf("level=WARN service=go-app event=webhook_signature_rejected provider=%s reason=%q client_ip=%s request_id=%s instance=%s", kycProvider, msg, a.clientIP(r), requestID(ctx), a.instanceID)
+		writeProblem(w, r, probUnauthorized, msg)
+		return
+	}
+
+	var ev providerEvent
+	if err := json.Unmarshal(body, &ev); err != nil {
+		writeProblem(w, r, probMalformed, "invalid JSON body: "+err.Error())
+		return
+	}
+	to, known := providerVerdicts[ev.Verdict]
+	switch {
+	case ev.EventID == "" || ev.Type == "" || ev.Reference == "":
+		writeProblem(w, r, probValidation, "event_id, type and reference are required")
+		return
+	case !known:
+		writeProblem(w, r, probValidation, "unknown verdict "+strconv.Quote(ev.Verdict))
+		return
+	}
+	if a.dbDown.Load() {
+		// The provider retries; nothing is lost by refusing for now.
+		writeProblem(w, r, probDatabaseUnavailable, "database unavailable")
+		return
+	}
+
+	res, err := a.applyProviderEvent(ctx, ev, to, string(body), signature)
+	if err != nil {
+		log.Printf("level=ERROR service=go-app event=webhook_failed provider=%s event_id=%q err=%v request_id=%s instance=%s", kycProvider, ev.EventID, err, requestID(ctx), a.instanceID)
+		writeProblem(w, r, probDatabase, "database error")
+		return
+	}
+	log.Printf("level=INFO service=go-app event=webhook_received provider=%s event_id=%q type=%s verdict=%s outcome=%s request_id=%s instance=%s", kycProvider, ev.EventID, ev.Type, ev.Verdict, res.Outcome, requestID(ctx), a.instanceID)
+	writeJSON(w, http.StatusOK, res)
+}
+
+// applyProviderEvent records ev and moves its user towards status to,
+// passing through review when the verdict skips it.
+func (a *app) applyProviderEvent(ctx context.Context, ev providerEvent, to, payload, signature string) (webhookResult, error) {
+	res := webhookResult{EventID: ev.EventID}
+	var changed *user
+	err := inTx(ctx, a.db, func(tx *sql.Tx) error {
+		// A concurrent delivery of the same event waits here on the unique
+		// index until this transaction ends, then finds it recorded.
+		var eventRow int64
+		err := tx.QueryRowContext(ctx, `
+		INSERT INTO webhook_events(provider, event_id, event_type, payload, signature, outcome)
+		VALUES ($1, $2, $3, $4, $5, '')
+		ON CONFLICT (provider, event_id) DO NOTHING
+		RETURNING id
+		`, kycProvider, ev.EventID, ev.Type, payload, signature).Scan(&eventRow)
+		if errors.Is(err, sql.ErrNoRows) {
+			res.Outcome, res.Detail = "duplicate", "event already received"
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var userID sql.NullInt64
+		u, err := scanUser(tx.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE reference = $1 FOR UPDATE`, normalizeReference(ev.Reference)))
+		switch {
+		case errors.Is(err, errUserNotFound):
+			res.Outcome, res.Detail = "unmatched", "no submission with this reference"
+		case err != nil:
+			return err
+		default:
+			userID = sql.NullInt64{Int64: u.ID, Valid: true}
+			from := u.KYCStatus
+			if from == "" {
+				from = statusUploaded
+			}
+			res.Status = from
+			steps, ok := statusPath(from, to)
+			switch {
+			case !ok:
+				res.Outcome, res.Detail = "ignored", (&transitionError{From: from, To: to}).Error()
+			case len(steps) == 0:
+				res.Outcome = "unchanged"
+			default:
+				res.Outcome = "applied"
+				reason := ev.Verdict
+				if ev.Reason != "" {
+					reason += ": " + ev.Reason
+				}
+				for _, step := range steps {
+					if changed, err = transitionStatusTx(ctx, tx, u.ID, step, "provider:"+kycProvider, reason); err != nil {
+						return err
+					}
+				}
+				res.Status = to
+			}
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE webhook_events SET user_id = $2, outcome = $3 WHERE id = $1`, eventRow, userID, res.Outcome)
+		return err
+	})
+	if err == nil && changed != nil {
+		a.tagStatus(ctx, changed)
+	}
+	return res, err
+}
+
+// statusPath returns the statuses a user in from passes through to reach
+// to: directly, or by way of review. It returns ok false when to cannot be
+// reached that way, and no steps when from is already to.
+func statusPath(from, to string) (steps []string, ok bool) {
+	switch {
+	case from == to:
+		return nil, true
+	case canTransition(from, to):
+		return []string{to}, true
+	case canTransition(from, statusInReview) && canTransition(statusInReview, to):
+		return []string{statusInReview, to}, true
+	}
+	return nil, false
+}
+
+// verifyWebhookSignature checks header against body, returning why it is
+// unacceptable or "" when it is valid and no older than tolerance.
+func verifyWebhookSignature(secret, header string, body []byte, now time.Time, tolerance time.Duration) string {
+	if header == "" {
+		return "missing " + webhookSignatureHeader + " header"
+	}
+	var ts string
+	var sigs []string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sigs = append(sigs, v)
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || len(sigs) == 0 {
+		return "malformed " + webhookSignatureHeader + " header"
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return "signature timestamp is outside the allowed window"
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	want := mac.Sum(nil)
+	for _, s := range sigs {
+		if got, err := hex.DecodeString(s); err == nil && hmac.Equal(got, want) {
+			return ""
+		}
+	}
+	return "signature does not match"
+}